@@ -4,6 +4,9 @@ import (
 	"database/sql"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -26,19 +29,316 @@ func ConnectDB() {
 }
 
 type Config struct {
-	JWTSecret      string
-	CloudinaryURL  string
-	ChapaSecretKey string
-	HasuraEndpoint string
-	HasuraAdminKey string
+	JWTSecret          string
+	CloudinaryURL      string
+	CloudinaryCloud    string
+	CloudinaryAPIKey   string
+	CloudinarySecret   string
+	ChapaSecretKey     string
+	ChapaWebhookSecret string
+	ChapaCallbackURL   string
+	ChapaReturnURL     string
+	HasuraEndpoint     string
+	HasuraAdminKey     string
+	PublicBaseURL      string
+
+	// PaymentProvider selects the gateway: "chapa" (default) or "fake".
+	PaymentProvider  string
+	FakeWebhookDelay time.Duration
+
+	// PlatformCommissionType is "percentage" or "flat". A percentage
+	// commission is PlatformCommissionValue percent of the sale; a flat one
+	// is the PlatformCommissionFlat amount for the sale's currency.
+	PlatformCommissionType  string
+	PlatformCommissionValue float64
+	PlatformCommissionFlat  map[string]float64
+
+	// Premium subscriptions renew manually: a renewal checkout is sent
+	// RenewalWindow before a period ends, and lapsed subscriptions keep
+	// access for GracePeriod.
+	SubscriptionRenewalWindow time.Duration
+	SubscriptionGracePeriod   time.Duration
+	SubscriptionJobInterval   time.Duration
+
+	// Outgoing email; with no SMTPHost messages are only logged.
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	MailFrom     string
+
+	// GiftCodeValidity is how long a paid gift code can be redeemed.
+	GiftCodeValidity time.Duration
+
+	// The reconciler re-verifies payments still pending after
+	// ReconciliationThreshold, and gives up on those older than
+	// ReconciliationMaxAge that the provider never saw paid.
+	ReconciliationInterval  time.Duration
+	ReconciliationThreshold time.Duration
+	ReconciliationMaxAge    time.Duration
+
+	// Receipts: prices are VAT-inclusive, and a VATRate of zero leaves the
+	// VAT line off. Receipts that failed to issue are retried every
+	// ReceiptBackfillInterval.
+	ReceiptIssuer           string
+	ReceiptIssuerTaxID      string
+	InvoicePrefix           string
+	VATLabel                string
+	VATRate                 float64
+	ReceiptBackfillInterval time.Duration
+
+	// ExchangeRateMaxAge is how old a stored rate may be before prices stop
+	// being converted with it.
+	ExchangeRateMaxAge time.Duration
+
+	// Payment velocity rules. A limit of zero disables it. Daily spend is
+	// capped per currency, e.g. "ETB:20000,USD:400".
+	RiskMaxInitiationsPerUserHour int
+	RiskMaxInitiationsPerIPHour   int
+	RiskMaxDailySpend             map[string]float64
+	RiskBlockedEmailDomains       []string
+
+	// TrustedProxies are the addresses or CIDR ranges whose
+	// X-Forwarded-For header is believed, e.g. Hasura's and the load
+	// balancer's. Without any, the connecting address is the client's.
+	TrustedProxies []string
+
+	// Multipart image uploads, in bytes per file and per request.
+	UploadMaxFileSize  int64
+	UploadMaxTotalSize int64
+	UploadMaxFiles     int
+
+	// Files of a batch are uploaded UploadConcurrency at a time. Transient
+	// failures are tried UploadRetryAttempts times in all, waiting
+	// UploadRetryBackoff before the first retry and twice as long each time
+	// after.
+	UploadConcurrency   int
+	UploadRetryAttempts int
+	UploadRetryBackoff  time.Duration
+
+	// Uploads not used by any recipe are deleted after UploadGracePeriod
+	// when UploadGCEnabled is set. Only uploads attached to a recipe or
+	// used as a step's image_url count as used, so it stays off until
+	// clients attach every image a recipe shows. Direct uploads never
+	// completed are removed either way.
+	UploadGracePeriod     time.Duration
+	UploadCleanupInterval time.Duration
+	UploadGCEnabled       bool
+
+	// Signed direct uploads must be sent within DirectUploadExpiry.
+	DirectUploadExpiry time.Duration
+
+	// Upload quotas by tier, e.g. "free:500,author:5000,premium:20000":
+	// stored megabytes, stored images and images uploaded per hour. A tier
+	// missing from a list has no limit there.
+	UploadQuotaMB     map[string]float64
+	UploadQuotaImages map[string]float64
+	UploadHourlyLimit map[string]float64
+
+	// Images larger than these are rejected before anything decodes them.
+	ImageMaxWidth  int
+	ImageMaxHeight int
+	ImageMaxPixels int64
+
+	// Images of more than ImageDecodeMaxPixels are stored without a
+	// perceptual hash or generated variants. At most ImageDecodeConcurrency
+	// images are decoded at once across the process.
+	ImageDecodeMaxPixels   int64
+	ImageDecodeConcurrency int
+
+	// Step videos: the largest file in bytes and the longest clip.
+	VideoMaxSize     int64
+	VideoMaxDuration time.Duration
+
+	// StorageBackend selects where uploads are kept: "cloudinary" (default),
+	// "local" (files under LocalStorageDir, served by this server) or "s3"
+	// (any S3-compatible service, such as MinIO).
+	StorageBackend  string
+	LocalStorageDir string
+	S3Endpoint      string
+	S3Region        string
+	S3Bucket        string
+	S3AccessKey     string
+	S3SecretKey     string
+	S3PublicURL     string
 }
 
 func LoadConfig() *Config {
 	return &Config{
-		JWTSecret:      os.Getenv("JWT_SECRET"),
-		CloudinaryURL:  os.Getenv("CLOUDINARY_URL"),
-		ChapaSecretKey: os.Getenv("CHAPA_SECRET_KEY"),
-		HasuraEndpoint: os.Getenv("HASURA_ENDPOINT"),
-		HasuraAdminKey: os.Getenv("HASURA_ADMIN_KEY"),
+		JWTSecret:          os.Getenv("JWT_SECRET"),
+		CloudinaryURL:      os.Getenv("CLOUDINARY_URL"),
+		CloudinaryCloud:    os.Getenv("CLOUDINARY_CLOUD_NAME"),
+		CloudinaryAPIKey:   os.Getenv("CLOUDINARY_API_KEY"),
+		CloudinarySecret:   os.Getenv("CLOUDINARY_API_SECRET"),
+		ChapaSecretKey:     os.Getenv("CHAPA_SECRET_KEY"),
+		ChapaWebhookSecret: os.Getenv("CHAPA_WEBHOOK_SECRET"),
+		ChapaCallbackURL:   os.Getenv("CHAPA_CALLBACK_URL"),
+		ChapaReturnURL:     os.Getenv("CHAPA_RETURN_URL"),
+		HasuraEndpoint:     os.Getenv("HASURA_ENDPOINT"),
+		HasuraAdminKey:     os.Getenv("HASURA_ADMIN_KEY"),
+		PublicBaseURL:      getEnv("PUBLIC_BASE_URL", "http://localhost:5050"),
+		PaymentProvider:    getEnv("PAYMENT_PROVIDER", "chapa"),
+		FakeWebhookDelay:   getDurationEnv("FAKE_WEBHOOK_DELAY", 2*time.Second),
+
+		PlatformCommissionType:  getEnv("PLATFORM_COMMISSION_TYPE", "percentage"),
+		PlatformCommissionValue: getFloatEnv("PLATFORM_COMMISSION_VALUE", 10),
+		PlatformCommissionFlat:  getAmountsEnv("PLATFORM_COMMISSION_FLAT", "ETB:10,USD:0.25,EUR:0.25"),
+
+		SubscriptionRenewalWindow: getDurationEnv("SUBSCRIPTION_RENEWAL_WINDOW", 72*time.Hour),
+		SubscriptionGracePeriod:   getDurationEnv("SUBSCRIPTION_GRACE_PERIOD", 72*time.Hour),
+		SubscriptionJobInterval:   getDurationEnv("SUBSCRIPTION_JOB_INTERVAL", time.Hour),
+
+		SMTPHost:     os.Getenv("SMTP_HOST"),
+		SMTPPort:     getEnv("SMTP_PORT", "587"),
+		SMTPUsername: os.Getenv("SMTP_USERNAME"),
+		SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+		MailFrom:     getEnv("MAIL_FROM", "Dishcovery <no-reply@dishcovery.local>"),
+
+		GiftCodeValidity: getDurationEnv("GIFT_CODE_VALIDITY", 365*24*time.Hour),
+
+		ReconciliationInterval:  getDurationEnv("RECONCILIATION_INTERVAL", 15*time.Minute),
+		ReconciliationThreshold: getDurationEnv("RECONCILIATION_THRESHOLD", time.Hour),
+		ReconciliationMaxAge:    getDurationEnv("RECONCILIATION_MAX_AGE", 72*time.Hour),
+
+		ReceiptIssuer:           getEnv("RECEIPT_ISSUER", "Dishcovery"),
+		ReceiptIssuerTaxID:      os.Getenv("RECEIPT_ISSUER_TAX_ID"),
+		InvoicePrefix:           getEnv("INVOICE_PREFIX", "INV"),
+		VATLabel:                getEnv("VAT_LABEL", "VAT"),
+		VATRate:                 getFloatEnv("VAT_RATE", 0),
+		ReceiptBackfillInterval: getDurationEnv("RECEIPT_BACKFILL_INTERVAL", time.Hour),
+
+		ExchangeRateMaxAge: getDurationEnv("EXCHANGE_RATE_MAX_AGE", 7*24*time.Hour),
+
+		RiskMaxInitiationsPerUserHour: getIntEnv("RISK_MAX_INITIATIONS_PER_USER_HOUR", 10),
+		RiskMaxInitiationsPerIPHour:   getIntEnv("RISK_MAX_INITIATIONS_PER_IP_HOUR", 30),
+		RiskMaxDailySpend:             getAmountsEnv("RISK_MAX_DAILY_SPEND", "ETB:20000,USD:400,EUR:400"),
+		RiskBlockedEmailDomains:       getListEnv("RISK_BLOCKED_EMAIL_DOMAINS", "mailinator.com,guerrillamail.com,10minutemail.com"),
+
+		TrustedProxies: getListEnv("TRUSTED_PROXIES", ""),
+
+		UploadMaxFileSize:  int64(getIntEnv("UPLOAD_MAX_FILE_SIZE", 10<<20)),
+		UploadMaxTotalSize: int64(getIntEnv("UPLOAD_MAX_TOTAL_SIZE", 40<<20)),
+		UploadMaxFiles:     getIntEnv("UPLOAD_MAX_FILES", 10),
+
+		UploadConcurrency:   getIntEnv("UPLOAD_CONCURRENCY", 4),
+		UploadRetryAttempts: getIntEnv("UPLOAD_RETRY_ATTEMPTS", 3),
+		UploadRetryBackoff:  getDurationEnv("UPLOAD_RETRY_BACKOFF", 500*time.Millisecond),
+
+		UploadGracePeriod:     getDurationEnv("UPLOAD_GRACE_PERIOD", 24*time.Hour),
+		UploadCleanupInterval: getDurationEnv("UPLOAD_CLEANUP_INTERVAL", time.Hour),
+		UploadGCEnabled:       getBoolEnv("UPLOAD_GC_ENABLED", false),
+
+		DirectUploadExpiry: getDurationEnv("DIRECT_UPLOAD_EXPIRY", 15*time.Minute),
+
+		UploadQuotaMB:     getAmountsEnv("UPLOAD_QUOTA_MB", "free:500,author:5000,premium:20000"),
+		UploadQuotaImages: getAmountsEnv("UPLOAD_QUOTA_IMAGES", "free:200,author:2000,premium:10000"),
+		UploadHourlyLimit: getAmountsEnv("UPLOAD_HOURLY_LIMIT", "free:30,author:120,premium:300"),
+
+		ImageMaxWidth:  getIntEnv("IMAGE_MAX_WIDTH", 8000),
+		ImageMaxHeight: getIntEnv("IMAGE_MAX_HEIGHT", 8000),
+		ImageMaxPixels: int64(getIntEnv("IMAGE_MAX_PIXELS", 40_000_000)),
+
+		ImageDecodeMaxPixels:   int64(getIntEnv("IMAGE_DECODE_MAX_PIXELS", 16_000_000)),
+		ImageDecodeConcurrency: getIntEnv("IMAGE_DECODE_CONCURRENCY", 2),
+
+		VideoMaxSize:     int64(getIntEnv("VIDEO_MAX_SIZE", 100<<20)),
+		VideoMaxDuration: getDurationEnv("VIDEO_MAX_DURATION", 90*time.Second),
+
+		StorageBackend:  getEnv("STORAGE_BACKEND", "cloudinary"),
+		LocalStorageDir: getEnv("LOCAL_STORAGE_DIR", "uploads"),
+		S3Endpoint:      os.Getenv("S3_ENDPOINT"),
+		S3Region:        getEnv("S3_REGION", "us-east-1"),
+		S3Bucket:        os.Getenv("S3_BUCKET"),
+		S3AccessKey:     os.Getenv("S3_ACCESS_KEY"),
+		S3SecretKey:     os.Getenv("S3_SECRET_KEY"),
+		S3PublicURL:     os.Getenv("S3_PUBLIC_URL"),
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getDurationEnv(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration for %s: %v, using %s", key, err, fallback)
+		return fallback
+	}
+	return d
+}
+
+func getBoolEnv(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid boolean for %s: %v, using %t", key, err, fallback)
+		return fallback
+	}
+	return b
+}
+
+func getFloatEnv(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Invalid number for %s: %v, using %v", key, err, fallback)
+		return fallback
+	}
+	return f
+}
+
+func getIntEnv(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid integer for %s: %v, using %d", key, err, fallback)
+		return fallback
+	}
+	return i
+}
+
+// getListEnv reads a comma-separated list, lowercased and trimmed.
+func getListEnv(key, fallback string) []string {
+	var list []string
+	for _, item := range strings.Split(getEnv(key, fallback), ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getAmountsEnv reads comma-separated CURRENCY:amount pairs.
+func getAmountsEnv(key, fallback string) map[string]float64 {
+	amounts := make(map[string]float64)
+	for _, pair := range strings.Split(getEnv(key, fallback), ",") {
+		currency, amount, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			continue
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(amount), 64)
+		if err != nil {
+			log.Printf("Invalid amount for %s in %s: %v", currency, key, err)
+			continue
+		}
+		amounts[strings.ToUpper(strings.TrimSpace(currency))] = f
 	}
+	return amounts
 }
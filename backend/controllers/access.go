@@ -0,0 +1,340 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"backend/config"
+	"backend/hasura"
+	"backend/middleware"
+)
+
+// Reasons reported alongside an access decision.
+const (
+	accessFree         = "free"
+	accessAdmin        = "admin"
+	accessAuthor       = "author"
+	accessPurchased    = "purchased"
+	accessGifted       = "gifted"
+	accessSubscription = "subscription"
+	accessNotPurchased = "not_purchased"
+	accessNotFound     = "not_found"
+)
+
+const (
+	maxAccessBatch = 100
+
+	// How much of a premium recipe is shown to users without access.
+	previewIngredientCount = 3
+	previewStepCount       = 1
+)
+
+type RecipeAccess struct {
+	RecipeID  string `json:"recipeId"`
+	CanAccess bool   `json:"canAccess"`
+	Reason    string `json:"reason"`
+}
+
+type RecipeAccessRequest struct {
+	RecipeID string `json:"recipeId"`
+}
+
+type RecipeAccessBatchRequest struct {
+	RecipeIDs []string `json:"recipeIds"`
+}
+
+// resolveRecipeAccess decides, in a single Hasura round trip, which of the
+// given recipes a user may read in full. Decisions are returned in the order
+// of recipeIDs.
+func resolveRecipeAccess(ctx context.Context, client *hasura.Client, userID, role string, recipeIDs []string) ([]RecipeAccess, error) {
+	query := `
+		query RecipeAccess($user_id: uuid!, $recipe_ids: [uuid!]!, $now: timestamptz!) {
+			Recipes(where: {id: {_in: $recipe_ids}}) {
+				id
+				user_id
+				price
+			}
+			Purchases(where: {user_id: {_eq: $user_id}, recipe_id: {_in: $recipe_ids}, status: {_eq: "completed"}}) {
+				recipe_id
+			}
+			Gifts(where: {redeemed_by: {_eq: $user_id}, recipe_id: {_in: $recipe_ids}, status: {_eq: "redeemed"}}) {
+				recipe_id
+			}
+			Subscriptions(where: {user_id: {_eq: $user_id}, _or: [
+				{status: {_eq: "active"}, current_period_end: {_gt: $now}},
+				{status: {_eq: "past_due"}, grace_until: {_gt: $now}}
+			]}, limit: 1) {
+				id
+			}
+		}
+	`
+
+	variables := map[string]interface{}{
+		"user_id":    userID,
+		"recipe_ids": recipeIDs,
+		"now":        time.Now().UTC().Format(time.RFC3339),
+	}
+
+	var response struct {
+		Recipes []struct {
+			ID     string  `json:"id"`
+			UserID string  `json:"user_id"`
+			Price  float64 `json:"price"`
+		} `json:"Recipes"`
+		Purchases []struct {
+			RecipeID string `json:"recipe_id"`
+		} `json:"Purchases"`
+		Gifts []struct {
+			RecipeID string `json:"recipe_id"`
+		} `json:"Gifts"`
+		Subscriptions []struct {
+			ID string `json:"id"`
+		} `json:"Subscriptions"`
+	}
+	if err := client.Execute(ctx, query, variables, &response); err != nil {
+		return nil, err
+	}
+
+	type recipeInfo struct {
+		authorID string
+		price    float64
+	}
+	recipes := make(map[string]recipeInfo, len(response.Recipes))
+	for _, recipe := range response.Recipes {
+		recipes[recipe.ID] = recipeInfo{authorID: recipe.UserID, price: recipe.Price}
+	}
+	purchased := make(map[string]bool, len(response.Purchases))
+	for _, purchase := range response.Purchases {
+		purchased[purchase.RecipeID] = true
+	}
+	gifted := make(map[string]bool, len(response.Gifts))
+	for _, gift := range response.Gifts {
+		gifted[gift.RecipeID] = true
+	}
+	subscribed := len(response.Subscriptions) > 0
+
+	decisions := make([]RecipeAccess, 0, len(recipeIDs))
+	for _, recipeID := range recipeIDs {
+		decision := RecipeAccess{RecipeID: recipeID, CanAccess: true}
+		recipe, ok := recipes[recipeID]
+		switch {
+		case !ok:
+			decision.CanAccess = false
+			decision.Reason = accessNotFound
+		case recipe.price <= 0:
+			decision.Reason = accessFree
+		case role == middleware.RoleAdmin:
+			decision.Reason = accessAdmin
+		case recipe.authorID == userID:
+			decision.Reason = accessAuthor
+		case purchased[recipeID]:
+			decision.Reason = accessPurchased
+		case gifted[recipeID]:
+			decision.Reason = accessGifted
+		case subscribed:
+			decision.Reason = accessSubscription
+		default:
+			decision.CanAccess = false
+			decision.Reason = accessNotPurchased
+		}
+		decisions = append(decisions, decision)
+	}
+	return decisions, nil
+}
+
+// CanAccessRecipeHandler answers whether the caller may read a recipe in
+// full, and why.
+func CanAccessRecipeHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req RecipeAccessRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.RecipeID == "" {
+		http.Error(w, "recipe ID is required", http.StatusBadRequest)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	decisions, err := resolveRecipeAccess(r.Context(), client, userID, role, []string{req.RecipeID})
+	if err != nil {
+		log.Printf("Error checking recipe access: %v", err)
+		http.Error(w, "Error checking recipe access", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Access checked", decisions[0]))
+}
+
+// CanAccessRecipesHandler is the batch variant of CanAccessRecipeHandler,
+// used by recipe listings.
+func CanAccessRecipesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req RecipeAccessBatchRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.RecipeIDs) == 0 {
+		http.Error(w, "at least one recipe ID is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.RecipeIDs) > maxAccessBatch {
+		http.Error(w, "too many recipe IDs in one request", http.StatusBadRequest)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	decisions, err := resolveRecipeAccess(r.Context(), client, userID, role, req.RecipeIDs)
+	if err != nil {
+		log.Printf("Error checking recipe access: %v", err)
+		http.Error(w, "Error checking recipe access", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Access checked", decisions))
+}
+
+// GetRecipeContentHandler returns a recipe's ingredients and steps. Callers
+// without access get a preview with the first few of each, so premium
+// content is only ever served through this action.
+func GetRecipeContentHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req RecipeAccessRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.RecipeID == "" {
+		http.Error(w, "recipe ID is required", http.StatusBadRequest)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	decisions, err := resolveRecipeAccess(r.Context(), client, userID, role, []string{req.RecipeID})
+	if err != nil {
+		log.Printf("Error checking recipe access: %v", err)
+		http.Error(w, "Error checking recipe access", http.StatusInternalServerError)
+		return
+	}
+	access := decisions[0]
+	if access.Reason == accessNotFound {
+		http.Error(w, "Recipe not found", http.StatusNotFound)
+		return
+	}
+
+	query := `
+		query RecipeContent($id: uuid!) {
+			Recipes_by_pk(id: $id) {
+				id
+				title
+				description
+				price
+				currency
+				user_id
+			}
+			Ingredients(where: {recipe_id: {_eq: $id}}) {
+				id
+				name
+				quantity
+				unit
+			}
+			Steps(where: {recipe_id: {_eq: $id}}, order_by: {step_number: asc}) {
+				id
+				step_number
+				description
+				image_url
+			}
+		}
+	`
+
+	var response struct {
+		Recipe      map[string]interface{}   `json:"Recipes_by_pk"`
+		Ingredients []map[string]interface{} `json:"Ingredients"`
+		Steps       []map[string]interface{} `json:"Steps"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"id": req.RecipeID}, &response); err != nil {
+		log.Printf("Error loading recipe content: %v", err)
+		http.Error(w, "Error loading recipe content", http.StatusInternalServerError)
+		return
+	}
+
+	if access.Reason != accessAuthor {
+		recordRecipeView(r.Context(), client, req.RecipeID, userID)
+	}
+
+	ingredients, steps := response.Ingredients, response.Steps
+	totalIngredients, totalSteps := len(ingredients), len(steps)
+	if !access.CanAccess {
+		if len(ingredients) > previewIngredientCount {
+			ingredients = ingredients[:previewIngredientCount]
+		}
+		if len(steps) > previewStepCount {
+			steps = steps[:previewStepCount]
+		}
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Recipe content retrieved", map[string]interface{}{
+		"recipe":           response.Recipe,
+		"access":           access,
+		"preview":          !access.CanAccess,
+		"ingredients":      ingredients,
+		"steps":            steps,
+		"totalIngredients": totalIngredients,
+		"totalSteps":       totalSteps,
+	}))
+}
+
+// recordRecipeView counts the caller as a viewer of the recipe today, for
+// the author dashboard's conversion rate. Repeat views the same day are
+// ignored, and failures never block the content.
+func recordRecipeView(ctx context.Context, client *hasura.Client, recipeID, userID string) {
+	query := `
+		mutation RecordRecipeView($object: RecipeViews_insert_input!) {
+			insert_RecipeViews_one(
+				object: $object,
+				on_conflict: {constraint: RecipeViews_recipe_id_viewer_id_viewed_on_key, update_columns: []}
+			) {
+				id
+			}
+		}
+	`
+	object := map[string]interface{}{
+		"recipe_id": recipeID,
+		"viewer_id": userID,
+		"viewed_on": time.Now().UTC().Format("2006-01-02"),
+	}
+	var response struct {
+		InsertRecipeViewsOne *struct {
+			ID string `json:"id"`
+		} `json:"insert_RecipeViews_one"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"object": object}, &response); err != nil {
+		log.Printf("Error recording view of recipe %s: %v", recipeID, err)
+	}
+}
@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"backend/middleware"
+)
+
+// decodeActionInput reads a Hasura action payload and unmarshals its "input"
+// object into v.
+func decodeActionInput(r *http.Request, v interface{}) error {
+	var payload struct {
+		Input json.RawMessage `json:"input"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		return fmt.Errorf("invalid JSON payload")
+	}
+	if len(payload.Input) == 0 {
+		return fmt.Errorf("missing action input")
+	}
+	if err := json.Unmarshal(payload.Input, v); err != nil {
+		return fmt.Errorf("invalid action input")
+	}
+	return nil
+}
+
+// requestUser returns the authenticated user's ID and role set by
+// AuthMiddleware.
+func requestUser(r *http.Request) (string, string) {
+	userID, _ := r.Context().Value(middleware.UserIDKey).(string)
+	role, _ := r.Context().Value(middleware.RoleKey).(string)
+	return userID, role
+}
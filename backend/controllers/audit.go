@@ -0,0 +1,44 @@
+package controllers
+
+import (
+	"context"
+	"log"
+
+	"backend/hasura"
+)
+
+// recordAudit appends an entry to the audit trail. Failures are logged rather
+// than returned so that auditing never undoes the action being audited.
+// actorID may be empty for actions taken by the system, such as webhooks.
+func recordAudit(ctx context.Context, client *hasura.Client, actorID, action, entityType, entityID string, details map[string]interface{}) {
+	query := `
+		mutation RecordAudit($object: AuditLogs_insert_input!) {
+			insert_AuditLogs_one(object: $object) {
+				id
+			}
+		}
+	`
+
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+
+	object := map[string]interface{}{
+		"action":      action,
+		"entity_type": entityType,
+		"entity_id":   entityID,
+		"details":     details,
+	}
+	if actorID != "" {
+		object["actor_id"] = actorID
+	}
+
+	var response struct {
+		InsertAuditLogsOne struct {
+			ID string `json:"id"`
+		} `json:"insert_AuditLogs_one"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"object": object}, &response); err != nil {
+		log.Printf("Error recording audit entry %s for %s %s: %v", action, entityType, entityID, err)
+	}
+}
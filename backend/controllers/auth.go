@@ -3,6 +3,7 @@ package controllers
 import (
 	"backend/config"
 	"backend/hasura"
+	"backend/middleware"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -29,6 +30,7 @@ type User struct {
 	Username string `json:"username"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	Role     string `json:"role"`
 }
 
 func RegisterHandler(w http.ResponseWriter, r *http.Request) {
@@ -111,6 +113,7 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 				username
 				email
 				password
+				role
 			}
 		}
 	`
@@ -141,10 +144,15 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if user.Role == "" {
+		user.Role = middleware.RoleUser
+	}
+
 	// Generate JWT
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": user.ID,
-		"exp": time.Now().Add(time.Hour * 24).Unix(),
+		"sub":  user.ID,
+		"role": user.Role,
+		"exp":  time.Now().Add(time.Hour * 24).Unix(),
 	})
 
 	tokenString, err := token.SignedString([]byte(cfg.JWTSecret))
@@ -0,0 +1,359 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"backend/config"
+	"backend/hasura"
+	"backend/middleware"
+
+	"github.com/google/uuid"
+)
+
+const minBundleRecipes = 2
+
+type CreateBundleRequest struct {
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Price       float64  `json:"price"`
+	RecipeIDs   []string `json:"recipeIds"`
+}
+
+type ListBundlesRequest struct {
+	AuthorID string `json:"authorId"`
+}
+
+type BundleRequest struct {
+	BundleID string `json:"bundleId"`
+}
+
+type bundleRecord struct {
+	ID          string   `json:"id"`
+	AuthorID    string   `json:"author_id"`
+	Title       string   `json:"title"`
+	Description *string  `json:"description"`
+	Price       float64  `json:"price"`
+	Currency    string   `json:"currency"`
+	Active      bool     `json:"active"`
+	RecipeIDs   []string `json:"recipe_ids"`
+	// ListPrice is what the recipes cost when bought one by one.
+	ListPrice float64 `json:"list_price"`
+}
+
+// CreateBundleHandler lets an author sell several of their premium recipes
+// together for less than their combined price.
+func CreateBundleHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req CreateBundleRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Title = strings.TrimSpace(req.Title)
+	if req.Title == "" {
+		http.Error(w, "title is required", http.StatusBadRequest)
+		return
+	}
+	recipeIDs := uniqueStrings(req.RecipeIDs)
+	if len(recipeIDs) < minBundleRecipes {
+		http.Error(w, fmt.Sprintf("a bundle needs at least %d different recipes", minBundleRecipes), http.StatusBadRequest)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	query := `
+		query BundleRecipes($ids: [uuid!]!) {
+			Recipes(where: {id: {_in: $ids}}) {
+				id
+				user_id
+				price
+				currency
+			}
+		}
+	`
+	var recipes struct {
+		Recipes []struct {
+			ID       string  `json:"id"`
+			UserID   string  `json:"user_id"`
+			Price    float64 `json:"price"`
+			Currency string  `json:"currency"`
+		} `json:"Recipes"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"ids": recipeIDs}, &recipes); err != nil {
+		log.Printf("Error loading bundle recipes: %v", err)
+		http.Error(w, "Error loading recipes", http.StatusInternalServerError)
+		return
+	}
+	if len(recipes.Recipes) != len(recipeIDs) {
+		http.Error(w, "Some recipes were not found", http.StatusNotFound)
+		return
+	}
+
+	var listPrice float64
+	currency := recipes.Recipes[0].Currency
+	for _, recipe := range recipes.Recipes {
+		if recipe.UserID != userID {
+			http.Error(w, "Bundles can only contain your own recipes", http.StatusForbidden)
+			return
+		}
+		if recipe.Price <= 0 {
+			http.Error(w, "Bundles can only contain premium recipes", http.StatusBadRequest)
+			return
+		}
+		if recipe.Currency != currency {
+			http.Error(w, "All recipes in a bundle must be priced in the same currency", http.StatusBadRequest)
+			return
+		}
+		listPrice += recipe.Price
+	}
+	listPrice = roundMoney(listPrice)
+
+	price := roundMoney(req.Price)
+	if price >= listPrice {
+		http.Error(w, fmt.Sprintf("bundle price must be lower than the recipes' combined price of %.2f %s", listPrice, currency), http.StatusBadRequest)
+		return
+	}
+	if err := validateAmount(price, currency); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	bundleID := uuid.New().String()
+	links := make([]map[string]interface{}, 0, len(recipeIDs))
+	for _, recipeID := range recipeIDs {
+		links = append(links, map[string]interface{}{"bundle_id": bundleID, "recipe_id": recipeID})
+	}
+
+	bundle := map[string]interface{}{
+		"id":        bundleID,
+		"author_id": userID,
+		"title":     req.Title,
+		"price":     price,
+		"currency":  currency,
+	}
+	if req.Description != "" {
+		bundle["description"] = req.Description
+	}
+
+	query = `
+		mutation CreateBundle($bundle: Bundles_insert_input!, $links: [BundleRecipes_insert_input!]!) {
+			insert_Bundles_one(object: $bundle) {
+				id
+			}
+			insert_BundleRecipes(objects: $links) {
+				affected_rows
+			}
+		}
+	`
+	var created struct {
+		InsertBundlesOne struct {
+			ID string `json:"id"`
+		} `json:"insert_Bundles_one"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"bundle": bundle, "links": links}, &created); err != nil {
+		log.Printf("Error creating bundle: %v", err)
+		http.Error(w, "Error creating bundle", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Bundle created", bundleRecord{
+		ID:        bundleID,
+		AuthorID:  userID,
+		Title:     req.Title,
+		Price:     price,
+		Currency:  currency,
+		Active:    true,
+		RecipeIDs: recipeIDs,
+		ListPrice: listPrice,
+	}))
+}
+
+// ListBundlesHandler returns active bundles, optionally for one author.
+func ListBundlesHandler(w http.ResponseWriter, r *http.Request) {
+	var req ListBundlesRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	where := map[string]interface{}{"active": map[string]interface{}{"_eq": true}}
+	if req.AuthorID != "" {
+		where["author_id"] = map[string]interface{}{"_eq": req.AuthorID}
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	bundles, err := loadBundles(r.Context(), client, where)
+	if err != nil {
+		log.Printf("Error listing bundles: %v", err)
+		http.Error(w, "Error listing bundles", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Bundles retrieved", bundles))
+}
+
+// DeactivateBundleHandler takes a bundle off sale. Only its author or an
+// admin may do so.
+func DeactivateBundleHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req BundleRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	where := map[string]interface{}{"id": map[string]interface{}{"_eq": req.BundleID}}
+	if role != middleware.RoleAdmin {
+		where["author_id"] = map[string]interface{}{"_eq": userID}
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	query := `
+		mutation DeactivateBundle($where: Bundles_bool_exp!) {
+			update_Bundles(where: $where, _set: {active: false}) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		UpdateBundles struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_Bundles"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"where": where}, &response); err != nil {
+		log.Printf("Error deactivating bundle: %v", err)
+		http.Error(w, "Error deactivating bundle", http.StatusInternalServerError)
+		return
+	}
+	if response.UpdateBundles.AffectedRows == 0 {
+		http.Error(w, "Bundle not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Bundle deactivated", nil))
+}
+
+// loadBundles returns the bundles matching where together with their recipes
+// and list prices.
+func loadBundles(ctx context.Context, client *hasura.Client, where map[string]interface{}) ([]bundleRecord, error) {
+	query := `
+		query Bundles($where: Bundles_bool_exp!) {
+			Bundles(where: $where, order_by: {created_at: desc}) {
+				id
+				author_id
+				title
+				description
+				price
+				currency
+				active
+			}
+		}
+	`
+	var response struct {
+		Bundles []bundleRecord `json:"Bundles"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"where": where}, &response); err != nil {
+		return nil, err
+	}
+	if len(response.Bundles) == 0 {
+		return response.Bundles, nil
+	}
+
+	bundleIDs := make([]string, 0, len(response.Bundles))
+	for _, bundle := range response.Bundles {
+		bundleIDs = append(bundleIDs, bundle.ID)
+	}
+
+	query = `
+		query BundleContents($bundle_ids: [uuid!]!) {
+			BundleRecipes(where: {bundle_id: {_in: $bundle_ids}}) {
+				bundle_id
+				recipe_id
+			}
+		}
+	`
+	var links struct {
+		BundleRecipes []struct {
+			BundleID string `json:"bundle_id"`
+			RecipeID string `json:"recipe_id"`
+		} `json:"BundleRecipes"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"bundle_ids": bundleIDs}, &links); err != nil {
+		return nil, err
+	}
+
+	recipesByBundle := make(map[string][]string)
+	var recipeIDs []string
+	for _, link := range links.BundleRecipes {
+		recipesByBundle[link.BundleID] = append(recipesByBundle[link.BundleID], link.RecipeID)
+		recipeIDs = append(recipeIDs, link.RecipeID)
+	}
+
+	query = `
+		query BundleRecipePrices($ids: [uuid!]!) {
+			Recipes(where: {id: {_in: $ids}}) {
+				id
+				price
+			}
+		}
+	`
+	var prices struct {
+		Recipes []struct {
+			ID    string  `json:"id"`
+			Price float64 `json:"price"`
+		} `json:"Recipes"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"ids": uniqueStrings(recipeIDs)}, &prices); err != nil {
+		return nil, err
+	}
+	priceByRecipe := make(map[string]float64, len(prices.Recipes))
+	for _, recipe := range prices.Recipes {
+		priceByRecipe[recipe.ID] = recipe.Price
+	}
+
+	for i := range response.Bundles {
+		bundle := &response.Bundles[i]
+		bundle.RecipeIDs = recipesByBundle[bundle.ID]
+		for _, recipeID := range bundle.RecipeIDs {
+			bundle.ListPrice += priceByRecipe[recipeID]
+		}
+		bundle.ListPrice = roundMoney(bundle.ListPrice)
+	}
+	return response.Bundles, nil
+}
+
+// uniqueStrings returns values without duplicates or empty strings, keeping
+// the first occurrence of each.
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := make([]string, 0, len(values))
+	for _, value := range values {
+		if value == "" || seen[value] {
+			continue
+		}
+		seen[value] = true
+		unique = append(unique, value)
+	}
+	return unique
+}
@@ -0,0 +1,604 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/config"
+	"backend/hasura"
+	"backend/payments"
+
+	"github.com/google/uuid"
+)
+
+const maxCartItems = 50
+
+// CartItem is either a single recipe or an author's bundle.
+type CartItem struct {
+	RecipeID string `json:"recipeId,omitempty"`
+	BundleID string `json:"bundleId,omitempty"`
+}
+
+type CheckoutRequest struct {
+	Items    []CartItem `json:"items"`
+	Currency string     `json:"currency"`
+}
+
+// checkoutLine is one line item of an order as shown to the buyer.
+type checkoutLine struct {
+	Type      string   `json:"type"`
+	ID        string   `json:"id"`
+	Title     string   `json:"title"`
+	Amount    float64  `json:"amount"`
+	ListPrice float64  `json:"listPrice"`
+	RecipeIDs []string `json:"recipeIds"`
+}
+
+// orderPurchase is the share of an order that becomes one recipe's purchase.
+type orderPurchase struct {
+	recipeID string
+	authorID string
+	bundleID string
+	amount   float64
+	exchange *conversion
+}
+
+type orderRecord struct {
+	ID          string  `json:"id"`
+	TxRef       string  `json:"tx_ref"`
+	Amount      float64 `json:"amount"`
+	Currency    string  `json:"currency"`
+	Status      string  `json:"status"`
+	CheckoutURL *string `json:"checkout_url"`
+}
+
+type cartRecipe struct {
+	ID       string  `json:"id"`
+	Title    string  `json:"title"`
+	UserID   string  `json:"user_id"`
+	Price    float64 `json:"price"`
+	Currency string  `json:"currency"`
+}
+
+// allocate splits total across parts in proportion to weights, rounding to
+// cents and giving any remainder to the last part so the parts add up.
+func allocate(total float64, weights []float64) []float64 {
+	var sum float64
+	for _, weight := range weights {
+		sum += weight
+	}
+
+	parts := make([]float64, len(weights))
+	var assigned float64
+	for i, weight := range weights {
+		if i == len(weights)-1 {
+			parts[i] = roundMoney(total - assigned)
+			break
+		}
+		if sum > 0 {
+			parts[i] = roundMoney(total * weight / sum)
+		}
+		assigned += parts[i]
+	}
+	return parts
+}
+
+// getOrderByIdempotencyKey returns the live order a user previously created
+// with the given Idempotency-Key header, or nil if there is none. As with
+// single purchases, a key whose order failed or expired can be used again,
+// and an expired checkout is retired first.
+func getOrderByIdempotencyKey(ctx context.Context, client *hasura.Client, userID, key string) (*orderRecord, error) {
+	if err := expirePendingOrders(ctx, client, userID, key); err != nil {
+		return nil, err
+	}
+
+	query := `
+		query OrderByIdempotencyKey($user_id: uuid!, $key: String!, $statuses: [String!]!) {
+			Orders(where: {user_id: {_eq: $user_id}, idempotency_key: {_eq: $key}, status: {_in: $statuses}}, limit: 1) {
+				id
+				tx_ref
+				amount
+				currency
+				status
+				checkout_url
+			}
+		}
+	`
+
+	var response struct {
+		Orders []orderRecord `json:"Orders"`
+	}
+	variables := map[string]interface{}{"user_id": userID, "key": key, "statuses": liveIdempotencyStatuses}
+	if err := client.Execute(ctx, query, variables, &response); err != nil {
+		return nil, err
+	}
+	if len(response.Orders) == 0 {
+		return nil, nil
+	}
+	return &response.Orders[0], nil
+}
+
+// expirePendingOrders marks a user's pending orders under key whose checkout
+// has expired as such, along with their purchases.
+func expirePendingOrders(ctx context.Context, client *hasura.Client, userID, key string) error {
+	query := `
+		mutation ExpirePendingOrders($user_id: uuid!, $key: String!, $now: timestamptz!) {
+			update_Orders(
+				where: {user_id: {_eq: $user_id}, idempotency_key: {_eq: $key}, status: {_eq: "pending"}, expires_at: {_lte: $now}},
+				_set: {status: "expired"}
+			) {
+				returning {
+					tx_ref
+				}
+			}
+		}
+	`
+	variables := map[string]interface{}{
+		"user_id": userID,
+		"key":     key,
+		"now":     time.Now().UTC().Format(time.RFC3339),
+	}
+
+	var expired struct {
+		UpdateOrders struct {
+			Returning []struct {
+				TxRef string `json:"tx_ref"`
+			} `json:"returning"`
+		} `json:"update_Orders"`
+	}
+	if err := client.Execute(ctx, query, variables, &expired); err != nil {
+		return err
+	}
+	if len(expired.UpdateOrders.Returning) == 0 {
+		return nil
+	}
+	var txRefs []string
+	for _, order := range expired.UpdateOrders.Returning {
+		txRefs = append(txRefs, order.TxRef)
+	}
+	return expirePendingPurchases(ctx, client, map[string]interface{}{
+		"chapa_tx_id": map[string]interface{}{"_in": txRefs},
+	})
+}
+
+// CheckoutHandler is the multi-recipe successor of PaymentInitHandler. It
+// prices a cart of recipes and bundles on the server, opens a single provider
+// transaction for the total and creates one pending purchase per recipe, all
+// sharing the transaction's tx_ref so the webhook completes them together.
+func CheckoutHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	var req CheckoutRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Error decoding request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Items) == 0 {
+		http.Error(w, "cart is empty", http.StatusBadRequest)
+		return
+	}
+	if len(req.Items) > maxCartItems {
+		http.Error(w, fmt.Sprintf("a cart can hold at most %d items", maxCartItems), http.StatusBadRequest)
+		return
+	}
+	currency := strings.ToUpper(req.Currency)
+	if !supportedCurrencies[currency] {
+		http.Error(w, fmt.Sprintf("unsupported currency: %s. Supported currencies are: ETB, USD, EUR", currency), http.StatusBadRequest)
+		return
+	}
+
+	var recipeIDs, bundleIDs []string
+	for _, item := range req.Items {
+		switch {
+		case item.RecipeID != "" && item.BundleID == "":
+			recipeIDs = append(recipeIDs, item.RecipeID)
+		case item.BundleID != "" && item.RecipeID == "":
+			bundleIDs = append(bundleIDs, item.BundleID)
+		default:
+			http.Error(w, "each cart item needs either a recipeId or a bundleId", http.StatusBadRequest)
+			return
+		}
+	}
+	recipeIDs = uniqueStrings(recipeIDs)
+	bundleIDs = uniqueStrings(bundleIDs)
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	idempotencyKey := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+	if idempotencyKey != "" {
+		existing, err := getOrderByIdempotencyKey(r.Context(), client, userID, idempotencyKey)
+		if err != nil {
+			log.Printf("Error looking up idempotency key: %v", err)
+			http.Error(w, "Error checking existing orders", http.StatusInternalServerError)
+			return
+		}
+		if existing != nil {
+			writeExistingOrder(w, existing)
+			return
+		}
+	}
+
+	var bundles []bundleRecord
+	if len(bundleIDs) > 0 {
+		bundles, err = loadBundles(r.Context(), client, map[string]interface{}{
+			"id":     map[string]interface{}{"_in": bundleIDs},
+			"active": map[string]interface{}{"_eq": true},
+		})
+		if err != nil {
+			log.Printf("Error loading bundles: %v", err)
+			http.Error(w, "Error loading bundles", http.StatusInternalServerError)
+			return
+		}
+		if len(bundles) != len(bundleIDs) {
+			http.Error(w, "Some bundles were not found or are no longer on sale", http.StatusNotFound)
+			return
+		}
+	}
+
+	// Every recipe may appear only once, whether on its own or in a bundle.
+	inCart := make(map[string]string)
+	allRecipeIDs := append([]string(nil), recipeIDs...)
+	for _, recipeID := range recipeIDs {
+		inCart[recipeID] = "recipe"
+	}
+	for _, bundle := range bundles {
+		for _, recipeID := range bundle.RecipeIDs {
+			if _, dup := inCart[recipeID]; dup {
+				http.Error(w, fmt.Sprintf("recipe %s appears more than once in the cart", recipeID), http.StatusBadRequest)
+				return
+			}
+			inCart[recipeID] = bundle.ID
+			allRecipeIDs = append(allRecipeIDs, recipeID)
+		}
+	}
+
+	query := `
+		query CartRecipes($ids: [uuid!]!, $user_id: uuid!) {
+			Recipes(where: {id: {_in: $ids}}) {
+				id
+				title
+				user_id
+				price
+				currency
+			}
+			Purchases(where: {user_id: {_eq: $user_id}, recipe_id: {_in: $ids}, status: {_eq: "completed"}}) {
+				recipe_id
+			}
+		}
+	`
+	var contents struct {
+		Recipes   []cartRecipe `json:"Recipes"`
+		Purchases []struct {
+			RecipeID string `json:"recipe_id"`
+		} `json:"Purchases"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"ids": allRecipeIDs, "user_id": userID}, &contents); err != nil {
+		log.Printf("Error loading cart recipes: %v", err)
+		http.Error(w, "Error loading recipes", http.StatusInternalServerError)
+		return
+	}
+	if len(contents.Recipes) != len(allRecipeIDs) {
+		http.Error(w, "Some recipes were not found", http.StatusNotFound)
+		return
+	}
+	if len(contents.Purchases) > 0 {
+		http.Error(w, fmt.Sprintf("You already own recipe %s", contents.Purchases[0].RecipeID), http.StatusConflict)
+		return
+	}
+
+	recipes := make(map[string]cartRecipe, len(contents.Recipes))
+	for _, recipe := range contents.Recipes {
+		if recipe.Price <= 0 {
+			http.Error(w, fmt.Sprintf("recipe %s is free and cannot be bought", recipe.ID), http.StatusBadRequest)
+			return
+		}
+		recipes[recipe.ID] = recipe
+	}
+
+	// Everything is charged in the buyer's currency; each line records the
+	// rate it was converted at.
+	rates, err := loadExchangeRates(r.Context(), client, cfg)
+	if err != nil {
+		log.Printf("Error loading exchange rates: %v", err)
+		http.Error(w, "Error loading exchange rates", http.StatusInternalServerError)
+		return
+	}
+	converted := make(map[string]*conversion, len(recipes))
+	for id, recipe := range recipes {
+		c, err := rates.convert(recipe.Price, recipe.Currency, currency)
+		if err != nil {
+			writePricingError(w, err)
+			return
+		}
+		converted[id] = c
+	}
+
+	var (
+		lines     []checkoutLine
+		purchases []orderPurchase
+		total     float64
+	)
+	for _, recipeID := range recipeIDs {
+		recipe := recipes[recipeID]
+		price := converted[recipeID]
+		lines = append(lines, checkoutLine{
+			Type:      "recipe",
+			ID:        recipe.ID,
+			Title:     recipe.Title,
+			Amount:    price.Amount,
+			ListPrice: price.Amount,
+			RecipeIDs: []string{recipe.ID},
+		})
+		purchases = append(purchases, orderPurchase{recipeID: recipe.ID, authorID: recipe.UserID, amount: price.Amount, exchange: price})
+		total += price.Amount
+	}
+	for _, bundle := range bundles {
+		price, err := rates.convert(bundle.Price, bundle.Currency, currency)
+		if err != nil {
+			writePricingError(w, err)
+			return
+		}
+		listPrice := 0.0
+		for _, recipeID := range bundle.RecipeIDs {
+			listPrice += converted[recipeID].Amount
+		}
+		lines = append(lines, checkoutLine{
+			Type:      "bundle",
+			ID:        bundle.ID,
+			Title:     bundle.Title,
+			Amount:    price.Amount,
+			ListPrice: roundMoney(listPrice),
+			RecipeIDs: bundle.RecipeIDs,
+		})
+
+		// The bundle discount is spread over its recipes in proportion to
+		// their list prices so refunds and earnings stay per recipe. A
+		// bundle's recipes share its currency, so the base shares are split
+		// the same way.
+		weights := make([]float64, len(bundle.RecipeIDs))
+		for i, recipeID := range bundle.RecipeIDs {
+			weights[i] = recipes[recipeID].Price
+		}
+		baseShares := allocate(bundle.Price, weights)
+		for i, amount := range allocate(price.Amount, weights) {
+			recipe := recipes[bundle.RecipeIDs[i]]
+			share := *price
+			share.BaseAmount = baseShares[i]
+			share.Amount = amount
+			purchases = append(purchases, orderPurchase{recipeID: recipe.ID, authorID: recipe.UserID, bundleID: bundle.ID, amount: amount, exchange: &share})
+		}
+		total += price.Amount
+	}
+	total = roundMoney(total)
+
+	if err := validateAmount(total, currency); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A transaction can only be split with one subaccount, so the author's
+	// share is paid out automatically only when the whole cart is theirs.
+	// Otherwise the platform collects and the ledger records what is owed.
+	singleAuthor := purchases[0].authorID
+	for _, purchase := range purchases {
+		if purchase.authorID != singleAuthor {
+			singleAuthor = ""
+			break
+		}
+	}
+	var payoutAccount *payoutAccountRecord
+	if singleAuthor != "" {
+		payoutAccount, err = getPayoutAccount(r.Context(), client, singleAuthor)
+		if err != nil {
+			log.Printf("Error loading payout account: %v", err)
+			http.Error(w, "Error loading recipe author", http.StatusInternalServerError)
+			return
+		}
+	}
+	subaccountID, split := payoutRoute(cfg, payoutAccount, currency)
+
+	amounts := make([]float64, len(purchases))
+	for i, purchase := range purchases {
+		amounts[i] = purchase.amount
+	}
+	fees := allocate(split.Fee(total), amounts)
+
+	// Clear out expired checkouts for these recipes so they do not trip the
+	// pending-purchase unique index.
+	for _, recipeID := range allRecipeIDs {
+		existing, err := findPendingPurchase(r.Context(), client, userID, recipeID)
+		if err != nil {
+			log.Printf("Error looking up pending purchase: %v", err)
+			http.Error(w, "Error checking existing purchases", http.StatusInternalServerError)
+			return
+		}
+		if existing != nil {
+			http.Error(w, fmt.Sprintf("A checkout for recipe %s is already in progress", recipeID), http.StatusConflict)
+			return
+		}
+	}
+
+	risk, ok := checkPaymentRisk(w, r, client, cfg, userID, "checkout", total, currency)
+	if !ok {
+		return
+	}
+
+	orderID := uuid.New().String()
+	txRef := uuid.New().String()
+	expiresAt := time.Now().Add(pendingPurchaseTTL).UTC().Format(time.RFC3339)
+
+	order := map[string]interface{}{
+		"id":         orderID,
+		"user_id":    userID,
+		"tx_ref":     txRef,
+		"amount":     total,
+		"currency":   currency,
+		"status":     "pending",
+		"expires_at": expiresAt,
+	}
+	if idempotencyKey != "" {
+		order["idempotency_key"] = idempotencyKey
+	}
+
+	purchaseObjects := make([]map[string]interface{}, 0, len(purchases))
+	for i, purchase := range purchases {
+		object := map[string]interface{}{
+			"id":              uuid.New().String(),
+			"user_id":         userID,
+			"recipe_id":       purchase.recipeID,
+			"chapa_tx_id":     txRef,
+			"amount":          purchase.amount,
+			"original_amount": converted[purchase.recipeID].Amount,
+			"discount_amount": roundMoney(converted[purchase.recipeID].Amount - purchase.amount),
+			"currency":        currency,
+			"status":          "pending",
+			"expires_at":      expiresAt,
+			"author_id":       purchase.authorID,
+			"platform_fee":    fees[i],
+			"order_id":        orderID,
+			"created_at":      "now()",
+		}
+		for column, value := range purchase.exchange.lockFields() {
+			object[column] = value
+		}
+		for column, value := range splitFields(split) {
+			object[column] = value
+		}
+		for column, value := range risk.lockFields() {
+			object[column] = value
+		}
+		if purchase.bundleID != "" {
+			object["bundle_id"] = purchase.bundleID
+		}
+		if subaccountID != "" {
+			object["subaccount_id"] = subaccountID
+		}
+		purchaseObjects = append(purchaseObjects, object)
+	}
+
+	// Hasura runs both inserts in one transaction.
+	query = `
+		mutation CreateOrder($order: Orders_insert_input!, $purchases: [Purchases_insert_input!]!) {
+			insert_Orders_one(object: $order) {
+				id
+			}
+			insert_Purchases(objects: $purchases) {
+				affected_rows
+			}
+		}
+	`
+	var created struct {
+		InsertOrdersOne struct {
+			ID string `json:"id"`
+		} `json:"insert_Orders_one"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"order": order, "purchases": purchaseObjects}, &created); err != nil {
+		if hasura.IsUniqueViolation(err) {
+			if idempotencyKey != "" {
+				if existing, err := getOrderByIdempotencyKey(r.Context(), client, userID, idempotencyKey); err == nil && existing != nil {
+					writeExistingOrder(w, existing)
+					return
+				}
+			}
+			http.Error(w, "A checkout for one of these recipes is already in progress", http.StatusConflict)
+			return
+		}
+		log.Printf("Error creating order: %v", err)
+		http.Error(w, "Error creating order", http.StatusInternalServerError)
+		return
+	}
+
+	checkout, err := paymentProvider.Initiate(r.Context(), payments.InitiateRequest{
+		TxRef:       txRef,
+		Amount:      total,
+		Currency:    currency,
+		Title:       "Recipe Purchase",
+		Description: fmt.Sprintf("Payment for %d recipes", len(purchases)),
+		CallbackURL: cfg.ChapaCallbackURL,
+		ReturnURL:   cfg.ChapaReturnURL,
+
+		SubaccountID: subaccountID,
+		Split:        split,
+	})
+	if err != nil {
+		if err := setOrderFields(r.Context(), client, txRef, map[string]interface{}{"status": "failed"}); err != nil {
+			log.Printf("Error marking order %s as failed: %v", orderID, err)
+		}
+		writeProviderError(w, err)
+		return
+	}
+
+	if err := setOrderFields(r.Context(), client, txRef, map[string]interface{}{"checkout_url": checkout.CheckoutURL}); err != nil {
+		log.Printf("Error storing checkout URL: %v", err)
+		http.Error(w, "Error updating order", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Payment initiated", map[string]interface{}{
+		"orderId":      orderID,
+		"checkout_url": checkout.CheckoutURL,
+		"tx_ref":       txRef,
+		"items":        lines,
+		"total":        total,
+		"currency":     currency,
+	}))
+}
+
+// setOrderFields updates an order and every purchase it covers.
+func setOrderFields(ctx context.Context, client *hasura.Client, txRef string, fields map[string]interface{}) error {
+	query := `
+		mutation UpdateOrder($tx_ref: String!, $order: Orders_set_input!, $purchase: Purchases_set_input!) {
+			update_Orders(where: {tx_ref: {_eq: $tx_ref}}, _set: $order) {
+				affected_rows
+			}
+			update_Purchases(where: {chapa_tx_id: {_eq: $tx_ref}}, _set: $purchase) {
+				affected_rows
+			}
+		}
+	`
+
+	var response struct {
+		UpdateOrders struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_Orders"`
+	}
+	return client.Execute(ctx, query, map[string]interface{}{"tx_ref": txRef, "order": fields, "purchase": fields}, &response)
+}
+
+func writeExistingOrder(w http.ResponseWriter, order *orderRecord) {
+	if order.Status == "review" {
+		http.Error(w, "This payment is being reviewed", http.StatusConflict)
+		return
+	}
+	if order.CheckoutURL == nil || *order.CheckoutURL == "" {
+		http.Error(w, "Payment initiation already in progress, retry shortly", http.StatusConflict)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Payment already initiated", map[string]interface{}{
+		"orderId":      order.ID,
+		"checkout_url": *order.CheckoutURL,
+		"tx_ref":       order.TxRef,
+		"total":        order.Amount,
+		"currency":     order.Currency,
+	}))
+}
@@ -0,0 +1,148 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		name    string
+		total   float64
+		weights []float64
+		want    []float64
+	}{
+		{"single part", 7.5, []float64{5}, []float64{7.5}},
+		{"even", 10, []float64{1, 1}, []float64{5, 5}},
+		{"proportional", 100, []float64{30, 70}, []float64{30, 70}},
+		{"discounted", 90, []float64{50, 50, 50}, []float64{30, 30, 30}},
+		{"remainder to the last part", 10, []float64{1, 1, 1}, []float64{3.33, 3.33, 3.34}},
+		{"rounded to cents", 9.99, []float64{1, 2}, []float64{3.33, 6.66}},
+		{"half cents round up", 0.05, []float64{1, 1}, []float64{0.03, 0.02}},
+		{"zero weights", 10, []float64{0, 0}, []float64{0, 10}},
+		{"no parts", 10, nil, []float64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := allocate(tt.total, tt.weights)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("allocate(%v, %v) = %v, want %v", tt.total, tt.weights, got, tt.want)
+			}
+			var sum float64
+			for _, part := range got {
+				sum += part
+			}
+			if len(got) > 0 && roundMoney(sum) != tt.total {
+				t.Errorf("parts add up to %v, want %v", sum, tt.total)
+			}
+		})
+	}
+}
+
+func TestGetOrderByIdempotencyKey(t *testing.T) {
+	later := time.Now().Add(time.Hour)
+	earlier := time.Now().Add(-time.Hour)
+	type orderRow struct {
+		id        string
+		status    string
+		expiresAt time.Time
+	}
+	tests := []struct {
+		name    string
+		orders  []*orderRow
+		want    string
+		expired []string
+	}{
+		{"unused key", nil, "", nil},
+		{"live order", []*orderRow{{"o1", "pending", later}}, "o1", nil},
+		{"completed order", []*orderRow{{"o1", "completed", earlier}}, "o1", nil},
+		{"order under review", []*orderRow{{"o1", "review", earlier}}, "o1", nil},
+		{"failed order", []*orderRow{{"o1", "failed", later}}, "", nil},
+		{"expired order", []*orderRow{{"o1", "expired", earlier}}, "", nil},
+		{"checkout past its expiry", []*orderRow{{"o1", "pending", earlier}}, "", []string{"tx-o1"}},
+		{"retry after failure", []*orderRow{
+			{"o1", "failed", later},
+			{"o2", "pending", earlier},
+			{"o3", "pending", later},
+		}, "o3", []string{"tx-o2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeHasura(t, func(call graphqlCall) interface{} {
+				switch call.Operation {
+				case "ExpirePendingOrders":
+					now, _ := time.Parse(time.RFC3339, call.Variables["now"].(string))
+					var returning []interface{}
+					for _, order := range tt.orders {
+						if order.status == "pending" && !order.expiresAt.After(now) {
+							order.status = "expired"
+							returning = append(returning, map[string]interface{}{"tx_ref": "tx-" + order.id})
+						}
+					}
+					return map[string]interface{}{"update_Orders": map[string]interface{}{"returning": returning}}
+				case "OrderByIdempotencyKey":
+					for _, order := range tt.orders {
+						for _, status := range call.Variables["statuses"].([]interface{}) {
+							if order.status == status {
+								return map[string]interface{}{"Orders": []interface{}{
+									map[string]interface{}{"id": order.id, "status": order.status},
+								}}
+							}
+						}
+					}
+					return map[string]interface{}{"Orders": []interface{}{}}
+				}
+				return nil
+			})
+			order, err := getOrderByIdempotencyKey(t.Context(), client, "u1", "key-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if order != nil {
+				got = order.ID
+			}
+			if got != tt.want {
+				t.Errorf("order = %q, want %q", got, tt.want)
+			}
+
+			// The purchases of an expired order expire with it.
+			var expired []string
+			if call := fake.call("ExpirePendingPurchases"); call != nil {
+				where := call.Variables["where"].(map[string]interface{})
+				for _, txRef := range where["chapa_tx_id"].(map[string]interface{})["_in"].([]interface{}) {
+					expired = append(expired, txRef.(string))
+				}
+			}
+			if !reflect.DeepEqual(expired, tt.expired) {
+				t.Errorf("expired purchases of %v, want %v", expired, tt.expired)
+			}
+		})
+	}
+}
+
+func TestWriteExistingOrder(t *testing.T) {
+	url := "https://checkout.example.com/pay/1"
+	tests := []struct {
+		name   string
+		order  orderRecord
+		status int
+	}{
+		{"checkout ready", orderRecord{Status: "pending", CheckoutURL: &url}, http.StatusOK},
+		{"completed", orderRecord{Status: "completed", CheckoutURL: &url}, http.StatusOK},
+		{"under review", orderRecord{Status: "review", CheckoutURL: &url}, http.StatusConflict},
+		{"initiation in flight", orderRecord{Status: "pending"}, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeExistingOrder(w, &tt.order)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,782 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/config"
+	"backend/hasura"
+	"backend/middleware"
+)
+
+const (
+	discountPercentage = "percentage"
+	discountFixed      = "fixed"
+)
+
+// couponError is a coupon that cannot be applied to the purchase at hand.
+// Its message is safe to show to the buyer.
+type couponError struct {
+	message string
+}
+
+func (e *couponError) Error() string {
+	return e.message
+}
+
+type CreateCouponRequest struct {
+	Code           string  `json:"code"`
+	DiscountType   string  `json:"discountType"`
+	DiscountValue  float64 `json:"discountValue"`
+	Currency       string  `json:"currency"`
+	RecipeID       string  `json:"recipeId"`
+	StartsAt       string  `json:"startsAt"`
+	EndsAt         string  `json:"endsAt"`
+	MaxRedemptions *int    `json:"maxRedemptions"`
+	PerUserLimit   *int    `json:"perUserLimit"`
+}
+
+type CouponRequest struct {
+	CouponID string `json:"couponId"`
+}
+
+type QuoteRequest struct {
+	RecipeID   string  `json:"recipeId"`
+	Amount     float64 `json:"amount"`
+	Currency   string  `json:"currency"`
+	CouponCode string  `json:"couponCode"`
+}
+
+type couponRecord struct {
+	ID              string  `json:"id"`
+	Code            string  `json:"code"`
+	AuthorID        *string `json:"author_id"`
+	RecipeID        *string `json:"recipe_id"`
+	DiscountType    string  `json:"discount_type"`
+	DiscountValue   float64 `json:"discount_value"`
+	Currency        *string `json:"currency"`
+	StartsAt        string  `json:"starts_at"`
+	EndsAt          *string `json:"ends_at"`
+	MaxRedemptions  *int    `json:"max_redemptions"`
+	PerUserLimit    *int    `json:"per_user_limit"`
+	RedemptionCount int     `json:"redemption_count"`
+	Active          bool    `json:"active"`
+}
+
+const couponFields = `
+	id
+	code
+	author_id
+	recipe_id
+	discount_type
+	discount_value
+	currency
+	starts_at
+	ends_at
+	max_redemptions
+	per_user_limit
+	redemption_count
+	active
+`
+
+// priceQuote is the price a buyer pays for a recipe after any coupon.
+type priceQuote struct {
+	OriginalAmount float64 `json:"originalAmount"`
+	DiscountAmount float64 `json:"discountAmount"`
+	FinalAmount    float64 `json:"finalAmount"`
+	Currency       string  `json:"currency"`
+	CouponCode     string  `json:"couponCode,omitempty"`
+
+	coupon *couponRecord
+}
+
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func getCouponByCode(ctx context.Context, client *hasura.Client, code string) (*couponRecord, error) {
+	query := `
+		query CouponByCode($code: String!) {
+			Coupons(where: {code: {_eq: $code}}, limit: 1) {` + couponFields + `}
+		}
+	`
+
+	var response struct {
+		Coupons []couponRecord `json:"Coupons"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"code": code}, &response); err != nil {
+		return nil, err
+	}
+	if len(response.Coupons) == 0 {
+		return nil, nil
+	}
+	return &response.Coupons[0], nil
+}
+
+func getCouponByID(ctx context.Context, client *hasura.Client, couponID string) (*couponRecord, error) {
+	query := `
+		query Coupon($id: uuid!) {
+			Coupons_by_pk(id: $id) {` + couponFields + `}
+		}
+	`
+
+	var response struct {
+		Coupon *couponRecord `json:"Coupons_by_pk"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"id": couponID}, &response); err != nil {
+		return nil, err
+	}
+	return response.Coupon, nil
+}
+
+// quotePrice works out what a user pays for a recipe, applying couponCode if
+// given. Coupons that do not apply are reported as a couponError.
+func quotePrice(ctx context.Context, client *hasura.Client, userID, recipeID, authorID string, amount float64, currency, couponCode string) (*priceQuote, error) {
+	quote := &priceQuote{
+		OriginalAmount: roundMoney(amount),
+		FinalAmount:    roundMoney(amount),
+		Currency:       currency,
+	}
+
+	code := normalizeCouponCode(couponCode)
+	if code == "" {
+		return quote, nil
+	}
+
+	coupon, err := getCouponByCode(ctx, client, code)
+	if err != nil {
+		return nil, err
+	}
+	if coupon == nil || !coupon.Active {
+		return nil, &couponError{"coupon code is not valid"}
+	}
+
+	now := time.Now()
+	if startsAt, ok := parseTimestamp(&coupon.StartsAt); ok && now.Before(startsAt) {
+		return nil, &couponError{"coupon is not active yet"}
+	}
+	if endsAt, ok := parseTimestamp(coupon.EndsAt); ok && !now.Before(endsAt) {
+		return nil, &couponError{"coupon has expired"}
+	}
+	if coupon.RecipeID != nil && *coupon.RecipeID != recipeID {
+		return nil, &couponError{"coupon does not apply to this recipe"}
+	}
+	if coupon.RecipeID == nil && coupon.AuthorID != nil && *coupon.AuthorID != authorID {
+		return nil, &couponError{"coupon does not apply to this recipe"}
+	}
+	if coupon.MaxRedemptions != nil && coupon.RedemptionCount >= *coupon.MaxRedemptions {
+		return nil, &couponError{"coupon has been fully redeemed"}
+	}
+
+	if coupon.PerUserLimit != nil {
+		query := `
+			query UserRedemptions($coupon_id: uuid!, $user_id: uuid!) {
+				CouponRedemptions_aggregate(where: {coupon_id: {_eq: $coupon_id}, user_id: {_eq: $user_id}, status: {_in: ["reserved", "completed"]}}) {
+					aggregate {
+						count
+					}
+				}
+			}
+		`
+		var response struct {
+			CouponRedemptionsAggregate struct {
+				Aggregate struct {
+					Count int `json:"count"`
+				} `json:"aggregate"`
+			} `json:"CouponRedemptions_aggregate"`
+		}
+		if err := client.Execute(ctx, query, map[string]interface{}{"coupon_id": coupon.ID, "user_id": userID}, &response); err != nil {
+			return nil, err
+		}
+		if response.CouponRedemptionsAggregate.Aggregate.Count >= *coupon.PerUserLimit {
+			return nil, &couponError{"you have already used this coupon"}
+		}
+	}
+
+	discount, final, err := applyDiscount(coupon, quote.OriginalAmount, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	quote.DiscountAmount = discount
+	quote.FinalAmount = final
+	quote.CouponCode = coupon.Code
+	quote.coupon = coupon
+	return quote, nil
+}
+
+// applyDiscount works out the discount coupon gives on amount and what is
+// left to pay, both in cents. A discount that would leave less than the
+// provider's minimum charge is reduced to that minimum; only a full discount
+// makes the purchase free.
+func applyDiscount(coupon *couponRecord, amount float64, currency string) (discount, final float64, err error) {
+	switch coupon.DiscountType {
+	case discountPercentage:
+		discount = amount * coupon.DiscountValue / 100
+	case discountFixed:
+		if coupon.Currency == nil || *coupon.Currency != currency {
+			return 0, 0, &couponError{fmt.Sprintf("coupon cannot be used for payments in %s", currency)}
+		}
+		discount = coupon.DiscountValue
+	default:
+		return 0, 0, &couponError{"coupon code is not valid"}
+	}
+	discount = roundMoney(discount)
+	if discount > amount {
+		discount = amount
+	}
+
+	final = roundMoney(amount - discount)
+	if minimum := minimumAmount(currency); final > 0 && final < minimum {
+		final = minimum
+		discount = roundMoney(amount - final)
+	}
+	return discount, final, nil
+}
+
+// reserveCouponRedemption counts a use of the quoted coupon against the
+// purchase. The user's and the coupon's redemption counters are each
+// incremented with a guard on their limit in the same statement, so
+// concurrent checkouts cannot overshoot either.
+func reserveCouponRedemption(ctx context.Context, client *hasura.Client, quote *priceQuote, userID, purchaseID string) error {
+	coupon := quote.coupon
+
+	counted, err := incrementUserCouponCount(ctx, client, coupon, userID)
+	if err != nil {
+		return err
+	}
+	if !counted {
+		return &couponError{"you have already used this coupon"}
+	}
+	counted, err = incrementCouponCount(ctx, client, coupon)
+	if err != nil || !counted {
+		decrementUserCouponCount(ctx, client, coupon.ID, userID)
+		if err != nil {
+			return err
+		}
+		return &couponError{"coupon has been fully redeemed"}
+	}
+
+	redemption := map[string]interface{}{
+		"coupon_id":       coupon.ID,
+		"user_id":         userID,
+		"purchase_id":     purchaseID,
+		"discount_amount": quote.DiscountAmount,
+		"status":          "reserved",
+	}
+
+	query := `
+		mutation RecordRedemption($object: CouponRedemptions_insert_input!) {
+			insert_CouponRedemptions_one(object: $object) {
+				id
+			}
+		}
+	`
+	var inserted struct {
+		InsertCouponRedemptionsOne struct {
+			ID string `json:"id"`
+		} `json:"insert_CouponRedemptions_one"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"object": redemption}, &inserted); err != nil {
+		decrementCouponCounts(ctx, client, coupon.ID, userID)
+		return err
+	}
+	return nil
+}
+
+// incrementCouponCount counts one more use of coupon, unless that would
+// exceed its max_redemptions. It reports whether the use was counted.
+func incrementCouponCount(ctx context.Context, client *hasura.Client, coupon *couponRecord) (bool, error) {
+	where := map[string]interface{}{
+		"id":     map[string]interface{}{"_eq": coupon.ID},
+		"active": map[string]interface{}{"_eq": true},
+	}
+	if coupon.MaxRedemptions != nil {
+		where["redemption_count"] = map[string]interface{}{"_lt": *coupon.MaxRedemptions}
+	}
+
+	query := `
+		mutation ReserveCoupon($where: Coupons_bool_exp!) {
+			update_Coupons(where: $where, _inc: {redemption_count: 1}) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		UpdateCoupons struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_Coupons"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"where": where}, &response); err != nil {
+		return false, err
+	}
+	return response.UpdateCoupons.AffectedRows > 0, nil
+}
+
+// incrementUserCouponCount counts one more use of coupon by userID in their
+// CouponUserRedemptions row, unless that would exceed its per_user_limit.
+// It reports whether the use was counted.
+func incrementUserCouponCount(ctx context.Context, client *hasura.Client, coupon *couponRecord, userID string) (bool, error) {
+	where := map[string]interface{}{
+		"coupon_id": map[string]interface{}{"_eq": coupon.ID},
+		"user_id":   map[string]interface{}{"_eq": userID},
+	}
+	if coupon.PerUserLimit != nil {
+		where["redemption_count"] = map[string]interface{}{"_lt": *coupon.PerUserLimit}
+	}
+
+	query := `
+		mutation ReserveUserCoupon($coupon_id: uuid!, $user_id: uuid!, $where: CouponUserRedemptions_bool_exp!) {
+			insert_CouponUserRedemptions_one(
+				object: {coupon_id: $coupon_id, user_id: $user_id},
+				on_conflict: {constraint: CouponUserRedemptions_pkey, update_columns: []}
+			) {
+				coupon_id
+			}
+			update_CouponUserRedemptions(where: $where, _inc: {redemption_count: 1}) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		UpdateCouponUserRedemptions struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_CouponUserRedemptions"`
+	}
+	variables := map[string]interface{}{"coupon_id": coupon.ID, "user_id": userID, "where": where}
+	if err := client.Execute(ctx, query, variables, &response); err != nil {
+		return false, err
+	}
+	return response.UpdateCouponUserRedemptions.AffectedRows > 0, nil
+}
+
+// decrementCouponCounts gives back a use of a coupon counted for userID.
+func decrementCouponCounts(ctx context.Context, client *hasura.Client, couponID, userID string) {
+	query := `
+		mutation ReleaseCoupon($id: uuid!, $user_id: uuid!) {
+			update_Coupons(where: {id: {_eq: $id}, redemption_count: {_gt: 0}}, _inc: {redemption_count: -1}) {
+				affected_rows
+			}
+			update_CouponUserRedemptions(
+				where: {coupon_id: {_eq: $id}, user_id: {_eq: $user_id}, redemption_count: {_gt: 0}},
+				_inc: {redemption_count: -1}
+			) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		UpdateCoupons struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_Coupons"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"id": couponID, "user_id": userID}, &response); err != nil {
+		log.Printf("Error releasing redemption of coupon %s: %v", couponID, err)
+	}
+}
+
+// decrementUserCouponCount gives back a use of a coupon counted for userID
+// alone.
+func decrementUserCouponCount(ctx context.Context, client *hasura.Client, couponID, userID string) {
+	query := `
+		mutation ReleaseUserCoupon($id: uuid!, $user_id: uuid!) {
+			update_CouponUserRedemptions(
+				where: {coupon_id: {_eq: $id}, user_id: {_eq: $user_id}, redemption_count: {_gt: 0}},
+				_inc: {redemption_count: -1}
+			) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		UpdateCouponUserRedemptions struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_CouponUserRedemptions"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"id": couponID, "user_id": userID}, &response); err != nil {
+		log.Printf("Error releasing redemption of coupon %s by user %s: %v", couponID, userID, err)
+	}
+}
+
+// couponRedemptionOwner is the coupon and user a redemption was counted for.
+type couponRedemptionOwner struct {
+	CouponID string `json:"coupon_id"`
+	UserID   string `json:"user_id"`
+}
+
+// releaseCouponRedemptions gives back the coupon uses reserved by purchases
+// that failed or expired.
+func releaseCouponRedemptions(ctx context.Context, client *hasura.Client, purchaseIDs []string) {
+	if len(purchaseIDs) == 0 {
+		return
+	}
+
+	query := `
+		mutation ReleaseRedemptions($purchase_ids: [uuid!]!) {
+			update_CouponRedemptions(where: {purchase_id: {_in: $purchase_ids}, status: {_eq: "reserved"}}, _set: {status: "released"}) {
+				returning {
+					coupon_id
+					user_id
+				}
+			}
+		}
+	`
+	var response struct {
+		UpdateCouponRedemptions struct {
+			Returning []couponRedemptionOwner `json:"returning"`
+		} `json:"update_CouponRedemptions"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"purchase_ids": purchaseIDs}, &response); err != nil {
+		log.Printf("Error releasing coupon redemptions: %v", err)
+		return
+	}
+	for _, released := range response.UpdateCouponRedemptions.Returning {
+		decrementCouponCounts(ctx, client, released.CouponID, released.UserID)
+	}
+}
+
+// reclaimCouponRedemptions counts again the coupon uses of purchases that a
+// late payment completed after their checkout expired and released them. The
+// discount has been paid for, so the redemption completes and counts against
+// the user's limit either way; if the coupon has since been used up or
+// withdrawn, that is logged for follow-up.
+func reclaimCouponRedemptions(ctx context.Context, client *hasura.Client, purchaseIDs []string) {
+	if len(purchaseIDs) == 0 {
+		return
+	}
+
+	query := `
+		mutation ReclaimRedemptions($purchase_ids: [uuid!]!) {
+			update_CouponRedemptions(where: {purchase_id: {_in: $purchase_ids}, status: {_eq: "released"}}, _set: {status: "completed"}) {
+				returning {
+					purchase_id
+					coupon_id
+					user_id
+				}
+			}
+		}
+	`
+	var response struct {
+		UpdateCouponRedemptions struct {
+			Returning []struct {
+				PurchaseID string `json:"purchase_id"`
+				couponRedemptionOwner
+			} `json:"returning"`
+		} `json:"update_CouponRedemptions"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"purchase_ids": purchaseIDs}, &response); err != nil {
+		log.Printf("Error reclaiming coupon redemptions: %v", err)
+		return
+	}
+	for _, reclaimed := range response.UpdateCouponRedemptions.Returning {
+		coupon, err := getCouponByID(ctx, client, reclaimed.CouponID)
+		if err != nil || coupon == nil {
+			log.Printf("Error loading coupon %s to reclaim its redemption: %v", reclaimed.CouponID, err)
+			continue
+		}
+		unlimited := *coupon
+		unlimited.PerUserLimit = nil
+		if _, err := incrementUserCouponCount(ctx, client, &unlimited, reclaimed.UserID); err != nil {
+			log.Printf("Error counting reclaimed redemption of coupon %s: %v", coupon.Code, err)
+		}
+		if counted, err := incrementCouponCount(ctx, client, coupon); err != nil || !counted {
+			log.Printf("Late payment of purchase %s could not be counted against coupon %s: %v", reclaimed.PurchaseID, coupon.Code, err)
+		}
+	}
+}
+
+// completeCouponRedemption makes the coupon use of a paid purchase final.
+func completeCouponRedemption(ctx context.Context, client *hasura.Client, purchaseID string) {
+	query := `
+		mutation CompleteRedemption($purchase_id: uuid!) {
+			update_CouponRedemptions(where: {purchase_id: {_eq: $purchase_id}, status: {_eq: "reserved"}}, _set: {status: "completed"}) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		UpdateCouponRedemptions struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_CouponRedemptions"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"purchase_id": purchaseID}, &response); err != nil {
+		log.Printf("Error completing coupon redemption for purchase %s: %v", purchaseID, err)
+	}
+}
+
+// PaymentQuoteHandler shows the original and discounted price of a recipe
+// before the buyer commits to paying.
+func PaymentQuoteHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req QuoteRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validatePaymentRequest(PaymentRequest{RecipeID: req.RecipeID, Amount: req.Amount, Currency: req.Currency}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	currency := strings.ToUpper(req.Currency)
+	pricing, err := priceRecipe(r.Context(), client, cfg, req.RecipeID, currency)
+	if err != nil {
+		writePricingError(w, err)
+		return
+	}
+	if pricing == nil {
+		http.Error(w, "Recipe not found", http.StatusNotFound)
+		return
+	}
+
+	quote, err := quotePrice(r.Context(), client, userID, req.RecipeID, pricing.recipe.UserID, pricing.Amount, currency, req.CouponCode)
+	if err != nil {
+		writeQuoteError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Price calculated", quote))
+}
+
+// writeQuoteError reports a failed price calculation, passing coupon
+// problems through to the buyer.
+func writeQuoteError(w http.ResponseWriter, err error) {
+	var cErr *couponError
+	if errors.As(err, &cErr) {
+		http.Error(w, cErr.message, http.StatusBadRequest)
+		return
+	}
+	log.Printf("Error calculating price: %v", err)
+	http.Error(w, "Error calculating price", http.StatusInternalServerError)
+}
+
+// CreateCouponHandler lets authors create coupons for their own recipes and
+// admins create coupons for any recipe or the whole site.
+func CreateCouponHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req CreateCouponRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	code := normalizeCouponCode(req.Code)
+	if len(code) < 3 || len(code) > 32 || strings.ContainsAny(code, " \t") {
+		http.Error(w, "code must be 3-32 characters without spaces", http.StatusBadRequest)
+		return
+	}
+
+	object := map[string]interface{}{
+		"code":           code,
+		"created_by":     userID,
+		"discount_type":  req.DiscountType,
+		"discount_value": req.DiscountValue,
+	}
+
+	switch req.DiscountType {
+	case discountPercentage:
+		if req.DiscountValue <= 0 || req.DiscountValue > 100 {
+			http.Error(w, "percentage discount must be between 0 and 100", http.StatusBadRequest)
+			return
+		}
+	case discountFixed:
+		currency := strings.ToUpper(req.Currency)
+		if !supportedCurrencies[currency] {
+			http.Error(w, "fixed discounts need a supported currency", http.StatusBadRequest)
+			return
+		}
+		if req.DiscountValue <= 0 {
+			http.Error(w, "discount value must be greater than 0", http.StatusBadRequest)
+			return
+		}
+		object["currency"] = currency
+	default:
+		http.Error(w, "discount type must be percentage or fixed", http.StatusBadRequest)
+		return
+	}
+
+	if req.StartsAt != "" {
+		if _, err := time.Parse(time.RFC3339, req.StartsAt); err != nil {
+			http.Error(w, "startsAt must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		object["starts_at"] = req.StartsAt
+	}
+	if req.EndsAt != "" {
+		endsAt, err := time.Parse(time.RFC3339, req.EndsAt)
+		if err != nil {
+			http.Error(w, "endsAt must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		if startsAt, err := time.Parse(time.RFC3339, req.StartsAt); err == nil && !endsAt.After(startsAt) {
+			http.Error(w, "endsAt must be after startsAt", http.StatusBadRequest)
+			return
+		}
+		object["ends_at"] = req.EndsAt
+	}
+	if req.MaxRedemptions != nil {
+		if *req.MaxRedemptions <= 0 {
+			http.Error(w, "maxRedemptions must be positive", http.StatusBadRequest)
+			return
+		}
+		object["max_redemptions"] = *req.MaxRedemptions
+	}
+	if req.PerUserLimit != nil {
+		if *req.PerUserLimit <= 0 {
+			http.Error(w, "perUserLimit must be positive", http.StatusBadRequest)
+			return
+		}
+		object["per_user_limit"] = *req.PerUserLimit
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	if req.RecipeID != "" {
+		authorID, err := getRecipeAuthorID(r.Context(), client, req.RecipeID)
+		if err != nil {
+			log.Printf("Error loading recipe author: %v", err)
+			http.Error(w, "Error loading recipe", http.StatusInternalServerError)
+			return
+		}
+		if authorID == "" {
+			http.Error(w, "Recipe not found", http.StatusNotFound)
+			return
+		}
+		if authorID != userID && role != middleware.RoleAdmin {
+			http.Error(w, "You can only create coupons for your own recipes", http.StatusForbidden)
+			return
+		}
+		object["recipe_id"] = req.RecipeID
+		object["author_id"] = authorID
+	} else if role != middleware.RoleAdmin {
+		// An author's coupon without a recipe covers all of their recipes.
+		object["author_id"] = userID
+	}
+
+	query := `
+		mutation CreateCoupon($object: Coupons_insert_input!) {
+			insert_Coupons_one(object: $object) {` + couponFields + `}
+		}
+	`
+	var response struct {
+		Coupon couponRecord `json:"insert_Coupons_one"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"object": object}, &response); err != nil {
+		if hasura.IsUniqueViolation(err) {
+			http.Error(w, "A coupon with this code already exists", http.StatusConflict)
+			return
+		}
+		log.Printf("Error creating coupon: %v", err)
+		http.Error(w, "Error creating coupon", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r.Context(), client, userID, "coupon.created", "Coupons", response.Coupon.ID, map[string]interface{}{
+		"code": code,
+	})
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Coupon created", response.Coupon))
+}
+
+// ListCouponsHandler returns the coupons the caller created; admins see all.
+func ListCouponsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	where := map[string]interface{}{}
+	if role != middleware.RoleAdmin {
+		where["created_by"] = map[string]interface{}{"_eq": userID}
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	query := `
+		query ListCoupons($where: Coupons_bool_exp!) {
+			Coupons(where: $where, order_by: {created_at: desc}) {` + couponFields + `}
+		}
+	`
+	var response struct {
+		Coupons []couponRecord `json:"Coupons"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"where": where}, &response); err != nil {
+		log.Printf("Error listing coupons: %v", err)
+		http.Error(w, "Error listing coupons", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Coupons retrieved", response.Coupons))
+}
+
+// DeactivateCouponHandler stops a coupon from being redeemed. Purchases
+// already reserved with it keep their discount.
+func DeactivateCouponHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req CouponRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	where := map[string]interface{}{"id": map[string]interface{}{"_eq": req.CouponID}}
+	if role != middleware.RoleAdmin {
+		where["created_by"] = map[string]interface{}{"_eq": userID}
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	query := `
+		mutation DeactivateCoupon($where: Coupons_bool_exp!) {
+			update_Coupons(where: $where, _set: {active: false}) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		UpdateCoupons struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_Coupons"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"where": where}, &response); err != nil {
+		log.Printf("Error deactivating coupon: %v", err)
+		http.Error(w, "Error deactivating coupon", http.StatusInternalServerError)
+		return
+	}
+	if response.UpdateCoupons.AffectedRows == 0 {
+		http.Error(w, "Coupon not found", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(r.Context(), client, userID, "coupon.deactivated", "Coupons", req.CouponID, nil)
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Coupon deactivated", nil))
+}
@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestApplyDiscount(t *testing.T) {
+	etb, usd := "ETB", "USD"
+	tests := []struct {
+		name     string
+		coupon   couponRecord
+		amount   float64
+		currency string
+		discount float64
+		final    float64
+		err      string
+	}{
+		{"percentage", couponRecord{DiscountType: discountPercentage, DiscountValue: 25}, 200, "ETB", 50, 150, ""},
+		{"percentage rounds to cents", couponRecord{DiscountType: discountPercentage, DiscountValue: 15}, 9.99, "USD", 1.5, 8.49, ""},
+		{"percentage rounds down", couponRecord{DiscountType: discountPercentage, DiscountValue: 10}, 10.04, "USD", 1, 9.04, ""},
+		{"full percentage is free", couponRecord{DiscountType: discountPercentage, DiscountValue: 100}, 80, "ETB", 80, 0, ""},
+		{"fixed", couponRecord{DiscountType: discountFixed, DiscountValue: 30, Currency: &etb}, 200, "ETB", 30, 170, ""},
+		{"fixed above price is free", couponRecord{DiscountType: discountFixed, DiscountValue: 300, Currency: &etb}, 200, "ETB", 200, 0, ""},
+		{"kept above the minimum charge", couponRecord{DiscountType: discountFixed, DiscountValue: 17, Currency: &etb}, 20, "ETB", 15, 5, ""},
+		{"kept above the USD minimum", couponRecord{DiscountType: discountPercentage, DiscountValue: 60}, 1, "USD", 0.5, 0.5, ""},
+		{"currency without a minimum", couponRecord{DiscountType: discountPercentage, DiscountValue: 99}, 1, "GBP", 0.99, 0.01, ""},
+		{"fixed in another currency", couponRecord{DiscountType: discountFixed, DiscountValue: 5, Currency: &usd}, 200, "ETB", 0, 0, "coupon cannot be used for payments in ETB"},
+		{"fixed without a currency", couponRecord{DiscountType: discountFixed, DiscountValue: 5}, 200, "ETB", 0, 0, "coupon cannot be used for payments in ETB"},
+		{"unknown type", couponRecord{DiscountType: "bogo", DiscountValue: 5}, 200, "ETB", 0, 0, "coupon code is not valid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			discount, final, err := applyDiscount(&tt.coupon, tt.amount, tt.currency)
+			if tt.err != "" {
+				var cErr *couponError
+				if !errors.As(err, &cErr) || cErr.message != tt.err {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if discount != tt.discount || final != tt.final {
+				t.Errorf("applyDiscount() = %v, %v; want %v, %v", discount, final, tt.discount, tt.final)
+			}
+		})
+	}
+}
+
+// fakeCouponCounts keeps the redemption counters of one coupon the way the
+// guarded increments in Hasura would.
+type fakeCouponCounts struct {
+	mu      sync.Mutex
+	total   int
+	perUser map[string]int
+}
+
+func (c *fakeCouponCounts) answer(call graphqlCall) interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	under := func(where map[string]interface{}, count int) bool {
+		guard, ok := where["redemption_count"].(map[string]interface{})
+		if !ok {
+			return true
+		}
+		if limit, ok := guard["_lt"].(float64); ok {
+			return count < int(limit)
+		}
+		return count > 0
+	}
+	switch call.Operation {
+	case "ReserveUserCoupon":
+		user := call.Variables["user_id"].(string)
+		affected := 0
+		if under(call.Variables["where"].(map[string]interface{}), c.perUser[user]) {
+			c.perUser[user]++
+			affected = 1
+		}
+		return map[string]interface{}{"update_CouponUserRedemptions": map[string]interface{}{"affected_rows": affected}}
+	case "ReserveCoupon":
+		affected := 0
+		if under(call.Variables["where"].(map[string]interface{}), c.total) {
+			c.total++
+			affected = 1
+		}
+		return map[string]interface{}{"update_Coupons": map[string]interface{}{"affected_rows": affected}}
+	case "ReleaseCoupon":
+		if c.total > 0 {
+			c.total--
+		}
+		fallthrough
+	case "ReleaseUserCoupon":
+		if user := call.Variables["user_id"].(string); c.perUser[user] > 0 {
+			c.perUser[user]--
+		}
+	}
+	return nil
+}
+
+func TestReserveCouponRedemption(t *testing.T) {
+	one, two := 1, 2
+	tests := []struct {
+		name      string
+		coupon    couponRecord
+		users     []string
+		succeeded int
+		total     int
+	}{
+		{"unlimited", couponRecord{ID: "c1"}, []string{"u1", "u1", "u2"}, 3, 3},
+		{"once per user", couponRecord{ID: "c1", PerUserLimit: &one}, []string{"u1", "u1", "u1", "u2"}, 2, 2},
+		{"fully redeemed", couponRecord{ID: "c1", MaxRedemptions: &two}, []string{"u1", "u2", "u3"}, 2, 2},
+		{"both limits", couponRecord{ID: "c1", MaxRedemptions: &two, PerUserLimit: &one}, []string{"u1", "u1", "u2", "u3"}, 2, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counts := &fakeCouponCounts{perUser: map[string]int{}}
+			_, client := newFakeHasura(t, counts.answer)
+			quote := &priceQuote{DiscountAmount: 10, coupon: &tt.coupon}
+
+			// Concurrent checkouts race for the same uses.
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			succeeded := 0
+			for i, user := range tt.users {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					err := reserveCouponRedemption(t.Context(), client, quote, user, "p"+string(rune('0'+i)))
+					var cErr *couponError
+					if err != nil && !errors.As(err, &cErr) {
+						t.Errorf("reserveCouponRedemption() = %v", err)
+					}
+					if err == nil {
+						mu.Lock()
+						succeeded++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+
+			if succeeded != tt.succeeded {
+				t.Errorf("%d redemptions reserved, want %d", succeeded, tt.succeeded)
+			}
+			if counts.total != tt.total {
+				t.Errorf("coupon counts %d redemptions, want %d", counts.total, tt.total)
+			}
+			perUser := 0
+			for user, count := range counts.perUser {
+				if tt.coupon.PerUserLimit != nil && count > *tt.coupon.PerUserLimit {
+					t.Errorf("user %s holds %d redemptions, over the limit", user, count)
+				}
+				perUser += count
+			}
+			if perUser != tt.total {
+				t.Errorf("users hold %d redemptions, want %d", perUser, tt.total)
+			}
+		})
+	}
+}
+
+func TestReclaimCouponRedemptions(t *testing.T) {
+	one := 1
+	counts := &fakeCouponCounts{total: 1, perUser: map[string]int{"u1": 1}}
+	_, client := newFakeHasura(t, func(call graphqlCall) interface{} {
+		switch call.Operation {
+		case "ReclaimRedemptions":
+			return map[string]interface{}{"update_CouponRedemptions": map[string]interface{}{"returning": []interface{}{
+				map[string]interface{}{"purchase_id": "p1", "coupon_id": "c1", "user_id": "u1"},
+			}}}
+		case "Coupon":
+			return map[string]interface{}{"Coupons_by_pk": map[string]interface{}{"id": "c1", "code": "SAVE", "per_user_limit": one, "active": true}}
+		}
+		return counts.answer(call)
+	})
+
+	// The user has used the coupon again since their checkout expired; the
+	// late payment still counts against them.
+	reclaimCouponRedemptions(t.Context(), client, []string{"p1"})
+	if counts.total != 2 || counts.perUser["u1"] != 2 {
+		t.Errorf("counts = %d total, %d for the user; want 2 and 2", counts.total, counts.perUser["u1"])
+	}
+}
@@ -0,0 +1,457 @@
+package controllers
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/config"
+	"backend/hasura"
+	"backend/middleware"
+)
+
+// currencyRounding is the step converted prices are rounded to in each
+// currency: whole birr, and cents for dollars and euros. Prices already in
+// the buyer's currency are charged as the author set them.
+var currencyRounding = map[string]float64{
+	"ETB": 1,
+	"USD": 0.01,
+	"EUR": 0.01,
+}
+
+// roundForCurrency rounds a converted amount to the currency's step, half
+// up, and never below the smallest charge the currency allows.
+func roundForCurrency(amount float64, currency string) float64 {
+	step, ok := currencyRounding[currency]
+	if !ok {
+		step = 0.01
+	}
+	rounded := roundMoney(math.Floor(amount/step+0.5) * step)
+	if minimum := minimumAmount(currency); rounded < minimum {
+		rounded = minimum
+	}
+	return rounded
+}
+
+type ExchangeRateInput struct {
+	BaseCurrency  string  `json:"baseCurrency"`
+	QuoteCurrency string  `json:"quoteCurrency"`
+	Rate          float64 `json:"rate"`
+}
+
+// SetExchangeRatesRequest updates rates from a list, a CSV document with
+// "base,quote,rate" rows, or both.
+type SetExchangeRatesRequest struct {
+	Rates  []ExchangeRateInput `json:"rates"`
+	CSV    string              `json:"csv"`
+	Source string              `json:"source"`
+}
+
+type RecipePricesRequest struct {
+	RecipeIDs []string `json:"recipeIds"`
+	Currency  string   `json:"currency"`
+}
+
+type exchangeRateRecord struct {
+	ID            string  `json:"id"`
+	BaseCurrency  string  `json:"base_currency"`
+	QuoteCurrency string  `json:"quote_currency"`
+	Rate          float64 `json:"rate"`
+	Source        string  `json:"source"`
+	UpdatedAt     string  `json:"updated_at"`
+}
+
+const exchangeRateFields = `
+	id
+	base_currency
+	quote_currency
+	rate
+	source
+	updated_at
+`
+
+// conversion is a price moved from the author's currency into the buyer's,
+// with the rate that was used so it can be locked on the purchase.
+type conversion struct {
+	BaseAmount   float64 `json:"baseAmount"`
+	BaseCurrency string  `json:"baseCurrency"`
+	Amount       float64 `json:"amount"`
+	Currency     string  `json:"currency"`
+	Rate         float64 `json:"rate"`
+	RateAt       string  `json:"rateAt,omitempty"`
+}
+
+// lockFields returns the purchase columns that record the conversion.
+func (c *conversion) lockFields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"base_amount":   c.BaseAmount,
+		"base_currency": c.BaseCurrency,
+		"exchange_rate": c.Rate,
+	}
+	if c.RateAt != "" {
+		fields["exchange_rate_at"] = c.RateAt
+	}
+	return fields
+}
+
+// conversionError means a price cannot be shown in the requested currency.
+type conversionError struct {
+	message string
+}
+
+func (e *conversionError) Error() string {
+	return e.message
+}
+
+// rateTable holds the stored exchange rates, keyed by base and quote.
+type rateTable struct {
+	rates  map[[2]string]exchangeRateRecord
+	maxAge time.Duration
+}
+
+func loadExchangeRates(ctx context.Context, client *hasura.Client, cfg *config.Config) (*rateTable, error) {
+	query := `
+		query ExchangeRates {
+			ExchangeRates {` + exchangeRateFields + `}
+		}
+	`
+	var response struct {
+		ExchangeRates []exchangeRateRecord `json:"ExchangeRates"`
+	}
+	if err := client.Execute(ctx, query, nil, &response); err != nil {
+		return nil, err
+	}
+
+	table := &rateTable{rates: make(map[[2]string]exchangeRateRecord), maxAge: cfg.ExchangeRateMaxAge}
+	for _, rate := range response.ExchangeRates {
+		table.rates[[2]string{rate.BaseCurrency, rate.QuoteCurrency}] = rate
+	}
+	return table, nil
+}
+
+// convert prices amount, given in from, in the currency to. A direct rate is
+// preferred; otherwise the inverse of the opposite rate is used. Rates
+// older than the configured maximum age are refused.
+func (t *rateTable) convert(amount float64, from, to string) (*conversion, error) {
+	result := &conversion{BaseAmount: roundMoney(amount), BaseCurrency: from, Currency: to}
+	if from == to {
+		result.Amount = result.BaseAmount
+		result.Rate = 1
+		return result, nil
+	}
+
+	record, ok := t.rates[[2]string{from, to}]
+	rate := record.Rate
+	if !ok {
+		if record, ok = t.rates[[2]string{to, from}]; ok {
+			rate = 1 / record.Rate
+		}
+	}
+	if !ok || rate <= 0 {
+		return nil, &conversionError{fmt.Sprintf("prices in %s cannot be shown in %s", from, to)}
+	}
+	if updatedAt, parsed := parseTimestamp(&record.UpdatedAt); !parsed || time.Since(updatedAt) > t.maxAge {
+		return nil, &conversionError{fmt.Sprintf("the %s/%s exchange rate is out of date", from, to)}
+	}
+
+	result.Rate = math.Round(rate*1e8) / 1e8
+	result.RateAt = record.UpdatedAt
+	result.Amount = roundForCurrency(amount*rate, to)
+	return result, nil
+}
+
+// recipePricing is a recipe's price converted for one buyer.
+type recipePricing struct {
+	recipe cartRecipe
+	*conversion
+}
+
+// priceRecipe converts a recipe's price into currency, or prices it in its
+// own currency when currency is empty. It returns nil if the recipe does not
+// exist.
+func priceRecipe(ctx context.Context, client *hasura.Client, cfg *config.Config, recipeID, currency string) (*recipePricing, error) {
+	query := `
+		query RecipePrice($id: uuid!) {
+			Recipes_by_pk(id: $id) {
+				id
+				title
+				user_id
+				price
+				currency
+			}
+		}
+	`
+	var response struct {
+		Recipe *cartRecipe `json:"Recipes_by_pk"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"id": recipeID}, &response); err != nil {
+		return nil, err
+	}
+	if response.Recipe == nil {
+		return nil, nil
+	}
+	if response.Recipe.Price <= 0 {
+		return nil, &conversionError{"this recipe is free"}
+	}
+
+	if currency == "" {
+		currency = response.Recipe.Currency
+	}
+
+	rates, err := loadExchangeRates(ctx, client, cfg)
+	if err != nil {
+		return nil, err
+	}
+	converted, err := rates.convert(response.Recipe.Price, response.Recipe.Currency, currency)
+	if err != nil {
+		return nil, err
+	}
+	return &recipePricing{recipe: *response.Recipe, conversion: converted}, nil
+}
+
+// writePricingError reports a failed price lookup, passing conversion
+// problems through to the buyer.
+func writePricingError(w http.ResponseWriter, err error) {
+	var cErr *conversionError
+	if errors.As(err, &cErr) {
+		http.Error(w, cErr.message, http.StatusBadRequest)
+		return
+	}
+	log.Printf("Error pricing recipe: %v", err)
+	http.Error(w, "Error loading recipe price", http.StatusInternalServerError)
+}
+
+// parseRatesCSV reads "base,quote,rate" rows. A header row is skipped.
+func parseRatesCSV(data string) ([]ExchangeRateInput, error) {
+	reader := csv.NewReader(strings.NewReader(data))
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+
+	var rates []ExchangeRateInput
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("csv line %d: %v", line, err)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+		if err != nil {
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("csv line %d: invalid rate %q", line, record[2])
+		}
+		rates = append(rates, ExchangeRateInput{BaseCurrency: record[0], QuoteCurrency: record[1], Rate: rate})
+	}
+	return rates, nil
+}
+
+// SetExchangeRatesHandler lets admins create or replace exchange rates.
+func SetExchangeRatesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role := requestUser(r)
+	if role != middleware.RoleAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var req SetExchangeRatesRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rates := req.Rates
+	if strings.TrimSpace(req.CSV) != "" {
+		imported, err := parseRatesCSV(req.CSV)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rates = append(rates, imported...)
+	}
+	if len(rates) == 0 {
+		http.Error(w, "no rates given", http.StatusBadRequest)
+		return
+	}
+
+	source := strings.TrimSpace(req.Source)
+	if source == "" {
+		source = "manual"
+	}
+	now := formatTimestamp(time.Now().UTC())
+
+	seen := make(map[[2]string]bool)
+	objects := make([]map[string]interface{}, 0, len(rates))
+	for _, rate := range rates {
+		base := strings.ToUpper(strings.TrimSpace(rate.BaseCurrency))
+		quote := strings.ToUpper(strings.TrimSpace(rate.QuoteCurrency))
+		if !supportedCurrencies[base] || !supportedCurrencies[quote] {
+			http.Error(w, fmt.Sprintf("unsupported currency pair: %s/%s", base, quote), http.StatusBadRequest)
+			return
+		}
+		if base == quote {
+			http.Error(w, fmt.Sprintf("%s/%s is not a currency pair", base, quote), http.StatusBadRequest)
+			return
+		}
+		if rate.Rate <= 0 || math.IsInf(rate.Rate, 0) || math.IsNaN(rate.Rate) {
+			http.Error(w, fmt.Sprintf("rate for %s/%s must be positive", base, quote), http.StatusBadRequest)
+			return
+		}
+		key := [2]string{base, quote}
+		if seen[key] {
+			http.Error(w, fmt.Sprintf("%s/%s is given more than once", base, quote), http.StatusBadRequest)
+			return
+		}
+		seen[key] = true
+
+		objects = append(objects, map[string]interface{}{
+			"base_currency":  base,
+			"quote_currency": quote,
+			"rate":           rate.Rate,
+			"source":         source,
+			"updated_by":     userID,
+			"updated_at":     now,
+		})
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	query := `
+		mutation SetExchangeRates($objects: [ExchangeRates_insert_input!]!) {
+			insert_ExchangeRates(
+				objects: $objects,
+				on_conflict: {constraint: ExchangeRates_base_currency_quote_currency_key, update_columns: [rate, source, updated_by, updated_at]}
+			) {
+				returning {` + exchangeRateFields + `}
+			}
+		}
+	`
+	var response struct {
+		InsertExchangeRates struct {
+			Returning []exchangeRateRecord `json:"returning"`
+		} `json:"insert_ExchangeRates"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"objects": objects}, &response); err != nil {
+		log.Printf("Error saving exchange rates: %v", err)
+		http.Error(w, "Error saving exchange rates", http.StatusInternalServerError)
+		return
+	}
+
+	for _, rate := range response.InsertExchangeRates.Returning {
+		recordAudit(r.Context(), client, userID, "exchange_rate.updated", "ExchangeRates", rate.ID, map[string]interface{}{
+			"pair":   rate.BaseCurrency + "/" + rate.QuoteCurrency,
+			"rate":   rate.Rate,
+			"source": rate.Source,
+		})
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Exchange rates updated", response.InsertExchangeRates.Returning))
+}
+
+// ExchangeRatesHandler lists the stored exchange rates.
+func ExchangeRatesHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	query := `
+		query ListExchangeRates {
+			ExchangeRates(order_by: [{base_currency: asc}, {quote_currency: asc}]) {` + exchangeRateFields + `}
+		}
+	`
+	var response struct {
+		ExchangeRates []exchangeRateRecord `json:"ExchangeRates"`
+	}
+	if err := client.Execute(r.Context(), query, nil, &response); err != nil {
+		log.Printf("Error loading exchange rates: %v", err)
+		http.Error(w, "Error loading exchange rates", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Exchange rates retrieved", response.ExchangeRates))
+}
+
+// RecipePricesHandler shows recipes' prices in the buyer's chosen currency.
+// Recipes that cannot be converted keep their own price and say so.
+func RecipePricesHandler(w http.ResponseWriter, r *http.Request) {
+	var req RecipePricesRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.RecipeIDs) == 0 {
+		http.Error(w, "recipe IDs are required", http.StatusBadRequest)
+		return
+	}
+	if len(req.RecipeIDs) > maxAccessBatch {
+		http.Error(w, fmt.Sprintf("at most %d recipes can be priced at once", maxAccessBatch), http.StatusBadRequest)
+		return
+	}
+	currency := strings.ToUpper(req.Currency)
+	if !supportedCurrencies[currency] {
+		http.Error(w, fmt.Sprintf("unsupported currency: %s. Supported currencies are: ETB, USD, EUR", currency), http.StatusBadRequest)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	query := `
+		query RecipePrices($ids: [uuid!]!) {
+			Recipes(where: {id: {_in: $ids}}) {
+				id
+				title
+				user_id
+				price
+				currency
+			}
+		}
+	`
+	var response struct {
+		Recipes []cartRecipe `json:"Recipes"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"ids": req.RecipeIDs}, &response); err != nil {
+		log.Printf("Error loading recipe prices: %v", err)
+		http.Error(w, "Error loading recipe prices", http.StatusInternalServerError)
+		return
+	}
+	rates, err := loadExchangeRates(r.Context(), client, cfg)
+	if err != nil {
+		log.Printf("Error loading exchange rates: %v", err)
+		http.Error(w, "Error loading exchange rates", http.StatusInternalServerError)
+		return
+	}
+
+	type recipePrice struct {
+		RecipeID string `json:"recipeId"`
+		Free     bool   `json:"free"`
+		*conversion
+		Error string `json:"error,omitempty"`
+	}
+	prices := make([]recipePrice, 0, len(response.Recipes))
+	for _, recipe := range response.Recipes {
+		price := recipePrice{RecipeID: recipe.ID, Free: recipe.Price <= 0}
+		if price.Free {
+			price.conversion = &conversion{BaseCurrency: recipe.Currency, Currency: recipe.Currency, Rate: 1}
+		} else if converted, err := rates.convert(recipe.Price, recipe.Currency, currency); err != nil {
+			price.conversion = &conversion{BaseAmount: recipe.Price, BaseCurrency: recipe.Currency, Amount: recipe.Price, Currency: recipe.Currency, Rate: 1}
+			price.Error = err.Error()
+		} else {
+			price.conversion = converted
+		}
+		prices = append(prices, price)
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Recipe prices retrieved", prices))
+}
@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRoundForCurrency(t *testing.T) {
+	tests := []struct {
+		amount   float64
+		currency string
+		want     float64
+	}{
+		{149.5, "ETB", 150},
+		{149.49, "ETB", 149},
+		{2.345, "USD", 2.35},
+		{2.344, "USD", 2.34},
+		{9.996, "EUR", 10},
+		// Never below the smallest charge.
+		{3.2, "ETB", 5},
+		{0.12, "USD", 0.5},
+		// Unknown currencies round to cents with no minimum.
+		{0.126, "GBP", 0.13},
+	}
+	for _, tt := range tests {
+		if got := roundForCurrency(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("roundForCurrency(%v, %s) = %v, want %v", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestRateTableConvert(t *testing.T) {
+	fresh := formatTimestamp(time.Now().Add(-time.Hour))
+	stale := formatTimestamp(time.Now().Add(-48 * time.Hour))
+	table := &rateTable{
+		rates: map[[2]string]exchangeRateRecord{
+			{"USD", "ETB"}: {Rate: 56.5, UpdatedAt: fresh},
+			{"EUR", "ETB"}: {Rate: 61.2, UpdatedAt: stale},
+			{"GBP", "ETB"}: {Rate: 0, UpdatedAt: fresh},
+		},
+		maxAge: 24 * time.Hour,
+	}
+	tests := []struct {
+		name     string
+		amount   float64
+		from, to string
+		want     float64
+		rate     float64
+		fails    bool
+	}{
+		{"same currency", 149.999, "ETB", "ETB", 150, 1, false},
+		{"direct rate", 2.99, "USD", "ETB", 169, 56.5, false},
+		{"inverse rate", 300, "ETB", "USD", 5.31, 0.01769912, false},
+		{"inverse below minimum", 10, "ETB", "USD", 0.5, 0.01769912, false},
+		{"stale rate", 10, "EUR", "ETB", 0, 0, true},
+		{"stale inverse rate", 100, "ETB", "EUR", 0, 0, true},
+		{"zero rate", 10, "GBP", "ETB", 0, 0, true},
+		{"no rate", 10, "USD", "EUR", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := table.convert(tt.amount, tt.from, tt.to)
+			if tt.fails {
+				var conversionErr *conversionError
+				if !errors.As(err, &conversionErr) {
+					t.Fatalf("convert() = %+v, %v, want a conversion error", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Amount != tt.want || got.Rate != tt.rate {
+				t.Errorf("convert() = %v at %v, want %v at %v", got.Amount, got.Rate, tt.want, tt.rate)
+			}
+			if got.BaseCurrency != tt.from || got.Currency != tt.to {
+				t.Errorf("convert() currencies = %s to %s", got.BaseCurrency, got.Currency)
+			}
+		})
+	}
+}
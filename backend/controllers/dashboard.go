@@ -0,0 +1,464 @@
+package controllers
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"backend/config"
+	"backend/hasura"
+	"backend/middleware"
+)
+
+const (
+	dashboardDateLayout  = "2006-01-02"
+	dashboardDefaultDays = 30
+	dashboardMaxDays     = 731
+)
+
+// DashboardRequest selects the sales shown on an author's dashboard. Dates
+// are inclusive YYYY-MM-DD days; Period groups them by "day", "week" or
+// "month". Admins may pass AuthorID to view another author.
+type DashboardRequest struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Period   string `json:"period"`
+	RecipeID string `json:"recipeId"`
+	AuthorID string `json:"authorId"`
+}
+
+type revenueSummary struct {
+	Gross        float64 `json:"gross"`
+	PlatformFees float64 `json:"platformFees"`
+	Refunds      float64 `json:"refunds"`
+	Net          float64 `json:"net"`
+	Tips         float64 `json:"tips"`
+	TipsNet      float64 `json:"tipsNet"`
+}
+
+func (s *revenueSummary) add(other *revenueSummary) {
+	s.Gross = roundMoney(s.Gross + other.Gross)
+	s.PlatformFees = roundMoney(s.PlatformFees + other.PlatformFees)
+	s.Refunds = roundMoney(s.Refunds + other.Refunds)
+	s.Net = roundMoney(s.Net + other.Net)
+	s.Tips = roundMoney(s.Tips + other.Tips)
+	s.TipsNet = roundMoney(s.TipsNet + other.TipsNet)
+}
+
+type salesSummary struct {
+	SalesCount     int                        `json:"salesCount"`
+	TipCount       int                        `json:"tipCount"`
+	Views          int                        `json:"views"`
+	ConversionRate float64                    `json:"conversionRate"`
+	Revenue        map[string]*revenueSummary `json:"revenue"`
+}
+
+func newSalesSummary() *salesSummary {
+	return &salesSummary{Revenue: map[string]*revenueSummary{}}
+}
+
+func (s *salesSummary) revenue(currency string) *revenueSummary {
+	revenue, ok := s.Revenue[currency]
+	if !ok {
+		revenue = &revenueSummary{}
+		s.Revenue[currency] = revenue
+	}
+	return revenue
+}
+
+func (s *salesSummary) add(other *salesSummary) {
+	s.SalesCount += other.SalesCount
+	s.TipCount += other.TipCount
+	s.Views += other.Views
+	for currency, revenue := range other.Revenue {
+		s.revenue(currency).add(revenue)
+	}
+}
+
+// finish fills in the conversion rate: sales per unique daily view.
+func (s *salesSummary) finish() {
+	if s.Views > 0 {
+		s.ConversionRate = math.Round(float64(s.SalesCount)/float64(s.Views)*10000) / 10000
+	}
+}
+
+type recipeSalesSummary struct {
+	RecipeID string `json:"recipeId"`
+	Title    string `json:"title"`
+	*salesSummary
+}
+
+type periodSalesSummary struct {
+	PeriodStart string `json:"periodStart"`
+	*salesSummary
+}
+
+// dashboardCell is the finest grain the dashboard works at: one recipe in
+// one period. Everything else is summed from cells.
+type dashboardCell struct {
+	period   string
+	recipeID string
+	*salesSummary
+}
+
+type dashboardData struct {
+	from, to string
+	period   string
+	titles   map[string]string
+	cells    []*dashboardCell
+}
+
+// parseDashboardRequest validates the request and resolves whose sales the
+// caller may see.
+func parseDashboardRequest(r *http.Request) (*DashboardRequest, string, error) {
+	userID, role := requestUser(r)
+
+	var req DashboardRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		return nil, "", err
+	}
+
+	authorID := userID
+	if req.AuthorID != "" && req.AuthorID != userID {
+		if role != middleware.RoleAdmin {
+			return nil, "", fmt.Errorf("only admins can view another author's sales")
+		}
+		authorID = req.AuthorID
+	}
+
+	switch req.Period {
+	case "":
+		req.Period = "day"
+	case "day", "week", "month":
+	default:
+		return nil, "", fmt.Errorf("period must be day, week or month")
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	to := today
+	if req.To != "" {
+		parsed, err := time.Parse(dashboardDateLayout, req.To)
+		if err != nil {
+			return nil, "", fmt.Errorf("to must be a date in YYYY-MM-DD format")
+		}
+		to = parsed
+	}
+	from := to.AddDate(0, 0, -(dashboardDefaultDays - 1))
+	if req.From != "" {
+		parsed, err := time.Parse(dashboardDateLayout, req.From)
+		if err != nil {
+			return nil, "", fmt.Errorf("from must be a date in YYYY-MM-DD format")
+		}
+		from = parsed
+	}
+	if from.After(to) {
+		return nil, "", fmt.Errorf("from must not be after to")
+	}
+	if to.Sub(from) > dashboardMaxDays*24*time.Hour {
+		return nil, "", fmt.Errorf("date range must be at most %d days", dashboardMaxDays)
+	}
+	req.From = from.Format(dashboardDateLayout)
+	req.To = to.Format(dashboardDateLayout)
+
+	return &req, authorID, nil
+}
+
+// periodStart returns the first day of the period containing day. Weeks
+// start on Monday.
+func periodStart(day time.Time, period string) time.Time {
+	switch period {
+	case "week":
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset)
+	case "month":
+		return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return day
+	}
+}
+
+func loadDashboard(ctx context.Context, client *hasura.Client, authorID string, req *DashboardRequest) (*dashboardData, error) {
+	query := `
+		query AuthorDashboard($author_id: uuid!, $from: date!, $to: date!, $recipe: uuid_comparison_exp!) {
+			RecipeSalesDaily(where: {author_id: {_eq: $author_id}, day: {_gte: $from, _lte: $to}, recipe_id: $recipe}) {
+				recipe_id
+				day
+				currency
+				sales_count
+				gross_amount
+				platform_fee
+				refunded_amount
+				net_amount
+			}
+			RecipeTipsDaily(where: {author_id: {_eq: $author_id}, day: {_gte: $from, _lte: $to}, recipe_id: $recipe}) {
+				recipe_id
+				day
+				currency
+				tip_count
+				gross_amount
+				net_amount
+			}
+			RecipeViewsDaily(where: {author_id: {_eq: $author_id}, day: {_gte: $from, _lte: $to}, recipe_id: $recipe}) {
+				recipe_id
+				day
+				views
+			}
+			Recipes(where: {user_id: {_eq: $author_id}, id: $recipe}) {
+				id
+				title
+			}
+		}
+	`
+	recipeFilter := map[string]interface{}{}
+	if req.RecipeID != "" {
+		recipeFilter["_eq"] = req.RecipeID
+	}
+	variables := map[string]interface{}{
+		"author_id": authorID,
+		"from":      req.From,
+		"to":        req.To,
+		"recipe":    recipeFilter,
+	}
+
+	var response struct {
+		Sales []struct {
+			RecipeID       string  `json:"recipe_id"`
+			Day            string  `json:"day"`
+			Currency       string  `json:"currency"`
+			SalesCount     int     `json:"sales_count"`
+			GrossAmount    float64 `json:"gross_amount"`
+			PlatformFee    float64 `json:"platform_fee"`
+			RefundedAmount float64 `json:"refunded_amount"`
+			NetAmount      float64 `json:"net_amount"`
+		} `json:"RecipeSalesDaily"`
+		Tips []struct {
+			RecipeID    string  `json:"recipe_id"`
+			Day         string  `json:"day"`
+			Currency    string  `json:"currency"`
+			TipCount    int     `json:"tip_count"`
+			GrossAmount float64 `json:"gross_amount"`
+			NetAmount   float64 `json:"net_amount"`
+		} `json:"RecipeTipsDaily"`
+		Views []struct {
+			RecipeID string `json:"recipe_id"`
+			Day      string `json:"day"`
+			Views    int    `json:"views"`
+		} `json:"RecipeViewsDaily"`
+		Recipes []struct {
+			ID    string `json:"id"`
+			Title string `json:"title"`
+		} `json:"Recipes"`
+	}
+	if err := client.Execute(ctx, query, variables, &response); err != nil {
+		return nil, err
+	}
+
+	data := &dashboardData{
+		from:   req.From,
+		to:     req.To,
+		period: req.Period,
+		titles: make(map[string]string, len(response.Recipes)),
+	}
+	for _, recipe := range response.Recipes {
+		data.titles[recipe.ID] = recipe.Title
+	}
+
+	cells := make(map[[2]string]*dashboardCell)
+	cell := func(recipeID, day string) *dashboardCell {
+		start := day
+		if parsed, err := time.Parse(dashboardDateLayout, day); err == nil {
+			start = periodStart(parsed, req.Period).Format(dashboardDateLayout)
+		}
+		key := [2]string{start, recipeID}
+		c, ok := cells[key]
+		if !ok {
+			c = &dashboardCell{period: start, recipeID: recipeID, salesSummary: newSalesSummary()}
+			cells[key] = c
+			data.cells = append(data.cells, c)
+		}
+		return c
+	}
+
+	for _, row := range response.Sales {
+		c := cell(row.RecipeID, row.Day)
+		c.SalesCount += row.SalesCount
+		c.revenue(row.Currency).add(&revenueSummary{
+			Gross:        row.GrossAmount,
+			PlatformFees: row.PlatformFee,
+			Refunds:      row.RefundedAmount,
+			Net:          row.NetAmount,
+		})
+	}
+	for _, row := range response.Tips {
+		c := cell(row.RecipeID, row.Day)
+		c.TipCount += row.TipCount
+		c.revenue(row.Currency).add(&revenueSummary{
+			Tips:    row.GrossAmount,
+			TipsNet: row.NetAmount,
+		})
+	}
+	for _, row := range response.Views {
+		cell(row.RecipeID, row.Day).Views += row.Views
+	}
+
+	sort.Slice(data.cells, func(i, j int) bool {
+		if data.cells[i].period != data.cells[j].period {
+			return data.cells[i].period < data.cells[j].period
+		}
+		return data.cells[i].recipeID < data.cells[j].recipeID
+	})
+	for _, c := range data.cells {
+		c.finish()
+	}
+	return data, nil
+}
+
+// AuthorDashboardHandler returns an author's sales broken down per recipe
+// and per period, with totals by currency.
+func AuthorDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	req, authorID, err := parseDashboardRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if authorID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	data, err := loadDashboard(r.Context(), client, authorID, req)
+	if err != nil {
+		log.Printf("Error loading dashboard: %v", err)
+		http.Error(w, "Error loading dashboard", http.StatusInternalServerError)
+		return
+	}
+
+	totals := newSalesSummary()
+	byRecipe := map[string]*recipeSalesSummary{}
+	byPeriod := map[string]*periodSalesSummary{}
+	recipes := []*recipeSalesSummary{}
+	periods := []*periodSalesSummary{}
+	for _, c := range data.cells {
+		recipe, ok := byRecipe[c.recipeID]
+		if !ok {
+			recipe = &recipeSalesSummary{RecipeID: c.recipeID, Title: data.titles[c.recipeID], salesSummary: newSalesSummary()}
+			byRecipe[c.recipeID] = recipe
+			recipes = append(recipes, recipe)
+		}
+		recipe.add(c.salesSummary)
+
+		period, ok := byPeriod[c.period]
+		if !ok {
+			period = &periodSalesSummary{PeriodStart: c.period, salesSummary: newSalesSummary()}
+			byPeriod[c.period] = period
+			periods = append(periods, period)
+		}
+		period.add(c.salesSummary)
+
+		totals.add(c.salesSummary)
+	}
+	for _, recipe := range recipes {
+		recipe.finish()
+	}
+	for _, period := range periods {
+		period.finish()
+	}
+	totals.finish()
+	sort.Slice(recipes, func(i, j int) bool { return recipes[i].SalesCount > recipes[j].SalesCount })
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Dashboard retrieved", map[string]interface{}{
+		"from":    data.from,
+		"to":      data.to,
+		"period":  data.period,
+		"totals":  totals,
+		"recipes": recipes,
+		"periods": periods,
+	}))
+}
+
+// AuthorDashboardExportHandler returns the same data as the dashboard as a
+// CSV file, one row per period, recipe and currency.
+func AuthorDashboardExportHandler(w http.ResponseWriter, r *http.Request) {
+	req, authorID, err := parseDashboardRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if authorID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	data, err := loadDashboard(r.Context(), client, authorID, req)
+	if err != nil {
+		log.Printf("Error loading dashboard: %v", err)
+		http.Error(w, "Error loading dashboard", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"sales_%s_%s.csv\"", data.from, data.to))
+
+	money := func(amount float64) string {
+		return strconv.FormatFloat(amount, 'f', 2, 64)
+	}
+
+	out := csv.NewWriter(w)
+	out.Write([]string{
+		"period_start", "recipe_id", "recipe_title", "currency",
+		"sales_count", "gross", "platform_fees", "refunds", "net",
+		"tip_count", "tips", "tips_net", "views", "conversion_rate",
+	})
+	for _, c := range data.cells {
+		common := []string{c.period, c.recipeID, data.titles[c.recipeID]}
+		tail := []string{strconv.Itoa(c.Views), strconv.FormatFloat(c.ConversionRate, 'f', 4, 64)}
+		if len(c.Revenue) == 0 {
+			// Views without sales still belong in the export.
+			row := append(common, "", "0", "", "", "", "", "0", "", "")
+			out.Write(append(row, tail...))
+			continue
+		}
+
+		currencies := make([]string, 0, len(c.Revenue))
+		for currency := range c.Revenue {
+			currencies = append(currencies, currency)
+		}
+		sort.Strings(currencies)
+		// Counts are per recipe and period, so they go on the first row only
+		// to keep column sums right.
+		for i, currency := range currencies {
+			revenue := c.Revenue[currency]
+			salesCount, tipCount := "", ""
+			if i == 0 {
+				salesCount, tipCount = strconv.Itoa(c.SalesCount), strconv.Itoa(c.TipCount)
+			}
+			row := append([]string{}, common...)
+			row = append(row, currency, salesCount,
+				money(revenue.Gross), money(revenue.PlatformFees), money(revenue.Refunds), money(revenue.Net),
+				tipCount, money(revenue.Tips), money(revenue.TipsNet))
+			if i == 0 {
+				row = append(row, tail...)
+			} else {
+				row = append(row, "", "")
+			}
+			out.Write(row)
+		}
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		log.Printf("Error writing dashboard export: %v", err)
+	}
+}
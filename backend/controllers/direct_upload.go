@@ -0,0 +1,566 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"backend/config"
+	"backend/hasura"
+	"backend/images"
+	"backend/storage"
+
+	"github.com/google/uuid"
+)
+
+type SignUploadRequest struct {
+	ContentType string `json:"contentType"`
+	// Size is the size of the file in bytes, when the browser knows it.
+	// The upload may be no larger.
+	Size int64 `json:"size"`
+}
+
+type CompleteUploadRequest struct {
+	Key string `json:"key"`
+}
+
+type UploadStatusRequest struct {
+	ID string `json:"id"`
+}
+
+// Statuses of an upload's row. A direct upload is pending from signing to
+// completion and processing while it is checked in the background, then
+// stored or failed; only stored uploads have files.
+const (
+	uploadProcessing = "processing"
+	uploadStored     = "stored"
+)
+
+// uploadHeaderBytes is how much of a staged upload is read to identify it
+// when it is completed, enough for the metadata segments that come before
+// the dimensions in most camera JPEGs.
+const uploadHeaderBytes = 256 << 10
+
+// stagedUploadTimeout bounds the processing of one completed direct upload.
+const stagedUploadTimeout = 10 * time.Minute
+
+var errUploadExpired = errors.New("upload expired before it was processed")
+
+var (
+	stagedUploadsOnce sync.Once
+	stagedUploads     *uploadPool
+)
+
+// stagingFolder is where a user's direct uploads land until they are
+// completed. Stores keep it off public delivery, so a staged file is not
+// served before it has been checked and stripped of metadata.
+func stagingFolder(userID string) string {
+	return storage.StagingPrefix + userID
+}
+
+// pendingUploadTTL is how long a signed direct upload keeps its quota
+// reservation.
+func pendingUploadTTL(cfg *config.Config) time.Duration {
+	return max(cfg.DirectUploadExpiry, time.Hour)
+}
+
+// SignUploadHandler authorizes the browser to upload one image straight to
+// the blob store, into the caller's staging folder. Each signature is
+// recorded as a pending upload of its size, or of the largest file allowed,
+// which counts against the caller's quota until it is completed or
+// expires, and counts towards the hourly limit as it is signed. The store enforces the content type and, where it
+// can, the size; CompleteUploadHandler checks both again.
+func SignUploadHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role := requestUser(r)
+
+	var req SignUploadRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	direct, ok := blobStore.(storage.DirectUploader)
+	if !ok {
+		http.Error(w, "Direct uploads are not supported by this storage backend", http.StatusNotImplemented)
+		return
+	}
+	ext, ok := images.ExtensionFor(req.ContentType)
+	if !ok {
+		http.Error(w, "Unsupported content type; use JPEG, PNG, WebP or GIF", http.StatusBadRequest)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	size := req.Size
+	switch {
+	case size < 0:
+		http.Error(w, "size must not be negative", http.StatusBadRequest)
+		return
+	case size > cfg.UploadMaxFileSize:
+		http.Error(w, errFileTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case size == 0:
+		size = cfg.UploadMaxFileSize
+	}
+
+	quota, err := loadUploadQuota(r.Context(), client, cfg, userID, role)
+	if err != nil {
+		log.Printf("Error loading upload quota: %v", err)
+		http.Error(w, "Error checking upload quota", http.StatusInternalServerError)
+		return
+	}
+	// The pending upload's row holds the quota once it is in.
+	reservation, err := quota.reserve(r.Context(), client, size)
+	if err != nil {
+		if errors.Is(err, errQuotaExceeded) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		log.Printf("Error reserving upload quota: %v", err)
+		http.Error(w, "Error checking upload quota", http.StatusInternalServerError)
+		return
+	}
+	defer reservation.release(context.Background(), client)
+
+	key := fmt.Sprintf("%s/%s.%s", stagingFolder(userID), uuid.New().String(), ext)
+	pendingID, err := insertPendingUpload(r.Context(), client, userID, key, req.ContentType, size)
+	if err != nil {
+		log.Printf("Error recording pending upload: %v", err)
+		http.Error(w, "Error signing upload", http.StatusInternalServerError)
+		return
+	}
+	upload, err := direct.PresignUpload(key, storage.UploadPolicy{
+		ContentType: req.ContentType,
+		MaxBytes:    size,
+		Expiry:      cfg.DirectUploadExpiry,
+	})
+	if err != nil {
+		log.Printf("Error signing upload: %v", err)
+		if err := deletePendingUpload(r.Context(), client, pendingID); err != nil {
+			log.Printf("Error deleting pending upload %s: %v", pendingID, err)
+		}
+		http.Error(w, "Error signing upload", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Upload authorized", upload))
+}
+
+// CompleteUploadHandler is called once the browser has uploaded a signed
+// image. Only the head of the staged file is read here, to reject files
+// that are too large or not a supported image; the upload is then marked
+// processing and handed to processStagedUpload, and the caller polls
+// UploadStatusHandler for the result.
+func CompleteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := requestUser(r)
+
+	var req CompleteUploadRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	direct, ok := blobStore.(storage.DirectUploader)
+	if !ok {
+		http.Error(w, "Direct uploads are not supported by this storage backend", http.StatusNotImplemented)
+		return
+	}
+	if path.Clean(req.Key) != req.Key || !strings.HasPrefix(req.Key, stagingFolder(userID)+"/") {
+		http.Error(w, "You can only complete your own uploads", http.StatusForbidden)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	pending, err := getPendingUpload(r.Context(), client, cfg, userID, req.Key)
+	if err != nil {
+		log.Printf("Error loading pending upload: %v", err)
+		http.Error(w, "Error checking upload", http.StatusInternalServerError)
+		return
+	}
+	if pending == nil {
+		http.Error(w, "Upload not found or expired; sign it again", http.StatusNotFound)
+		return
+	}
+
+	object, err := direct.Stat(r.Context(), req.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Upload not found; send the file before completing it", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error checking staged upload: %v", err)
+		http.Error(w, "Error checking upload", http.StatusInternalServerError)
+		return
+	}
+
+	// The quota was reserved for the signed size when the upload was
+	// signed.
+	result := imageUploadResult{Filename: path.Base(object.Key)}
+	if object.Size > pending.Bytes {
+		rejectStagedUpload(client, pending.ID, object.Key)
+		result.fail(errFileTooLarge)
+		writeUploadResults(w, []imageUploadResult{result})
+		return
+	}
+	info, err := inspectStagedUpload(r.Context(), direct, object, imageLimits(cfg))
+	if images.IsValidationError(err) {
+		rejectStagedUpload(client, pending.ID, object.Key)
+		result.fail(err)
+		writeUploadResults(w, []imageUploadResult{result})
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading staged upload: %v", err)
+		http.Error(w, "Error reading upload", http.StatusInternalServerError)
+		return
+	}
+
+	accepted, err := markUploadProcessing(r.Context(), client, pending.ID, object.Size)
+	if err != nil {
+		log.Printf("Error accepting staged upload: %v", err)
+		http.Error(w, "Error checking upload", http.StatusInternalServerError)
+		return
+	}
+	if !accepted {
+		http.Error(w, "Upload is already being completed", http.StatusConflict)
+		return
+	}
+
+	result.ID = pending.ID
+	result.staged = object.Key
+	result.Bytes = object.Size
+	result.Status = uploadProcessing
+	if info != nil {
+		result.ContentType = info.ContentType
+		result.Width = info.Width
+		result.Height = info.Height
+	}
+	go processStagedUpload(cfg, client, userID, result)
+
+	writeUploadResults(w, []imageUploadResult{result})
+}
+
+// inspectStagedUpload identifies a staged upload from a ranged read of its
+// head. The head of a large file may stop short of its dimensions, so
+// it is only rejected here when it is not a supported type, and its info
+// is then left to processing to find.
+func inspectStagedUpload(ctx context.Context, direct storage.DirectUploader, object *storage.Object, limits images.Limits) (*images.Info, error) {
+	body, err := direct.OpenRange(ctx, object.Key, 0, uploadHeaderBytes)
+	if err != nil {
+		return nil, err
+	}
+	head, err := io.ReadAll(io.LimitReader(body, uploadHeaderBytes))
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	return inspectHead(head, object.Size, limits)
+}
+
+func inspectHead(head []byte, size int64, limits images.Limits) (*images.Info, error) {
+	info, err := images.Inspect(bytes.NewReader(head), limits)
+	if err == nil || int64(len(head)) >= size {
+		return info, err
+	}
+	contentType, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	if _, ok := images.ExtensionFor(contentType); !ok {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// rejectStagedUpload deletes the pending upload and the staged file of a
+// direct upload that failed its checks.
+func rejectStagedUpload(client *hasura.Client, id, key string) {
+	ctx := context.Background()
+	if err := deletePendingUpload(ctx, client, id); err != nil {
+		log.Printf("Error deleting pending upload %s: %v", id, err)
+	}
+	if err := blobStore.Delete(ctx, key); err != nil {
+		log.Printf("Error deleting staged upload %s: %v", key, err)
+	}
+}
+
+// markUploadProcessing moves a pending upload to processing, holding
+// quota for the size actually uploaded from now on. It reports false when
+// the upload was no longer pending, as when it is completed twice.
+func markUploadProcessing(ctx context.Context, client *hasura.Client, id string, size int64) (bool, error) {
+	query := `
+		mutation ProcessUpload($id: uuid!, $bytes: bigint!) {
+			update_Uploads(where: {id: {_eq: $id}, status: {_eq: "pending"}}, _set: {status: "processing", bytes: $bytes}) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		UpdateUploads struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_Uploads"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"id": id, "bytes": size}, &response); err != nil {
+		return false, err
+	}
+	return response.UpdateUploads.AffectedRows > 0, nil
+}
+
+// processStagedUpload reads a completed direct upload once and puts it
+// through the same validation, metadata stripping and variant generation
+// as a proxied upload, stored in place of its processing row. A failure is
+// recorded on the row for the uploader to see until cleanup removes it.
+// The staged file is deleted either way, unless it was promoted.
+func processStagedUpload(cfg *config.Config, client *hasura.Client, userID string, result imageUploadResult) {
+	stagedUploadPool(cfg).Go(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), stagedUploadTimeout)
+		defer cancel()
+		defer func() {
+			if err := blobStore.Delete(context.Background(), result.staged); err != nil {
+				log.Printf("Error deleting staged upload %s: %v", result.staged, err)
+			}
+		}()
+
+		direct := blobStore.(storage.DirectUploader)
+		body, err := direct.Open(ctx, result.staged)
+		var spool *os.File
+		if err == nil {
+			// The limit covers the file alone, so only the per-file check
+			// can trip.
+			totalLeft := result.Bytes
+			spool, _, err = spoolUpload(cfg, &result, body, &totalLeft)
+			body.Close()
+		}
+		switch {
+		case err != nil:
+			result.fail(err)
+		case spool != nil:
+			uploadImageWithRetry(ctx, client, cfg, userID, &result, spool)
+			removeSpool(spool)
+		}
+
+		switch {
+		case result.Error != "":
+			if err := failProcessingUpload(context.Background(), client, result.ID, result.Error); err != nil {
+				log.Printf("Error recording failed upload %s: %v", result.ID, err)
+			}
+		case result.Reused:
+			if err := deletePendingUpload(context.Background(), client, result.ID); err != nil {
+				log.Printf("Error deleting pending upload %s: %v", result.ID, err)
+			}
+		}
+	})
+}
+
+// stagedUploadPool bounds how many completed direct uploads are processed
+// at once. Uploads beyond that wait for a slot in their own goroutine.
+func stagedUploadPool(cfg *config.Config) *uploadPool {
+	stagedUploadsOnce.Do(func() {
+		stagedUploads = newUploadPool(cfg.UploadConcurrency)
+	})
+	return stagedUploads
+}
+
+// failProcessingUpload records why a direct upload could not be stored. Its
+// row stops holding quota bytes but still counts as an image until cleanup
+// removes it.
+func failProcessingUpload(ctx context.Context, client *hasura.Client, id, reason string) error {
+	query := `
+		mutation FailUpload($id: uuid!, $error: String!) {
+			update_Uploads(where: {id: {_eq: $id}, status: {_eq: "processing"}}, _set: {status: "failed", error: $error, bytes: 0}) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		UpdateUploads struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_Uploads"`
+	}
+	return client.Execute(ctx, query, map[string]interface{}{"id": id, "error": reason}, &response)
+}
+
+// UploadStatusHandler reports on one of the caller's uploads, which is how
+// the result of a completed direct upload is picked up.
+func UploadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := requestUser(r)
+
+	var req UploadStatusRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := uuid.Parse(req.ID); err != nil {
+		http.Error(w, "id must be an upload ID", http.StatusBadRequest)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	query := `
+		query UploadStatus($id: uuid!, $user_id: uuid!) {
+			Uploads(where: {id: {_eq: $id}, user_id: {_eq: $user_id}}) {` + uploadFields + `}
+		}
+	`
+	var response struct {
+		Uploads []uploadRecord `json:"Uploads"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"id": req.ID, "user_id": userID}, &response); err != nil {
+		log.Printf("Error loading upload %s: %v", req.ID, err)
+		http.Error(w, "Error loading upload", http.StatusInternalServerError)
+		return
+	}
+	if len(response.Uploads) == 0 {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	writeUploadResults(w, []imageUploadResult{response.Uploads[0].result()})
+}
+
+// result describes the upload as an upload batch would.
+func (u *uploadRecord) result() imageUploadResult {
+	result := imageUploadResult{ID: u.ID, Filename: path.Base(u.Key), Status: u.Status}
+	if u.Error != nil {
+		result.Error = *u.Error
+	}
+	if u.Status != uploadStored {
+		return result
+	}
+	result.URL = u.URL
+	result.Key = u.Key
+	result.ContentType = u.ContentType
+	result.Width = u.Width
+	result.Height = u.Height
+	result.Bytes = u.Bytes
+	result.Variants = u.Variants
+	result.Placeholder = u.Placeholder
+	return result
+}
+
+// insertPendingUpload records a signed direct upload of up to size bytes,
+// returning its ID.
+func insertPendingUpload(ctx context.Context, client *hasura.Client, userID, key, contentType string, size int64) (string, error) {
+	query := `
+		mutation InsertPendingUpload($object: Uploads_insert_input!) {
+			insert_Uploads_one(object: $object) {
+				id
+			}
+		}
+	`
+	object := map[string]interface{}{
+		"user_id":      userID,
+		"key":          key,
+		"url":          "",
+		"content_type": contentType,
+		"bytes":        size,
+		"status":       "pending",
+	}
+	var response struct {
+		InsertUploadsOne struct {
+			ID string `json:"id"`
+		} `json:"insert_Uploads_one"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"object": object}, &response); err != nil {
+		return "", err
+	}
+	return response.InsertUploadsOne.ID, nil
+}
+
+// getPendingUpload returns the user's pending direct upload to key, unless
+// it has expired.
+func getPendingUpload(ctx context.Context, client *hasura.Client, cfg *config.Config, userID, key string) (*uploadRecord, error) {
+	query := `
+		query PendingUpload($user_id: uuid!, $key: String!, $since: timestamptz!) {
+			Uploads(where: {user_id: {_eq: $user_id}, key: {_eq: $key}, status: {_eq: "pending"}, created_at: {_gt: $since}}) {` + uploadFields + `}
+		}
+	`
+	var response struct {
+		Uploads []uploadRecord `json:"Uploads"`
+	}
+	variables := map[string]interface{}{
+		"user_id": userID,
+		"key":     key,
+		"since":   formatTimestamp(time.Now().UTC().Add(-pendingUploadTTL(cfg))),
+	}
+	if err := client.Execute(ctx, query, variables, &response); err != nil {
+		return nil, err
+	}
+	if len(response.Uploads) == 0 {
+		return nil, nil
+	}
+	return &response.Uploads[0], nil
+}
+
+// deletePendingUpload deletes the row of a direct upload that has not been
+// stored.
+func deletePendingUpload(ctx context.Context, client *hasura.Client, id string) error {
+	query := `
+		mutation DeletePendingUpload($id: uuid!) {
+			delete_Uploads(where: {id: {_eq: $id}, status: {_in: ["pending", "processing"]}}) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		DeleteUploads struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"delete_Uploads"`
+	}
+	return client.Execute(ctx, query, map[string]interface{}{"id": id}, &response)
+}
+
+// cleanupStagedUploads deletes direct uploads that were never stored:
+// their pending, processing or failed rows once they expire, and their
+// staged files after the grace period.
+func cleanupStagedUploads(ctx context.Context, cfg *config.Config, client *hasura.Client, cutoff time.Time) {
+	if _, ok := blobStore.(storage.DirectUploader); !ok {
+		return
+	}
+
+	query := `
+		mutation ExpirePendingUploads($before: timestamptz!) {
+			delete_Uploads(where: {status: {_in: ["pending", "processing", "failed"]}, created_at: {_lt: $before}}) {
+				affected_rows
+			}
+		}
+	`
+	var expired struct {
+		DeleteUploads struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"delete_Uploads"`
+	}
+	before := formatTimestamp(time.Now().UTC().Add(-pendingUploadTTL(cfg)))
+	if err := client.Execute(ctx, query, map[string]interface{}{"before": before}, &expired); err != nil {
+		log.Printf("Error expiring pending uploads: %v", err)
+	}
+
+	objects, err := blobStore.List(ctx, storage.StagingPrefix)
+	if err != nil {
+		log.Printf("Error listing staged uploads: %v", err)
+		return
+	}
+	var deleted int
+	for _, object := range objects {
+		if object.LastModified.IsZero() || object.LastModified.After(cutoff) {
+			continue
+		}
+		if err := blobStore.Delete(ctx, object.Key); err != nil {
+			log.Printf("Error deleting staged upload %s: %v", object.Key, err)
+			continue
+		}
+		deleted++
+	}
+	if deleted > 0 {
+		log.Printf("Upload cleanup: deleted %d abandoned direct uploads", deleted)
+	}
+}
@@ -0,0 +1,217 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+
+	"backend/images"
+	"backend/storage"
+)
+
+// fakeDirectStore keeps files on disk and records promotions instead of
+// moving staged files.
+type fakeDirectStore struct {
+	*storage.LocalStore
+	promoteErr error
+	promoted   []string
+	puts       []string
+}
+
+func newFakeDirectStore(t *testing.T) *fakeDirectStore {
+	t.Helper()
+	local, err := storage.NewLocalStore(t.TempDir(), "http://localhost", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &fakeDirectStore{LocalStore: local}
+	previous := blobStore
+	blobStore = store
+	t.Cleanup(func() { blobStore = previous })
+	return store
+}
+
+func (s *fakeDirectStore) Put(ctx context.Context, key string, body io.Reader, contentType string) (*storage.Object, error) {
+	s.puts = append(s.puts, key)
+	return s.LocalStore.Put(ctx, key, body, contentType)
+}
+
+func (s *fakeDirectStore) PresignUpload(key string, policy storage.UploadPolicy) (*storage.PresignedUpload, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s *fakeDirectStore) Stat(ctx context.Context, key string) (*storage.Object, error) {
+	return nil, storage.ErrNotFound
+}
+
+func (s *fakeDirectStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return nil, storage.ErrNotFound
+}
+
+func (s *fakeDirectStore) OpenRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	return nil, storage.ErrNotFound
+}
+
+func (s *fakeDirectStore) Promote(ctx context.Context, src, dst, contentType string) (*storage.Object, error) {
+	s.promoted = append(s.promoted, src)
+	if s.promoteErr != nil {
+		return nil, s.promoteErr
+	}
+	return &storage.Object{Key: dst, URL: s.URL(dst), ContentType: contentType}, nil
+}
+
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 4)
+	}
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// withTextChunk inserts a tEXt chunk after the PNG's IHDR.
+func withTextChunk(data []byte, text string) []byte {
+	const ihdrEnd = 8 + 8 + 13 + 4
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(text)))
+	chunk = append(chunk, "tEXt"...)
+	chunk = append(chunk, text...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	out := append([]byte{}, data[:ihdrEnd]...)
+	out = append(out, chunk...)
+	return append(out, data[ihdrEnd:]...)
+}
+
+func TestStoreOriginal(t *testing.T) {
+	plain := testPNG(t)
+	tests := []struct {
+		name       string
+		data       []byte
+		promoteErr error
+		promoted   bool
+		put        bool
+	}{
+		{"unchanged", plain, nil, true, false},
+		{"metadata stripped", withTextChunk(plain, "Comment\x00taken at home"), nil, false, true},
+		{"promote failed", plain, errors.New("copy failed"), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeDirectStore(t)
+			store.promoteErr = tt.promoteErr
+			src := bytes.NewReader(tt.data)
+			info, err := images.Inspect(src, images.Limits{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result := &imageUploadResult{staged: "Incoming/u1/a.png"}
+			object, err := storeOriginal(t.Context(), result, "RecipeImages/u1/b.png", src, info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if object.Key != "RecipeImages/u1/b.png" {
+				t.Errorf("key = %s", object.Key)
+			}
+			if got := len(store.promoted) > 0; got != tt.promoted {
+				t.Errorf("promoted = %v, want %v", got, tt.promoted)
+			}
+			if got := len(store.puts) > 0; got != tt.put {
+				t.Errorf("put = %v, want %v", got, tt.put)
+			}
+		})
+	}
+}
+
+func TestStoreOriginalProxied(t *testing.T) {
+	store := newFakeDirectStore(t)
+	src := bytes.NewReader(testPNG(t))
+	info, err := images.Inspect(src, images.Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storeOriginal(t.Context(), &imageUploadResult{}, "RecipeImages/u1/b.png", src, info); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.promoted) != 0 || len(store.puts) != 1 {
+		t.Errorf("promoted %v and put %v, want one put", store.promoted, store.puts)
+	}
+}
+
+func TestInspectHead(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	img.Set(3, 3, color.White)
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Metadata larger than the head pushes the dimensions out of it.
+	segment := []byte{0xff, 0xe1, 0xff, 0xff}
+	big := append([]byte{0xff, 0xd8}, segment...)
+	big = append(big, make([]byte, 0xffff-2)...)
+	big = append(big, jpg.Bytes()[2:]...)
+
+	text := bytes.Repeat([]byte("not an image "), 100)
+	tests := []struct {
+		name     string
+		head     []byte
+		size     int64
+		wantInfo bool
+		wantErr  bool
+	}{
+		{"whole image", jpg.Bytes(), int64(jpg.Len()), true, false},
+		{"dimensions past the head", big[:1024], int64(len(big)), false, false},
+		{"whole file unreadable", big[:1024], 1024, false, true},
+		{"unsupported type", text[:512], int64(len(text)), false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := inspectHead(tt.head, tt.size, images.Limits{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("inspectHead() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !images.IsValidationError(err) {
+				t.Errorf("inspectHead() error = %v, want a validation error", err)
+			}
+			if (info != nil) != tt.wantInfo {
+				t.Errorf("inspectHead() info = %+v, want info %v", info, tt.wantInfo)
+			}
+		})
+	}
+}
+
+func TestSameBytesWriter(t *testing.T) {
+	original := []byte("the quick brown fox")
+	tests := []struct {
+		name   string
+		writes []string
+		want   bool
+	}{
+		{"same", []string{"the quick ", "brown fox"}, true},
+		{"different", []string{"the quick ", "brown cat"}, false},
+		{"shorter", []string{"the quick"}, false},
+		{"longer", []string{"the quick brown fox", "es"}, false},
+	}
+	for _, tt := range tests {
+		w := &sameBytesWriter{r: bytes.NewReader(original)}
+		for _, s := range tt.writes {
+			if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+				t.Fatalf("%s: Write() = %d, %v", tt.name, n, err)
+			}
+		}
+		if got := w.matched(int64(len(original))); got != tt.want {
+			t.Errorf("%s: matched() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,631 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"backend/config"
+	"backend/hasura"
+	"backend/payments"
+	"backend/utils"
+
+	"github.com/google/uuid"
+)
+
+// giftTxPrefix marks provider transactions that pay for a gift.
+const giftTxPrefix = "gift-"
+
+const maxGiftMessageLength = 500
+
+// Gift codes avoid characters that are easily confused when read aloud or
+// retyped (0/O, 1/I/L).
+const giftCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+type GiftPurchaseRequest struct {
+	RecipeID string `json:"recipeId"`
+	// Currency is the one the buyer pays in; the recipe's own if empty.
+	Currency       string `json:"currency"`
+	RecipientEmail string `json:"recipientEmail"`
+	Message        string `json:"message"`
+}
+
+type RedeemGiftRequest struct {
+	Code string `json:"code"`
+}
+
+type giftRecord struct {
+	ID             string  `json:"id"`
+	PurchaserID    string  `json:"purchaser_id"`
+	RecipeID       string  `json:"recipe_id"`
+	AuthorID       string  `json:"author_id"`
+	Amount         float64 `json:"amount"`
+	Currency       string  `json:"currency"`
+	Status         string  `json:"status"`
+	Code           string  `json:"code,omitempty"`
+	RecipientEmail *string `json:"recipient_email"`
+	Message        *string `json:"message"`
+	TxRef          string  `json:"tx_ref"`
+	CheckoutURL    *string `json:"checkout_url"`
+	SubaccountID   *string `json:"subaccount_id"`
+	PlatformFee    float64 `json:"platform_fee"`
+	PaidAt         *string `json:"paid_at"`
+	ExpiresAt      *string `json:"expires_at"`
+	RedeemedBy     *string `json:"redeemed_by"`
+	RedeemedAt     *string `json:"redeemed_at"`
+	CreatedAt      string  `json:"created_at"`
+}
+
+const giftFields = `
+	id
+	purchaser_id
+	recipe_id
+	author_id
+	amount
+	currency
+	status
+	code
+	recipient_email
+	message
+	tx_ref
+	checkout_url
+	subaccount_id
+	platform_fee
+	paid_at
+	expires_at
+	redeemed_by
+	redeemed_at
+	created_at
+`
+
+func isGiftTxRef(txRef string) bool {
+	return strings.HasPrefix(txRef, giftTxPrefix)
+}
+
+func newMailer(cfg *config.Config) utils.Mailer {
+	return utils.Mailer{
+		Host:     cfg.SMTPHost,
+		Port:     cfg.SMTPPort,
+		Username: cfg.SMTPUsername,
+		Password: cfg.SMTPPassword,
+		From:     cfg.MailFrom,
+	}
+}
+
+// generateGiftCode returns a random code such as "K7QM-3XTP-WN9D".
+func generateGiftCode() (string, error) {
+	max := big.NewInt(int64(len(giftCodeAlphabet)))
+	var b strings.Builder
+	for i := 0; i < 12; i++ {
+		if i > 0 && i%4 == 0 {
+			b.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(giftCodeAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+func normalizeGiftCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// findGiftByIdempotencyKey returns the gift a user previously started with
+// the given Idempotency-Key header, or nil if there is none. A key whose
+// checkout failed can be used again.
+func findGiftByIdempotencyKey(ctx context.Context, client *hasura.Client, userID, key string) (*giftRecord, error) {
+	query := `
+		query GiftByIdempotencyKey($user_id: uuid!, $key: String!) {
+			Gifts(where: {purchaser_id: {_eq: $user_id}, idempotency_key: {_eq: $key}, status: {_neq: "failed"}}, limit: 1) {` + giftFields + `}
+		}
+	`
+	var response struct {
+		Gifts []giftRecord `json:"Gifts"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"user_id": userID, "key": key}, &response); err != nil {
+		return nil, err
+	}
+	if len(response.Gifts) == 0 {
+		return nil, nil
+	}
+	return &response.Gifts[0], nil
+}
+
+// writeExistingGift answers a repeated gift checkout with the one already
+// started, the same way writeExistingPurchase does for purchases.
+func writeExistingGift(w http.ResponseWriter, gift *giftRecord) {
+	if gift.Status != "pending" {
+		http.Error(w, "This gift has already been paid for", http.StatusConflict)
+		return
+	}
+	if gift.CheckoutURL == nil || *gift.CheckoutURL == "" {
+		http.Error(w, "Payment initiation already in progress, retry shortly", http.StatusConflict)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Gift checkout already initiated", map[string]interface{}{
+		"giftId":       gift.ID,
+		"checkout_url": *gift.CheckoutURL,
+		"tx_ref":       gift.TxRef,
+		"amount":       gift.Amount,
+		"currency":     gift.Currency,
+	}))
+}
+
+func getGiftByCode(ctx context.Context, client *hasura.Client, code string) (*giftRecord, error) {
+	query := `
+		query GetGiftByCode($code: String!) {
+			Gifts(where: {code: {_eq: $code}}) {` + giftFields + `}
+		}
+	`
+	var response struct {
+		Gifts []giftRecord `json:"Gifts"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"code": code}, &response); err != nil {
+		return nil, err
+	}
+	if len(response.Gifts) == 0 {
+		return nil, nil
+	}
+	return &response.Gifts[0], nil
+}
+
+// GiftPurchaseHandler opens a checkout for a recipe bought on someone else's
+// behalf. The gift code is released to the buyer, and emailed to the
+// recipient if one was given, once the payment is confirmed.
+func GiftPurchaseHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req GiftPurchaseRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.RecipeID == "" {
+		http.Error(w, "recipe ID is required", http.StatusBadRequest)
+		return
+	}
+
+	recipientEmail := strings.TrimSpace(req.RecipientEmail)
+	if recipientEmail != "" {
+		address, err := mail.ParseAddress(recipientEmail)
+		if err != nil {
+			http.Error(w, "invalid recipient email", http.StatusBadRequest)
+			return
+		}
+		recipientEmail = address.Address
+	}
+	message := strings.TrimSpace(req.Message)
+	if utf8.RuneCountInString(message) > maxGiftMessageLength {
+		http.Error(w, fmt.Sprintf("message must be at most %d characters", maxGiftMessageLength), http.StatusBadRequest)
+		return
+	}
+
+	currency := strings.ToUpper(strings.TrimSpace(req.Currency))
+	if currency != "" && !supportedCurrencies[currency] {
+		http.Error(w, fmt.Sprintf("unsupported currency: %s. Supported currencies are: ETB, USD, EUR", currency), http.StatusBadRequest)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	// A retried request carrying the same Idempotency-Key gets the original
+	// checkout back instead of paying for a second gift.
+	idempotencyKey := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+	if idempotencyKey != "" {
+		existing, err := findGiftByIdempotencyKey(r.Context(), client, userID, idempotencyKey)
+		if err != nil {
+			log.Printf("Error looking up idempotency key: %v", err)
+			http.Error(w, "Error checking existing gifts", http.StatusInternalServerError)
+			return
+		}
+		if existing != nil {
+			if existing.RecipeID != req.RecipeID {
+				http.Error(w, "Idempotency-Key was already used for a different recipe", http.StatusUnprocessableEntity)
+				return
+			}
+			writeExistingGift(w, existing)
+			return
+		}
+	}
+
+	// Gifts are priced from the recipe itself, converted like a purchase;
+	// there is no client-supplied amount to trust. The rate is locked on the
+	// gift below.
+	pricing, err := priceRecipe(r.Context(), client, cfg, req.RecipeID, currency)
+	if err != nil {
+		writePricingError(w, err)
+		return
+	}
+	if pricing == nil {
+		http.Error(w, "Recipe not found", http.StatusNotFound)
+		return
+	}
+	recipe := pricing.recipe
+	amount, currency := pricing.Amount, pricing.Currency
+	if err := validateAmount(amount, currency); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	payoutAccount, err := getPayoutAccount(r.Context(), client, recipe.UserID)
+	if err != nil {
+		log.Printf("Error loading payout account: %v", err)
+		http.Error(w, "Error loading recipe author", http.StatusInternalServerError)
+		return
+	}
+	subaccountID, split := payoutRoute(cfg, payoutAccount, currency)
+
+	code, err := generateGiftCode()
+	if err != nil {
+		log.Printf("Error generating gift code: %v", err)
+		http.Error(w, "Error creating gift", http.StatusInternalServerError)
+		return
+	}
+
+	if _, ok := checkPaymentRisk(w, r, client, cfg, userID, "gift", amount, currency); !ok {
+		return
+	}
+
+	txRef := giftTxPrefix + uuid.New().String()
+	gift := map[string]interface{}{
+		"id":           uuid.New().String(),
+		"purchaser_id": userID,
+		"recipe_id":    recipe.ID,
+		"author_id":    recipe.UserID,
+		"amount":       amount,
+		"currency":     currency,
+		"status":       "pending",
+		"code":         code,
+		"tx_ref":       txRef,
+		"platform_fee": split.Fee(amount),
+	}
+	if recipientEmail != "" {
+		gift["recipient_email"] = recipientEmail
+	}
+	if message != "" {
+		gift["message"] = message
+	}
+	for column, value := range pricing.lockFields() {
+		gift[column] = value
+	}
+	for column, value := range splitFields(split) {
+		gift[column] = value
+	}
+	if idempotencyKey != "" {
+		gift["idempotency_key"] = idempotencyKey
+	}
+	if subaccountID != "" {
+		gift["subaccount_id"] = subaccountID
+	}
+
+	query := `
+		mutation CreateGift($object: Gifts_insert_input!) {
+			insert_Gifts_one(object: $object) {
+				id
+			}
+		}
+	`
+	var created struct {
+		InsertGiftsOne struct {
+			ID string `json:"id"`
+		} `json:"insert_Gifts_one"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"object": gift}, &created); err != nil {
+		if idempotencyKey != "" && hasura.IsUniqueViolation(err) {
+			// Lost the race to a concurrent request with the same key.
+			if existing, err := findGiftByIdempotencyKey(r.Context(), client, userID, idempotencyKey); err == nil && existing != nil {
+				writeExistingGift(w, existing)
+				return
+			}
+		}
+		log.Printf("Error creating gift: %v", err)
+		http.Error(w, "Error creating gift", http.StatusInternalServerError)
+		return
+	}
+
+	checkout, err := paymentProvider.Initiate(r.Context(), payments.InitiateRequest{
+		TxRef:       txRef,
+		Amount:      amount,
+		Currency:    currency,
+		Title:       "Recipe Gift",
+		Description: "Gift purchase of a recipe",
+		CallbackURL: cfg.ChapaCallbackURL,
+		ReturnURL:   cfg.ChapaReturnURL,
+
+		SubaccountID: subaccountID,
+		Split:        split,
+	})
+	if err != nil {
+		if _, err := updateGift(r.Context(), client, txRef, "pending", map[string]interface{}{"status": "failed"}); err != nil {
+			log.Printf("Error marking gift %s as failed: %v", txRef, err)
+		}
+		writeProviderError(w, err)
+		return
+	}
+
+	if _, err := updateGift(r.Context(), client, txRef, "pending", map[string]interface{}{"checkout_url": checkout.CheckoutURL}); err != nil {
+		log.Printf("Error storing gift checkout URL: %v", err)
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Gift checkout initiated", map[string]interface{}{
+		"giftId":       created.InsertGiftsOne.ID,
+		"checkout_url": checkout.CheckoutURL,
+		"tx_ref":       txRef,
+		"amount":       amount,
+		"currency":     currency,
+		"exchange":     pricing.conversion,
+	}))
+}
+
+// updateGift sets fields on the gift paid by txRef while it is still in
+// fromStatus, returning the updated gift if this call changed it.
+func updateGift(ctx context.Context, client *hasura.Client, txRef, fromStatus string, fields map[string]interface{}) (*giftRecord, error) {
+	query := `
+		mutation UpdateGift($tx_ref: String!, $from: String!, $fields: Gifts_set_input!) {
+			update_Gifts(where: {tx_ref: {_eq: $tx_ref}, status: {_eq: $from}}, _set: $fields) {
+				returning {` + giftFields + `}
+			}
+		}
+	`
+	variables := map[string]interface{}{
+		"tx_ref": txRef,
+		"from":   fromStatus,
+		"fields": fields,
+	}
+	var response struct {
+		UpdateGifts struct {
+			Returning []giftRecord `json:"returning"`
+		} `json:"update_Gifts"`
+	}
+	if err := client.Execute(ctx, query, variables, &response); err != nil {
+		return nil, err
+	}
+	if len(response.UpdateGifts.Returning) == 0 {
+		return nil, nil
+	}
+	return &response.UpdateGifts.Returning[0], nil
+}
+
+// applyGiftCharge applies a verified provider result to a gift. A paid gift
+// starts its validity period, credits the author and notifies the recipient.
+func applyGiftCharge(ctx context.Context, client *hasura.Client, cfg *config.Config, txRef, status string) error {
+	switch status {
+	case payments.StatusSuccess:
+		now := time.Now().UTC()
+		gift, err := updateGift(ctx, client, txRef, "pending", map[string]interface{}{
+			"status":     "paid",
+			"paid_at":    formatTimestamp(now),
+			"expires_at": formatTimestamp(now.Add(cfg.GiftCodeValidity)),
+		})
+		if err != nil {
+			return fmt.Errorf("error updating gift: %w", err)
+		}
+		if gift != nil {
+			recordGiftEarning(ctx, client, gift)
+			recordAudit(ctx, client, "", "gift.paid", "Gifts", gift.ID, nil)
+			if gift.RecipientEmail != nil {
+				sendGiftEmail(ctx, client, cfg, gift)
+			}
+		}
+	case payments.StatusFailed:
+		if _, err := updateGift(ctx, client, txRef, "pending", map[string]interface{}{"status": "failed"}); err != nil {
+			return fmt.Errorf("error updating gift: %w", err)
+		}
+	}
+	return nil
+}
+
+func recordGiftEarning(ctx context.Context, client *hasura.Client, gift *giftRecord) {
+	object := map[string]interface{}{
+		"author_id":    gift.AuthorID,
+		"gift_id":      gift.ID,
+		"type":         "sale",
+		"gross_amount": gift.Amount,
+		"platform_fee": gift.PlatformFee,
+		"net_amount":   roundMoney(gift.Amount - gift.PlatformFee),
+		"currency":     gift.Currency,
+	}
+	if gift.SubaccountID != nil {
+		object["subaccount_id"] = *gift.SubaccountID
+	}
+	insertEarning(ctx, client, object)
+}
+
+// sendGiftEmail delivers the code to the recipient. Failures are logged; the
+// buyer can still pass the code on from their gift list.
+func sendGiftEmail(ctx context.Context, client *hasura.Client, cfg *config.Config, gift *giftRecord) {
+	query := `
+		query GiftEmailDetails($recipe_id: uuid!, $purchaser_id: uuid!) {
+			Recipes_by_pk(id: $recipe_id) {
+				title
+			}
+			Users_by_pk(id: $purchaser_id) {
+				username
+			}
+		}
+	`
+	var response struct {
+		Recipe *struct {
+			Title string `json:"title"`
+		} `json:"Recipes_by_pk"`
+		User *struct {
+			Username string `json:"username"`
+		} `json:"Users_by_pk"`
+	}
+	variables := map[string]interface{}{"recipe_id": gift.RecipeID, "purchaser_id": gift.PurchaserID}
+	if err := client.Execute(ctx, query, variables, &response); err != nil {
+		log.Printf("Error loading gift %s email details: %v", gift.ID, err)
+		return
+	}
+
+	sender := "Someone"
+	if response.User != nil && response.User.Username != "" {
+		sender = response.User.Username
+	}
+	title := "a recipe"
+	if response.Recipe != nil {
+		title = fmt.Sprintf("%q", response.Recipe.Title)
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "%s sent you %s on Dishcovery.\n\n", sender, title)
+	if gift.Message != nil {
+		fmt.Fprintf(&body, "%s\n\n", *gift.Message)
+	}
+	fmt.Fprintf(&body, "Your gift code: %s\n", gift.Code)
+	if expiresAt, ok := parseTimestamp(gift.ExpiresAt); ok {
+		fmt.Fprintf(&body, "Redeem it before %s.\n", expiresAt.Format("2 January 2006"))
+	}
+
+	if err := newMailer(cfg).Send(*gift.RecipientEmail, "You received a recipe gift", body.String()); err != nil {
+		log.Printf("Error emailing gift %s: %v", gift.ID, err)
+	}
+}
+
+// RedeemGiftHandler exchanges a paid, unexpired gift code for access to its
+// recipe. The conditional update makes redemption one-time even when the
+// same code is submitted concurrently.
+func RedeemGiftHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req RedeemGiftRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	code := normalizeGiftCode(req.Code)
+	if code == "" {
+		http.Error(w, "gift code is required", http.StatusBadRequest)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	gift, err := getGiftByCode(r.Context(), client, code)
+	if err != nil {
+		log.Printf("Error loading gift: %v", err)
+		http.Error(w, "Error loading gift", http.StatusInternalServerError)
+		return
+	}
+	if gift == nil {
+		http.Error(w, "Gift code not found", http.StatusNotFound)
+		return
+	}
+	switch gift.Status {
+	case "paid":
+	case "redeemed":
+		http.Error(w, "Gift code has already been redeemed", http.StatusConflict)
+		return
+	default:
+		http.Error(w, "Gift code is not valid", http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC()
+	if expiresAt, ok := parseTimestamp(gift.ExpiresAt); !ok || !now.Before(expiresAt) {
+		http.Error(w, "Gift code has expired", http.StatusGone)
+		return
+	}
+
+	// Don't burn the code on someone who can already read the recipe.
+	decisions, err := resolveRecipeAccess(r.Context(), client, userID, role, []string{gift.RecipeID})
+	if err != nil {
+		log.Printf("Error checking recipe access: %v", err)
+		http.Error(w, "Error checking recipe access", http.StatusInternalServerError)
+		return
+	}
+	if len(decisions) == 1 && decisions[0].CanAccess {
+		http.Error(w, "You already have access to this recipe", http.StatusConflict)
+		return
+	}
+
+	query := `
+		mutation RedeemGift($id: uuid!, $user_id: uuid!, $now: timestamptz!) {
+			update_Gifts(where: {id: {_eq: $id}, status: {_eq: "paid"}, expires_at: {_gt: $now}}, _set: {status: "redeemed", redeemed_by: $user_id, redeemed_at: $now}) {
+				affected_rows
+			}
+		}
+	`
+	variables := map[string]interface{}{
+		"id":      gift.ID,
+		"user_id": userID,
+		"now":     formatTimestamp(now),
+	}
+	var response struct {
+		UpdateGifts struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_Gifts"`
+	}
+	if err := client.Execute(r.Context(), query, variables, &response); err != nil {
+		log.Printf("Error redeeming gift: %v", err)
+		http.Error(w, "Error redeeming gift", http.StatusInternalServerError)
+		return
+	}
+	if response.UpdateGifts.AffectedRows == 0 {
+		http.Error(w, "Gift code has already been redeemed", http.StatusConflict)
+		return
+	}
+
+	recordAudit(r.Context(), client, userID, "gift.redeemed", "Gifts", gift.ID, nil)
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Gift redeemed", map[string]interface{}{
+		"recipeId": gift.RecipeID,
+	}))
+}
+
+// MyGiftsHandler lists the gifts the caller has bought. Codes are only shown
+// once the gift is paid for.
+func MyGiftsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	query := `
+		query MyGifts($user_id: uuid!) {
+			Gifts(where: {purchaser_id: {_eq: $user_id}}, order_by: {created_at: desc}) {` + giftFields + `}
+		}
+	`
+	var response struct {
+		Gifts []giftRecord `json:"Gifts"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"user_id": userID}, &response); err != nil {
+		log.Printf("Error loading gifts: %v", err)
+		http.Error(w, "Error loading gifts", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range response.Gifts {
+		gift := &response.Gifts[i]
+		if gift.Status != "paid" && gift.Status != "redeemed" {
+			gift.Code = ""
+		}
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Gifts retrieved", response.Gifts))
+}
@@ -0,0 +1,317 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/config"
+	"backend/hasura"
+	"backend/images"
+	"backend/middleware"
+)
+
+// duplicateHashDistance is how many bits the perceptual hashes of two
+// images may differ by for them to count as the same picture. The indexed
+// hash bands find every upload this close.
+const duplicateHashDistance = 3
+
+const (
+	maxDuplicateCandidates  = 50
+	maxDuplicateFlagsListed = 200
+)
+
+const reviewConfirmed = "confirmed"
+
+type ListImageDuplicatesRequest struct {
+	// IncludeReviewed also lists flags a moderator has already reviewed.
+	IncludeReviewed bool `json:"includeReviewed"`
+}
+
+type ReviewImageDuplicateRequest struct {
+	FlagID  string `json:"flagId"`
+	Outcome string `json:"outcome"`
+	Note    string `json:"note"`
+}
+
+type imageDuplicateFlag struct {
+	ID               string        `json:"id"`
+	UploadID         string        `json:"upload_id"`
+	OriginalUploadID string        `json:"original_upload_id"`
+	Distance         int           `json:"distance"`
+	CreatedAt        string        `json:"created_at"`
+	ReviewedBy       *string       `json:"reviewed_by"`
+	ReviewedAt       *string       `json:"reviewed_at"`
+	ReviewOutcome    *string       `json:"review_outcome"`
+	ReviewNote       *string       `json:"review_note"`
+	Upload           *uploadRecord `json:"upload,omitempty"`
+	OriginalUpload   *uploadRecord `json:"original_upload,omitempty"`
+}
+
+const imageDuplicateFlagFields = `
+	id
+	upload_id
+	original_upload_id
+	distance
+	created_at
+	reviewed_by
+	reviewed_at
+	review_outcome
+	review_note
+`
+
+// similarUpload is an earlier upload whose hash is within
+// duplicateHashDistance of a new image's.
+type similarUpload struct {
+	uploadRecord
+	Distance int
+}
+
+// findSimilarUploads returns the uploads, of any user, that look like the
+// image with hash, oldest first. Candidates share a hash band with it.
+func findSimilarUploads(ctx context.Context, client *hasura.Client, hash images.Hash) ([]similarUpload, error) {
+	var bands []map[string]interface{}
+	for i, band := range hash.Bands() {
+		bands = append(bands, map[string]interface{}{
+			fmt.Sprintf("phash_band%d", i): map[string]interface{}{"_eq": band},
+		})
+	}
+	query := `
+		query SimilarUploads($where: Uploads_bool_exp!, $limit: Int!) {
+			Uploads(where: $where, order_by: {created_at: asc}, limit: $limit) {` + uploadFields + `}
+		}
+	`
+	var response struct {
+		Uploads []uploadRecord `json:"Uploads"`
+	}
+	variables := map[string]interface{}{
+		"where": map[string]interface{}{"_or": bands},
+		"limit": maxDuplicateCandidates,
+	}
+	if err := client.Execute(ctx, query, variables, &response); err != nil {
+		return nil, err
+	}
+
+	var similar []similarUpload
+	for _, upload := range response.Uploads {
+		if upload.Phash == nil {
+			continue
+		}
+		other, err := images.ParseHash(*upload.Phash)
+		if err != nil {
+			continue
+		}
+		if distance := hash.Distance(other); distance <= duplicateHashDistance {
+			similar = append(similar, similarUpload{uploadRecord: upload, Distance: distance})
+		}
+	}
+	return similar, nil
+}
+
+// closestUploadOf returns the user's upload that is most like the image,
+// the oldest of equally close ones, or nil.
+func closestUploadOf(similar []similarUpload, userID string) *similarUpload {
+	var closest *similarUpload
+	for i := range similar {
+		if similar[i].UserID == userID && (closest == nil || similar[i].Distance < closest.Distance) {
+			closest = &similar[i]
+		}
+	}
+	return closest
+}
+
+// reuseUpload answers an upload with an existing one.
+func reuseUpload(result *imageUploadResult, upload *similarUpload) {
+	result.URL = upload.URL
+	result.Key = upload.Key
+	result.ContentType = upload.ContentType
+	result.Bytes = upload.Bytes
+	result.Width = upload.Width
+	result.Height = upload.Height
+	result.Variants = upload.Variants
+	result.Placeholder = upload.Placeholder
+	result.Reused = true
+}
+
+// flagDuplicateUploads flags a new upload for moderation when it looks like
+// another user's, against the oldest such upload, which is most likely the
+// original. The upload itself has succeeded, so failures are only logged.
+func flagDuplicateUploads(ctx context.Context, client *hasura.Client, uploadID, userID string, similar []similarUpload) {
+	var original *similarUpload
+	for i := range similar {
+		if similar[i].UserID != userID {
+			original = &similar[i]
+			break
+		}
+	}
+	if original == nil {
+		return
+	}
+
+	query := `
+		mutation FlagImageDuplicate($object: ImageDuplicateFlags_insert_input!) {
+			insert_ImageDuplicateFlags_one(
+				object: $object,
+				on_conflict: {constraint: ImageDuplicateFlags_upload_id_original_upload_id_key, update_columns: []}
+			) {
+				id
+			}
+		}
+	`
+	object := map[string]interface{}{
+		"upload_id":          uploadID,
+		"original_upload_id": original.ID,
+		"distance":           original.Distance,
+	}
+	var response struct {
+		Flag *struct {
+			ID string `json:"id"`
+		} `json:"insert_ImageDuplicateFlags_one"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"object": object}, &response); err != nil {
+		log.Printf("Error flagging upload %s as a duplicate of %s: %v", uploadID, original.ID, err)
+		return
+	}
+	log.Printf("Flagged upload %s as a near-duplicate of upload %s by another user", uploadID, original.ID)
+}
+
+// loadFlaggedUploads fills in both uploads of each flag.
+func loadFlaggedUploads(ctx context.Context, client *hasura.Client, flags []imageDuplicateFlag) error {
+	var ids []string
+	for _, flag := range flags {
+		ids = append(ids, flag.UploadID, flag.OriginalUploadID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	query := `
+		query FlaggedUploads($ids: [uuid!]!) {
+			Uploads(where: {id: {_in: $ids}}) {` + uploadFields + `}
+		}
+	`
+	var response struct {
+		Uploads []uploadRecord `json:"Uploads"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"ids": ids}, &response); err != nil {
+		return err
+	}
+	uploads := make(map[string]*uploadRecord, len(response.Uploads))
+	for i := range response.Uploads {
+		uploads[response.Uploads[i].ID] = &response.Uploads[i]
+	}
+	for i := range flags {
+		flags[i].Upload = uploads[flags[i].UploadID]
+		flags[i].OriginalUpload = uploads[flags[i].OriginalUploadID]
+	}
+	return nil
+}
+
+// ListImageDuplicatesHandler lists uploads flagged as copies of another
+// user's image, newest first, for moderators.
+func ListImageDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	_, role := requestUser(r)
+	if role != middleware.RoleAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var req ListImageDuplicatesRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	where := map[string]interface{}{}
+	if !req.IncludeReviewed {
+		where["reviewed_at"] = map[string]interface{}{"_is_null": true}
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	query := `
+		query ListImageDuplicates($where: ImageDuplicateFlags_bool_exp!, $limit: Int!) {
+			ImageDuplicateFlags(where: $where, order_by: {created_at: desc}, limit: $limit) {` + imageDuplicateFlagFields + `}
+		}
+	`
+	var response struct {
+		Flags []imageDuplicateFlag `json:"ImageDuplicateFlags"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"where": where, "limit": maxDuplicateFlagsListed}, &response); err != nil {
+		log.Printf("Error listing image duplicates: %v", err)
+		http.Error(w, "Error listing image duplicates", http.StatusInternalServerError)
+		return
+	}
+	if err := loadFlaggedUploads(r.Context(), client, response.Flags); err != nil {
+		log.Printf("Error loading flagged uploads: %v", err)
+		http.Error(w, "Error listing image duplicates", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Image duplicates retrieved", response.Flags))
+}
+
+// ReviewImageDuplicateHandler records a moderator's verdict on a flag:
+// dismissed when the images are not a copy, or may legitimately be shared,
+// and confirmed when they are.
+func ReviewImageDuplicateHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role := requestUser(r)
+	if role != middleware.RoleAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var req ReviewImageDuplicateRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.FlagID == "" {
+		http.Error(w, "flag ID is required", http.StatusBadRequest)
+		return
+	}
+	if req.Outcome != reviewDismissed && req.Outcome != reviewConfirmed {
+		http.Error(w, "outcome must be dismissed or confirmed", http.StatusBadRequest)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	fields := map[string]interface{}{
+		"reviewed_by":    userID,
+		"reviewed_at":    formatTimestamp(time.Now().UTC()),
+		"review_outcome": req.Outcome,
+	}
+	if note := strings.TrimSpace(req.Note); note != "" {
+		fields["review_note"] = note
+	}
+	query := `
+		mutation ReviewImageDuplicate($id: uuid!, $set: ImageDuplicateFlags_set_input!) {
+			update_ImageDuplicateFlags_by_pk(pk_columns: {id: $id}, _set: $set) {` + imageDuplicateFlagFields + `}
+		}
+	`
+	var response struct {
+		Flag *imageDuplicateFlag `json:"update_ImageDuplicateFlags_by_pk"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"id": req.FlagID, "set": fields}, &response); err != nil {
+		log.Printf("Error reviewing image duplicate: %v", err)
+		http.Error(w, "Error reviewing image duplicate", http.StatusInternalServerError)
+		return
+	}
+	if response.Flag == nil {
+		http.Error(w, "Flag not found", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(r.Context(), client, userID, "image_duplicate.reviewed", "ImageDuplicateFlags", response.Flag.ID, map[string]interface{}{
+		"outcome":            req.Outcome,
+		"upload_id":          response.Flag.UploadID,
+		"original_upload_id": response.Flag.OriginalUploadID,
+	})
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Image duplicate reviewed", response.Flag))
+}
@@ -2,29 +2,43 @@
 package controllers
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
-	"os"
 	"strings"
+	"time"
 
 	"backend/config"
 	"backend/hasura"
 	"backend/middleware"
+	"backend/payments"
 
 	"github.com/google/uuid"
 )
 
 const (
-	chapaURL     = "https://api.chapa.co/v1/transaction/initialize"
 	minAmountETB = 5.0 // Minimum amount in ETB
 	minAmountUSD = 0.5 // Minimum amount in USD
 	minAmountEUR = 0.5 // Minimum amount in EUR
+
+	// pendingPurchaseTTL is how long an initiated checkout is handed back to
+	// repeated requests before a fresh transaction is started.
+	pendingPurchaseTTL = 30 * time.Minute
 )
 
+// paymentProvider processes every payment; main installs it at startup.
+var paymentProvider payments.PaymentProvider
+
+// SetPaymentProvider installs the provider used by the payment handlers.
+func SetPaymentProvider(provider payments.PaymentProvider) {
+	paymentProvider = provider
+}
+
 var supportedCurrencies = map[string]bool{
 	"ETB": true,
 	"USD": true,
@@ -32,17 +46,10 @@ var supportedCurrencies = map[string]bool{
 }
 
 type PaymentRequest struct {
-	RecipeID string  `json:"recipeId"`
-	Amount   float64 `json:"amount"`
-	Currency string  `json:"currency"`
-}
-
-type ChapaResponse struct {
-	Status string `json:"status"`
-	Data   struct {
-		CheckoutURL string `json:"checkout_url"`
-	} `json:"data"`
-	Message interface{} `json:"message"`
+	RecipeID   string  `json:"recipeId"`
+	Amount     float64 `json:"amount"`
+	Currency   string  `json:"currency"`
+	CouponCode string  `json:"couponCode,omitempty"`
 }
 
 func validatePaymentRequest(req PaymentRequest) error {
@@ -52,8 +59,10 @@ func validatePaymentRequest(req PaymentRequest) error {
 		return fmt.Errorf("recipe ID is required")
 	}
 
-	if req.Amount <= 0 {
-		return fmt.Errorf("amount must be greater than 0")
+	// The price is worked out on the server; an amount sent by the client is
+	// only compared against it.
+	if req.Amount < 0 {
+		return fmt.Errorf("amount must not be negative")
 	}
 
 	if req.Currency == "" {
@@ -65,29 +74,237 @@ func validatePaymentRequest(req PaymentRequest) error {
 		return fmt.Errorf("unsupported currency: %s. Supported currencies are: ETB, USD, EUR", currency)
 	}
 
-	return validateAmount(req.Amount, currency)
+	return nil
 }
 
 func validateAmount(amount float64, currency string) error {
+	minimum := minimumAmount(currency)
+	if minimum == 0 {
+		return fmt.Errorf("unsupported currency: %s", currency)
+	}
+	if amount < minimum {
+		return fmt.Errorf("minimum amount for %s is %.2f", currency, minimum)
+	}
+	return nil
+}
+
+// minimumAmount returns the smallest charge accepted in currency, or zero
+// for unsupported currencies.
+func minimumAmount(currency string) float64 {
 	switch currency {
 	case "ETB":
-		if amount < minAmountETB {
-			return fmt.Errorf("minimum amount for ETB is %.2f", minAmountETB)
-		}
+		return minAmountETB
 	case "USD":
-		if amount < minAmountUSD {
-			return fmt.Errorf("minimum amount for USD is %.2f", minAmountUSD)
-		}
+		return minAmountUSD
 	case "EUR":
-		if amount < minAmountEUR {
-			return fmt.Errorf("minimum amount for EUR is %.2f", minAmountEUR)
-		}
+		return minAmountEUR
 	default:
-		return fmt.Errorf("unsupported currency: %s", currency)
+		return 0
+	}
+}
+
+// purchaseRecord is the subset of a Purchases row needed to hand an
+// in-flight checkout back to the client. chapa_tx_id holds our tx_ref for
+// whichever provider processed the payment.
+type purchaseRecord struct {
+	ID             string  `json:"id"`
+	UserID         string  `json:"user_id"`
+	RecipeID       string  `json:"recipe_id"`
+	AuthorID       *string `json:"author_id"`
+	SubaccountID   *string `json:"subaccount_id"`
+	PlatformFee    float64 `json:"platform_fee"`
+	ChapaTxID      string  `json:"chapa_tx_id"`
+	Amount         float64 `json:"amount"`
+	RefundedAmount float64 `json:"refunded_amount"`
+	Currency       string  `json:"currency"`
+	Status         string  `json:"status"`
+	CheckoutURL    *string `json:"checkout_url"`
+}
+
+const purchaseFields = `
+	id
+	user_id
+	recipe_id
+	author_id
+	subaccount_id
+	platform_fee
+	chapa_tx_id
+	amount
+	refunded_amount
+	currency
+	status
+	checkout_url
+`
+
+// getPurchase loads a purchase by ID, returning nil if it does not exist.
+func getPurchase(ctx context.Context, client *hasura.Client, purchaseID string) (*purchaseRecord, error) {
+	query := `
+		query GetPurchase($id: uuid!) {
+			Purchases_by_pk(id: $id) {` + purchaseFields + `}
+		}
+	`
+
+	var response struct {
+		Purchase *purchaseRecord `json:"Purchases_by_pk"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"id": purchaseID}, &response); err != nil {
+		return nil, err
 	}
+	return response.Purchase, nil
+}
+
+// getRecipeAuthorID returns the ID of the user who published a recipe, or an
+// empty string if the recipe does not exist.
+func getRecipeAuthorID(ctx context.Context, client *hasura.Client, recipeID string) (string, error) {
+	query := `
+		query GetRecipeAuthor($id: uuid!) {
+			Recipes_by_pk(id: $id) {
+				user_id
+			}
+		}
+	`
+
+	var response struct {
+		Recipe *struct {
+			UserID string `json:"user_id"`
+		} `json:"Recipes_by_pk"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"id": recipeID}, &response); err != nil {
+		return "", err
+	}
+	if response.Recipe == nil {
+		return "", nil
+	}
+	return response.Recipe.UserID, nil
+}
+
+// roundMoney rounds an amount to whole cents.
+func roundMoney(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// liveIdempotencyStatuses are the purchase statuses that keep hold of their
+// Idempotency-Key; a failed or expired purchase releases it.
+var liveIdempotencyStatuses = []string{"pending", "review", "completed"}
+
+// findPurchaseByIdempotencyKey returns the live purchase a user previously
+// created with the given Idempotency-Key header, or nil if there is none. A
+// key whose purchase failed or expired can be used again, so the user can
+// retry; an expired checkout is retired first.
+func findPurchaseByIdempotencyKey(ctx context.Context, client *hasura.Client, userID, key string) (*purchaseRecord, error) {
+	err := expirePendingPurchases(ctx, client, map[string]interface{}{
+		"user_id":         map[string]interface{}{"_eq": userID},
+		"idempotency_key": map[string]interface{}{"_eq": key},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		query PurchaseByIdempotencyKey($user_id: uuid!, $key: String!, $statuses: [String!]!) {
+			Purchases(where: {user_id: {_eq: $user_id}, idempotency_key: {_eq: $key}, status: {_in: $statuses}}, limit: 1) {` + purchaseFields + `}
+		}
+	`
+
+	var response struct {
+		Purchases []purchaseRecord `json:"Purchases"`
+	}
+	variables := map[string]interface{}{"user_id": userID, "key": key, "statuses": liveIdempotencyStatuses}
+	if err := client.Execute(ctx, query, variables, &response); err != nil {
+		return nil, err
+	}
+	if len(response.Purchases) == 0 {
+		return nil, nil
+	}
+	return &response.Purchases[0], nil
+}
+
+// findPendingPurchase returns the user's unexpired pending purchase of a
+// recipe, or nil if there is none. Pending purchases whose checkout has
+// expired are marked as such first so they no longer block a new one.
+func findPendingPurchase(ctx context.Context, client *hasura.Client, userID, recipeID string) (*purchaseRecord, error) {
+	err := expirePendingPurchases(ctx, client, map[string]interface{}{
+		"user_id":   map[string]interface{}{"_eq": userID},
+		"recipe_id": map[string]interface{}{"_eq": recipeID},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		query PendingPurchase($user_id: uuid!, $recipe_id: uuid!) {
+			Purchases(where: {user_id: {_eq: $user_id}, recipe_id: {_eq: $recipe_id}, status: {_eq: "pending"}}, limit: 1) {` + purchaseFields + `}
+		}
+	`
+	variables := map[string]interface{}{
+		"user_id":   userID,
+		"recipe_id": recipeID,
+	}
+
+	var response struct {
+		Purchases []purchaseRecord `json:"Purchases"`
+	}
+	if err := client.Execute(ctx, query, variables, &response); err != nil {
+		return nil, err
+	}
+	if len(response.Purchases) == 0 {
+		return nil, nil
+	}
+	return &response.Purchases[0], nil
+}
+
+// expirePendingPurchases marks the pending purchases matching where whose
+// checkout has expired as such, releasing their coupons.
+func expirePendingPurchases(ctx context.Context, client *hasura.Client, where map[string]interface{}) error {
+	query := `
+		mutation ExpirePendingPurchases($where: Purchases_bool_exp!) {
+			update_Purchases(where: $where, _set: {status: "expired"}) {
+				returning {
+					id
+				}
+			}
+		}
+	`
+	where["status"] = map[string]interface{}{"_eq": "pending"}
+	where["expires_at"] = map[string]interface{}{"_lte": time.Now().UTC().Format(time.RFC3339)}
+
+	var expired struct {
+		UpdatePurchases struct {
+			Returning []struct {
+				ID string `json:"id"`
+			} `json:"returning"`
+		} `json:"update_Purchases"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"where": where}, &expired); err != nil {
+		return err
+	}
+	var expiredIDs []string
+	for _, purchase := range expired.UpdatePurchases.Returning {
+		expiredIDs = append(expiredIDs, purchase.ID)
+	}
+	releaseCouponRedemptions(ctx, client, expiredIDs)
 	return nil
 }
 
+// writeExistingPurchase answers a repeated initiation with the checkout that
+// is already in flight. A purchase without a checkout URL is still waiting on
+// the provider in another request, so the client is told to retry shortly.
+func writeExistingPurchase(w http.ResponseWriter, purchase *purchaseRecord) {
+	if purchase.Status == "review" {
+		http.Error(w, "This payment is being reviewed", http.StatusConflict)
+		return
+	}
+	if purchase.CheckoutURL == nil || *purchase.CheckoutURL == "" {
+		http.Error(w, "Payment initiation already in progress, retry shortly", http.StatusConflict)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Payment already initiated", map[string]interface{}{
+		"checkout_url": *purchase.CheckoutURL,
+		"tx_ref":       purchase.ChapaTxID,
+	}))
+}
+
 func PaymentInitHandler(w http.ResponseWriter, r *http.Request) {
 	// Get user ID from JWT token
 	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
@@ -123,88 +340,90 @@ func PaymentInitHandler(w http.ResponseWriter, r *http.Request) {
 	// Normalize currency to uppercase
 	currency := strings.ToUpper(paymentReq.Currency)
 
-	// Generate transaction reference
-	txRef := uuid.New().String()
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
 
-	// Prepare Chapa request
-	chapaPayload := map[string]interface{}{
-		"amount":       paymentReq.Amount,
-		"currency":     currency,
-		"tx_ref":       txRef,
-		"callback_url": os.Getenv("CHAPA_CALLBACK_URL"),
-		"return_url":   os.Getenv("CHAPA_RETURN_URL"),
-		"customization": map[string]interface{}{
-			"title":       "Recipe Purchase",
-			"description": "Payment for recipe purchase",
-		},
+	// A retried request carrying the same Idempotency-Key gets the original
+	// checkout back, whatever state the recipe's other purchases are in.
+	idempotencyKey := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+	if idempotencyKey != "" {
+		existing, err := findPurchaseByIdempotencyKey(r.Context(), client, userID, idempotencyKey)
+		if err != nil {
+			log.Printf("Error looking up idempotency key: %v", err)
+			http.Error(w, "Error checking existing purchases", http.StatusInternalServerError)
+			return
+		}
+		if existing != nil {
+			if existing.RecipeID != paymentReq.RecipeID {
+				http.Error(w, "Idempotency-Key was already used for a different recipe", http.StatusUnprocessableEntity)
+				return
+			}
+			writeExistingPurchase(w, existing)
+			return
+		}
 	}
 
-	chapaPayloadBytes, err := json.Marshal(chapaPayload)
+	// Independently of the header, never open a second checkout while one
+	// for the same recipe is still payable.
+	existing, err := findPendingPurchase(r.Context(), client, userID, paymentReq.RecipeID)
 	if err != nil {
-		http.Error(w, "Error preparing Chapa request", http.StatusInternalServerError)
+		log.Printf("Error looking up pending purchase: %v", err)
+		http.Error(w, "Error checking existing purchases", http.StatusInternalServerError)
+		return
+	}
+	if existing != nil {
+		writeExistingPurchase(w, existing)
 		return
 	}
 
-	// Get Chapa API key from config
-	cfg := config.LoadConfig()
-	chapaReq, err := http.NewRequest("POST", chapaURL, bytes.NewBuffer(chapaPayloadBytes))
+	// Price the recipe in the buyer's currency at the current rate; the rate
+	// is locked on the purchase below.
+	pricing, err := priceRecipe(r.Context(), client, cfg, paymentReq.RecipeID, currency)
 	if err != nil {
-		http.Error(w, "Error creating Chapa request", http.StatusInternalServerError)
+		writePricingError(w, err)
+		return
+	}
+	if pricing == nil {
+		http.Error(w, "Recipe not found", http.StatusNotFound)
+		return
+	}
+	if paymentReq.Amount > 0 && math.Abs(paymentReq.Amount-pricing.Amount) >= 0.01 {
+		http.Error(w, fmt.Sprintf("the price of this recipe is now %.2f %s", pricing.Amount, currency), http.StatusConflict)
+		return
+	}
+	if err := validateAmount(pricing.Amount, currency); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	chapaReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", cfg.ChapaSecretKey))
-	chapaReq.Header.Set("Content-Type", "application/json")
-
-	// Log the request for debugging
-	log.Printf("Making Chapa request with payload: %s", string(chapaPayloadBytes))
-
-	chapaClient := &http.Client{}
-	chapaResp, err := chapaClient.Do(chapaReq)
+	// Route the author's share to their payout account when they have one;
+	// the sale is credited to their ledger either way.
+	authorID := pricing.recipe.UserID
+	payoutAccount, err := getPayoutAccount(r.Context(), client, authorID)
 	if err != nil {
-		http.Error(w, "Error making payment request to Chapa", http.StatusInternalServerError)
+		log.Printf("Error loading payout account: %v", err)
+		http.Error(w, "Error loading recipe author", http.StatusInternalServerError)
 		return
 	}
-	defer chapaResp.Body.Close()
-
-	// Log the response status and body for debugging
-	bodyBytes, _ := io.ReadAll(chapaResp.Body)
-	log.Printf("Chapa response status: %d", chapaResp.StatusCode)
-	log.Printf("Chapa response body: %s", string(bodyBytes))
-
-	if chapaResp.StatusCode != http.StatusOK {
-		var errorResp ChapaResponse
-		if err := json.Unmarshal(bodyBytes, &errorResp); err == nil {
-			if errorMessage, ok := errorResp.Message.(map[string]interface{}); ok {
-				// Format validation errors nicely
-				var formattedErrors []string
-				for field, errors := range errorMessage {
-					if errorList, ok := errors.([]interface{}); ok {
-						for _, err := range errorList {
-							formattedErrors = append(formattedErrors, fmt.Sprintf("%s: %v", field, err))
-						}
-					}
-				}
-				if len(formattedErrors) > 0 {
-					http.Error(w, fmt.Sprintf("Chapa validation errors: %s", strings.Join(formattedErrors, ", ")), http.StatusBadRequest)
-					return
-				}
-			}
-		}
-		http.Error(w, fmt.Sprintf("Received non-200 response from Chapa: %s", string(bodyBytes)), http.StatusInternalServerError)
+	subaccountID, split := payoutRoute(cfg, payoutAccount, currency)
+
+	quote, err := quotePrice(r.Context(), client, userID, paymentReq.RecipeID, authorID, pricing.Amount, currency, paymentReq.CouponCode)
+	if err != nil {
+		writeQuoteError(w, err)
 		return
 	}
 
-	// Create a new reader for the response body since we've already read it
-	var chapaResponse ChapaResponse
-	if err := json.Unmarshal(bodyBytes, &chapaResponse); err != nil {
-		http.Error(w, "Error decoding Chapa response", http.StatusInternalServerError)
+	risk, ok := checkPaymentRisk(w, r, client, cfg, userID, "purchase", quote.FinalAmount, currency)
+	if !ok {
 		return
 	}
 
-	// Create purchase record in Hasura
-	client := hasura.NewClient(cfg)
+	// Generate transaction reference
+	txRef := uuid.New().String()
 
+	// Reserve the purchase before talking to the provider so that a concurrent
+	// request trips the pending/idempotency unique indexes instead of
+	// creating a second transaction.
 	query := `
 		mutation CreatePurchase($object: Purchases_insert_input!) {
 			insert_Purchases_one(object: $object) {
@@ -218,89 +437,350 @@ func PaymentInitHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	`
 
+	purchaseID := uuid.New().String()
+	object := map[string]interface{}{
+		"id":              purchaseID,
+		"user_id":         userID,
+		"recipe_id":       paymentReq.RecipeID,
+		"chapa_tx_id":     txRef,
+		"amount":          quote.FinalAmount,
+		"original_amount": quote.OriginalAmount,
+		"discount_amount": quote.DiscountAmount,
+		"currency":        currency,
+		"status":          "pending",
+		"expires_at":      time.Now().Add(pendingPurchaseTTL).UTC().Format(time.RFC3339),
+		"author_id":       authorID,
+		"platform_fee":    split.Fee(quote.FinalAmount),
+		"created_at":      "now()",
+	}
+	for column, value := range pricing.lockFields() {
+		object[column] = value
+	}
+	for column, value := range splitFields(split) {
+		object[column] = value
+	}
+	for column, value := range risk.lockFields() {
+		object[column] = value
+	}
+	if quote.coupon != nil {
+		object["coupon_id"] = quote.coupon.ID
+	}
+	if idempotencyKey != "" {
+		object["idempotency_key"] = idempotencyKey
+	}
+	if subaccountID != "" {
+		object["subaccount_id"] = subaccountID
+	}
 	variables := map[string]interface{}{
-		"object": map[string]interface{}{
-			"id":          uuid.New().String(),
-			"user_id":     userID,
-			"recipe_id":   paymentReq.RecipeID,
-			"chapa_tx_id": txRef,
-			"amount":      int(paymentReq.Amount),
-			"created_at":  "now()",
-		},
+		"object": object,
 	}
 
 	var response struct {
 		InsertPurchasesOne struct {
-			ID        string `json:"id"`
-			UserID    string `json:"user_id"`
-			RecipeID  string `json:"recipe_id"`
-			ChapaTxID string `json:"chapa_tx_id"`
-			Amount    int    `json:"amount"`
-			CreatedAt string `json:"created_at"`
+			ID        string  `json:"id"`
+			UserID    string  `json:"user_id"`
+			RecipeID  string  `json:"recipe_id"`
+			ChapaTxID string  `json:"chapa_tx_id"`
+			Amount    float64 `json:"amount"`
+			CreatedAt string  `json:"created_at"`
 		} `json:"insert_Purchases_one"`
 	}
 
 	if err := client.Execute(r.Context(), query, variables, &response); err != nil {
+		if hasura.IsUniqueViolation(err) {
+			// Lost the race to a concurrent request; answer with its purchase.
+			if idempotencyKey != "" {
+				existing, err = findPurchaseByIdempotencyKey(r.Context(), client, userID, idempotencyKey)
+			} else {
+				existing, err = findPendingPurchase(r.Context(), client, userID, paymentReq.RecipeID)
+			}
+			if err == nil && existing != nil {
+				writeExistingPurchase(w, existing)
+				return
+			}
+		}
 		log.Printf("Error creating purchase record: %v", err)
 		http.Error(w, "Error creating purchase record", http.StatusInternalServerError)
 		return
 	}
 
+	if quote.coupon != nil {
+		if err := reserveCouponRedemption(r.Context(), client, quote, userID, purchaseID); err != nil {
+			if err := setPurchaseFields(r.Context(), client, purchaseID, map[string]interface{}{"status": "failed"}); err != nil {
+				log.Printf("Error marking purchase %s as failed: %v", purchaseID, err)
+			}
+			writeQuoteError(w, err)
+			return
+		}
+	}
+
+	// A fully discounted recipe is granted without involving the provider.
+	if quote.FinalAmount == 0 {
+		if err := setPurchaseFields(r.Context(), client, purchaseID, map[string]interface{}{"status": "completed"}); err != nil {
+			log.Printf("Error completing free purchase %s: %v", purchaseID, err)
+			releaseCouponRedemptions(r.Context(), client, []string{purchaseID})
+			http.Error(w, "Error updating purchase record", http.StatusInternalServerError)
+			return
+		}
+		completeCouponRedemption(r.Context(), client, purchaseID)
+		if purchase, err := getPurchase(r.Context(), client, purchaseID); err != nil || purchase == nil {
+			log.Printf("Error loading free purchase %s for its receipt: %v", purchaseID, err)
+		} else {
+			issueReceipt(r.Context(), client, cfg, purchase)
+		}
+
+		json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Purchase completed", map[string]interface{}{
+			"checkout_url": "",
+			"tx_ref":       txRef,
+			"status":       "completed",
+			"price":        quote,
+			"exchange":     pricing.conversion,
+		}))
+		return
+	}
+
+	checkout, err := paymentProvider.Initiate(r.Context(), payments.InitiateRequest{
+		TxRef:       txRef,
+		Amount:      quote.FinalAmount,
+		Currency:    currency,
+		Title:       "Recipe Purchase",
+		Description: "Payment for recipe purchase",
+		CallbackURL: cfg.ChapaCallbackURL,
+		ReturnURL:   cfg.ChapaReturnURL,
+
+		SubaccountID: subaccountID,
+		Split:        split,
+	})
+	if err != nil {
+		// Release the reservation so the user can try again straight away.
+		if err := setPurchaseFields(r.Context(), client, purchaseID, map[string]interface{}{"status": "failed"}); err != nil {
+			log.Printf("Error marking purchase %s as failed: %v", purchaseID, err)
+		}
+		releaseCouponRedemptions(r.Context(), client, []string{purchaseID})
+		writeProviderError(w, err)
+		return
+	}
+	checkoutURL := checkout.CheckoutURL
+
+	if err := setPurchaseFields(r.Context(), client, purchaseID, map[string]interface{}{"checkout_url": checkoutURL}); err != nil {
+		log.Printf("Error storing checkout URL: %v", err)
+		http.Error(w, "Error updating purchase record", http.StatusInternalServerError)
+		return
+	}
+
 	// Return response in Hasura Action format
 	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Payment initiated", map[string]interface{}{
-		"checkout_url": chapaResponse.Data.CheckoutURL,
+		"checkout_url": checkoutURL,
 		"tx_ref":       txRef,
+		"status":       "pending",
+		"price":        quote,
+		"exchange":     pricing.conversion,
 	}))
 }
 
+// setPurchaseFields updates columns of a single purchase by ID.
+func setPurchaseFields(ctx context.Context, client *hasura.Client, purchaseID string, fields map[string]interface{}) error {
+	query := `
+		mutation UpdatePurchaseByID($id: uuid!, $set: Purchases_set_input!) {
+			update_Purchases_by_pk(pk_columns: {id: $id}, _set: $set) {
+				id
+			}
+		}
+	`
+
+	var response struct {
+		UpdatePurchasesByPk *struct {
+			ID string `json:"id"`
+		} `json:"update_Purchases_by_pk"`
+	}
+	return client.Execute(ctx, query, map[string]interface{}{"id": purchaseID, "set": fields}, &response)
+}
+
+// writeProviderError reports a failed provider call, distinguishing requests
+// the provider rejected from provider outages.
+func writeProviderError(w http.ResponseWriter, err error) {
+	var validationErr *payments.ValidationError
+	if errors.As(err, &validationErr) {
+		http.Error(w, validationErr.Message, http.StatusBadRequest)
+		return
+	}
+	log.Printf("Payment provider error: %v", err)
+	http.Error(w, "Error communicating with payment provider", http.StatusBadGateway)
+}
+
+// PaymentWebhookHandler receives notifications from the payment provider. It
+// is mounted without JWT auth; authenticity comes from the provider's
+// signature, and every charge is re-verified before its status is applied.
 func PaymentWebhookHandler(w http.ResponseWriter, r *http.Request) {
-	var payload map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+	event, err := paymentProvider.ParseWebhook(r)
+	if err != nil {
+		if errors.Is(err, payments.ErrInvalidSignature) {
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("Error parsing webhook: %v", err)
 		http.Error(w, "Invalid payload", http.StatusBadRequest)
 		return
 	}
 
-	// Verify event type
-	event, _ := payload["event"].(string)
-	if event != "charge.completed" {
-		http.Error(w, "Invalid event", http.StatusBadRequest)
+	log.Printf("Received %s webhook for %s with status %s", event.Type, event.TxRef, event.Status)
+
+	if event.Type == payments.EventRefund {
+		handleRefundWebhook(w, r, event)
 		return
 	}
 
-	// Extract transaction data
-	data := payload["data"].(map[string]interface{})
-	status := data["status"].(string)
-	txRef := data["tx_ref"].(string)
+	if event.Type != payments.EventCharge {
+		// Acknowledge events we do not act on so the provider stops retrying.
+		json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Webhook ignored", nil))
+		return
+	}
 
-	if status == "success" {
-		// Update purchase status in Hasura
-		cfg := config.LoadConfig()
-		client := hasura.NewClient(cfg)
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
 
-		query := `
-			mutation UpdatePurchase($tx_ref: String!) {
-				update_purchases(where: {chapa_tx_id: {_eq: $tx_ref}}, _set: {status: "completed"}) {
-					affected_rows
-				}
-			}
-		`
+	charge, err := loadStoredCharge(r.Context(), client, event.TxRef)
+	if err != nil {
+		log.Printf("Error loading stored charge %s: %v", event.TxRef, err)
+		http.Error(w, "Error updating payment status", http.StatusInternalServerError)
+		return
+	}
+	if charge == nil {
+		log.Printf("Ignoring webhook for unknown transaction %s", event.TxRef)
+		json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Webhook ignored", nil))
+		return
+	}
 
-		variables := map[string]interface{}{
-			"tx_ref": txRef,
+	// The event itself is only a hint: whatever it says, the outcome is
+	// taken from the provider.
+	tx, mismatch, err := verifyCharge(r.Context(), charge)
+	if err != nil {
+		log.Printf("Error verifying transaction %s: %v", event.TxRef, err)
+		http.Error(w, "Error verifying transaction", http.StatusBadGateway)
+		return
+	}
+	status := tx.Status
+
+	// A charge that does not match what was priced is held for review
+	// rather than granting access.
+	if status == payments.StatusSuccess && mismatch != nil {
+		if err := holdChargeForReview(r.Context(), client, charge, tx, discrepancyKinds(mismatch)); err != nil {
+			log.Printf("Error recording discrepancy for %s: %v", event.TxRef, err)
+			http.Error(w, "Error updating payment status", http.StatusInternalServerError)
+			return
 		}
+		json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Webhook processed", nil))
+		return
+	}
 
-		var response struct {
-			UpdatePurchases struct {
-				AffectedRows int `json:"affected_rows"`
-			} `json:"update_purchases"`
-		}
+	if err := applyChargeResult(r.Context(), client, cfg, event.TxRef, status); err != nil {
+		log.Printf("Error applying %s result for %s: %v", status, event.TxRef, err)
+		http.Error(w, "Error updating payment status", http.StatusInternalServerError)
+		return
+	}
 
-		if err := client.Execute(r.Context(), query, variables, &response); err != nil {
-			log.Printf("Error updating purchase status: %v", err)
-			http.Error(w, "Error updating purchase status", http.StatusInternalServerError)
-			return
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Webhook processed", nil))
+}
+
+// chargeKind is what a transaction paid for.
+type chargeKind int
+
+const (
+	purchaseCharge chargeKind = iota
+	subscriptionCharge
+	tipCharge
+	giftCharge
+)
+
+// chargeKindOf identifies what txRef paid for from its prefix.
+func chargeKindOf(txRef string) chargeKind {
+	switch {
+	case isSubscriptionTxRef(txRef):
+		return subscriptionCharge
+	case isTipTxRef(txRef):
+		return tipCharge
+	case isGiftTxRef(txRef):
+		return giftCharge
+	default:
+		return purchaseCharge
+	}
+}
+
+// applyChargeResult applies a provider's verdict on a transaction to
+// whatever it paid for. It is shared by the webhook and the reconciler, and
+// is safe to repeat.
+func applyChargeResult(ctx context.Context, client *hasura.Client, cfg *config.Config, txRef, status string) error {
+	switch chargeKindOf(txRef) {
+	case subscriptionCharge:
+		return applySubscriptionCharge(ctx, client, txRef, status)
+	case tipCharge:
+		return applyTipCharge(ctx, client, txRef, status)
+	case giftCharge:
+		return applyGiftCharge(ctx, client, cfg, txRef, status)
+	default:
+		return applyPurchaseCharge(ctx, client, cfg, txRef, status)
+	}
+}
+
+// applyPurchaseCharge completes or fails the purchases paid by txRef.
+func applyPurchaseCharge(ctx context.Context, client *hasura.Client, cfg *config.Config, txRef, status string) error {
+	var purchaseStatus string
+	switch status {
+	case payments.StatusSuccess:
+		purchaseStatus = "completed"
+	case payments.StatusFailed:
+		purchaseStatus = "failed"
+	default:
+		return nil
+	}
+
+	// A late success still completes an expired checkout: the money was taken.
+	// Cart orders share one tx_ref across their purchases, so every row
+	// paid by the transaction moves together.
+	query := `
+		mutation UpdatePurchase($tx_ref: String!, $status: String!) {
+			update_Purchases(where: {chapa_tx_id: {_eq: $tx_ref}, status: {_in: ["pending", "expired"]}}, _set: {status: $status}) {
+				returning {` + purchaseFields + `}
+			}
+			update_Orders(where: {tx_ref: {_eq: $tx_ref}, status: {_in: ["pending", "expired"]}}, _set: {status: $status}) {
+				affected_rows
+			}
 		}
+	`
+
+	variables := map[string]interface{}{
+		"tx_ref": txRef,
+		"status": purchaseStatus,
 	}
 
-	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Webhook processed", nil))
+	var response struct {
+		UpdatePurchases struct {
+			Returning []purchaseRecord `json:"returning"`
+		} `json:"update_Purchases"`
+	}
+
+	if err := client.Execute(ctx, query, variables, &response); err != nil {
+		return fmt.Errorf("error updating purchase status: %w", err)
+	}
+
+	// Only the delivery that moved a purchase acts on it, so authors are
+	// credited once however often the webhook is retried.
+	var changedIDs []string
+	for i := range response.UpdatePurchases.Returning {
+		purchase := &response.UpdatePurchases.Returning[i]
+		changedIDs = append(changedIDs, purchase.ID)
+		if purchaseStatus == "completed" {
+			completeCouponRedemption(ctx, client, purchase.ID)
+			recordSaleEarning(ctx, client, purchase)
+			issueReceipt(ctx, client, cfg, purchase)
+		}
+	}
+	switch purchaseStatus {
+	case "completed":
+		// Expiry released the coupon uses of purchases a late payment revived.
+		reclaimCouponRedemptions(ctx, client, changedIDs)
+	case "failed":
+		releaseCouponRedemptions(ctx, client, changedIDs)
+	}
+	return nil
 }
@@ -0,0 +1,284 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"backend/config"
+	"backend/hasura"
+	"backend/payments"
+)
+
+var operationName = regexp.MustCompile(`(?:query|mutation)\s+(\w+)`)
+
+// graphqlCall is one request a fakeHasura received.
+type graphqlCall struct {
+	Operation string
+	Query     string
+	Variables map[string]interface{}
+}
+
+// fakeHasura serves GraphQL requests with answer, which returns the data
+// for an operation, and records every call. Handlers that load their own
+// config reach it through HASURA_ENDPOINT set to endpoint.
+type fakeHasura struct {
+	endpoint string
+
+	mu     sync.Mutex
+	calls  []graphqlCall
+	answer func(call graphqlCall) interface{}
+}
+
+func newFakeHasura(t *testing.T, answer func(call graphqlCall) interface{}) (*fakeHasura, *hasura.Client) {
+	t.Helper()
+	fake := &fakeHasura{answer: answer}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Query     string                 `json:"query"`
+			Variables map[string]interface{} `json:"variables"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		call := graphqlCall{Query: body.Query, Variables: body.Variables}
+		if m := operationName.FindStringSubmatch(body.Query); m != nil {
+			call.Operation = m[1]
+		}
+		fake.mu.Lock()
+		fake.calls = append(fake.calls, call)
+		fake.mu.Unlock()
+		data := fake.answer(call)
+		if data == nil {
+			data = map[string]interface{}{}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	t.Cleanup(server.Close)
+	fake.endpoint = server.URL
+	return fake, hasura.NewClient(&config.Config{HasuraEndpoint: server.URL})
+}
+
+// operations lists the operations called, in order.
+func (f *fakeHasura) operations() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for _, call := range f.calls {
+		names = append(names, call.Operation)
+	}
+	return names
+}
+
+func (f *fakeHasura) call(operation string) *graphqlCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.calls {
+		if f.calls[i].Operation == operation {
+			return &f.calls[i]
+		}
+	}
+	return nil
+}
+
+// purchaseRow is a purchase held by fakePurchases.
+type purchaseRow struct {
+	ID        string
+	Status    string
+	ExpiresAt time.Time
+}
+
+// fakePurchases answers the idempotency lookup from rows, applying the
+// expiry update and the status filter the way Hasura would.
+func fakePurchases(rows []*purchaseRow) func(call graphqlCall) interface{} {
+	return func(call graphqlCall) interface{} {
+		switch call.Operation {
+		case "ExpirePendingPurchases":
+			where := call.Variables["where"].(map[string]interface{})
+			status := where["status"].(map[string]interface{})["_eq"].(string)
+			cutoff, _ := time.Parse(time.RFC3339, where["expires_at"].(map[string]interface{})["_lte"].(string))
+			var returning []interface{}
+			for _, row := range rows {
+				if row.Status == status && !row.ExpiresAt.After(cutoff) {
+					row.Status = "expired"
+					returning = append(returning, map[string]interface{}{"id": row.ID})
+				}
+			}
+			return map[string]interface{}{"update_Purchases": map[string]interface{}{"returning": returning}}
+		case "PurchaseByIdempotencyKey":
+			var purchases []interface{}
+			for _, row := range rows {
+				for _, status := range call.Variables["statuses"].([]interface{}) {
+					if row.Status == status {
+						purchases = append(purchases, map[string]interface{}{"id": row.ID, "status": row.Status})
+					}
+				}
+			}
+			if len(purchases) > 1 {
+				purchases = purchases[:1]
+			}
+			return map[string]interface{}{"Purchases": purchases}
+		}
+		return nil
+	}
+}
+
+func TestFindPurchaseByIdempotencyKey(t *testing.T) {
+	later := time.Now().Add(time.Hour)
+	earlier := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name      string
+		purchases []*purchaseRow
+		want      string
+	}{
+		{"unused key", nil, ""},
+		{"live purchase", []*purchaseRow{{ID: "p1", Status: "pending", ExpiresAt: later}}, "p1"},
+		{"completed purchase", []*purchaseRow{{ID: "p1", Status: "completed", ExpiresAt: earlier}}, "p1"},
+		{"purchase under review", []*purchaseRow{{ID: "p1", Status: "review", ExpiresAt: earlier}}, "p1"},
+		{"failed purchase", []*purchaseRow{{ID: "p1", Status: "failed", ExpiresAt: later}}, ""},
+		{"expired purchase", []*purchaseRow{{ID: "p1", Status: "expired", ExpiresAt: earlier}}, ""},
+		{"checkout past its expiry", []*purchaseRow{{ID: "p1", Status: "pending", ExpiresAt: earlier}}, ""},
+		{"retry after failure", []*purchaseRow{
+			{ID: "p1", Status: "failed", ExpiresAt: later},
+			{ID: "p2", Status: "expired", ExpiresAt: earlier},
+			{ID: "p3", Status: "pending", ExpiresAt: later},
+		}, "p3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, client := newFakeHasura(t, fakePurchases(tt.purchases))
+			purchase, err := findPurchaseByIdempotencyKey(t.Context(), client, "u1", "key-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if purchase != nil {
+				got = purchase.ID
+			}
+			if got != tt.want {
+				t.Errorf("purchase = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteExistingPurchase(t *testing.T) {
+	url := "https://checkout.example.com/pay/1"
+	empty := ""
+	tests := []struct {
+		name     string
+		purchase purchaseRecord
+		status   int
+	}{
+		{"checkout ready", purchaseRecord{Status: "pending", CheckoutURL: &url, ChapaTxID: "tx-1"}, http.StatusOK},
+		{"completed", purchaseRecord{Status: "completed", CheckoutURL: &url, ChapaTxID: "tx-1"}, http.StatusOK},
+		{"under review", purchaseRecord{Status: "review", CheckoutURL: &url}, http.StatusConflict},
+		{"initiation in flight", purchaseRecord{Status: "pending"}, http.StatusConflict},
+		{"empty checkout URL", purchaseRecord{Status: "pending", CheckoutURL: &empty}, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeExistingPurchase(w, &tt.purchase)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var response struct {
+				Data map[string]string `json:"data"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Data["checkout_url"] != url || response.Data["tx_ref"] != "tx-1" {
+				t.Errorf("data = %v, want the existing checkout", response.Data)
+			}
+		})
+	}
+}
+
+func TestChargeKindOf(t *testing.T) {
+	tests := []struct {
+		txRef string
+		want  chargeKind
+	}{
+		{"sub-1", subscriptionCharge},
+		{"tip-1", tipCharge},
+		{"gift-1", giftCharge},
+		{"tx-1", purchaseCharge},
+		{"recipe-sub-1", purchaseCharge},
+		{"", purchaseCharge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.txRef, func(t *testing.T) {
+			if got := chargeKindOf(tt.txRef); got != tt.want {
+				t.Errorf("chargeKindOf(%q) = %v, want %v", tt.txRef, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPaymentWebhookHandler(t *testing.T) {
+	provider := payments.NewFakeProvider("", "secret", 0)
+	previous := paymentProvider
+	SetPaymentProvider(provider)
+	defer SetPaymentProvider(previous)
+
+	signed := func(body string) map[string]string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(body))
+		return map[string]string{"x-chapa-signature": hex.EncodeToString(mac.Sum(nil))}
+	}
+	// Only tx-1 is on record; the provider knows neither transaction.
+	fake, _ := newFakeHasura(t, func(call graphqlCall) interface{} {
+		if call.Operation == "StoredCharge" && call.Variables["tx_ref"] == "tx-1" {
+			return map[string]interface{}{"Purchases": []map[string]interface{}{
+				{"tx_ref": "tx-1", "amount": 100, "currency": "ETB", "status": "pending", "created_at": "2026-01-01T00:00:00Z"},
+			}}
+		}
+		return nil
+	})
+	t.Setenv("HASURA_ENDPOINT", fake.endpoint)
+
+	charge := `{"event":"charge.success","tx_ref":"tx-1","status":"success"}`
+	unknown := `{"event":"charge.success","tx_ref":"tx-unknown","status":"success"}`
+	payout := `{"event":"payout.success","tx_ref":"po-1","status":"success"}`
+	tests := []struct {
+		name    string
+		body    string
+		headers map[string]string
+		status  int
+	}{
+		{"unsigned", charge, nil, http.StatusUnauthorized},
+		{"forged", charge, map[string]string{"x-chapa-signature": strings.Repeat("0", 64)}, http.StatusUnauthorized},
+		{"invalid payload", `{"event":`, signed(`{"event":`), http.StatusBadRequest},
+		{"ignored event", payout, signed(payout), http.StatusOK},
+		{"unknown charge", unknown, signed(unknown), http.StatusOK},
+		// The charge is verified with the provider, which does not know it.
+		{"unverifiable charge", charge, signed(charge), http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/webhooks/payment", strings.NewReader(tt.body))
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			PaymentWebhookHandler(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
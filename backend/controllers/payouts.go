@@ -0,0 +1,364 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"backend/config"
+	"backend/hasura"
+	"backend/payments"
+)
+
+type PayoutAccountRequest struct {
+	BusinessName  string `json:"businessName"`
+	AccountName   string `json:"accountName"`
+	BankCode      string `json:"bankCode"`
+	AccountNumber string `json:"accountNumber"`
+}
+
+type payoutAccountRecord struct {
+	ID                 string   `json:"id"`
+	Provider           string   `json:"provider"`
+	SubaccountID       string   `json:"subaccount_id"`
+	BusinessName       string   `json:"business_name"`
+	AccountName        string   `json:"account_name"`
+	BankCode           string   `json:"bank_code"`
+	AccountNumberLast4 string   `json:"account_number_last4"`
+	SplitType          *string  `json:"split_type"`
+	SplitValue         *float64 `json:"split_value"`
+	SplitCurrency      *string  `json:"split_currency"`
+}
+
+const payoutAccountFields = `
+	id
+	provider
+	subaccount_id
+	business_name
+	account_name
+	bank_code
+	account_number_last4
+	split_type
+	split_value
+	split_currency
+`
+
+// subaccountCurrency is the currency of authors' payout accounts, which are
+// Ethiopian bank accounts; a flat commission is registered in it.
+const subaccountCurrency = "ETB"
+
+// earningRecord is one line of an author's earnings ledger.
+type earningRecord struct {
+	ID          string  `json:"id"`
+	PurchaseID  *string `json:"purchase_id"`
+	RefundID    *string `json:"refund_id"`
+	TipID       *string `json:"tip_id"`
+	GiftID      *string `json:"gift_id"`
+	Type        string  `json:"type"`
+	GrossAmount float64 `json:"gross_amount"`
+	PlatformFee float64 `json:"platform_fee"`
+	NetAmount   float64 `json:"net_amount"`
+	Currency    string  `json:"currency"`
+	CreatedAt   string  `json:"created_at"`
+}
+
+// platformSplit is the commission the platform currently keeps on a sale
+// in currency.
+func platformSplit(cfg *config.Config, currency string) payments.Split {
+	if strings.ToLower(cfg.PlatformCommissionType) == payments.SplitFlat {
+		return payments.Split{Type: payments.SplitFlat, Value: cfg.PlatformCommissionFlat[currency]}
+	}
+	return payments.Split{Type: payments.SplitPercentage, Value: cfg.PlatformCommissionValue}
+}
+
+// payoutRoute decides where an author's share of a payment in currency
+// goes: to their subaccount when they have one with the current provider,
+// and to the platform otherwise. A payment to a subaccount keeps the split
+// the subaccount was registered with, so the ledger matches what the
+// provider settles; a flat split only carries over to payments in its own
+// currency.
+func payoutRoute(cfg *config.Config, account *payoutAccountRecord, currency string) (string, payments.Split) {
+	if account == nil || account.Provider != paymentProvider.Name() {
+		return "", platformSplit(cfg, currency)
+	}
+	if account.SplitType != nil && account.SplitValue != nil {
+		split := payments.Split{Type: *account.SplitType, Value: *account.SplitValue}
+		if split.Type != payments.SplitFlat || (account.SplitCurrency != nil && *account.SplitCurrency == currency) {
+			return account.SubaccountID, split
+		}
+	}
+	return account.SubaccountID, platformSplit(cfg, currency)
+}
+
+// splitFields are the columns recording the split sent to the provider with
+// a charge.
+func splitFields(split payments.Split) map[string]interface{} {
+	return map[string]interface{}{
+		"split_type":  split.Type,
+		"split_value": split.Value,
+	}
+}
+
+// getPayoutAccount returns an author's registered payout account, or nil if
+// they have not registered one.
+func getPayoutAccount(ctx context.Context, client *hasura.Client, userID string) (*payoutAccountRecord, error) {
+	query := `
+		query GetPayoutAccount($user_id: uuid!) {
+			AuthorPayoutAccounts(where: {user_id: {_eq: $user_id}}, limit: 1) {` + payoutAccountFields + `}
+		}
+	`
+
+	var response struct {
+		Accounts []payoutAccountRecord `json:"AuthorPayoutAccounts"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"user_id": userID}, &response); err != nil {
+		return nil, err
+	}
+	if len(response.Accounts) == 0 {
+		return nil, nil
+	}
+	return &response.Accounts[0], nil
+}
+
+// RegisterPayoutAccountHandler registers the caller's bank details with the
+// payment provider as a subaccount so their share of each sale is paid out
+// automatically. Registering again replaces the previous account.
+func RegisterPayoutAccountHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req PayoutAccountRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.AccountNumber = strings.ReplaceAll(req.AccountNumber, " ", "")
+	if req.AccountName == "" || req.BankCode == "" || len(req.AccountNumber) < 4 {
+		http.Error(w, "account name, bank code and account number are required", http.StatusBadRequest)
+		return
+	}
+	if req.BusinessName == "" {
+		req.BusinessName = req.AccountName
+	}
+
+	subaccounts, ok := paymentProvider.(payments.SubaccountProvider)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Payment provider %s does not support payouts", paymentProvider.Name()), http.StatusNotImplemented)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	split := platformSplit(cfg, subaccountCurrency)
+	subaccountID, err := subaccounts.CreateSubaccount(r.Context(), payments.Subaccount{
+		BusinessName:  req.BusinessName,
+		AccountName:   req.AccountName,
+		BankCode:      req.BankCode,
+		AccountNumber: req.AccountNumber,
+		Split:         split,
+	})
+	if err != nil {
+		writeProviderError(w, err)
+		return
+	}
+
+	query := `
+		mutation UpsertPayoutAccount($object: AuthorPayoutAccounts_insert_input!) {
+			insert_AuthorPayoutAccounts_one(
+				object: $object,
+				on_conflict: {
+					constraint: AuthorPayoutAccounts_user_id_key,
+					update_columns: [provider, subaccount_id, business_name, account_name, bank_code, account_number_last4, split_type, split_value, split_currency, updated_at]
+				}
+			) {` + payoutAccountFields + `}
+		}
+	`
+
+	account := map[string]interface{}{
+		"user_id":              userID,
+		"provider":             paymentProvider.Name(),
+		"subaccount_id":        subaccountID,
+		"business_name":        req.BusinessName,
+		"account_name":         req.AccountName,
+		"bank_code":            req.BankCode,
+		"account_number_last4": req.AccountNumber[len(req.AccountNumber)-4:],
+		"split_type":           split.Type,
+		"split_value":          split.Value,
+		"split_currency":       nil,
+		"updated_at":           "now()",
+	}
+	if split.Type == payments.SplitFlat {
+		account["split_currency"] = subaccountCurrency
+	}
+	variables := map[string]interface{}{
+		"object": account,
+	}
+
+	var response struct {
+		Account payoutAccountRecord `json:"insert_AuthorPayoutAccounts_one"`
+	}
+	if err := client.Execute(r.Context(), query, variables, &response); err != nil {
+		log.Printf("Error saving payout account: %v", err)
+		http.Error(w, "Error saving payout account", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r.Context(), client, userID, "payout_account.registered", "AuthorPayoutAccounts", response.Account.ID, map[string]interface{}{
+		"provider":      response.Account.Provider,
+		"subaccount_id": subaccountID,
+	})
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Payout account registered", response.Account))
+}
+
+// insertEarning appends an entry to an author's ledger. The unique indexes on
+// purchase, refund, tip and gift make repeated webhook deliveries harmless.
+func insertEarning(ctx context.Context, client *hasura.Client, object map[string]interface{}) {
+	query := `
+		mutation RecordEarning($object: AuthorEarnings_insert_input!) {
+			insert_AuthorEarnings_one(object: $object) {
+				id
+			}
+		}
+	`
+
+	var response struct {
+		InsertAuthorEarningsOne struct {
+			ID string `json:"id"`
+		} `json:"insert_AuthorEarnings_one"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"object": object}, &response); err != nil && !hasura.IsUniqueViolation(err) {
+		log.Printf("Error recording %s earning: %v", object["type"], err)
+	}
+}
+
+// recordSaleEarning credits the author of a completed purchase with the
+// sale, net of the platform fee fixed at checkout.
+func recordSaleEarning(ctx context.Context, client *hasura.Client, purchase *purchaseRecord) {
+	if purchase.AuthorID == nil {
+		return
+	}
+
+	object := map[string]interface{}{
+		"author_id":    *purchase.AuthorID,
+		"purchase_id":  purchase.ID,
+		"type":         "sale",
+		"gross_amount": purchase.Amount,
+		"platform_fee": purchase.PlatformFee,
+		"net_amount":   roundMoney(purchase.Amount - purchase.PlatformFee),
+		"currency":     purchase.Currency,
+	}
+	if purchase.SubaccountID != nil {
+		object["subaccount_id"] = *purchase.SubaccountID
+	}
+	insertEarning(ctx, client, object)
+}
+
+// recordRefundEarning debits the author for a completed refund. The platform
+// fee is returned in proportion to the share of the purchase refunded.
+func recordRefundEarning(ctx context.Context, client *hasura.Client, refund refundRecord) {
+	purchase, err := getPurchase(ctx, client, refund.PurchaseID)
+	if err != nil {
+		log.Printf("Error loading purchase %s for refund earning: %v", refund.PurchaseID, err)
+		return
+	}
+	if purchase == nil || purchase.AuthorID == nil || purchase.Amount <= 0 {
+		return
+	}
+
+	fee := roundMoney(purchase.PlatformFee * refund.Amount / purchase.Amount)
+	object := map[string]interface{}{
+		"author_id":    *purchase.AuthorID,
+		"purchase_id":  purchase.ID,
+		"refund_id":    refund.ID,
+		"type":         "refund",
+		"gross_amount": -refund.Amount,
+		"platform_fee": -fee,
+		"net_amount":   -roundMoney(refund.Amount - fee),
+		"currency":     refund.Currency,
+	}
+	if purchase.SubaccountID != nil {
+		object["subaccount_id"] = *purchase.SubaccountID
+	}
+	insertEarning(ctx, client, object)
+}
+
+// EarningsHandler returns the caller's earnings ledger, covering sales,
+// refunds and tips, with totals per currency.
+func EarningsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	query := `
+		query AuthorEarnings($author_id: uuid!) {
+			AuthorEarnings(where: {author_id: {_eq: $author_id}}, order_by: {created_at: desc}) {
+				id
+				purchase_id
+				refund_id
+				tip_id
+				gift_id
+				type
+				gross_amount
+				platform_fee
+				net_amount
+				currency
+				created_at
+			}
+		}
+	`
+
+	var response struct {
+		Earnings []earningRecord `json:"AuthorEarnings"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"author_id": userID}, &response); err != nil {
+		log.Printf("Error loading earnings: %v", err)
+		http.Error(w, "Error loading earnings", http.StatusInternalServerError)
+		return
+	}
+
+	type currencyTotal struct {
+		Currency    string  `json:"currency"`
+		Gross       float64 `json:"gross"`
+		PlatformFee float64 `json:"platformFee"`
+		Net         float64 `json:"net"`
+		Tips        float64 `json:"tips"`
+	}
+	totals := make(map[string]*currencyTotal)
+	var order []string
+	for _, entry := range response.Earnings {
+		total, ok := totals[entry.Currency]
+		if !ok {
+			total = &currencyTotal{Currency: entry.Currency}
+			totals[entry.Currency] = total
+			order = append(order, entry.Currency)
+		}
+		total.Gross = roundMoney(total.Gross + entry.GrossAmount)
+		total.PlatformFee = roundMoney(total.PlatformFee + entry.PlatformFee)
+		total.Net = roundMoney(total.Net + entry.NetAmount)
+		if entry.Type == "tip" {
+			total.Tips = roundMoney(total.Tips + entry.NetAmount)
+		}
+	}
+	summary := make([]currencyTotal, 0, len(order))
+	for _, currency := range order {
+		summary = append(summary, *totals[currency])
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Earnings retrieved", map[string]interface{}{
+		"totals":  summary,
+		"entries": response.Earnings,
+	}))
+}
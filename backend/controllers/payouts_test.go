@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"testing"
+
+	"backend/config"
+	"backend/payments"
+)
+
+func TestPayoutRoute(t *testing.T) {
+	previous := paymentProvider
+	SetPaymentProvider(payments.NewFakeProvider("", "secret", 0))
+	defer SetPaymentProvider(previous)
+
+	cfg := &config.Config{
+		PlatformCommissionType:  payments.SplitPercentage,
+		PlatformCommissionValue: 10,
+	}
+	flatCfg := &config.Config{
+		PlatformCommissionType: "FLAT",
+		PlatformCommissionFlat: map[string]float64{"ETB": 10, "USD": 0.25},
+	}
+	str := func(s string) *string { return &s }
+	num := func(f float64) *float64 { return &f }
+
+	tests := []struct {
+		name       string
+		cfg        *config.Config
+		account    *payoutAccountRecord
+		currency   string
+		subaccount string
+		split      payments.Split
+	}{
+		{"no account", cfg, nil, "ETB", "", payments.Split{Type: payments.SplitPercentage, Value: 10}},
+		{"no account, flat platform fee", flatCfg, nil, "USD", "", payments.Split{Type: payments.SplitFlat, Value: 0.25}},
+		{"flat platform fee in an unpriced currency", flatCfg, nil, "EUR", "", payments.Split{Type: payments.SplitFlat, Value: 0}},
+		{"account with another provider", cfg,
+			&payoutAccountRecord{Provider: "chapa", SubaccountID: "sa-1"},
+			"ETB", "", payments.Split{Type: payments.SplitPercentage, Value: 10}},
+		{"account without a recorded split", cfg,
+			&payoutAccountRecord{Provider: "fake", SubaccountID: "sa-1"},
+			"ETB", "sa-1", payments.Split{Type: payments.SplitPercentage, Value: 10}},
+		{"account percentage split", cfg,
+			&payoutAccountRecord{Provider: "fake", SubaccountID: "sa-1", SplitType: str(payments.SplitPercentage), SplitValue: num(5)},
+			"USD", "sa-1", payments.Split{Type: payments.SplitPercentage, Value: 5}},
+		{"account flat split in its currency", cfg,
+			&payoutAccountRecord{Provider: "fake", SubaccountID: "sa-1", SplitType: str(payments.SplitFlat), SplitValue: num(20), SplitCurrency: str("ETB")},
+			"ETB", "sa-1", payments.Split{Type: payments.SplitFlat, Value: 20}},
+		{"account flat split in another currency", flatCfg,
+			&payoutAccountRecord{Provider: "fake", SubaccountID: "sa-1", SplitType: str(payments.SplitFlat), SplitValue: num(20), SplitCurrency: str("ETB")},
+			"USD", "sa-1", payments.Split{Type: payments.SplitFlat, Value: 0.25}},
+		{"account flat split without a currency", cfg,
+			&payoutAccountRecord{Provider: "fake", SubaccountID: "sa-1", SplitType: str(payments.SplitFlat), SplitValue: num(20)},
+			"ETB", "sa-1", payments.Split{Type: payments.SplitPercentage, Value: 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subaccount, split := payoutRoute(tt.cfg, tt.account, tt.currency)
+			if subaccount != tt.subaccount || split != tt.split {
+				t.Errorf("payoutRoute() = %q, %+v; want %q, %+v", subaccount, split, tt.subaccount, tt.split)
+			}
+		})
+	}
+}
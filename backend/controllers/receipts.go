@@ -0,0 +1,434 @@
+package controllers
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/config"
+	"backend/hasura"
+	"backend/middleware"
+	"backend/receipts"
+
+	"github.com/gorilla/mux"
+)
+
+type receiptRecord struct {
+	ID            string  `json:"id"`
+	PurchaseID    string  `json:"purchase_id"`
+	InvoiceNumber int64   `json:"invoice_number"`
+	InvoicePrefix string  `json:"invoice_prefix"`
+	Issuer        string  `json:"issuer"`
+	IssuerTaxID   *string `json:"issuer_tax_id"`
+	BuyerID       string  `json:"buyer_id"`
+	AuthorID      *string `json:"author_id"`
+	BuyerName     string  `json:"buyer_name"`
+	BuyerEmail    string  `json:"buyer_email"`
+	RecipeTitle   string  `json:"recipe_title"`
+	AuthorName    string  `json:"author_name"`
+	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
+	VATLabel      string  `json:"vat_label"`
+	VATRate       float64 `json:"vat_rate"`
+	VATAmount     float64 `json:"vat_amount"`
+	TxRef         string  `json:"tx_ref"`
+	PurchasedAt   string  `json:"purchased_at"`
+	IssuedAt      string  `json:"issued_at"`
+	EmailedAt     *string `json:"emailed_at"`
+}
+
+const receiptFields = `
+	id
+	purchase_id
+	invoice_number
+	invoice_prefix
+	issuer
+	issuer_tax_id
+	buyer_id
+	author_id
+	buyer_name
+	buyer_email
+	recipe_title
+	author_name
+	amount
+	currency
+	vat_label
+	vat_rate
+	vat_amount
+	tx_ref
+	purchased_at
+	issued_at
+	emailed_at
+`
+
+func (rec *receiptRecord) invoice() string {
+	return fmt.Sprintf("%s-%06d", rec.InvoicePrefix, rec.InvoiceNumber)
+}
+
+func (rec *receiptRecord) render() []byte {
+	issuedAt, _ := parseTimestamp(&rec.IssuedAt)
+	purchasedAt, _ := parseTimestamp(&rec.PurchasedAt)
+	receipt := receipts.Receipt{
+		InvoiceNumber: rec.invoice(),
+		IssuedAt:      issuedAt,
+		Issuer:        rec.Issuer,
+		BuyerName:     rec.BuyerName,
+		BuyerEmail:    rec.BuyerEmail,
+		RecipeTitle:   rec.RecipeTitle,
+		AuthorName:    rec.AuthorName,
+		Amount:        rec.Amount,
+		Currency:      rec.Currency,
+		VATLabel:      rec.VATLabel,
+		VATRate:       rec.VATRate,
+		VATAmount:     rec.VATAmount,
+		TxRef:         rec.TxRef,
+		PurchaseDate:  purchasedAt,
+	}
+	if rec.IssuerTaxID != nil {
+		receipt.IssuerTaxID = *rec.IssuerTaxID
+	}
+	return receipts.Render(receipt)
+}
+
+// receiptBackfillBatchSize bounds how many missing receipts one pass of
+// the backfill job issues.
+const receiptBackfillBatchSize = 50
+
+// issueReceipt records a receipt for a newly completed purchase, stores its
+// PDF and emails it to the buyer. Failures are logged, as the purchase
+// itself has already succeeded; the backfill job issues the receipt later.
+func issueReceipt(ctx context.Context, client *hasura.Client, cfg *config.Config, purchase *purchaseRecord) {
+	if _, err := ensureReceipt(ctx, client, cfg, purchase); err != nil {
+		log.Printf("Error issuing receipt for purchase %s: %v", purchase.ID, err)
+	}
+}
+
+// getReceipt returns the receipt of a purchase, or nil if none was issued.
+func getReceipt(ctx context.Context, client *hasura.Client, purchaseID string) (*receiptRecord, error) {
+	query := `
+		query ReceiptByPurchase($purchase_id: uuid!) {
+			Receipts(where: {purchase_id: {_eq: $purchase_id}}) {` + receiptFields + `}
+		}
+	`
+	var response struct {
+		Receipts []receiptRecord `json:"Receipts"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"purchase_id": purchaseID}, &response); err != nil {
+		return nil, err
+	}
+	if len(response.Receipts) == 0 {
+		return nil, nil
+	}
+	return &response.Receipts[0], nil
+}
+
+// ensureReceipt returns the receipt of a paid purchase, issuing it first if
+// there is none. It is safe to call any number of times: the unique
+// purchase_id turns a concurrent second issue into a lookup, and the
+// invoice counter only advances for the receipt that is kept.
+func ensureReceipt(ctx context.Context, client *hasura.Client, cfg *config.Config, purchase *purchaseRecord) (*receiptRecord, error) {
+	if existing, err := getReceipt(ctx, client, purchase.ID); err != nil || existing != nil {
+		return existing, err
+	}
+
+	authorID := ""
+	if purchase.AuthorID != nil {
+		authorID = *purchase.AuthorID
+	} else {
+		var err error
+		if authorID, err = getRecipeAuthorID(ctx, client, purchase.RecipeID); err != nil {
+			return nil, fmt.Errorf("error loading author: %w", err)
+		}
+	}
+
+	query := `
+		query ReceiptDetails($purchase_id: uuid!, $recipe_id: uuid!, $buyer_id: uuid!, $author_id: uuid!) {
+			Purchases_by_pk(id: $purchase_id) {
+				created_at
+			}
+			Recipes_by_pk(id: $recipe_id) {
+				title
+			}
+			buyer: Users_by_pk(id: $buyer_id) {
+				username
+				email
+			}
+			author: Users_by_pk(id: $author_id) {
+				username
+			}
+		}
+	`
+	variables := map[string]interface{}{
+		"purchase_id": purchase.ID,
+		"recipe_id":   purchase.RecipeID,
+		"buyer_id":    purchase.UserID,
+		"author_id":   authorID,
+	}
+	var details struct {
+		Purchase *struct {
+			CreatedAt string `json:"created_at"`
+		} `json:"Purchases_by_pk"`
+		Recipe *struct {
+			Title string `json:"title"`
+		} `json:"Recipes_by_pk"`
+		Buyer *struct {
+			Username string `json:"username"`
+			Email    string `json:"email"`
+		} `json:"buyer"`
+		Author *struct {
+			Username string `json:"username"`
+		} `json:"author"`
+	}
+	if err := client.Execute(ctx, query, variables, &details); err != nil {
+		return nil, fmt.Errorf("error loading receipt details: %w", err)
+	}
+	if details.Purchase == nil || details.Recipe == nil || details.Buyer == nil {
+		return nil, fmt.Errorf("missing receipt details")
+	}
+
+	object := map[string]interface{}{
+		"purchase_id":    purchase.ID,
+		"invoice_prefix": cfg.InvoicePrefix,
+		"issuer":         cfg.ReceiptIssuer,
+		"buyer_id":       purchase.UserID,
+		"buyer_name":     details.Buyer.Username,
+		"buyer_email":    details.Buyer.Email,
+		"recipe_title":   details.Recipe.Title,
+		"author_name":    "",
+		"amount":         purchase.Amount,
+		"currency":       purchase.Currency,
+		"vat_label":      cfg.VATLabel,
+		"vat_rate":       cfg.VATRate,
+		"vat_amount":     receipts.VATIncluded(purchase.Amount, cfg.VATRate),
+		"tx_ref":         purchase.ChapaTxID,
+		"purchased_at":   details.Purchase.CreatedAt,
+	}
+	if authorID != "" {
+		object["author_id"] = authorID
+	}
+	if details.Author != nil {
+		object["author_name"] = details.Author.Username
+	}
+	if cfg.ReceiptIssuerTaxID != "" {
+		object["issuer_tax_id"] = cfg.ReceiptIssuerTaxID
+	}
+
+	query = `
+		mutation IssueReceipt($object: Receipts_insert_input!) {
+			insert_Receipts_one(object: $object) {` + receiptFields + `}
+		}
+	`
+	var created struct {
+		Receipt receiptRecord `json:"insert_Receipts_one"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"object": object}, &created); err != nil {
+		if hasura.IsUniqueViolation(err) {
+			return getReceipt(ctx, client, purchase.ID)
+		}
+		return nil, err
+	}
+	receipt := &created.Receipt
+	pdf := receipt.render()
+
+	fields := map[string]interface{}{"pdf": `\x` + hex.EncodeToString(pdf)}
+	body := fmt.Sprintf("Thank you for your purchase of %q.\n\nYour receipt %s is attached.\n", receipt.RecipeTitle, receipt.invoice())
+	filename := receipt.invoice() + ".pdf"
+	if err := newMailer(cfg).SendWithAttachment(receipt.BuyerEmail, "Your receipt "+receipt.invoice(), body, filename, "application/pdf", pdf); err != nil {
+		log.Printf("Error emailing receipt %s: %v", receipt.invoice(), err)
+	} else {
+		fields["emailed_at"] = formatTimestamp(time.Now().UTC())
+	}
+
+	query = `
+		mutation StoreReceiptPDF($id: uuid!, $set: Receipts_set_input!) {
+			update_Receipts_by_pk(pk_columns: {id: $id}, _set: $set) {
+				id
+			}
+		}
+	`
+	var updated struct {
+		UpdateReceiptsByPk *struct {
+			ID string `json:"id"`
+		} `json:"update_Receipts_by_pk"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"id": receipt.ID, "set": fields}, &updated); err != nil {
+		log.Printf("Error storing receipt %s: %v", receipt.invoice(), err)
+	}
+	return receipt, nil
+}
+
+// RunReceiptBackfill issues the receipts of paid purchases that have none,
+// such as when issuing failed after the payment was applied.
+func RunReceiptBackfill(ctx context.Context) {
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	query := `
+		query PurchasesWithoutReceipt($limit: Int!) {
+			PurchasesWithoutReceipt(order_by: {created_at: asc}, limit: $limit) {
+				id
+			}
+		}
+	`
+	var response struct {
+		Purchases []struct {
+			ID string `json:"id"`
+		} `json:"PurchasesWithoutReceipt"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"limit": receiptBackfillBatchSize}, &response); err != nil {
+		log.Printf("Error loading purchases without receipts: %v", err)
+		return
+	}
+
+	issued := 0
+	for _, missing := range response.Purchases {
+		if ctx.Err() != nil {
+			break
+		}
+		purchase, err := getPurchase(ctx, client, missing.ID)
+		if err != nil || purchase == nil {
+			log.Printf("Error loading purchase %s for its receipt: %v", missing.ID, err)
+			continue
+		}
+		if _, err := ensureReceipt(ctx, client, cfg, purchase); err != nil {
+			log.Printf("Error issuing receipt for purchase %s: %v", purchase.ID, err)
+			continue
+		}
+		issued++
+	}
+	if issued > 0 {
+		log.Printf("Issued %d missing receipts", issued)
+	}
+}
+
+// MyReceiptsHandler lists the caller's receipts.
+func MyReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	query := `
+		query MyReceipts($user_id: uuid!) {
+			Receipts(where: {buyer_id: {_eq: $user_id}}, order_by: {invoice_number: desc}) {` + receiptFields + `}
+		}
+	`
+	var response struct {
+		Receipts []receiptRecord `json:"Receipts"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"user_id": userID}, &response); err != nil {
+		log.Printf("Error loading receipts: %v", err)
+		http.Error(w, "Error loading receipts", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Receipts retrieved", response.Receipts))
+}
+
+// issueReceiptOnRead issues the missing receipt of a paid purchase for its
+// buyer, its author or an admin. Without a receipt it returns the status to
+// answer with; others are told the receipt does not exist.
+func issueReceiptOnRead(ctx context.Context, client *hasura.Client, cfg *config.Config, purchaseID, userID, role string) (*receiptRecord, int) {
+	purchase, err := getPurchase(ctx, client, purchaseID)
+	if err != nil {
+		log.Printf("Error loading purchase %s: %v", purchaseID, err)
+		return nil, http.StatusInternalServerError
+	}
+	if purchase == nil || (purchase.Status != "completed" && purchase.Status != "refunded") {
+		return nil, http.StatusNotFound
+	}
+	isAuthor := purchase.AuthorID != nil && *purchase.AuthorID == userID
+	if purchase.UserID != userID && !isAuthor && role != middleware.RoleAdmin {
+		return nil, http.StatusNotFound
+	}
+	receipt, err := ensureReceipt(ctx, client, cfg, purchase)
+	if err != nil {
+		log.Printf("Error issuing receipt for purchase %s: %v", purchaseID, err)
+		return nil, http.StatusInternalServerError
+	}
+	return receipt, http.StatusOK
+}
+
+// DownloadReceiptHandler serves the PDF receipt of a purchase to its buyer,
+// the recipe's author or an admin.
+func DownloadReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	purchaseID := mux.Vars(r)["purchaseId"]
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	query := `
+		query ReceiptForDownload($purchase_id: uuid!) {
+			Receipts(where: {purchase_id: {_eq: $purchase_id}}) {` + receiptFields + `
+				pdf
+			}
+		}
+	`
+	type storedReceipt struct {
+		receiptRecord
+		PDF *string `json:"pdf"`
+	}
+	var response struct {
+		Receipts []storedReceipt `json:"Receipts"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"purchase_id": purchaseID}, &response); err != nil {
+		log.Printf("Error loading receipt: %v", err)
+		http.Error(w, "Error loading receipt", http.StatusInternalServerError)
+		return
+	}
+	if len(response.Receipts) == 0 {
+		// The receipt may not have been issued yet; issue it now for a paid
+		// purchase the caller may see.
+		receipt, status := issueReceiptOnRead(r.Context(), client, cfg, purchaseID, userID, role)
+		if status == http.StatusNotFound {
+			http.Error(w, "Receipt not found", status)
+			return
+		}
+		if receipt == nil {
+			http.Error(w, "Error issuing receipt", status)
+			return
+		}
+		response.Receipts = append(response.Receipts, storedReceipt{receiptRecord: *receipt})
+	}
+	receipt := response.Receipts[0]
+
+	isAuthor := receipt.AuthorID != nil && *receipt.AuthorID == userID
+	if receipt.BuyerID != userID && !isAuthor && role != middleware.RoleAdmin {
+		// Don't reveal that the purchase exists.
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+
+	// The stored PDF is authoritative; one that failed to store is rendered
+	// again from the issued fields, which yields the same document.
+	var pdf []byte
+	if receipt.PDF != nil {
+		decoded, err := hex.DecodeString(strings.TrimPrefix(*receipt.PDF, `\x`))
+		if err != nil {
+			log.Printf("Error decoding stored receipt %s: %v", receipt.invoice(), err)
+		} else {
+			pdf = decoded
+		}
+	}
+	if pdf == nil {
+		pdf = receipt.render()
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", receipt.invoice()+".pdf"))
+	w.Write(pdf)
+}
@@ -0,0 +1,693 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/config"
+	"backend/hasura"
+	"backend/middleware"
+	"backend/payments"
+)
+
+const (
+	reconciliationBatchSize = 100
+	// Expired purchases are only re-checked for late payments, so fewer are
+	// taken per pass than pending charges.
+	reconciliationExpiredBatchSize = 20
+	reconciliationRunsShown        = 20
+)
+
+// Kinds of disagreement between a provider transaction and our records.
+const (
+	discrepancyAmount   = "amount_mismatch"
+	discrepancyCurrency = "currency_mismatch"
+)
+
+type ResolveDiscrepancyRequest struct {
+	DiscrepancyID string `json:"discrepancyId"`
+	// Apply grants what the transaction paid for despite the mismatch;
+	// otherwise the discrepancy is dismissed and the charge left unapplied.
+	Apply bool   `json:"apply"`
+	Note  string `json:"note"`
+}
+
+type discrepancyRecord struct {
+	ID               string  `json:"id"`
+	TxRef            string  `json:"tx_ref"`
+	Source           string  `json:"source"`
+	Kind             string  `json:"kind"`
+	ExpectedAmount   float64 `json:"expected_amount"`
+	ProviderAmount   float64 `json:"provider_amount"`
+	ExpectedCurrency string  `json:"expected_currency"`
+	ProviderCurrency string  `json:"provider_currency"`
+	ProviderStatus   string  `json:"provider_status"`
+	LocalStatus      string  `json:"local_status"`
+	DetectedAt       string  `json:"detected_at"`
+	ResolvedAt       *string `json:"resolved_at"`
+	ResolvedBy       *string `json:"resolved_by"`
+	Resolution       *string `json:"resolution"`
+	ResolutionNote   *string `json:"resolution_note"`
+}
+
+const discrepancyFields = `
+	id
+	tx_ref
+	source
+	kind
+	expected_amount
+	provider_amount
+	expected_currency
+	provider_currency
+	provider_status
+	local_status
+	detected_at
+	resolved_at
+	resolved_by
+	resolution
+	resolution_note
+`
+
+// storedCharge is a provider transaction as we recorded it. A cart order
+// spreads one transaction over several purchases, whose amounts are summed.
+type storedCharge struct {
+	TxRef     string
+	Source    string
+	Amount    float64
+	Currency  string
+	Status    string
+	CreatedAt time.Time
+}
+
+type chargeRow struct {
+	TxRef     string  `json:"tx_ref"`
+	Amount    float64 `json:"amount"`
+	Currency  string  `json:"currency"`
+	Status    string  `json:"status"`
+	CreatedAt string  `json:"created_at"`
+}
+
+// chargeRows holds the rows of every table that records provider
+// transactions. Purchases alias chapa_tx_id to tx_ref.
+type chargeRows struct {
+	Purchases            []chargeRow `json:"Purchases"`
+	Tips                 []chargeRow `json:"Tips"`
+	Gifts                []chargeRow `json:"Gifts"`
+	SubscriptionPayments []chargeRow `json:"SubscriptionPayments"`
+}
+
+const chargeRowFields = `
+	amount
+	currency
+	status
+	created_at
+`
+
+// charges groups rows by transaction, in the order they were returned.
+func (rows chargeRows) charges() []*storedCharge {
+	var charges []*storedCharge
+	byTxRef := make(map[string]*storedCharge)
+	add := func(source string, rows []chargeRow) {
+		for _, row := range rows {
+			if charge, ok := byTxRef[row.TxRef]; ok {
+				charge.Amount = roundMoney(charge.Amount + row.Amount)
+				continue
+			}
+			createdAt, _ := parseTimestamp(&row.CreatedAt)
+			charge := &storedCharge{
+				TxRef:     row.TxRef,
+				Source:    source,
+				Amount:    roundMoney(row.Amount),
+				Currency:  row.Currency,
+				Status:    row.Status,
+				CreatedAt: createdAt,
+			}
+			byTxRef[row.TxRef] = charge
+			charges = append(charges, charge)
+		}
+	}
+	add("purchase", rows.Purchases)
+	add("tip", rows.Tips)
+	add("gift", rows.Gifts)
+	add("subscription", rows.SubscriptionPayments)
+	return charges
+}
+
+// loadStoredCharge returns what we recorded for txRef, or nil if it is not
+// ours.
+func loadStoredCharge(ctx context.Context, client *hasura.Client, txRef string) (*storedCharge, error) {
+	query := `
+		query StoredCharge($tx_ref: String!) {
+			Purchases(where: {chapa_tx_id: {_eq: $tx_ref}}) {
+				tx_ref: chapa_tx_id` + chargeRowFields + `}
+			Tips(where: {tx_ref: {_eq: $tx_ref}}) {
+				tx_ref` + chargeRowFields + `}
+			Gifts(where: {tx_ref: {_eq: $tx_ref}}) {
+				tx_ref` + chargeRowFields + `}
+			SubscriptionPayments(where: {tx_ref: {_eq: $tx_ref}}) {
+				tx_ref` + chargeRowFields + `}
+		}
+	`
+	var rows chargeRows
+	if err := client.Execute(ctx, query, map[string]interface{}{"tx_ref": txRef}, &rows); err != nil {
+		return nil, err
+	}
+	charges := rows.charges()
+	if len(charges) == 0 {
+		return nil, nil
+	}
+	return charges[0], nil
+}
+
+// verifyCharge asks the provider for the outcome of charge. A transaction
+// whose amount or currency differ from the charge is returned along with
+// the mismatch, so that a success can be held for review.
+func verifyCharge(ctx context.Context, charge *storedCharge) (*payments.Transaction, *payments.MismatchError, error) {
+	tx, err := paymentProvider.Verify(ctx, payments.VerifyRequest{
+		TxRef:    charge.TxRef,
+		Amount:   charge.Amount,
+		Currency: charge.Currency,
+	})
+	var mismatch *payments.MismatchError
+	if errors.As(err, &mismatch) {
+		return mismatch.Transaction, mismatch, nil
+	}
+	return tx, nil, err
+}
+
+// discrepancyKinds names the discrepancies recorded for a mismatch.
+func discrepancyKinds(mismatch *payments.MismatchError) []string {
+	kinds := make([]string, 0, len(mismatch.Fields))
+	for _, field := range mismatch.Fields {
+		switch field {
+		case payments.MismatchAmount:
+			kinds = append(kinds, discrepancyAmount)
+		case payments.MismatchCurrency:
+			kinds = append(kinds, discrepancyCurrency)
+		}
+	}
+	return kinds
+}
+
+// recordDiscrepancies files one discrepancy per kind. A transaction already
+// on file keeps its original entry, including any resolution.
+func recordDiscrepancies(ctx context.Context, client *hasura.Client, charge *storedCharge, tx *payments.Transaction, kinds []string) error {
+	objects := make([]map[string]interface{}, 0, len(kinds))
+	for _, kind := range kinds {
+		objects = append(objects, map[string]interface{}{
+			"tx_ref":            charge.TxRef,
+			"source":            charge.Source,
+			"kind":              kind,
+			"expected_amount":   charge.Amount,
+			"provider_amount":   roundMoney(tx.Amount),
+			"expected_currency": charge.Currency,
+			"provider_currency": tx.Currency,
+			"provider_status":   tx.Status,
+			"local_status":      charge.Status,
+		})
+	}
+
+	query := `
+		mutation RecordDiscrepancies($objects: [PaymentDiscrepancies_insert_input!]!) {
+			insert_PaymentDiscrepancies(
+				objects: $objects,
+				on_conflict: {constraint: PaymentDiscrepancies_tx_ref_kind_key, update_columns: []}
+			) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		InsertPaymentDiscrepancies struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"insert_PaymentDiscrepancies"`
+	}
+	return client.Execute(ctx, query, map[string]interface{}{"objects": objects}, &response)
+}
+
+// holdChargeForReview files the discrepancies of a mismatched charge and
+// moves its rows to review, where neither the webhook nor the reconciler
+// touches them again until an admin resolves them.
+func holdChargeForReview(ctx context.Context, client *hasura.Client, charge *storedCharge, tx *payments.Transaction, kinds []string) error {
+	log.Printf("Transaction %s differs from stored %s: expected %.2f %s, provider reports %.2f %s",
+		tx.TxRef, charge.Source, charge.Amount, charge.Currency, tx.Amount, tx.Currency)
+	if err := recordDiscrepancies(ctx, client, charge, tx, kinds); err != nil {
+		return err
+	}
+	return setChargeReviewStatus(ctx, client, charge.TxRef, []string{"pending", "expired"}, "review", "review")
+}
+
+// releaseChargeFromReview hands a reviewed charge back to the status its
+// apply path settles from. Purchases go to expired rather than pending, so a
+// checkout the user opened meanwhile does not collide with them.
+func releaseChargeFromReview(ctx context.Context, client *hasura.Client, txRef string) error {
+	return setChargeReviewStatus(ctx, client, txRef, []string{"review"}, "expired", "pending")
+}
+
+// setChargeReviewStatus moves every row paid by txRef from one of
+// fromStatuses: purchases and their order to purchaseStatus, and tips, gifts
+// and subscription payments to otherStatus. Only pending purchases and
+// orders are ever expired; the other tables never hold expired charges.
+func setChargeReviewStatus(ctx context.Context, client *hasura.Client, txRef string, fromStatuses []string, purchaseStatus, otherStatus string) error {
+	query := `
+		mutation SetChargeReviewStatus($tx_ref: String!, $from: [String!]!, $purchase_status: String!, $status: String!) {
+			update_Purchases(where: {chapa_tx_id: {_eq: $tx_ref}, status: {_in: $from}}, _set: {status: $purchase_status}) {
+				affected_rows
+			}
+			update_Orders(where: {tx_ref: {_eq: $tx_ref}, status: {_in: $from}}, _set: {status: $purchase_status}) {
+				affected_rows
+			}
+			update_Tips(where: {tx_ref: {_eq: $tx_ref}, status: {_in: $from}}, _set: {status: $status}) {
+				affected_rows
+			}
+			update_Gifts(where: {tx_ref: {_eq: $tx_ref}, status: {_in: $from}}, _set: {status: $status}) {
+				affected_rows
+			}
+			update_SubscriptionPayments(where: {tx_ref: {_eq: $tx_ref}, status: {_in: $from}}, _set: {status: $status, updated_at: "now()"}) {
+				affected_rows
+			}
+		}
+	`
+	variables := map[string]interface{}{
+		"tx_ref":          txRef,
+		"from":            fromStatuses,
+		"purchase_status": purchaseStatus,
+		"status":          otherStatus,
+	}
+	var response map[string]struct {
+		AffectedRows int `json:"affected_rows"`
+	}
+	return client.Execute(ctx, query, variables, &response)
+}
+
+// expireAbandonedPurchases retires the pending purchases of a transaction
+// the provider never saw paid. They stay expired rather than failed so a
+// very late payment can still complete them.
+func expireAbandonedPurchases(ctx context.Context, client *hasura.Client, txRef string) error {
+	query := `
+		mutation ExpireAbandonedPurchases($tx_ref: String!) {
+			update_Purchases(where: {chapa_tx_id: {_eq: $tx_ref}, status: {_eq: "pending"}}, _set: {status: "expired"}) {
+				returning {
+					id
+				}
+			}
+			update_Orders(where: {tx_ref: {_eq: $tx_ref}, status: {_eq: "pending"}}, _set: {status: "expired"}) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		UpdatePurchases struct {
+			Returning []struct {
+				ID string `json:"id"`
+			} `json:"returning"`
+		} `json:"update_Purchases"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"tx_ref": txRef}, &response); err != nil {
+		return err
+	}
+	var ids []string
+	for _, purchase := range response.UpdatePurchases.Returning {
+		ids = append(ids, purchase.ID)
+	}
+	releaseCouponRedemptions(ctx, client, ids)
+	return nil
+}
+
+type reconciliationStats struct {
+	Checked       int `json:"checked"`
+	Completed     int `json:"completed"`
+	Failed        int `json:"failed"`
+	Abandoned     int `json:"abandoned"`
+	StillPending  int `json:"still_pending"`
+	Discrepancies int `json:"discrepancies"`
+	Errors        int `json:"errors"`
+}
+
+// RunPaymentReconciliation re-verifies payments that have been pending longer
+// than the reconciliation threshold, in case their webhook was lost. Charges
+// the provider settled are applied exactly as the webhook would, mismatched
+// charges are held for review, and charges never paid within the maximum age
+// are abandoned. Pending charges come first; expired purchases still within
+// the maximum age are then re-checked in a smaller batch for late payments,
+// and pending refunds are settled last. Each pass is recorded for drift
+// metrics.
+func RunPaymentReconciliation(ctx context.Context) {
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+	startedAt := time.Now().UTC()
+	abandonBefore := startedAt.Add(-cfg.ReconciliationMaxAge)
+	before := formatTimestamp(startedAt.Add(-cfg.ReconciliationThreshold))
+
+	query := `
+		query ReconciliationCandidates($before: timestamptz!, $limit: Int!) {
+			Purchases(where: {created_at: {_lt: $before}, status: {_eq: "pending"}}, order_by: {created_at: asc}, limit: $limit) {
+				tx_ref: chapa_tx_id` + chargeRowFields + `}
+			Tips(where: {created_at: {_lt: $before}, status: {_eq: "pending"}}, order_by: {created_at: asc}, limit: $limit) {
+				tx_ref` + chargeRowFields + `}
+			Gifts(where: {created_at: {_lt: $before}, status: {_eq: "pending"}}, order_by: {created_at: asc}, limit: $limit) {
+				tx_ref` + chargeRowFields + `}
+			SubscriptionPayments(where: {created_at: {_lt: $before}, status: {_eq: "pending"}}, order_by: {created_at: asc}, limit: $limit) {
+				tx_ref` + chargeRowFields + `}
+		}
+	`
+	var pending chargeRows
+	if err := client.Execute(ctx, query, map[string]interface{}{"before": before, "limit": reconciliationBatchSize}, &pending); err != nil {
+		log.Printf("Error loading payments to reconcile: %v", err)
+		return
+	}
+
+	query = `
+		query ExpiredReconciliationCandidates($before: timestamptz!, $since: timestamptz!, $limit: Int!) {
+			Purchases(where: {created_at: {_lt: $before, _gt: $since}, status: {_eq: "expired"}}, order_by: {created_at: desc}, limit: $limit) {
+				tx_ref: chapa_tx_id` + chargeRowFields + `}
+		}
+	`
+	variables := map[string]interface{}{
+		"before": before,
+		"since":  formatTimestamp(abandonBefore),
+		"limit":  reconciliationExpiredBatchSize,
+	}
+	var expired chargeRows
+	if err := client.Execute(ctx, query, variables, &expired); err != nil {
+		log.Printf("Error loading expired payments to reconcile: %v", err)
+	}
+
+	var stats reconciliationStats
+	for _, candidate := range append(pending.charges(), expired.charges()...) {
+		if ctx.Err() != nil {
+			break
+		}
+		stats.Checked++
+
+		// The batch may hold only part of a cart order; reload it whole so
+		// the amount compared is the full charge.
+		charge, err := loadStoredCharge(ctx, client, candidate.TxRef)
+		if err != nil || charge == nil {
+			log.Printf("Error loading stored charge %s: %v", candidate.TxRef, err)
+			stats.Errors++
+			continue
+		}
+		charge.Status = candidate.Status
+		abandoned := charge.CreatedAt.Before(abandonBefore)
+
+		tx, mismatch, err := verifyCharge(ctx, charge)
+		status := payments.StatusPending
+		if err != nil {
+			if !abandoned {
+				log.Printf("Error verifying transaction %s: %v", charge.TxRef, err)
+				stats.Errors++
+				continue
+			}
+		} else {
+			status = tx.Status
+		}
+
+		switch status {
+		case payments.StatusSuccess:
+			if mismatch != nil {
+				if err := holdChargeForReview(ctx, client, charge, tx, discrepancyKinds(mismatch)); err != nil {
+					log.Printf("Error recording discrepancy for %s: %v", charge.TxRef, err)
+					stats.Errors++
+					continue
+				}
+				stats.Discrepancies++
+				continue
+			}
+			if err := applyChargeResult(ctx, client, cfg, charge.TxRef, status); err != nil {
+				log.Printf("Error applying reconciled success for %s: %v", charge.TxRef, err)
+				stats.Errors++
+				continue
+			}
+			stats.Completed++
+		case payments.StatusFailed:
+			if err := applyChargeResult(ctx, client, cfg, charge.TxRef, status); err != nil {
+				log.Printf("Error applying reconciled failure for %s: %v", charge.TxRef, err)
+				stats.Errors++
+				continue
+			}
+			stats.Failed++
+		default:
+			if !abandoned {
+				stats.StillPending++
+				continue
+			}
+			// Only pending purchases are abandoned; expired ones age out of
+			// the candidate window on their own.
+			if charge.Status != "pending" {
+				continue
+			}
+			if charge.Source == "purchase" {
+				err = expireAbandonedPurchases(ctx, client, charge.TxRef)
+			} else {
+				err = applyChargeResult(ctx, client, cfg, charge.TxRef, payments.StatusFailed)
+			}
+			if err != nil {
+				log.Printf("Error abandoning transaction %s: %v", charge.TxRef, err)
+				stats.Errors++
+				continue
+			}
+			stats.Abandoned++
+		}
+	}
+
+	reconcilePendingRefunds(ctx, client, before, abandonBefore, &stats)
+
+	run := map[string]interface{}{
+		"started_at":    formatTimestamp(startedAt),
+		"finished_at":   formatTimestamp(time.Now().UTC()),
+		"checked":       stats.Checked,
+		"completed":     stats.Completed,
+		"failed":        stats.Failed,
+		"abandoned":     stats.Abandoned,
+		"still_pending": stats.StillPending,
+		"discrepancies": stats.Discrepancies,
+		"errors":        stats.Errors,
+	}
+	query = `
+		mutation RecordReconciliationRun($object: ReconciliationRuns_insert_input!) {
+			insert_ReconciliationRuns_one(object: $object) {
+				id
+			}
+		}
+	`
+	var response struct {
+		InsertReconciliationRunsOne struct {
+			ID string `json:"id"`
+		} `json:"insert_ReconciliationRuns_one"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"object": run}, &response); err != nil {
+		log.Printf("Error recording reconciliation run: %v", err)
+	}
+
+	if stats.Checked > 0 {
+		log.Printf("Payment reconciliation: %+v", stats)
+	}
+}
+
+// ReconciliationReportHandler returns drift metrics for admins: recent
+// reconciler passes, payments currently stuck past the threshold, and open
+// discrepancies.
+func ReconciliationReportHandler(w http.ResponseWriter, r *http.Request) {
+	_, role := requestUser(r)
+	if role != middleware.RoleAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	query := `
+		query ReconciliationReport($before: timestamptz!, $runs: Int!) {
+			ReconciliationRuns(order_by: {started_at: desc}, limit: $runs) {
+				started_at
+				finished_at
+				checked
+				completed
+				failed
+				abandoned
+				still_pending
+				discrepancies
+				errors
+			}
+			Purchases_aggregate(where: {status: {_eq: "pending"}, created_at: {_lt: $before}}) {
+				aggregate {
+					count
+				}
+			}
+			Tips_aggregate(where: {status: {_eq: "pending"}, created_at: {_lt: $before}}) {
+				aggregate {
+					count
+				}
+			}
+			Gifts_aggregate(where: {status: {_eq: "pending"}, created_at: {_lt: $before}}) {
+				aggregate {
+					count
+				}
+			}
+			SubscriptionPayments_aggregate(where: {status: {_eq: "pending"}, created_at: {_lt: $before}}) {
+				aggregate {
+					count
+				}
+			}
+			PaymentDiscrepancies(where: {resolved_at: {_is_null: true}}, order_by: {detected_at: asc}) {` + discrepancyFields + `}
+		}
+	`
+	type count struct {
+		Aggregate struct {
+			Count int `json:"count"`
+		} `json:"aggregate"`
+	}
+	var response struct {
+		Runs []struct {
+			StartedAt  string `json:"started_at"`
+			FinishedAt string `json:"finished_at"`
+			reconciliationStats
+		} `json:"ReconciliationRuns"`
+		Purchases            count               `json:"Purchases_aggregate"`
+		Tips                 count               `json:"Tips_aggregate"`
+		Gifts                count               `json:"Gifts_aggregate"`
+		SubscriptionPayments count               `json:"SubscriptionPayments_aggregate"`
+		Discrepancies        []discrepancyRecord `json:"PaymentDiscrepancies"`
+	}
+	variables := map[string]interface{}{
+		"before": formatTimestamp(time.Now().UTC().Add(-cfg.ReconciliationThreshold)),
+		"runs":   reconciliationRunsShown,
+	}
+	if err := client.Execute(r.Context(), query, variables, &response); err != nil {
+		log.Printf("Error loading reconciliation report: %v", err)
+		http.Error(w, "Error loading reconciliation report", http.StatusInternalServerError)
+		return
+	}
+
+	// Totals over the recent passes: how many payments the webhook missed
+	// and the reconciler had to settle.
+	var totals reconciliationStats
+	for _, run := range response.Runs {
+		totals.Checked += run.Checked
+		totals.Completed += run.Completed
+		totals.Failed += run.Failed
+		totals.Abandoned += run.Abandoned
+		totals.StillPending += run.StillPending
+		totals.Discrepancies += run.Discrepancies
+		totals.Errors += run.Errors
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Reconciliation report retrieved", map[string]interface{}{
+		"stalePending": map[string]int{
+			"purchases":     response.Purchases.Aggregate.Count,
+			"tips":          response.Tips.Aggregate.Count,
+			"gifts":         response.Gifts.Aggregate.Count,
+			"subscriptions": response.SubscriptionPayments.Aggregate.Count,
+		},
+		"recentRuns":         response.Runs,
+		"recentTotals":       totals,
+		"openDiscrepancies":  response.Discrepancies,
+		"discrepancyBacklog": len(response.Discrepancies),
+	}))
+}
+
+// ResolveDiscrepancyHandler closes the open discrepancies of a transaction,
+// either applying the charge anyway or dismissing it, which fails it. The
+// charge leaves review either way.
+func ResolveDiscrepancyHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role := requestUser(r)
+	if role != middleware.RoleAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var req ResolveDiscrepancyRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.DiscrepancyID == "" {
+		http.Error(w, "discrepancy ID is required", http.StatusBadRequest)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	query := `
+		query GetDiscrepancy($id: uuid!) {
+			PaymentDiscrepancies_by_pk(id: $id) {` + discrepancyFields + `}
+		}
+	`
+	var lookup struct {
+		Discrepancy *discrepancyRecord `json:"PaymentDiscrepancies_by_pk"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"id": req.DiscrepancyID}, &lookup); err != nil {
+		log.Printf("Error loading discrepancy: %v", err)
+		http.Error(w, "Error loading discrepancy", http.StatusInternalServerError)
+		return
+	}
+	discrepancy := lookup.Discrepancy
+	if discrepancy == nil {
+		http.Error(w, "Discrepancy not found", http.StatusNotFound)
+		return
+	}
+	if discrepancy.ResolvedAt != nil {
+		http.Error(w, "Discrepancy is already resolved", http.StatusConflict)
+		return
+	}
+
+	resolution, status := "dismissed", payments.StatusFailed
+	if req.Apply {
+		resolution, status = "applied", payments.StatusSuccess
+	}
+	if err := releaseChargeFromReview(r.Context(), client, discrepancy.TxRef); err != nil {
+		log.Printf("Error releasing charge %s from review: %v", discrepancy.TxRef, err)
+		http.Error(w, "Error applying charge", http.StatusInternalServerError)
+		return
+	}
+	if err := applyChargeResult(r.Context(), client, cfg, discrepancy.TxRef, status); err != nil {
+		log.Printf("Error applying charge %s: %v", discrepancy.TxRef, err)
+		http.Error(w, "Error applying charge", http.StatusInternalServerError)
+		return
+	}
+
+	query = `
+		mutation ResolveDiscrepancies($tx_ref: String!, $fields: PaymentDiscrepancies_set_input!) {
+			update_PaymentDiscrepancies(where: {tx_ref: {_eq: $tx_ref}, resolved_at: {_is_null: true}}, _set: $fields) {
+				affected_rows
+			}
+		}
+	`
+	fields := map[string]interface{}{
+		"resolved_at": formatTimestamp(time.Now().UTC()),
+		"resolved_by": userID,
+		"resolution":  resolution,
+	}
+	if note := strings.TrimSpace(req.Note); note != "" {
+		fields["resolution_note"] = note
+	}
+	var response struct {
+		UpdatePaymentDiscrepancies struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_PaymentDiscrepancies"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"tx_ref": discrepancy.TxRef, "fields": fields}, &response); err != nil {
+		log.Printf("Error resolving discrepancy: %v", err)
+		http.Error(w, "Error resolving discrepancy", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r.Context(), client, userID, "payment_discrepancy.resolved", "PaymentDiscrepancies", discrepancy.ID, map[string]interface{}{
+		"tx_ref":     discrepancy.TxRef,
+		"resolution": resolution,
+	})
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Discrepancy resolved", map[string]interface{}{
+		"txRef":      discrepancy.TxRef,
+		"resolution": resolution,
+		"resolved":   response.UpdatePaymentDiscrepancies.AffectedRows,
+	}))
+}
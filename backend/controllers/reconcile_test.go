@@ -0,0 +1,28 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	"backend/payments"
+)
+
+func TestDiscrepancyKinds(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []string
+		want   []string
+	}{
+		{"amount", []string{payments.MismatchAmount}, []string{discrepancyAmount}},
+		{"currency", []string{payments.MismatchCurrency}, []string{discrepancyCurrency}},
+		{"both", []string{payments.MismatchAmount, payments.MismatchCurrency}, []string{discrepancyAmount, discrepancyCurrency}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mismatch := &payments.MismatchError{Transaction: &payments.Transaction{TxRef: "tx-1"}, Fields: tt.fields}
+			if got := discrepancyKinds(mismatch); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("discrepancyKinds() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
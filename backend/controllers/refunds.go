@@ -0,0 +1,492 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"backend/config"
+	"backend/hasura"
+	"backend/middleware"
+	"backend/payments"
+
+	"github.com/google/uuid"
+)
+
+type RefundRequest struct {
+	PurchaseID string `json:"purchaseId"`
+	// Amount is optional; zero refunds the whole remaining balance.
+	Amount float64 `json:"amount"`
+	Reason string  `json:"reason"`
+}
+
+type refundRecord struct {
+	ID         string  `json:"id"`
+	PurchaseID string  `json:"purchase_id"`
+	Amount     float64 `json:"amount"`
+	Currency   string  `json:"currency"`
+	Status     string  `json:"status"`
+	Reference  string  `json:"reference"`
+}
+
+const refundFields = `
+	id
+	purchase_id
+	amount
+	currency
+	status
+	reference
+`
+
+// RefundHandler returns part or all of a completed purchase to the buyer.
+// Only admins and the author of the purchased recipe may issue refunds.
+func RefundHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req RefundRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.PurchaseID == "" {
+		http.Error(w, "purchase ID is required", http.StatusBadRequest)
+		return
+	}
+	if req.Reason == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	purchase, err := getPurchase(r.Context(), client, req.PurchaseID)
+	if err != nil {
+		log.Printf("Error loading purchase %s: %v", req.PurchaseID, err)
+		http.Error(w, "Error loading purchase", http.StatusInternalServerError)
+		return
+	}
+	if purchase == nil {
+		http.Error(w, "Purchase not found", http.StatusNotFound)
+		return
+	}
+
+	if role != middleware.RoleAdmin {
+		authorID, err := getRecipeAuthorID(r.Context(), client, purchase.RecipeID)
+		if err != nil {
+			log.Printf("Error loading recipe %s: %v", purchase.RecipeID, err)
+			http.Error(w, "Error loading recipe", http.StatusInternalServerError)
+			return
+		}
+		if authorID != userID {
+			http.Error(w, "Only admins and the recipe author can refund this purchase", http.StatusForbidden)
+			return
+		}
+	}
+
+	if purchase.Status != "completed" {
+		http.Error(w, "Only completed purchases can be refunded", http.StatusConflict)
+		return
+	}
+
+	remaining := roundMoney(purchase.Amount - purchase.RefundedAmount)
+	amount := roundMoney(req.Amount)
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount <= 0 || amount > remaining {
+		http.Error(w, fmt.Sprintf("refund amount must be between 0 and the refundable balance of %.2f %s", remaining, purchase.Currency), http.StatusBadRequest)
+		return
+	}
+
+	// Reserve the amount against the balance we just read. If another refund
+	// got there first the guard on refunded_amount fails and nothing changes.
+	query := `
+		mutation ReserveRefund($id: uuid!, $seen: numeric!, $amount: numeric!) {
+			update_Purchases(where: {id: {_eq: $id}, status: {_eq: "completed"}, refunded_amount: {_eq: $seen}}, _inc: {refunded_amount: $amount}) {
+				affected_rows
+			}
+		}
+	`
+	var reserved struct {
+		UpdatePurchases struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_Purchases"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{
+		"id":     purchase.ID,
+		"seen":   purchase.RefundedAmount,
+		"amount": amount,
+	}, &reserved); err != nil {
+		log.Printf("Error reserving refund on purchase %s: %v", purchase.ID, err)
+		http.Error(w, "Error creating refund", http.StatusInternalServerError)
+		return
+	}
+	if reserved.UpdatePurchases.AffectedRows == 0 {
+		http.Error(w, "Purchase changed while refunding, please retry", http.StatusConflict)
+		return
+	}
+
+	refund := refundRecord{
+		ID:         uuid.New().String(),
+		PurchaseID: purchase.ID,
+		Amount:     amount,
+		Currency:   purchase.Currency,
+		Status:     "pending",
+		Reference:  uuid.New().String(),
+	}
+
+	query = `
+		mutation CreateRefund($object: Refunds_insert_input!) {
+			insert_Refunds_one(object: $object) {
+				id
+			}
+		}
+	`
+	var inserted struct {
+		InsertRefundsOne struct {
+			ID string `json:"id"`
+		} `json:"insert_Refunds_one"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{
+		"object": map[string]interface{}{
+			"id":           refund.ID,
+			"purchase_id":  refund.PurchaseID,
+			"amount":       refund.Amount,
+			"currency":     refund.Currency,
+			"reason":       req.Reason,
+			"status":       refund.Status,
+			"reference":    refund.Reference,
+			"requested_by": userID,
+		},
+	}, &inserted); err != nil {
+		log.Printf("Error creating refund record: %v", err)
+		releaseRefundReservation(r.Context(), client, purchase.ID, amount)
+		http.Error(w, "Error creating refund", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r.Context(), client, userID, "refund.requested", "Refunds", refund.ID, map[string]interface{}{
+		"purchase_id": purchase.ID,
+		"amount":      amount,
+		"currency":    refund.Currency,
+		"reason":      req.Reason,
+		"reference":   refund.Reference,
+	})
+
+	result, err := paymentProvider.Refund(r.Context(), payments.RefundRequest{
+		TxRef:     purchase.ChapaTxID,
+		Amount:    amount,
+		Reason:    req.Reason,
+		Reference: refund.Reference,
+	})
+	if err != nil {
+		if payments.IsRejected(err) {
+			failRefund(r.Context(), client, userID, refund, err.Error())
+			writeProviderError(w, err)
+			return
+		}
+		// The provider may have acted on the request, so the refund stays
+		// pending, holding its amount, until the webhook or the reconciler
+		// learns its outcome.
+		log.Printf("Refund %s left pending after provider error: %v", refund.ID, err)
+		result = &payments.RefundResult{Reference: refund.Reference, Status: payments.StatusPending, Amount: amount}
+	}
+
+	if result.Status == payments.StatusSuccess || result.Status == payments.StatusRefunded {
+		if err := completeRefund(r.Context(), client, userID, refund); err != nil {
+			log.Printf("Error completing refund %s: %v", refund.ID, err)
+			http.Error(w, "Refund sent but could not be recorded", http.StatusInternalServerError)
+			return
+		}
+		refund.Status = "completed"
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Refund requested", map[string]interface{}{
+		"id":         refund.ID,
+		"purchaseId": refund.PurchaseID,
+		"amount":     refund.Amount,
+		"currency":   refund.Currency,
+		"status":     refund.Status,
+	}))
+}
+
+// releaseRefundReservation gives back balance reserved for a refund that will
+// not happen.
+func releaseRefundReservation(ctx context.Context, client *hasura.Client, purchaseID string, amount float64) {
+	query := `
+		mutation ReleaseRefund($id: uuid!, $amount: numeric!) {
+			update_Purchases_by_pk(pk_columns: {id: $id}, _inc: {refunded_amount: $amount}) {
+				id
+			}
+		}
+	`
+	var response struct {
+		UpdatePurchasesByPk *struct {
+			ID string `json:"id"`
+		} `json:"update_Purchases_by_pk"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"id": purchaseID, "amount": -amount}, &response); err != nil {
+		log.Printf("Error releasing refund reservation on purchase %s: %v", purchaseID, err)
+	}
+}
+
+// setRefundStatus moves a pending refund to status and reports whether this
+// call made the transition, so duplicate webhooks are applied only once.
+func setRefundStatus(ctx context.Context, client *hasura.Client, refundID, status string) (bool, error) {
+	query := `
+		mutation SetRefundStatus($id: uuid!, $fields: Refunds_set_input!) {
+			update_Refunds(where: {id: {_eq: $id}, status: {_eq: "pending"}}, _set: $fields) {
+				affected_rows
+			}
+		}
+	`
+	fields := map[string]interface{}{"status": status, "updated_at": "now()"}
+	if status == "completed" {
+		fields["refunded_at"] = "now()"
+	}
+	var response struct {
+		UpdateRefunds struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_Refunds"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"id": refundID, "fields": fields}, &response); err != nil {
+		return false, err
+	}
+	return response.UpdateRefunds.AffectedRows > 0, nil
+}
+
+// completeRefund records that the provider returned the money. Once refunds
+// cover the whole purchase it is marked refunded, which revokes access to
+// the recipe.
+func completeRefund(ctx context.Context, client *hasura.Client, actorID string, refund refundRecord) error {
+	changed, err := setRefundStatus(ctx, client, refund.ID, "completed")
+	if err != nil || !changed {
+		return err
+	}
+
+	recordAudit(ctx, client, actorID, "refund.completed", "Refunds", refund.ID, map[string]interface{}{
+		"purchase_id": refund.PurchaseID,
+		"amount":      refund.Amount,
+		"currency":    refund.Currency,
+	})
+	recordRefundEarning(ctx, client, refund)
+
+	query := `
+		query RefundedTotal($purchase_id: uuid!) {
+			Purchases_by_pk(id: $purchase_id) {
+				amount
+			}
+			Refunds_aggregate(where: {purchase_id: {_eq: $purchase_id}, status: {_eq: "completed"}}) {
+				aggregate {
+					sum {
+						amount
+					}
+				}
+			}
+		}
+	`
+	var totals struct {
+		Purchase *struct {
+			Amount float64 `json:"amount"`
+		} `json:"Purchases_by_pk"`
+		RefundsAggregate struct {
+			Aggregate struct {
+				Sum struct {
+					Amount *float64 `json:"amount"`
+				} `json:"sum"`
+			} `json:"aggregate"`
+		} `json:"Refunds_aggregate"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"purchase_id": refund.PurchaseID}, &totals); err != nil {
+		return err
+	}
+	refunded := totals.RefundsAggregate.Aggregate.Sum.Amount
+	if totals.Purchase == nil || refunded == nil || roundMoney(*refunded) < roundMoney(totals.Purchase.Amount) {
+		return nil
+	}
+
+	if err := setPurchaseFields(ctx, client, refund.PurchaseID, map[string]interface{}{"status": "refunded"}); err != nil {
+		return err
+	}
+	recordAudit(ctx, client, actorID, "purchase.access_revoked", "Purchases", refund.PurchaseID, map[string]interface{}{
+		"refund_id": refund.ID,
+		"reason":    "fully refunded",
+	})
+	return nil
+}
+
+// failRefund records a refund the provider rejected and returns its amount to
+// the refundable balance.
+func failRefund(ctx context.Context, client *hasura.Client, actorID string, refund refundRecord, reason string) {
+	changed, err := setRefundStatus(ctx, client, refund.ID, "failed")
+	if err != nil {
+		log.Printf("Error marking refund %s as failed: %v", refund.ID, err)
+		return
+	}
+	if !changed {
+		return
+	}
+
+	releaseRefundReservation(ctx, client, refund.PurchaseID, refund.Amount)
+	recordAudit(ctx, client, actorID, "refund.failed", "Refunds", refund.ID, map[string]interface{}{
+		"purchase_id": refund.PurchaseID,
+		"amount":      refund.Amount,
+		"error":       reason,
+	})
+}
+
+// handleRefundWebhook settles the pending refunds a provider notification
+// may refer to. The event names our refund reference when the provider
+// echoes it; otherwise every pending refund of the purchases the
+// transaction paid for is a candidate. Either way the outcome of each refund
+// is taken from the provider, by its own reference, not from the event.
+func handleRefundWebhook(w http.ResponseWriter, r *http.Request, event *payments.WebhookEvent) {
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	refunds, err := webhookRefunds(r.Context(), client, event)
+	if err != nil {
+		log.Printf("Error loading refunds for webhook: %v", err)
+		http.Error(w, "Error loading refund", http.StatusInternalServerError)
+		return
+	}
+	if len(refunds) == 0 {
+		log.Printf("No pending refund found for webhook on %s", event.TxRef)
+		json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Webhook ignored", nil))
+		return
+	}
+
+	for _, refund := range refunds {
+		if err := settleRefund(r.Context(), client, refund); err != nil {
+			log.Printf("Error settling refund %s: %v", refund.ID, err)
+			http.Error(w, "Error updating refund", http.StatusBadGateway)
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Webhook processed", nil))
+}
+
+// webhookRefunds returns the pending refunds a refund event may settle.
+func webhookRefunds(ctx context.Context, client *hasura.Client, event *payments.WebhookEvent) ([]refundRecord, error) {
+	var response struct {
+		Refunds []refundRecord `json:"Refunds"`
+	}
+	if event.RefundReference != "" {
+		query := `
+			query RefundByReference($reference: String!) {
+				Refunds(where: {reference: {_eq: $reference}, status: {_eq: "pending"}}) {` + refundFields + `}
+			}
+		`
+		err := client.Execute(ctx, query, map[string]interface{}{"reference": event.RefundReference}, &response)
+		return response.Refunds, err
+	}
+
+	// Cart orders pay for several purchases with one transaction.
+	query := `
+		query TransactionPurchases($tx_ref: String!) {
+			Purchases(where: {chapa_tx_id: {_eq: $tx_ref}}) {
+				id
+			}
+		}
+	`
+	var purchases struct {
+		Purchases []struct {
+			ID string `json:"id"`
+		} `json:"Purchases"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"tx_ref": event.TxRef}, &purchases); err != nil {
+		return nil, err
+	}
+	var purchaseIDs []string
+	for _, purchase := range purchases.Purchases {
+		purchaseIDs = append(purchaseIDs, purchase.ID)
+	}
+	if len(purchaseIDs) == 0 {
+		return nil, nil
+	}
+
+	query = `
+		query PendingRefunds($purchase_ids: [uuid!]!) {
+			Refunds(where: {purchase_id: {_in: $purchase_ids}, status: {_eq: "pending"}}, order_by: {created_at: asc}) {` + refundFields + `}
+		}
+	`
+	err := client.Execute(ctx, query, map[string]interface{}{"purchase_ids": purchaseIDs}, &response)
+	return response.Refunds, err
+}
+
+// settleRefund asks the provider for the status of a pending refund and
+// applies it. Refunds the provider has not finished stay pending.
+func settleRefund(ctx context.Context, client *hasura.Client, refund refundRecord) error {
+	result, err := paymentProvider.VerifyRefund(ctx, refund.Reference)
+	if err != nil {
+		return fmt.Errorf("error verifying refund: %w", err)
+	}
+	switch result.Status {
+	case payments.StatusRefunded, payments.StatusSuccess:
+		// A different amount needs a person to look at it; retrying the
+		// webhook would not change the answer.
+		if result.Amount > 0 && roundMoney(result.Amount) != roundMoney(refund.Amount) {
+			log.Printf("Refund %s: provider refunded %.2f %s instead of %.2f; left pending for review",
+				refund.ID, result.Amount, refund.Currency, refund.Amount)
+			return nil
+		}
+		return completeRefund(ctx, client, "", refund)
+	case payments.StatusFailed:
+		failRefund(ctx, client, "", refund, "provider reported failure")
+	}
+	return nil
+}
+
+// reconcilePendingRefunds settles refunds pending longer than the
+// reconciliation threshold, whose request may never have reached the
+// provider or whose webhook was lost. A refund the provider still has no
+// record of past the maximum age is failed, returning its amount to the
+// refundable balance.
+func reconcilePendingRefunds(ctx context.Context, client *hasura.Client, before string, abandonBefore time.Time, stats *reconciliationStats) {
+	query := `
+		query ReconciliationRefunds($before: timestamptz!, $limit: Int!) {
+			Refunds(where: {created_at: {_lt: $before}, status: {_eq: "pending"}}, order_by: {created_at: asc}, limit: $limit) {` + refundFields + `
+				created_at
+			}
+		}
+	`
+	var response struct {
+		Refunds []struct {
+			refundRecord
+			CreatedAt string `json:"created_at"`
+		} `json:"Refunds"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"before": before, "limit": reconciliationBatchSize}, &response); err != nil {
+		log.Printf("Error loading refunds to reconcile: %v", err)
+		stats.Errors++
+		return
+	}
+
+	for _, refund := range response.Refunds {
+		if ctx.Err() != nil {
+			return
+		}
+		stats.Checked++
+		err := settleRefund(ctx, client, refund.refundRecord)
+		if err == nil {
+			continue
+		}
+		createdAt, _ := parseTimestamp(&refund.CreatedAt)
+		if payments.IsRejected(err) && createdAt.Before(abandonBefore) {
+			failRefund(ctx, client, "", refund.refundRecord, "provider has no record of the refund")
+			stats.Abandoned++
+			continue
+		}
+		log.Printf("Error reconciling refund %s: %v", refund.ID, err)
+		stats.Errors++
+	}
+}
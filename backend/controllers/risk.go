@@ -0,0 +1,528 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/config"
+	"backend/hasura"
+	"backend/middleware"
+)
+
+// Risk decisions recorded on payment attempts.
+const (
+	riskAllow = "allow"
+	riskBlock = "block"
+)
+
+// Reasons a payment attempt was blocked.
+const (
+	riskUserBlocked  = "user_blocked"
+	riskEmailDomain  = "blocked_email_domain"
+	riskUserVelocity = "user_velocity"
+	riskIPVelocity   = "ip_velocity"
+	riskDailySpend   = "daily_spend"
+)
+
+// Outcomes an admin can record when reviewing a blocked attempt.
+const (
+	reviewDismissed   = "dismissed"
+	reviewBlockUser   = "block_user"
+	reviewUnblockUser = "unblock_user"
+)
+
+const maxAttemptsListed = 200
+
+type ListPaymentAttemptsRequest struct {
+	// Decision filters by "allow" or "block"; it defaults to "block".
+	Decision string `json:"decision"`
+	// IncludeReviewed also lists attempts an admin has already reviewed.
+	IncludeReviewed bool   `json:"includeReviewed"`
+	UserID          string `json:"userId"`
+}
+
+type ReviewPaymentAttemptRequest struct {
+	AttemptID string `json:"attemptId"`
+	Outcome   string `json:"outcome"`
+	Note      string `json:"note"`
+}
+
+type paymentAttemptRecord struct {
+	ID            string   `json:"id"`
+	UserID        string   `json:"user_id"`
+	IPAddress     string   `json:"ip_address"`
+	EmailDomain   *string  `json:"email_domain"`
+	Kind          string   `json:"kind"`
+	Amount        float64  `json:"amount"`
+	Currency      string   `json:"currency"`
+	Decision      string   `json:"decision"`
+	Reasons       []string `json:"reasons"`
+	CreatedAt     string   `json:"created_at"`
+	ReviewedBy    *string  `json:"reviewed_by"`
+	ReviewedAt    *string  `json:"reviewed_at"`
+	ReviewOutcome *string  `json:"review_outcome"`
+	ReviewNote    *string  `json:"review_note"`
+}
+
+const paymentAttemptFields = `
+	id
+	user_id
+	ip_address
+	email_domain
+	kind
+	amount
+	currency
+	decision
+	reasons
+	created_at
+	reviewed_by
+	reviewed_at
+	review_outcome
+	review_note
+`
+
+type riskDecision struct {
+	AttemptID string
+	Decision  string
+	Reasons   []string
+}
+
+// lockFields returns the purchase columns that record the decision.
+func (d *riskDecision) lockFields() map[string]interface{} {
+	return map[string]interface{}{
+		"risk_attempt_id": d.AttemptID,
+		"risk_decision":   d.Decision,
+	}
+}
+
+// clientIP returns the address a request came from. X-Forwarded-For is
+// only believed when the request arrived through one of the trusted proxies
+// (addresses or CIDR ranges, such as Hasura's or a load balancer's). The
+// client is then the rightmost hop that is not itself trusted; hops to its
+// left were supplied by the client and may be forged.
+func clientIP(r *http.Request, trustedProxies []string) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	trusted := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return false
+		}
+		for _, proxy := range trustedProxies {
+			if _, network, err := net.ParseCIDR(proxy); err == nil {
+				if network.Contains(ip) {
+					return true
+				}
+			} else if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	if !trusted(remote) {
+		return remote
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			// Whatever is left of a malformed hop cannot be attributed.
+			break
+		}
+		if !trusted(hops[i]) {
+			return hops[i]
+		}
+	}
+	return remote
+}
+
+func emailDomain(email string) string {
+	_, domain, ok := strings.Cut(email, "@")
+	if !ok {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(domain))
+}
+
+func domainBlocked(domain string, blocked []string) bool {
+	for _, b := range blocked {
+		if domain == b || strings.HasSuffix(domain, "."+b) {
+			return true
+		}
+	}
+	return false
+}
+
+// assessPaymentRisk applies the velocity rules to a payment about to be
+// initiated and records the attempt with its decision. Attempts are counted
+// whether or not they were allowed, so hammering the endpoint keeps a
+// client blocked. Daily spend counts what was actually charged in the last
+// day, not checkouts opened and abandoned. Concurrent attempts can each pass
+// a limit they jointly exceed; the rules bound abuse rather than enforce
+// exact quotas.
+func assessPaymentRisk(ctx context.Context, r *http.Request, client *hasura.Client, cfg *config.Config, userID, kind string, amount float64, currency string) (*riskDecision, error) {
+	now := time.Now().UTC()
+	ip := clientIP(r, cfg.TrustedProxies)
+
+	query := `
+		query PaymentRisk($user_id: uuid!, $ip: String!, $currency: String!, $hour_ago: timestamptz!, $day_ago: timestamptz!) {
+			Users_by_pk(id: $user_id) {
+				email
+				payments_blocked
+			}
+			user_attempts: PaymentAttempts_aggregate(where: {user_id: {_eq: $user_id}, created_at: {_gt: $hour_ago}}) {
+				aggregate {
+					count
+				}
+			}
+			ip_attempts: PaymentAttempts_aggregate(where: {ip_address: {_eq: $ip}, created_at: {_gt: $hour_ago}}) {
+				aggregate {
+					count
+				}
+			}
+			purchases: Purchases_aggregate(where: {user_id: {_eq: $user_id}, status: {_eq: "completed"}, currency: {_eq: $currency}, created_at: {_gt: $day_ago}}) {
+				aggregate {
+					sum {
+						amount
+					}
+				}
+			}
+			tips: Tips_aggregate(where: {tipper_id: {_eq: $user_id}, status: {_eq: "completed"}, currency: {_eq: $currency}, created_at: {_gt: $day_ago}}) {
+				aggregate {
+					sum {
+						amount
+					}
+				}
+			}
+			gifts: Gifts_aggregate(where: {purchaser_id: {_eq: $user_id}, status: {_in: ["paid", "redeemed"]}, currency: {_eq: $currency}, paid_at: {_gt: $day_ago}}) {
+				aggregate {
+					sum {
+						amount
+					}
+				}
+			}
+			Subscriptions(where: {user_id: {_eq: $user_id}}) {
+				id
+			}
+		}
+	`
+	variables := map[string]interface{}{
+		"user_id":  userID,
+		"ip":       ip,
+		"currency": currency,
+		"hour_ago": formatTimestamp(now.Add(-time.Hour)),
+		"day_ago":  formatTimestamp(now.Add(-24 * time.Hour)),
+	}
+	var response struct {
+		User *struct {
+			Email           string `json:"email"`
+			PaymentsBlocked bool   `json:"payments_blocked"`
+		} `json:"Users_by_pk"`
+		UserAttempts  countAggregate `json:"user_attempts"`
+		IPAttempts    countAggregate `json:"ip_attempts"`
+		Purchases     sumAggregate   `json:"purchases"`
+		Tips          sumAggregate   `json:"tips"`
+		Gifts         sumAggregate   `json:"gifts"`
+		Subscriptions []struct {
+			ID string `json:"id"`
+		} `json:"Subscriptions"`
+	}
+	if err := client.Execute(ctx, query, variables, &response); err != nil {
+		return nil, err
+	}
+
+	var domain string
+	var reasons []string
+	if response.User != nil {
+		domain = emailDomain(response.User.Email)
+		if response.User.PaymentsBlocked {
+			reasons = append(reasons, riskUserBlocked)
+		}
+	}
+	if domain != "" && domainBlocked(domain, cfg.RiskBlockedEmailDomains) {
+		reasons = append(reasons, riskEmailDomain)
+	}
+	if limit := cfg.RiskMaxInitiationsPerUserHour; limit > 0 && response.UserAttempts.Aggregate.Count >= limit {
+		reasons = append(reasons, riskUserVelocity)
+	}
+	if limit := cfg.RiskMaxInitiationsPerIPHour; limit > 0 && response.IPAttempts.Aggregate.Count >= limit {
+		reasons = append(reasons, riskIPVelocity)
+	}
+	if limit := cfg.RiskMaxDailySpend[currency]; limit > 0 {
+		spent := response.Purchases.total() + response.Tips.total() + response.Gifts.total()
+		if len(response.Subscriptions) > 0 {
+			subscriptionIDs := make([]string, 0, len(response.Subscriptions))
+			for _, sub := range response.Subscriptions {
+				subscriptionIDs = append(subscriptionIDs, sub.ID)
+			}
+			subscriptions, err := subscriptionSpend(ctx, client, subscriptionIDs, currency, variables["day_ago"].(string))
+			if err != nil {
+				return nil, err
+			}
+			spent += subscriptions
+		}
+		if roundMoney(spent+amount) > limit {
+			reasons = append(reasons, riskDailySpend)
+		}
+	}
+
+	decision := &riskDecision{Decision: riskAllow, Reasons: reasons}
+	if len(reasons) > 0 {
+		decision.Decision = riskBlock
+	}
+
+	object := map[string]interface{}{
+		"user_id":    userID,
+		"ip_address": ip,
+		"kind":       kind,
+		"amount":     roundMoney(amount),
+		"currency":   currency,
+		"decision":   decision.Decision,
+		// Hasura takes Postgres array literals for text[] columns; reason
+		// codes never need quoting.
+		"reasons": "{" + strings.Join(reasons, ",") + "}",
+	}
+	if domain != "" {
+		object["email_domain"] = domain
+	}
+	query = `
+		mutation RecordPaymentAttempt($object: PaymentAttempts_insert_input!) {
+			insert_PaymentAttempts_one(object: $object) {
+				id
+			}
+		}
+	`
+	var created struct {
+		InsertPaymentAttemptsOne struct {
+			ID string `json:"id"`
+		} `json:"insert_PaymentAttempts_one"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"object": object}, &created); err != nil {
+		return nil, err
+	}
+	decision.AttemptID = created.InsertPaymentAttemptsOne.ID
+
+	if decision.Decision == riskBlock {
+		log.Printf("Blocked %s payment attempt %s by user %s from %s: %v", kind, decision.AttemptID, userID, ip, reasons)
+	}
+	return decision, nil
+}
+
+type countAggregate struct {
+	Aggregate struct {
+		Count int `json:"count"`
+	} `json:"aggregate"`
+}
+
+type sumAggregate struct {
+	Aggregate struct {
+		Sum struct {
+			Amount *float64 `json:"amount"`
+		} `json:"sum"`
+	} `json:"aggregate"`
+}
+
+func (a sumAggregate) total() float64 {
+	if a.Aggregate.Sum.Amount == nil {
+		return 0
+	}
+	return *a.Aggregate.Sum.Amount
+}
+
+// subscriptionSpend sums what the given subscriptions were charged in
+// currency since the given time.
+func subscriptionSpend(ctx context.Context, client *hasura.Client, subscriptionIDs []string, currency, since string) (float64, error) {
+	query := `
+		query SubscriptionSpend($ids: [uuid!]!, $currency: String!, $since: timestamptz!) {
+			SubscriptionPayments_aggregate(where: {subscription_id: {_in: $ids}, status: {_eq: "completed"}, currency: {_eq: $currency}, updated_at: {_gt: $since}}) {
+				aggregate {
+					sum {
+						amount
+					}
+				}
+			}
+		}
+	`
+	var response struct {
+		Spend sumAggregate `json:"SubscriptionPayments_aggregate"`
+	}
+	variables := map[string]interface{}{"ids": subscriptionIDs, "currency": currency, "since": since}
+	if err := client.Execute(ctx, query, variables, &response); err != nil {
+		return 0, err
+	}
+	return response.Spend.total(), nil
+}
+
+// checkPaymentRisk runs assessPaymentRisk for a handler and answers the
+// request itself when the payment may not go ahead. Velocity blocks are
+// reported as rate limiting; other reasons are not disclosed.
+func checkPaymentRisk(w http.ResponseWriter, r *http.Request, client *hasura.Client, cfg *config.Config, userID, kind string, amount float64, currency string) (*riskDecision, bool) {
+	decision, err := assessPaymentRisk(r.Context(), r, client, cfg, userID, kind, amount, currency)
+	if err != nil {
+		log.Printf("Error assessing payment risk: %v", err)
+		http.Error(w, "Error checking payment", http.StatusInternalServerError)
+		return nil, false
+	}
+	if decision.Decision == riskAllow {
+		return decision, true
+	}
+
+	for _, reason := range decision.Reasons {
+		if reason == riskUserBlocked || reason == riskEmailDomain {
+			http.Error(w, "This payment cannot be processed", http.StatusForbidden)
+			return nil, false
+		}
+	}
+	http.Error(w, "Too many payment attempts, try again later", http.StatusTooManyRequests)
+	return nil, false
+}
+
+// ListPaymentAttemptsHandler lists payment attempts for admin review,
+// unreviewed blocked attempts by default.
+func ListPaymentAttemptsHandler(w http.ResponseWriter, r *http.Request) {
+	_, role := requestUser(r)
+	if role != middleware.RoleAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var req ListPaymentAttemptsRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	decision := req.Decision
+	if decision == "" {
+		decision = riskBlock
+	}
+	if decision != riskAllow && decision != riskBlock {
+		http.Error(w, "decision must be allow or block", http.StatusBadRequest)
+		return
+	}
+	where := map[string]interface{}{
+		"decision": map[string]interface{}{"_eq": decision},
+	}
+	if !req.IncludeReviewed {
+		where["reviewed_at"] = map[string]interface{}{"_is_null": true}
+	}
+	if req.UserID != "" {
+		where["user_id"] = map[string]interface{}{"_eq": req.UserID}
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	query := `
+		query ListPaymentAttempts($where: PaymentAttempts_bool_exp!, $limit: Int!) {
+			PaymentAttempts(where: $where, order_by: {created_at: desc}, limit: $limit) {` + paymentAttemptFields + `}
+		}
+	`
+	var response struct {
+		PaymentAttempts []paymentAttemptRecord `json:"PaymentAttempts"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"where": where, "limit": maxAttemptsListed}, &response); err != nil {
+		log.Printf("Error listing payment attempts: %v", err)
+		http.Error(w, "Error listing payment attempts", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Payment attempts retrieved", response.PaymentAttempts))
+}
+
+// ReviewPaymentAttemptHandler records an admin's review of a blocked
+// attempt. Besides dismissing it, the admin can block the user from paying
+// at all, or lift such a block.
+func ReviewPaymentAttemptHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role := requestUser(r)
+	if role != middleware.RoleAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var req ReviewPaymentAttemptRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.AttemptID == "" {
+		http.Error(w, "attempt ID is required", http.StatusBadRequest)
+		return
+	}
+	switch req.Outcome {
+	case reviewDismissed, reviewBlockUser, reviewUnblockUser:
+	default:
+		http.Error(w, "outcome must be dismissed, block_user or unblock_user", http.StatusBadRequest)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	fields := map[string]interface{}{
+		"reviewed_by":    userID,
+		"reviewed_at":    formatTimestamp(time.Now().UTC()),
+		"review_outcome": req.Outcome,
+	}
+	if note := strings.TrimSpace(req.Note); note != "" {
+		fields["review_note"] = note
+	}
+	query := `
+		mutation ReviewPaymentAttempt($id: uuid!, $set: PaymentAttempts_set_input!) {
+			update_PaymentAttempts_by_pk(pk_columns: {id: $id}, _set: $set) {` + paymentAttemptFields + `}
+		}
+	`
+	var response struct {
+		Attempt *paymentAttemptRecord `json:"update_PaymentAttempts_by_pk"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"id": req.AttemptID, "set": fields}, &response); err != nil {
+		log.Printf("Error reviewing payment attempt: %v", err)
+		http.Error(w, "Error reviewing payment attempt", http.StatusInternalServerError)
+		return
+	}
+	if response.Attempt == nil {
+		http.Error(w, "Payment attempt not found", http.StatusNotFound)
+		return
+	}
+	attempt := response.Attempt
+
+	if req.Outcome == reviewBlockUser || req.Outcome == reviewUnblockUser {
+		query = `
+			mutation SetPaymentsBlocked($id: uuid!, $blocked: Boolean!) {
+				update_Users_by_pk(pk_columns: {id: $id}, _set: {payments_blocked: $blocked}) {
+					id
+				}
+			}
+		`
+		var updated struct {
+			UpdateUsersByPk *struct {
+				ID string `json:"id"`
+			} `json:"update_Users_by_pk"`
+		}
+		variables := map[string]interface{}{"id": attempt.UserID, "blocked": req.Outcome == reviewBlockUser}
+		if err := client.Execute(r.Context(), query, variables, &updated); err != nil {
+			log.Printf("Error updating user payment block: %v", err)
+			http.Error(w, "Error updating user", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	recordAudit(r.Context(), client, userID, "payment_attempt.reviewed", "PaymentAttempts", attempt.ID, map[string]interface{}{
+		"outcome": req.Outcome,
+		"user_id": attempt.UserID,
+	})
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Payment attempt reviewed", attempt))
+}
@@ -0,0 +1,45 @@
+package controllers
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "192.0.2.7", "fd00::/8"}
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		proxies   []string
+		want      string
+	}{
+		{"direct", "203.0.113.5:4000", nil, trusted, "203.0.113.5"},
+		{"untrusted remote ignores header", "203.0.113.5:4000", []string{"198.51.100.1"}, trusted, "203.0.113.5"},
+		{"no trusted proxies", "10.1.2.3:4000", []string{"198.51.100.1"}, nil, "10.1.2.3"},
+		{"single proxy", "10.1.2.3:4000", []string{"198.51.100.1"}, trusted, "198.51.100.1"},
+		{"forged leftmost hop", "10.1.2.3:4000", []string{"1.1.1.1, 198.51.100.1"}, trusted, "198.51.100.1"},
+		{"proxy chain", "10.1.2.3:4000", []string{"198.51.100.1, 192.0.2.7, 10.9.9.9"}, trusted, "198.51.100.1"},
+		{"repeated headers", "10.1.2.3:4000", []string{"1.1.1.1", "198.51.100.1, 10.9.9.9"}, trusted, "198.51.100.1"},
+		{"all hops trusted", "10.1.2.3:4000", []string{"10.4.4.4, 192.0.2.7"}, trusted, "10.1.2.3"},
+		{"malformed hop", "10.1.2.3:4000", []string{"198.51.100.1, not-an-ip"}, trusted, "10.1.2.3"},
+		{"empty header", "10.1.2.3:4000", []string{""}, trusted, "10.1.2.3"},
+		{"port in hop", "10.1.2.3:4000", []string{"198.51.100.1:443"}, trusted, "10.1.2.3"},
+		{"ipv6 remote", "[2001:db8::1]:4000", []string{"198.51.100.1"}, trusted, "2001:db8::1"},
+		{"ipv6 proxy and client", "[fd00::2]:4000", []string{"2001:db8::9"}, trusted, "2001:db8::9"},
+		{"remote without port", "10.1.2.3", []string{"198.51.100.1"}, trusted, "198.51.100.1"},
+		{"malformed proxy entry", "10.1.2.3:4000", []string{"198.51.100.1"}, []string{"10.0.0.0/99", "junk"}, "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := clientIP(r, tt.proxies); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"backend/config"
+	"backend/hasura"
+	"backend/middleware"
+	"backend/storage"
+	"backend/videos"
+
+	"github.com/google/uuid"
+)
+
+// stepVideo describes the video of a recipe step. StreamURL is an adaptive
+// stream where the store transcodes videos, and the file itself otherwise;
+// PosterURL is only set by stores that can extract frames.
+type stepVideo struct {
+	StepID      string  `json:"stepId"`
+	RecipeID    string  `json:"recipeId"`
+	Key         string  `json:"key"`
+	URL         string  `json:"url"`
+	StreamURL   string  `json:"streamUrl"`
+	PosterURL   string  `json:"posterUrl,omitempty"`
+	ContentType string  `json:"contentType"`
+	Duration    float64 `json:"duration"`
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+	Bytes       int64   `json:"bytes"`
+}
+
+// videoFolder is where a user's step videos are stored.
+func videoFolder(userID string) string {
+	return fmt.Sprintf("RecipeVideos/%s", userID)
+}
+
+// getStepRecipeID returns the recipe a step belongs to, or "" when there is
+// no such step.
+func getStepRecipeID(ctx context.Context, client *hasura.Client, stepID string) (string, error) {
+	query := `
+		query GetStepRecipe($id: uuid!) {
+			Steps_by_pk(id: $id) {
+				recipe_id
+			}
+		}
+	`
+	var response struct {
+		Step *struct {
+			RecipeID string `json:"recipe_id"`
+		} `json:"Steps_by_pk"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"id": stepID}, &response); err != nil {
+		return "", err
+	}
+	if response.Step == nil {
+		return "", nil
+	}
+	return response.Step.RecipeID, nil
+}
+
+// registerStepVideo records a stored video as the video of its step. The
+// step's previous video is detached in the same transaction, so cleanup
+// deletes it after the grace period.
+func registerStepVideo(ctx context.Context, client *hasura.Client, userID string, video *stepVideo) error {
+	now := formatTimestamp(time.Now().UTC())
+	object := map[string]interface{}{
+		"user_id":      userID,
+		"kind":         "video",
+		"key":          video.Key,
+		"url":          video.URL,
+		"content_type": video.ContentType,
+		"bytes":        video.Bytes,
+		"width":        video.Width,
+		"height":       video.Height,
+		"duration_ms":  int64(video.Duration * 1000),
+		"stream_url":   video.StreamURL,
+		"step_id":      video.StepID,
+		"recipe_id":    video.RecipeID,
+		"attached_at":  now,
+	}
+	if video.PosterURL != "" {
+		object["poster_url"] = video.PosterURL
+	}
+	query := `
+		mutation RegisterStepVideo($step_id: uuid!, $object: Uploads_insert_input!, $now: timestamptz!) {
+			update_Uploads(where: {step_id: {_eq: $step_id}, kind: {_eq: "video"}}, _set: {step_id: null, recipe_id: null, attached_at: null, detached_at: $now}) {
+				affected_rows
+			}
+			insert_Uploads_one(object: $object) {
+				id
+			}
+		}
+	`
+	variables := map[string]interface{}{
+		"step_id": video.StepID,
+		"object":  object,
+		"now":     now,
+	}
+	var response struct {
+		UpdateUploads struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_Uploads"`
+		InsertUploadsOne struct {
+			ID string `json:"id"`
+		} `json:"insert_Uploads_one"`
+	}
+	return client.Execute(ctx, query, variables, &response)
+}
+
+// UploadStepVideoHandler accepts a short MP4 or WebM clip for a recipe step
+// as multipart/form-data: a "stepId" field followed by the file. The step's
+// recipe must be the caller's. The clip replaces any video the step had.
+func UploadStepVideoHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role := requestUser(r)
+	cfg := config.LoadConfig()
+
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.VideoMaxSize+uploadOverhead)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart/form-data body", http.StatusBadRequest)
+		return
+	}
+
+	client := hasura.NewClient(cfg)
+	var stepID, recipeID string
+	var spool *os.File
+	defer func() {
+		if spool != nil {
+			removeSpool(spool)
+		}
+	}()
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, errFileTooLarge.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Malformed multipart body", http.StatusBadRequest)
+			return
+		}
+		if part.FileName() == "" {
+			if part.FormName() == "stepId" {
+				value, _ := io.ReadAll(io.LimitReader(part, 128))
+				stepID = strings.TrimSpace(string(value))
+			}
+			part.Close()
+			continue
+		}
+		if spool != nil {
+			part.Close()
+			http.Error(w, "Only one video can be uploaded at a time", http.StatusBadRequest)
+			return
+		}
+
+		// The step is checked before the file is received.
+		if stepID == "" {
+			part.Close()
+			http.Error(w, "stepId must be sent before the file", http.StatusBadRequest)
+			return
+		}
+		recipeID, err = getStepRecipeID(r.Context(), client, stepID)
+		if err != nil {
+			part.Close()
+			log.Printf("Error loading step: %v", err)
+			http.Error(w, "Error loading step", http.StatusInternalServerError)
+			return
+		}
+		if recipeID == "" {
+			part.Close()
+			http.Error(w, "Step not found", http.StatusNotFound)
+			return
+		}
+		authorID, err := getRecipeAuthorID(r.Context(), client, recipeID)
+		if err != nil {
+			part.Close()
+			log.Printf("Error loading recipe author: %v", err)
+			http.Error(w, "Error loading recipe", http.StatusInternalServerError)
+			return
+		}
+		if authorID != userID && role != middleware.RoleAdmin {
+			part.Close()
+			http.Error(w, "You can only add videos to your own recipes", http.StatusForbidden)
+			return
+		}
+
+		if spool, err = os.CreateTemp("", "video-*"); err != nil {
+			part.Close()
+			log.Printf("Error buffering video: %v", err)
+			http.Error(w, "Error receiving upload", http.StatusInternalServerError)
+			return
+		}
+		totalLeft := cfg.VideoMaxSize
+		body := &sizeLimitedReader{r: part, fileLeft: cfg.VideoMaxSize, totalLeft: &totalLeft}
+		_, err = io.Copy(spool, body)
+		part.Close()
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if body.err != nil || errors.As(err, &tooLarge) {
+				http.Error(w, errFileTooLarge.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			log.Printf("Error buffering video: %v", err)
+			http.Error(w, "Error receiving upload", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if spool == nil {
+		http.Error(w, "No video file provided", http.StatusBadRequest)
+		return
+	}
+
+	info, err := videos.Inspect(spool, videos.Limits{MaxDuration: cfg.VideoMaxDuration})
+	if err != nil {
+		if videos.IsValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Error reading video: %v", err)
+		http.Error(w, "Error reading video", http.StatusInternalServerError)
+		return
+	}
+	size, err := spool.Seek(0, io.SeekEnd)
+	if err != nil {
+		log.Printf("Error reading video: %v", err)
+		http.Error(w, "Error reading video", http.StatusInternalServerError)
+		return
+	}
+
+	quota, err := loadUploadQuota(r.Context(), client, cfg, userID, role)
+	if err != nil {
+		log.Printf("Error loading upload quota: %v", err)
+		http.Error(w, "Error checking upload quota", http.StatusInternalServerError)
+		return
+	}
+	reservation, err := quota.reserve(r.Context(), client, size)
+	if err != nil {
+		if errors.Is(err, errQuotaExceeded) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		log.Printf("Error reserving upload quota: %v", err)
+		http.Error(w, "Error checking upload quota", http.StatusInternalServerError)
+		return
+	}
+	defer reservation.release(context.Background(), client)
+
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		log.Printf("Error reading video: %v", err)
+		http.Error(w, "Error reading video", http.StatusInternalServerError)
+		return
+	}
+	key := fmt.Sprintf("%s/%s.%s", videoFolder(userID), uuid.New().String(), info.Extension())
+	object, err := blobStore.Put(r.Context(), key, spool, info.ContentType)
+	if err != nil {
+		log.Printf("Error storing video: %v", err)
+		http.Error(w, "Error uploading video", http.StatusInternalServerError)
+		return
+	}
+
+	video := &stepVideo{
+		StepID:      stepID,
+		RecipeID:    recipeID,
+		Key:         object.Key,
+		URL:         object.URL,
+		StreamURL:   object.URL,
+		ContentType: info.ContentType,
+		Duration:    info.Duration.Seconds(),
+		Width:       info.Width,
+		Height:      info.Height,
+		Bytes:       object.Size,
+	}
+	if transformer, ok := blobStore.(storage.VideoTransformer); ok {
+		video.StreamURL = transformer.StreamURL(object.Key)
+		video.PosterURL = transformer.PosterURL(object.Key)
+	}
+
+	if err := registerStepVideo(r.Context(), client, userID, video); err != nil {
+		log.Printf("Error registering step video: %v", err)
+		if deleteErr := blobStore.Delete(context.Background(), object.Key); deleteErr != nil {
+			log.Printf("Error deleting files of failed upload: %v", deleteErr)
+		}
+		http.Error(w, "Error uploading video", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Uploaded video for step %s to: %s", stepID, video.URL)
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Video uploaded", video))
+}
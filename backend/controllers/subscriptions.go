@@ -0,0 +1,949 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"backend/config"
+	"backend/hasura"
+	"backend/payments"
+
+	"github.com/google/uuid"
+)
+
+// subscriptionTxPrefix marks provider transactions that pay for a
+// subscription rather than a recipe purchase.
+const subscriptionTxPrefix = "sub-"
+
+// Renewal is manual: Chapa cannot charge a saved payment method, so before
+// each period ends the subscriber is sent a checkout to pay, and the period
+// is extended only once they do. manualRenewal is reported to clients so
+// they can prompt for it.
+const manualRenewal = "manual"
+
+// renewalRetryInterval is how long the renewal job waits before opening a
+// new checkout when the previous one was not paid.
+const renewalRetryInterval = 24 * time.Hour
+
+type SubscribeRequest struct {
+	PlanCode string `json:"planCode"`
+}
+
+type subscriptionPlan struct {
+	ID              string  `json:"id"`
+	Code            string  `json:"code"`
+	Name            string  `json:"name"`
+	BillingInterval string  `json:"billing_interval"`
+	Price           float64 `json:"price"`
+	Currency        string  `json:"currency"`
+}
+
+const subscriptionPlanFields = `
+	id
+	code
+	name
+	billing_interval
+	price
+	currency
+`
+
+type subscriptionRecord struct {
+	ID                 string            `json:"id"`
+	UserID             string            `json:"user_id"`
+	Status             string            `json:"status"`
+	CurrentPeriodStart *string           `json:"current_period_start"`
+	CurrentPeriodEnd   *string           `json:"current_period_end"`
+	GraceUntil         *string           `json:"grace_until"`
+	CancelAtPeriodEnd  bool              `json:"cancel_at_period_end"`
+	Plan               *subscriptionPlan `json:"plan"`
+}
+
+const subscriptionFields = `
+	id
+	user_id
+	status
+	current_period_start
+	current_period_end
+	grace_until
+	cancel_at_period_end
+	plan_id
+`
+
+// subscriptionPayment is a checkout for one billing period. It keeps the
+// plan and interval it was opened for, so a payment made after the plan
+// changed still buys what it was priced as.
+type subscriptionPayment struct {
+	ID              string  `json:"id"`
+	SubscriptionID  string  `json:"subscription_id"`
+	PlanID          string  `json:"plan_id"`
+	TxRef           string  `json:"tx_ref"`
+	Amount          float64 `json:"amount"`
+	Currency        string  `json:"currency"`
+	BillingInterval string  `json:"billing_interval"`
+	Kind            string  `json:"kind"`
+	Status          string  `json:"status"`
+	CheckoutURL     *string `json:"checkout_url"`
+	CreatedAt       string  `json:"created_at"`
+}
+
+const subscriptionPaymentFields = `
+	id
+	subscription_id
+	plan_id
+	tx_ref
+	amount
+	currency
+	billing_interval
+	kind
+	status
+	checkout_url
+	created_at
+`
+
+func isSubscriptionTxRef(txRef string) bool {
+	return strings.HasPrefix(txRef, subscriptionTxPrefix)
+}
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func parseTimestamp(value *string) (time.Time, bool) {
+	if value == nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, *value)
+	if err != nil {
+		log.Printf("Invalid timestamp %q: %v", *value, err)
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// addBillingInterval returns the end of a period of the given interval that
+// starts at start.
+func addBillingInterval(start time.Time, interval string) time.Time {
+	if interval == "year" {
+		return start.AddDate(1, 0, 0)
+	}
+	return start.AddDate(0, 1, 0)
+}
+
+// subscriptionRow is a Subscriptions row as returned by Hasura, before its
+// plan is attached.
+type subscriptionRow struct {
+	subscriptionRecord
+	PlanID *string `json:"plan_id"`
+}
+
+// loadSubscriptions runs a query returning Subscriptions rows and attaches
+// each row's plan.
+func loadSubscriptions(ctx context.Context, client *hasura.Client, query string, variables map[string]interface{}) ([]subscriptionRecord, error) {
+	var response struct {
+		Subscriptions []subscriptionRow  `json:"Subscriptions"`
+		Plans         []subscriptionPlan `json:"SubscriptionPlans"`
+	}
+	if err := client.Execute(ctx, query, variables, &response); err != nil {
+		return nil, err
+	}
+
+	plans := make(map[string]subscriptionPlan)
+	for _, plan := range response.Plans {
+		plans[plan.ID] = plan
+	}
+
+	subscriptions := make([]subscriptionRecord, 0, len(response.Subscriptions))
+	for _, row := range response.Subscriptions {
+		sub := row.subscriptionRecord
+		if row.PlanID != nil {
+			if plan, ok := plans[*row.PlanID]; ok {
+				sub.Plan = &plan
+			}
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+	return subscriptions, nil
+}
+
+// getOpenSubscription returns the user's pending, active or past-due
+// subscription, or nil if they have none.
+func getOpenSubscription(ctx context.Context, client *hasura.Client, userID string) (*subscriptionRecord, error) {
+	query := `
+		query OpenSubscription($user_id: uuid!) {
+			Subscriptions(where: {user_id: {_eq: $user_id}, status: {_in: ["pending", "active", "past_due"]}}, limit: 1) {` + subscriptionFields + `}
+			SubscriptionPlans {` + subscriptionPlanFields + `}
+		}
+	`
+
+	subscriptions, err := loadSubscriptions(ctx, client, query, map[string]interface{}{"user_id": userID})
+	if err != nil || len(subscriptions) == 0 {
+		return nil, err
+	}
+	return &subscriptions[0], nil
+}
+
+// getLatestSubscriptionPayment returns the most recent payment attempt for a
+// subscription, or nil if there is none.
+func getLatestSubscriptionPayment(ctx context.Context, client *hasura.Client, subscriptionID string) (*subscriptionPayment, error) {
+	query := `
+		query LatestSubscriptionPayment($subscription_id: uuid!) {
+			SubscriptionPayments(where: {subscription_id: {_eq: $subscription_id}}, order_by: {created_at: desc}, limit: 1) {` + subscriptionPaymentFields + `}
+		}
+	`
+
+	var response struct {
+		Payments []subscriptionPayment `json:"SubscriptionPayments"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"subscription_id": subscriptionID}, &response); err != nil {
+		return nil, err
+	}
+	if len(response.Payments) == 0 {
+		return nil, nil
+	}
+	return &response.Payments[0], nil
+}
+
+// updateSubscription sets columns on a subscription, optionally only while it
+// is in one of the given statuses. It reports whether a row was changed.
+func updateSubscription(ctx context.Context, client *hasura.Client, subscriptionID string, fromStatuses []string, fields map[string]interface{}) (bool, error) {
+	where := map[string]interface{}{"id": map[string]interface{}{"_eq": subscriptionID}}
+	if len(fromStatuses) > 0 {
+		where["status"] = map[string]interface{}{"_in": fromStatuses}
+	}
+	fields["updated_at"] = "now()"
+
+	query := `
+		mutation UpdateSubscription($where: Subscriptions_bool_exp!, $set: Subscriptions_set_input!) {
+			update_Subscriptions(where: $where, _set: $set) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		UpdateSubscriptions struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_Subscriptions"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"where": where, "set": fields}, &response); err != nil {
+		return false, err
+	}
+	return response.UpdateSubscriptions.AffectedRows > 0, nil
+}
+
+// setSubscriptionPaymentStatus moves a pending payment to status and reports
+// whether this call made the transition.
+func setSubscriptionPaymentStatus(ctx context.Context, client *hasura.Client, txRef, status string) (bool, error) {
+	return moveSubscriptionPayment(ctx, client, txRef, []string{"pending"}, status)
+}
+
+// moveSubscriptionPayment moves a payment in one of fromStatuses to status
+// and reports whether this call made the transition.
+func moveSubscriptionPayment(ctx context.Context, client *hasura.Client, txRef string, fromStatuses []string, status string) (bool, error) {
+	query := `
+		mutation SetSubscriptionPaymentStatus($tx_ref: String!, $from: [String!]!, $status: String!) {
+			update_SubscriptionPayments(where: {tx_ref: {_eq: $tx_ref}, status: {_in: $from}}, _set: {status: $status, updated_at: "now()"}) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		UpdateSubscriptionPayments struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_SubscriptionPayments"`
+	}
+	variables := map[string]interface{}{"tx_ref": txRef, "from": fromStatuses, "status": status}
+	if err := client.Execute(ctx, query, variables, &response); err != nil {
+		return false, err
+	}
+	return response.UpdateSubscriptionPayments.AffectedRows > 0, nil
+}
+
+// expirePendingSubscriptionPayments retires the open checkouts of a
+// subscription, so paying one later is refunded rather than applied.
+func expirePendingSubscriptionPayments(ctx context.Context, client *hasura.Client, subscriptionID string) error {
+	query := `
+		mutation ExpireSubscriptionPayments($subscription_id: uuid!) {
+			update_SubscriptionPayments(where: {subscription_id: {_eq: $subscription_id}, status: {_eq: "pending"}}, _set: {status: "expired", updated_at: "now()"}) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		UpdateSubscriptionPayments struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_SubscriptionPayments"`
+	}
+	return client.Execute(ctx, query, map[string]interface{}{"subscription_id": subscriptionID}, &response)
+}
+
+// getSubscriptionPayment loads a payment by its tx_ref, returning nil if
+// there is none.
+func getSubscriptionPayment(ctx context.Context, client *hasura.Client, txRef string) (*subscriptionPayment, error) {
+	query := `
+		query SubscriptionPaymentByTxRef($tx_ref: String!) {
+			SubscriptionPayments(where: {tx_ref: {_eq: $tx_ref}}, limit: 1) {` + subscriptionPaymentFields + `}
+		}
+	`
+	var response struct {
+		Payments []subscriptionPayment `json:"SubscriptionPayments"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"tx_ref": txRef}, &response); err != nil {
+		return nil, err
+	}
+	if len(response.Payments) == 0 {
+		return nil, nil
+	}
+	return &response.Payments[0], nil
+}
+
+// startSubscriptionPayment opens a checkout for one billing period of a
+// subscription.
+func startSubscriptionPayment(ctx context.Context, client *hasura.Client, cfg *config.Config, sub *subscriptionRecord, kind string) (*subscriptionPayment, error) {
+	payment := subscriptionPayment{
+		ID:              uuid.New().String(),
+		SubscriptionID:  sub.ID,
+		PlanID:          sub.Plan.ID,
+		TxRef:           subscriptionTxPrefix + uuid.New().String(),
+		Amount:          sub.Plan.Price,
+		Currency:        sub.Plan.Currency,
+		BillingInterval: sub.Plan.BillingInterval,
+		Kind:            kind,
+		Status:          "pending",
+	}
+
+	query := `
+		mutation CreateSubscriptionPayment($object: SubscriptionPayments_insert_input!) {
+			insert_SubscriptionPayments_one(object: $object) {
+				id
+			}
+		}
+	`
+	var inserted struct {
+		InsertSubscriptionPaymentsOne struct {
+			ID string `json:"id"`
+		} `json:"insert_SubscriptionPayments_one"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{
+		"object": map[string]interface{}{
+			"id":               payment.ID,
+			"subscription_id":  payment.SubscriptionID,
+			"plan_id":          payment.PlanID,
+			"tx_ref":           payment.TxRef,
+			"amount":           payment.Amount,
+			"currency":         payment.Currency,
+			"billing_interval": payment.BillingInterval,
+			"kind":             payment.Kind,
+			"status":           payment.Status,
+		},
+	}, &inserted); err != nil {
+		return nil, err
+	}
+
+	checkout, err := paymentProvider.Initiate(ctx, payments.InitiateRequest{
+		TxRef:       payment.TxRef,
+		Amount:      payment.Amount,
+		Currency:    payment.Currency,
+		Title:       "Dishcovery Premium",
+		Description: sub.Plan.Name,
+		CallbackURL: cfg.ChapaCallbackURL,
+		ReturnURL:   cfg.ChapaReturnURL,
+	})
+	if err != nil {
+		if _, err := setSubscriptionPaymentStatus(ctx, client, payment.TxRef, "failed"); err != nil {
+			log.Printf("Error marking subscription payment %s as failed: %v", payment.TxRef, err)
+		}
+		return nil, err
+	}
+
+	query = `
+		mutation SetSubscriptionCheckout($id: uuid!, $checkout_url: String!) {
+			update_SubscriptionPayments_by_pk(pk_columns: {id: $id}, _set: {checkout_url: $checkout_url}) {
+				id
+			}
+		}
+	`
+	var updated struct {
+		UpdateSubscriptionPaymentsByPk *struct {
+			ID string `json:"id"`
+		} `json:"update_SubscriptionPayments_by_pk"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"id": payment.ID, "checkout_url": checkout.CheckoutURL}, &updated); err != nil {
+		return nil, err
+	}
+
+	payment.CheckoutURL = &checkout.CheckoutURL
+	return &payment, nil
+}
+
+// SubscriptionPlansHandler lists the plans users can subscribe to.
+func SubscriptionPlansHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	query := `
+		query SubscriptionPlans {
+			SubscriptionPlans(where: {active: {_eq: true}}, order_by: {price: asc}) {` + subscriptionPlanFields + `}
+		}
+	`
+
+	var response struct {
+		Plans []subscriptionPlan `json:"SubscriptionPlans"`
+	}
+	if err := client.Execute(r.Context(), query, nil, &response); err != nil {
+		log.Printf("Error loading subscription plans: %v", err)
+		http.Error(w, "Error loading subscription plans", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Subscription plans retrieved", response.Plans))
+}
+
+// SubscribeHandler starts a Premium subscription and returns the checkout for
+// its first period. Calling it again while that checkout is open returns the
+// same checkout.
+func SubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req SubscribeRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.PlanCode == "" {
+		http.Error(w, "plan code is required", http.StatusBadRequest)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	query := `
+		query PlanByCode($code: String!) {
+			SubscriptionPlans(where: {code: {_eq: $code}, active: {_eq: true}}, limit: 1) {` + subscriptionPlanFields + `}
+		}
+	`
+	var plans struct {
+		Plans []subscriptionPlan `json:"SubscriptionPlans"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"code": req.PlanCode}, &plans); err != nil {
+		log.Printf("Error loading subscription plan: %v", err)
+		http.Error(w, "Error loading subscription plan", http.StatusInternalServerError)
+		return
+	}
+	if len(plans.Plans) == 0 {
+		http.Error(w, "Subscription plan not found", http.StatusNotFound)
+		return
+	}
+	plan := plans.Plans[0]
+
+	sub, err := getOpenSubscription(r.Context(), client, userID)
+	if err != nil {
+		log.Printf("Error loading subscription: %v", err)
+		http.Error(w, "Error loading subscription", http.StatusInternalServerError)
+		return
+	}
+
+	if sub != nil && sub.Status != "pending" {
+		http.Error(w, "You already have a Premium subscription", http.StatusConflict)
+		return
+	}
+
+	if sub != nil {
+		// Hand back the open checkout for the first period, if any.
+		payment, err := getLatestSubscriptionPayment(r.Context(), client, sub.ID)
+		if err != nil {
+			log.Printf("Error loading subscription payment: %v", err)
+			http.Error(w, "Error loading subscription", http.StatusInternalServerError)
+			return
+		}
+		if payment != nil && payment.Status == "pending" && payment.CheckoutURL != nil && payment.PlanID == plan.ID {
+			json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Subscription already initiated", map[string]interface{}{
+				"subscriptionId": sub.ID,
+				"checkout_url":   *payment.CheckoutURL,
+				"tx_ref":         payment.TxRef,
+			}))
+			return
+		}
+		// The old checkout is for another plan; paying it now is refunded.
+		if err := expirePendingSubscriptionPayments(r.Context(), client, sub.ID); err != nil {
+			log.Printf("Error expiring subscription payments: %v", err)
+			http.Error(w, "Error updating subscription", http.StatusInternalServerError)
+			return
+		}
+		if _, err := updateSubscription(r.Context(), client, sub.ID, []string{"pending"}, map[string]interface{}{"plan_id": plan.ID}); err != nil {
+			log.Printf("Error updating subscription plan: %v", err)
+			http.Error(w, "Error updating subscription", http.StatusInternalServerError)
+			return
+		}
+		sub.Plan = &plan
+	} else {
+		sub = &subscriptionRecord{ID: uuid.New().String(), UserID: userID, Status: "pending", Plan: &plan}
+
+		query = `
+			mutation CreateSubscription($object: Subscriptions_insert_input!) {
+				insert_Subscriptions_one(object: $object) {
+					id
+				}
+			}
+		`
+		var inserted struct {
+			InsertSubscriptionsOne struct {
+				ID string `json:"id"`
+			} `json:"insert_Subscriptions_one"`
+		}
+		if err := client.Execute(r.Context(), query, map[string]interface{}{
+			"object": map[string]interface{}{
+				"id":      sub.ID,
+				"user_id": userID,
+				"plan_id": plan.ID,
+				"status":  "pending",
+			},
+		}, &inserted); err != nil {
+			if hasura.IsUniqueViolation(err) {
+				http.Error(w, "Subscription is already being set up, retry shortly", http.StatusConflict)
+				return
+			}
+			log.Printf("Error creating subscription: %v", err)
+			http.Error(w, "Error creating subscription", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if _, ok := checkPaymentRisk(w, r, client, cfg, userID, "subscription", plan.Price, plan.Currency); !ok {
+		return
+	}
+
+	payment, err := startSubscriptionPayment(r.Context(), client, cfg, sub, "initial")
+	if err != nil {
+		writeProviderError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Subscription initiated", map[string]interface{}{
+		"subscriptionId": sub.ID,
+		"checkout_url":   *payment.CheckoutURL,
+		"tx_ref":         payment.TxRef,
+	}))
+}
+
+// MySubscriptionHandler returns the caller's current subscription along with
+// any checkout waiting to be paid.
+func MySubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	sub, err := getOpenSubscription(r.Context(), client, userID)
+	if err != nil {
+		log.Printf("Error loading subscription: %v", err)
+		http.Error(w, "Error loading subscription", http.StatusInternalServerError)
+		return
+	}
+	if sub == nil {
+		json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "No subscription", nil))
+		return
+	}
+
+	data := map[string]interface{}{"subscription": sub, "renewal": manualRenewal}
+	payment, err := getLatestSubscriptionPayment(r.Context(), client, sub.ID)
+	if err != nil {
+		log.Printf("Error loading subscription payment: %v", err)
+		http.Error(w, "Error loading subscription", http.StatusInternalServerError)
+		return
+	}
+	if payment != nil && payment.Status == "pending" {
+		data["pendingPayment"] = payment
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Subscription retrieved", data))
+}
+
+// CancelSubscriptionHandler stops renewal checkouts for a subscription.
+// Access lasts until the end of the paid period; a subscription that was
+// never paid is cancelled straight away.
+func CancelSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	setCancelAtPeriodEnd(w, r, true)
+}
+
+// ResumeSubscriptionHandler undoes a cancellation before the period ends, so
+// the next renewal checkout is sent again.
+func ResumeSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	setCancelAtPeriodEnd(w, r, false)
+}
+
+func setCancelAtPeriodEnd(w http.ResponseWriter, r *http.Request, cancel bool) {
+	userID, _ := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	sub, err := getOpenSubscription(r.Context(), client, userID)
+	if err != nil {
+		log.Printf("Error loading subscription: %v", err)
+		http.Error(w, "Error loading subscription", http.StatusInternalServerError)
+		return
+	}
+	if sub == nil {
+		http.Error(w, "No active subscription", http.StatusNotFound)
+		return
+	}
+
+	action := "subscription.resumed"
+	fields := map[string]interface{}{"cancel_at_period_end": cancel}
+	fromStatuses := []string{"active", "past_due"}
+	switch {
+	case cancel && sub.Status == "pending":
+		action = "subscription.canceled"
+		fields["status"] = "canceled"
+		fields["canceled_at"] = "now()"
+		fromStatuses = []string{"pending"}
+	case cancel:
+		action = "subscription.cancel_scheduled"
+		fields["canceled_at"] = "now()"
+	case sub.Status == "pending":
+		http.Error(w, "Subscription is not active", http.StatusConflict)
+		return
+	default:
+		fields["canceled_at"] = nil
+	}
+
+	changed, err := updateSubscription(r.Context(), client, sub.ID, fromStatuses, fields)
+	if err != nil {
+		log.Printf("Error updating subscription: %v", err)
+		http.Error(w, "Error updating subscription", http.StatusInternalServerError)
+		return
+	}
+	if !changed {
+		http.Error(w, "Subscription changed, please retry", http.StatusConflict)
+		return
+	}
+
+	recordAudit(r.Context(), client, userID, action, "Subscriptions", sub.ID, map[string]interface{}{
+		"current_period_end": sub.CurrentPeriodEnd,
+	})
+
+	message := "Subscription will not renew"
+	if !cancel {
+		message = "Renewal checkout will be sent before the period ends"
+	}
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", message, map[string]interface{}{
+		"subscriptionId":    sub.ID,
+		"cancelAtPeriodEnd": cancel,
+		"currentPeriodEnd":  sub.CurrentPeriodEnd,
+	}))
+}
+
+// applySubscriptionCharge applies a verified provider result to a
+// subscription payment, starting or extending the paid period on success.
+func applySubscriptionCharge(ctx context.Context, client *hasura.Client, txRef, status string) error {
+	switch status {
+	case payments.StatusSuccess:
+		if err := activateSubscriptionPeriod(ctx, client, txRef); err != nil {
+			return fmt.Errorf("error activating subscription: %w", err)
+		}
+	case payments.StatusFailed:
+		if _, err := setSubscriptionPaymentStatus(ctx, client, txRef, "failed"); err != nil {
+			return fmt.Errorf("error marking subscription payment as failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// activateSubscriptionPeriod marks a subscription payment completed and
+// extends its subscription by the interval the payment was priced for, on
+// the plan it was opened for. Renewals continue from the end of the current
+// period; first payments start now. A payment that can no longer be applied,
+// because its checkout was superseded or the subscription has ended, is
+// refunded.
+func activateSubscriptionPeriod(ctx context.Context, client *hasura.Client, txRef string) error {
+	payment, err := getSubscriptionPayment(ctx, client, txRef)
+	if err != nil || payment == nil {
+		return err
+	}
+
+	query := `
+		query SubscriptionByID($id: uuid!) {
+			Subscriptions(where: {id: {_eq: $id}}) {` + subscriptionFields + `}
+			SubscriptionPlans {` + subscriptionPlanFields + `}
+		}
+	`
+	subscriptions, err := loadSubscriptions(ctx, client, query, map[string]interface{}{"id": payment.SubscriptionID})
+	if err != nil {
+		return err
+	}
+
+	// A first payment starts a pending subscription; a renewal extends a
+	// running one.
+	fromStatuses := []string{"active", "past_due"}
+	if payment.Kind == "initial" {
+		fromStatuses = []string{"pending"}
+	}
+	switch {
+	case payment.Status == "completed" || payment.Status == "refunding" || payment.Status == "refunded":
+		return nil
+	case payment.Status != "pending":
+		return refundSubscriptionPayment(ctx, client, payment, "checkout was superseded")
+	case len(subscriptions) == 0 || !slices.Contains(fromStatuses, subscriptions[0].Status):
+		return refundSubscriptionPayment(ctx, client, payment, "subscription is no longer open")
+	}
+	sub := subscriptions[0]
+
+	changed, err := setSubscriptionPaymentStatus(ctx, client, txRef, "completed")
+	if err != nil || !changed {
+		return err
+	}
+
+	start := time.Now()
+	if end, ok := parseTimestamp(sub.CurrentPeriodEnd); ok && payment.Kind != "initial" {
+		start = end
+	}
+	end := addBillingInterval(start, payment.BillingInterval)
+
+	updated, err := updateSubscription(ctx, client, sub.ID, fromStatuses, map[string]interface{}{
+		"status":               "active",
+		"plan_id":              payment.PlanID,
+		"current_period_start": formatTimestamp(start),
+		"current_period_end":   formatTimestamp(end),
+		"grace_until":          nil,
+	})
+	if err != nil {
+		return err
+	}
+	if !updated {
+		// The subscription ended while the payment was being applied.
+		return refundSubscriptionPayment(ctx, client, payment, "subscription is no longer open")
+	}
+
+	recordAudit(ctx, client, "", "subscription.period_paid", "Subscriptions", sub.ID, map[string]interface{}{
+		"tx_ref":             txRef,
+		"plan_id":            payment.PlanID,
+		"current_period_end": formatTimestamp(end),
+	})
+	return nil
+}
+
+// refundSubscriptionPayment returns a payment that bought nothing. It runs
+// once per payment; a refund the provider rejects is left in refunding and
+// audited for an admin to settle by hand.
+func refundSubscriptionPayment(ctx context.Context, client *hasura.Client, payment *subscriptionPayment, reason string) error {
+	changed, err := moveSubscriptionPayment(ctx, client, payment.TxRef, []string{"pending", "expired", "completed"}, "refunding")
+	if err != nil || !changed {
+		return err
+	}
+
+	result, err := paymentProvider.Refund(ctx, payments.RefundRequest{
+		TxRef:     payment.TxRef,
+		Amount:    payment.Amount,
+		Reason:    "Subscription payment not applied: " + reason,
+		Reference: payment.ID,
+	})
+	if err != nil {
+		log.Printf("Error refunding subscription payment %s: %v", payment.TxRef, err)
+		recordAudit(ctx, client, "", "subscription.payment_refund_failed", "SubscriptionPayments", payment.ID, map[string]interface{}{
+			"tx_ref": payment.TxRef,
+			"reason": reason,
+			"error":  err.Error(),
+		})
+		return nil
+	}
+	if result.Status == payments.StatusSuccess || result.Status == payments.StatusRefunded {
+		if _, err := moveSubscriptionPayment(ctx, client, payment.TxRef, []string{"refunding"}, "refunded"); err != nil {
+			log.Printf("Error marking subscription payment %s as refunded: %v", payment.TxRef, err)
+		}
+	}
+
+	recordAudit(ctx, client, "", "subscription.payment_refunded", "SubscriptionPayments", payment.ID, map[string]interface{}{
+		"tx_ref":   payment.TxRef,
+		"amount":   payment.Amount,
+		"currency": payment.Currency,
+		"reason":   reason,
+	})
+	return nil
+}
+
+// sendRenewalEmail sends the user the checkout for their next period.
+// Failures are logged; the checkout is also shown in their subscription.
+func sendRenewalEmail(ctx context.Context, client *hasura.Client, cfg *config.Config, sub *subscriptionRecord, payment *subscriptionPayment) {
+	query := `
+		query RenewalEmailDetails($id: uuid!) {
+			Users_by_pk(id: $id) {
+				email
+				username
+			}
+		}
+	`
+	var response struct {
+		User *struct {
+			Email    string `json:"email"`
+			Username string `json:"username"`
+		} `json:"Users_by_pk"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"id": sub.UserID}, &response); err != nil {
+		log.Printf("Error loading subscription %s email details: %v", sub.ID, err)
+		return
+	}
+	if response.User == nil || response.User.Email == "" || payment.CheckoutURL == nil {
+		return
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "Hi %s,\n\n", response.User.Username)
+	if end, ok := parseTimestamp(sub.CurrentPeriodEnd); ok {
+		fmt.Fprintf(&body, "Your %s subscription ends on %s.\n", sub.Plan.Name, end.Format("2 January 2006"))
+	}
+	fmt.Fprintf(&body, "Renew it for %.2f %s here:\n\n%s\n", payment.Amount, payment.Currency, *payment.CheckoutURL)
+
+	if err := newMailer(cfg).Send(response.User.Email, "Renew your Dishcovery Premium subscription", body.String()); err != nil {
+		log.Printf("Error emailing renewal for subscription %s: %v", sub.ID, err)
+	}
+}
+
+// RunManualSubscriptionRenewals opens renewal checkouts for subscriptions
+// nearing the end of their period and emails them to the subscriber; nothing
+// is charged until the subscriber pays one. It also moves lapsed
+// subscriptions through grace, expiry and scheduled cancellation.
+func RunManualSubscriptionRenewals(ctx context.Context) {
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+	now := time.Now()
+
+	query := `
+		query SubscriptionsDue($renew_before: timestamptz!) {
+			Subscriptions(where: {
+				status: {_in: ["active", "past_due"]},
+				cancel_at_period_end: {_eq: false},
+				current_period_end: {_lte: $renew_before}
+			}) {` + subscriptionFields + `}
+			SubscriptionPlans {` + subscriptionPlanFields + `}
+		}
+	`
+	due, err := loadSubscriptions(ctx, client, query, map[string]interface{}{
+		"renew_before": formatTimestamp(now.Add(cfg.SubscriptionRenewalWindow)),
+	})
+	if err != nil {
+		log.Printf("Error loading subscriptions due for renewal: %v", err)
+		return
+	}
+
+	for i := range due {
+		sub := &due[i]
+		if sub.Plan == nil {
+			continue
+		}
+
+		latest, err := getLatestSubscriptionPayment(ctx, client, sub.ID)
+		if err != nil {
+			log.Printf("Error loading payments for subscription %s: %v", sub.ID, err)
+			continue
+		}
+		if latest != nil && latest.Kind == "renewal" {
+			createdAt, ok := parseTimestamp(&latest.CreatedAt)
+			if ok && now.Sub(createdAt) < renewalRetryInterval {
+				continue
+			}
+			if latest.Status == "pending" {
+				if _, err := setSubscriptionPaymentStatus(ctx, client, latest.TxRef, "expired"); err != nil {
+					log.Printf("Error expiring subscription payment %s: %v", latest.TxRef, err)
+				}
+			}
+		}
+
+		payment, err := startSubscriptionPayment(ctx, client, cfg, sub, "renewal")
+		if err != nil {
+			log.Printf("Error opening renewal checkout for subscription %s: %v", sub.ID, err)
+			continue
+		}
+		log.Printf("Opened renewal checkout for subscription %s", sub.ID)
+		sendRenewalEmail(ctx, client, cfg, sub, payment)
+	}
+
+	nowStr := formatTimestamp(now)
+	transitions := []struct {
+		name  string
+		query string
+	}{
+		{"canceled", `
+			mutation EndCanceledSubscriptions($now: timestamptz!) {
+				update_Subscriptions(
+					where: {status: {_in: ["active", "past_due"]}, cancel_at_period_end: {_eq: true}, current_period_end: {_lte: $now}},
+					_set: {status: "canceled", updated_at: $now}
+				) {
+					affected_rows
+				}
+			}
+		`},
+		{"expired", `
+			mutation ExpireLapsedSubscriptions($now: timestamptz!) {
+				update_Subscriptions(
+					where: {status: {_eq: "past_due"}, grace_until: {_lte: $now}},
+					_set: {status: "expired", updated_at: $now}
+				) {
+					affected_rows
+				}
+			}
+		`},
+	}
+	for _, transition := range transitions {
+		var response struct {
+			UpdateSubscriptions struct {
+				AffectedRows int `json:"affected_rows"`
+			} `json:"update_Subscriptions"`
+		}
+		if err := client.Execute(ctx, transition.query, map[string]interface{}{"now": nowStr}, &response); err != nil {
+			log.Printf("Error moving subscriptions to %s: %v", transition.name, err)
+			continue
+		}
+		if response.UpdateSubscriptions.AffectedRows > 0 {
+			log.Printf("Moved %d subscriptions to %s", response.UpdateSubscriptions.AffectedRows, transition.name)
+		}
+	}
+
+	// Unpaid periods enter the grace period, which lasts a fixed time from
+	// the end of the period.
+	query = `
+		query LapsedSubscriptions($now: timestamptz!) {
+			Subscriptions(where: {status: {_eq: "active"}, cancel_at_period_end: {_eq: false}, current_period_end: {_lte: $now}}) {` + subscriptionFields + `}
+		}
+	`
+	lapsed, err := loadSubscriptions(ctx, client, query, map[string]interface{}{"now": nowStr})
+	if err != nil {
+		log.Printf("Error loading lapsed subscriptions: %v", err)
+		return
+	}
+	for _, sub := range lapsed {
+		end, ok := parseTimestamp(sub.CurrentPeriodEnd)
+		if !ok {
+			continue
+		}
+		graceUntil := end.Add(cfg.SubscriptionGracePeriod)
+		if _, err := updateSubscription(ctx, client, sub.ID, []string{"active"}, map[string]interface{}{
+			"status":      "past_due",
+			"grace_until": formatTimestamp(graceUntil),
+		}); err != nil {
+			log.Printf("Error moving subscription %s to past_due: %v", sub.ID, err)
+			continue
+		}
+		recordAudit(ctx, client, "", "subscription.past_due", "Subscriptions", sub.ID, map[string]interface{}{
+			"grace_until": formatTimestamp(graceUntil),
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"backend/config"
+	"backend/hasura"
+	"backend/payments"
+
+	"github.com/google/uuid"
+)
+
+// tipTxPrefix marks provider transactions that pay a tip.
+const tipTxPrefix = "tip-"
+
+const maxTipMessageLength = 280
+
+// tipPresets are the one-tap tip amounts offered per currency.
+var tipPresets = map[string]map[string]float64{
+	"ETB": {"small": 20, "medium": 50, "large": 100},
+	"USD": {"small": 1, "medium": 3, "large": 5},
+	"EUR": {"small": 1, "medium": 3, "large": 5},
+}
+
+type TipRequest struct {
+	RecipeID string `json:"recipeId"`
+	// Preset picks one of tipPresets; otherwise Amount is used.
+	Preset   string  `json:"preset"`
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency"`
+	Message  string  `json:"message"`
+}
+
+type tipRecord struct {
+	ID           string  `json:"id"`
+	RecipeID     string  `json:"recipe_id"`
+	AuthorID     string  `json:"author_id"`
+	TipperID     string  `json:"tipper_id"`
+	Amount       float64 `json:"amount"`
+	Currency     string  `json:"currency"`
+	Message      *string `json:"message"`
+	Status       string  `json:"status"`
+	TxRef        string  `json:"tx_ref"`
+	SubaccountID *string `json:"subaccount_id"`
+	PlatformFee  float64 `json:"platform_fee"`
+	CreatedAt    string  `json:"created_at"`
+}
+
+const tipFields = `
+	id
+	recipe_id
+	author_id
+	tipper_id
+	amount
+	currency
+	message
+	status
+	tx_ref
+	subaccount_id
+	platform_fee
+	created_at
+`
+
+func isTipTxRef(txRef string) bool {
+	return strings.HasPrefix(txRef, tipTxPrefix)
+}
+
+// TipPresetsHandler returns the preset tip amounts for each currency.
+func TipPresetsHandler(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Tip presets retrieved", tipPresets))
+}
+
+// TipHandler opens a checkout for a tip to a recipe's author, using a preset
+// or custom amount and an optional message shown to the author.
+func TipHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req TipRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.RecipeID == "" {
+		http.Error(w, "recipe ID is required", http.StatusBadRequest)
+		return
+	}
+
+	currency := strings.ToUpper(req.Currency)
+	if !supportedCurrencies[currency] {
+		http.Error(w, fmt.Sprintf("unsupported currency: %s. Supported currencies are: ETB, USD, EUR", currency), http.StatusBadRequest)
+		return
+	}
+
+	amount := roundMoney(req.Amount)
+	if req.Preset != "" {
+		preset, ok := tipPresets[currency][req.Preset]
+		if !ok {
+			http.Error(w, "unknown tip preset", http.StatusBadRequest)
+			return
+		}
+		amount = preset
+	}
+	if err := validateAmount(amount, currency); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	message := strings.TrimSpace(req.Message)
+	if utf8.RuneCountInString(message) > maxTipMessageLength {
+		http.Error(w, fmt.Sprintf("message must be at most %d characters", maxTipMessageLength), http.StatusBadRequest)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	authorID, err := getRecipeAuthorID(r.Context(), client, req.RecipeID)
+	if err != nil {
+		log.Printf("Error loading recipe author: %v", err)
+		http.Error(w, "Error loading recipe", http.StatusInternalServerError)
+		return
+	}
+	if authorID == "" {
+		http.Error(w, "Recipe not found", http.StatusNotFound)
+		return
+	}
+	if authorID == userID {
+		http.Error(w, "You cannot tip your own recipe", http.StatusBadRequest)
+		return
+	}
+
+	payoutAccount, err := getPayoutAccount(r.Context(), client, authorID)
+	if err != nil {
+		log.Printf("Error loading payout account: %v", err)
+		http.Error(w, "Error loading recipe author", http.StatusInternalServerError)
+		return
+	}
+	subaccountID, split := payoutRoute(cfg, payoutAccount, currency)
+
+	if _, ok := checkPaymentRisk(w, r, client, cfg, userID, "tip", amount, currency); !ok {
+		return
+	}
+
+	tip := map[string]interface{}{
+		"id":           uuid.New().String(),
+		"recipe_id":    req.RecipeID,
+		"author_id":    authorID,
+		"tipper_id":    userID,
+		"amount":       amount,
+		"currency":     currency,
+		"status":       "pending",
+		"tx_ref":       tipTxPrefix + uuid.New().String(),
+		"platform_fee": split.Fee(amount),
+	}
+	for column, value := range splitFields(split) {
+		tip[column] = value
+	}
+	if message != "" {
+		tip["message"] = message
+	}
+	if subaccountID != "" {
+		tip["subaccount_id"] = subaccountID
+	}
+	txRef := tip["tx_ref"].(string)
+
+	query := `
+		mutation CreateTip($object: Tips_insert_input!) {
+			insert_Tips_one(object: $object) {
+				id
+			}
+		}
+	`
+	var created struct {
+		InsertTipsOne struct {
+			ID string `json:"id"`
+		} `json:"insert_Tips_one"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"object": tip}, &created); err != nil {
+		log.Printf("Error creating tip: %v", err)
+		http.Error(w, "Error creating tip", http.StatusInternalServerError)
+		return
+	}
+
+	checkout, err := paymentProvider.Initiate(r.Context(), payments.InitiateRequest{
+		TxRef:       txRef,
+		Amount:      amount,
+		Currency:    currency,
+		Title:       "Recipe Tip",
+		Description: "Tip for a recipe author",
+		CallbackURL: cfg.ChapaCallbackURL,
+		ReturnURL:   cfg.ChapaReturnURL,
+
+		SubaccountID: subaccountID,
+		Split:        split,
+	})
+	if err != nil {
+		if _, err := setTipStatus(r.Context(), client, txRef, "failed"); err != nil {
+			log.Printf("Error marking tip %s as failed: %v", txRef, err)
+		}
+		writeProviderError(w, err)
+		return
+	}
+
+	query = `
+		mutation SetTipCheckout($tx_ref: String!, $checkout_url: String!) {
+			update_Tips(where: {tx_ref: {_eq: $tx_ref}}, _set: {checkout_url: $checkout_url}) {
+				affected_rows
+			}
+		}
+	`
+	var updated struct {
+		UpdateTips struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_Tips"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"tx_ref": txRef, "checkout_url": checkout.CheckoutURL}, &updated); err != nil {
+		log.Printf("Error storing tip checkout URL: %v", err)
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Tip initiated", map[string]interface{}{
+		"tipId":        created.InsertTipsOne.ID,
+		"checkout_url": checkout.CheckoutURL,
+		"tx_ref":       txRef,
+		"amount":       amount,
+		"currency":     currency,
+	}))
+}
+
+// setTipStatus moves a pending tip to status, returning the tip if this call
+// made the transition.
+func setTipStatus(ctx context.Context, client *hasura.Client, txRef, status string) (*tipRecord, error) {
+	query := `
+		mutation SetTipStatus($tx_ref: String!, $status: String!) {
+			update_Tips(where: {tx_ref: {_eq: $tx_ref}, status: {_eq: "pending"}}, _set: {status: $status}) {
+				returning {` + tipFields + `}
+			}
+		}
+	`
+	var response struct {
+		UpdateTips struct {
+			Returning []tipRecord `json:"returning"`
+		} `json:"update_Tips"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"tx_ref": txRef, "status": status}, &response); err != nil {
+		return nil, err
+	}
+	if len(response.UpdateTips.Returning) == 0 {
+		return nil, nil
+	}
+	return &response.UpdateTips.Returning[0], nil
+}
+
+// applyTipCharge applies a verified provider result to a tip and credits
+// the author once it is paid.
+func applyTipCharge(ctx context.Context, client *hasura.Client, txRef, status string) error {
+	var tipStatus string
+	switch status {
+	case payments.StatusSuccess:
+		tipStatus = "completed"
+	case payments.StatusFailed:
+		tipStatus = "failed"
+	default:
+		return nil
+	}
+
+	tip, err := setTipStatus(ctx, client, txRef, tipStatus)
+	if err != nil {
+		return fmt.Errorf("error updating tip: %w", err)
+	}
+
+	if tip != nil && tipStatus == "completed" {
+		object := map[string]interface{}{
+			"author_id":    tip.AuthorID,
+			"tip_id":       tip.ID,
+			"type":         "tip",
+			"gross_amount": tip.Amount,
+			"platform_fee": tip.PlatformFee,
+			"net_amount":   roundMoney(tip.Amount - tip.PlatformFee),
+			"currency":     tip.Currency,
+		}
+		if tip.SubaccountID != nil {
+			object["subaccount_id"] = *tip.SubaccountID
+		}
+		insertEarning(ctx, client, object)
+	}
+	return nil
+}
+
+// TipsReceivedHandler lists the completed tips on the caller's recipes with
+// the messages tippers left.
+func TipsReceivedHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := requestUser(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	query := `
+		query TipsReceived($author_id: uuid!) {
+			Tips(where: {author_id: {_eq: $author_id}, status: {_eq: "completed"}}, order_by: {created_at: desc}) {` + tipFields + `}
+		}
+	`
+	var response struct {
+		Tips []tipRecord `json:"Tips"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"author_id": userID}, &response); err != nil {
+		log.Printf("Error loading tips: %v", err)
+		http.Error(w, "Error loading tips", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Tips retrieved", response.Tips))
+}
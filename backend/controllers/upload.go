@@ -2,26 +2,44 @@ package controllers
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
+	"backend/config"
 	"backend/hasura"
+	"backend/images"
+	"backend/storage"
 
-	"github.com/cloudinary/cloudinary-go/v2"
-	"github.com/cloudinary/cloudinary-go/v2/api/uploader"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 )
 
+// blobStore keeps uploaded files; main installs it at startup.
+var blobStore storage.BlobStore
+
+// SetBlobStore installs the store used by the upload handlers.
+func SetBlobStore(store storage.BlobStore) {
+	blobStore = store
+}
+
 type UploadImagesRequest struct {
 	Input struct {
 		UserInput struct {
 			Files []string `json:"files"`
+			// RecipeID, when set, attaches the uploaded images to this
+			// recipe of the uploader.
+			RecipeID string `json:"recipeId"`
 		} `json:"userInput"`
 	} `json:"input"`
 }
@@ -83,22 +101,15 @@ func UploadImagesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cloudName := os.Getenv("CLOUDINARY_CLOUD_NAME")
-	apiKey := os.Getenv("CLOUDINARY_API_KEY")
-	apiSecret := os.Getenv("CLOUDINARY_API_SECRET")
-
-	cld, err := cloudinary.NewFromParams(cloudName, apiKey, apiSecret)
-	if err != nil {
-		log.Printf("Failed to initialize Cloudinary: %v", err)
-		http.Error(w, `{"error": "Failed to initialize Cloudinary"}`, http.StatusInternalServerError)
-		return
-	}
-
 	if r.Method != http.MethodPost {
 		http.Error(w, `{"error": "Only POST allowed"}`, http.StatusMethodNotAllowed)
 		return
 	}
 
+	cfg := config.LoadConfig()
+	// Base64 inflates each file by a third.
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.UploadMaxTotalSize/3*4+uploadOverhead)
+
 	var req UploadImagesRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, `{"error": "Invalid JSON payload"}`, http.StatusBadRequest)
@@ -111,9 +122,40 @@ func UploadImagesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var urls []string
+	if len(files) > cfg.UploadMaxFiles {
+		http.Error(w, fmt.Sprintf(`{"error": "At most %d files can be uploaded at once"}`, cfg.UploadMaxFiles), http.StatusBadRequest)
+		return
+	}
 
+	client := hasura.NewClient(cfg)
+	recipeID := req.Input.UserInput.RecipeID
+	if recipeID != "" {
+		if status, err := checkUploadRecipe(r.Context(), client, recipeID, userId); err != nil {
+			if status == http.StatusInternalServerError {
+				log.Printf("Error loading recipe author: %v", err)
+				err = errors.New("Error loading recipe")
+			}
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), status)
+			return
+		}
+	}
+
+	_, role := requestUser(r)
+	quota, err := loadUploadQuota(r.Context(), client, cfg, userId, role)
+	if err != nil {
+		log.Printf("Error loading upload quota: %v", err)
+		http.Error(w, `{"error": "Error checking upload quota"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// A bad file is reported in its result rather than failing the batch.
+	// Files are uploaded concurrently, each into its own result.
+	results := make([]imageUploadResult, len(files))
+	pool := newUploadPool(cfg.UploadConcurrency)
 	for i, file := range files {
+		result := &results[i]
+		result.Index = i
+
 		// Clean base64 if it includes a prefix like "data:image/png;base64,..."
 		if commaIdx := bytes.IndexByte([]byte(file), ','); commaIdx != -1 {
 			file = file[commaIdx+1:]
@@ -122,28 +164,689 @@ func UploadImagesHandler(w http.ResponseWriter, r *http.Request) {
 		imageData, err := base64.StdEncoding.DecodeString(file)
 		if err != nil {
 			log.Printf("Failed to decode base64 at index %d: %v", i, err)
-			http.Error(w, `{"error": "Invalid base64 image"}`, http.StatusBadRequest)
-			return
+			result.Error = "invalid base64 image"
+			continue
+		}
+		if int64(len(imageData)) > cfg.UploadMaxFileSize {
+			result.Error = errFileTooLarge.Error()
+			continue
+		}
+		reservation, err := quota.reserve(r.Context(), client, int64(len(imageData)))
+		if err != nil {
+			result.fail(err)
+			continue
 		}
 
-		// Create a folder structure that includes user ID
-		folderPath := fmt.Sprintf("RecipeImages/%s", userId)
-
-		uploadResp, err := cld.Upload.Upload(r.Context(), bytes.NewReader(imageData), uploader.UploadParams{
-			Folder: folderPath,
+		pool.Go(func() {
+			defer reservation.release(context.Background(), client)
+			uploadImageWithRetry(r.Context(), client, cfg, userId, result, bytes.NewReader(imageData))
 		})
+	}
+	pool.Wait()
+
+	if recipeID != "" {
+		if err := attachUploadedImages(r.Context(), client, userId, recipeID, results); err != nil {
+			log.Printf("Error attaching uploads to recipe %s: %v", recipeID, err)
+		}
+	}
+	writeUploadResults(w, results)
+}
+
+// uploadOverhead allows for JSON framing or multipart headers and
+// boundaries on top of the file bytes an upload request may carry.
+const uploadOverhead = 1 << 20
+
+var (
+	errFileTooLarge   = errors.New("file exceeds the upload size limit")
+	errUploadTooLarge = errors.New("upload exceeds the total size limit")
+)
+
+// imageUploadResult reports one file of an upload batch. Exactly one of URL
+// and Error is set.
+type imageUploadResult struct {
+	Index       int                     `json:"index"`
+	Filename    string                  `json:"filename,omitempty"`
+	URL         string                  `json:"url,omitempty"`
+	Key         string                  `json:"key,omitempty"`
+	ContentType string                  `json:"contentType,omitempty"`
+	Width       int                     `json:"width,omitempty"`
+	Height      int                     `json:"height,omitempty"`
+	Bytes       int64                   `json:"bytes,omitempty"`
+	Variants    map[string]imageVariant `json:"variants,omitempty"`
+	Placeholder *imagePlaceholder       `json:"placeholder,omitempty"`
+	// Reused is set when the file duplicates an earlier upload of the same
+	// user, which is returned instead of storing it again.
+	Reused bool   `json:"reused,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// ID and Status are set for completed direct uploads, which are
+	// processing until the upload's row says stored or failed.
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status,omitempty"`
+
+	// staged is the direct upload the image was read from. It is
+	// promoted in place when stripping metadata leaves it unchanged.
+	staged string
+}
+
+// imageVariant is a resized copy of an upload. Generated variants are
+// stored as JPEG and as WebP; stores that resize on delivery pick the
+// format themselves, and their variants have no keys.
+type imageVariant struct {
+	URL     string `json:"url"`
+	Key     string `json:"key,omitempty"`
+	WebPURL string `json:"webpUrl,omitempty"`
+	WebPKey string `json:"webpKey,omitempty"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+}
+
+// imagePlaceholder is shown while an image loads: a BlurHash and an inline
+// LQIP data URI for generated variants, or a blurred rendition URL from
+// stores that transform on delivery.
+type imagePlaceholder struct {
+	BlurHash string `json:"blurhash,omitempty"`
+	DataURI  string `json:"dataUri,omitempty"`
+	URL      string `json:"url,omitempty"`
+}
+
+// sizeLimitedReader fails once a file, or the request as a whole, goes
+// over its byte allowance. totalLeft is shared by every file of a request.
+type sizeLimitedReader struct {
+	r         io.Reader
+	fileLeft  int64
+	totalLeft *int64
+	err       error
+}
+
+func (s *sizeLimitedReader) Read(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	n, err := s.r.Read(p)
+	s.fileLeft -= int64(n)
+	*s.totalLeft -= int64(n)
+	switch {
+	case s.fileLeft < 0:
+		s.err = errFileTooLarge
+	case *s.totalLeft < 0:
+		s.err = errUploadTooLarge
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	return n, err
+}
+
+func imageLimits(cfg *config.Config) images.Limits {
+	return images.Limits{
+		MaxWidth:  cfg.ImageMaxWidth,
+		MaxHeight: cfg.ImageMaxHeight,
+		MaxPixels: cfg.ImageMaxPixels,
+	}
+}
+
+// uploadFolder is where a user's uploads are stored.
+func uploadFolder(userID string) string {
+	return fmt.Sprintf("RecipeImages/%s", userID)
+}
+
+// uploadImage checks that src is an image within the configured limits,
+// strips its metadata and stores it in the user's folder together with its
+// variants, describing the stored files in result. The sanitized copy is streamed
+// to the store as it is produced, and the stored files are registered as
+// an upload of the user. Anything stored is removed again when a later
+// step fails.
+func uploadImage(ctx context.Context, client *hasura.Client, cfg *config.Config, userID string, result *imageUploadResult, src io.ReadSeeker) error {
+	folder := uploadFolder(userID)
+	info, err := images.Inspect(src, imageLimits(cfg))
+	if err != nil {
+		return err
+	}
+	result.ContentType = info.ContentType
+	result.Width = info.Width
+	result.Height = info.Height
+
+	// The pixels are decoded for the perceptual hash and, for stores that
+	// cannot resize on delivery, to render variants; this also proves the
+	// pixel data decodes. There is no WebP decoder in the standard library,
+	// and images beyond the decode limit would take too much memory, so
+	// those uploads have no hash and no generated variants.
+	transformer, transforms := blobStore.(storage.Transformer)
+	picture, err := images.Decode(ctx, src, info, cfg.ImageDecodeMaxPixels)
+	if err != nil && err != images.ErrNoDecoder && err != images.ErrTooLarge {
+		return err
+	}
+	var hash *images.Hash
+	var similar []similarUpload
+	if picture != nil {
+		h := picture.Hash()
+		hash = &h
+		if similar, err = findSimilarUploads(ctx, client, h); err != nil {
+			return err
+		}
+		// A user uploading the same image again gets the existing upload.
+		if own := closestUploadOf(similar, userID); own != nil {
+			reuseUpload(result, own)
+			log.Printf("Image %d duplicates upload %s; reusing it", result.Index, own.ID)
+			return nil
+		}
+	}
+
+	name := uuid.New().String()
+	key := fmt.Sprintf("%s/%s.%s", folder, name, info.Extension())
+	object, err := storeOriginal(ctx, result, key, src, info)
+	if err != nil {
+		return err
+	}
+
+	result.URL = object.URL
+	result.Key = object.Key
+	result.Bytes = object.Size
+
+	switch {
+	case transforms:
+		result.Variants = make(map[string]imageVariant, len(images.Variants))
+		for _, spec := range images.Variants {
+			width, height := spec.Size(info.Width, info.Height)
+			result.Variants[spec.Name] = imageVariant{
+				URL:    transformer.VariantURL(object.Key, spec.Width, spec.Height, spec.Crop),
+				Width:  width,
+				Height: height,
+			}
+		}
+		result.Placeholder = &imagePlaceholder{URL: transformer.PlaceholderURL(object.Key)}
+	case picture != nil:
+		if err := storeVariants(ctx, folder, name, picture, result); err != nil {
+			discardUpload(ctx, result)
+			return err
+		}
+	}
+
+	uploadID, err := registerUpload(ctx, client, userID, result, hash)
+	if err != nil {
+		discardUpload(ctx, result)
+		return err
+	}
+	flagDuplicateUploads(ctx, client, uploadID, userID, similar)
+
+	log.Printf("Uploaded image %d to: %s", result.Index, result.URL)
+	return nil
+}
+
+// storeOriginal stores the sanitized copy of src under key. A staged
+// direct upload that sanitizing leaves unchanged is promoted within the
+// store instead, so its bytes are not sent to the store a second time.
+func storeOriginal(ctx context.Context, result *imageUploadResult, key string, src io.ReadSeeker, info *images.Info) (*storage.Object, error) {
+	direct, ok := blobStore.(storage.DirectUploader)
+	original, seekable := src.(io.ReaderAt)
+	if result.staged == "" || !ok || !seekable {
+		return putSanitized(ctx, key, src, info)
+	}
+
+	size, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	clean, err := os.CreateTemp("", "sanitized-*")
+	if err != nil {
+		return nil, err
+	}
+	defer removeSpool(clean)
+	unchanged := &sameBytesWriter{r: io.NewSectionReader(original, 0, size)}
+	if err := images.Sanitize(io.MultiWriter(clean, unchanged), src, info.Format); err != nil {
+		return nil, err
+	}
+	if unchanged.matched(size) {
+		object, err := direct.Promote(ctx, result.staged, key, info.ContentType)
+		if err == nil {
+			return object, nil
+		}
+		log.Printf("Error promoting staged upload %s, storing it instead: %v", result.staged, err)
+	}
+	if _, err := clean.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return blobStore.Put(ctx, key, clean, info.ContentType)
+}
+
+// putSanitized streams the sanitized copy of src to the store as it is
+// produced.
+func putSanitized(ctx context.Context, key string, src io.ReadSeeker, info *images.Info) (*storage.Object, error) {
+	clean, pipe := io.Pipe()
+	sanitized := make(chan error, 1)
+	go func() {
+		err := images.Sanitize(pipe, src, info.Format)
+		pipe.CloseWithError(err)
+		sanitized <- err
+	}()
+	object, err := blobStore.Put(ctx, key, clean, info.ContentType)
+	clean.Close()
+	if sanitizeErr := <-sanitized; images.IsValidationError(sanitizeErr) {
+		return nil, sanitizeErr
+	}
+	return object, err
+}
+
+// sameBytesWriter compares what is written to it with r.
+type sameBytesWriter struct {
+	r       io.Reader
+	n       int64
+	differs bool
+}
+
+func (s *sameBytesWriter) Write(p []byte) (int, error) {
+	if !s.differs {
+		expected := make([]byte, len(p))
+		if _, err := io.ReadFull(s.r, expected); err != nil || !bytes.Equal(expected, p) {
+			s.differs = true
+		}
+		s.n += int64(len(p))
+	}
+	return len(p), nil
+}
+
+// matched reports whether exactly the size bytes of r were written.
+func (s *sameBytesWriter) matched(size int64) bool {
+	return !s.differs && s.n == size
+}
+
+// storeVariants renders and stores every variant of picture next to the
+// original, and computes its placeholder.
+func storeVariants(ctx context.Context, folder, name string, picture *images.Picture, result *imageUploadResult) error {
+	result.Variants = make(map[string]imageVariant, len(images.Variants))
+	for _, spec := range images.Variants {
+		rendition, err := picture.Render(spec)
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s/%s_%s.jpg", folder, name, spec.Name)
+		object, err := blobStore.Put(ctx, key, bytes.NewReader(rendition.JPEG), "image/jpeg")
 		if err != nil {
-			log.Printf("Upload failed at index %d: %v", i, err)
-			http.Error(w, `{"error": "Failed to upload image"}`, http.StatusInternalServerError)
+			return err
+		}
+		variant := imageVariant{URL: object.URL, Key: object.Key, Width: rendition.Width, Height: rendition.Height}
+		result.Variants[spec.Name] = variant
+
+		key = fmt.Sprintf("%s/%s_%s.webp", folder, name, spec.Name)
+		object, err = blobStore.Put(ctx, key, bytes.NewReader(rendition.WebP), "image/webp")
+		if err != nil {
+			return err
+		}
+		variant.WebPURL, variant.WebPKey = object.URL, object.Key
+		result.Variants[spec.Name] = variant
+	}
+
+	placeholder, err := picture.Placeholder()
+	if err != nil {
+		return err
+	}
+	result.Placeholder = &imagePlaceholder{BlurHash: placeholder.BlurHash, DataURI: placeholder.DataURI}
+	return nil
+}
+
+// discardUpload removes whatever was stored for an upload that failed
+// part way.
+func discardUpload(ctx context.Context, result *imageUploadResult) {
+	if err := deleteStoredKeys(ctx, uploadKeys(result.Key, result.Variants)); err != nil {
+		log.Printf("Error deleting files of failed upload: %v", err)
+	}
+	result.reset()
+}
+
+// reset clears what an attempt to upload the file recorded in result.
+func (result *imageUploadResult) reset() {
+	*result = imageUploadResult{Index: result.Index, Filename: result.Filename, ID: result.ID, staged: result.staged}
+}
+
+// isTransientUploadError reports whether an upload that failed with err
+// may succeed when tried again, as after a network error or an outage of
+// the store or Hasura.
+func isTransientUploadError(err error) bool {
+	return !images.IsValidationError(err) &&
+		!errors.Is(err, errFileTooLarge) &&
+		!errors.Is(err, errQuotaExceeded) &&
+		!errors.Is(err, errUploadExpired) &&
+		!errors.Is(err, storage.ErrInvalidKey) &&
+		!errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded)
+}
+
+// uploadImageWithRetry runs uploadImage, trying again after transient
+// failures with exponential backoff, and records the final error in result.
+func uploadImageWithRetry(ctx context.Context, client *hasura.Client, cfg *config.Config, userID string, result *imageUploadResult, src io.ReadSeeker) {
+	retryUpload(ctx, cfg, result, func() error {
+		return uploadImage(ctx, client, cfg, userID, result, src)
+	})
+}
+
+// retryUpload runs upload until it succeeds, fails for good or has been
+// tried cfg.UploadRetryAttempts times, clearing result between attempts.
+func retryUpload(ctx context.Context, cfg *config.Config, result *imageUploadResult, upload func() error) {
+	delay := cfg.UploadRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := upload()
+		if err == nil {
 			return
 		}
-		log.Printf("Upload response: %+v", uploadResp.Error)
-		log.Printf("Uploaded image %d to: %s", i, uploadResp.SecureURL)
-		urls = append(urls, uploadResp.SecureURL)
+		if attempt >= cfg.UploadRetryAttempts || !isTransientUploadError(err) {
+			result.fail(err)
+			return
+		}
+		log.Printf("Upload attempt %d at index %d failed, retrying in %s: %v", attempt, result.Index, delay, err)
+		result.reset()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			result.fail(ctx.Err())
+			return
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// uploadPool runs the uploads of a batch at most a fixed number at a time.
+type uploadPool struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newUploadPool(size int) *uploadPool {
+	return &uploadPool{slots: make(chan struct{}, max(1, size))}
+}
+
+// Go runs upload once a slot is free, blocking until then.
+func (p *uploadPool) Go(upload func()) {
+	p.slots <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			<-p.slots
+			p.wg.Done()
+		}()
+		upload()
+	}()
+}
+
+// Wait blocks until every upload started has finished.
+func (p *uploadPool) Wait() {
+	p.wg.Wait()
+}
+
+// fail records why a file was not uploaded. Only validation messages are
+// shown to the uploader.
+func (result *imageUploadResult) fail(err error) {
+	if images.IsValidationError(err) || errors.Is(err, errFileTooLarge) || errors.Is(err, errQuotaExceeded) {
+		result.Error = err.Error()
+		return
+	}
+	log.Printf("Upload failed at index %d: %v", result.Index, err)
+	result.Error = "failed to upload image"
+}
+
+// writeUploadResults answers an upload batch with the URLs of the images
+// stored, as the upload actions always have, and one entry per file in the
+// order they were sent alongside them. The action output types are kept in
+// the Hasura metadata, which lives in the console rather than in this
+// repository; to select the entries, the data type needs
+//
+//	images: [UploadImageResult!]!
+//
+//	type UploadImageResult {
+//	  index: Int!
+//	  filename: String
+//	  url: String
+//	  key: String
+//	  contentType: String
+//	  width: Int
+//	  height: Int
+//	  bytes: bigint
+//	  variants: jsonb
+//	  placeholder: jsonb
+//	  reused: Boolean
+//	  error: String
+//	  id: uuid
+//	  status: String
+//	}
+func writeUploadResults(w http.ResponseWriter, results []imageUploadResult) {
+	urls := []string{}
+	var uploaded int
+	for _, result := range results {
+		if result.Error != "" {
+			continue
+		}
+		uploaded++
+		if result.URL != "" {
+			urls = append(urls, result.URL)
+		}
+	}
+
+	code, message := "success", "Images uploaded successfully"
+	switch {
+	case processing(results):
+		code, message = "processing", "Images are being processed"
+	case uploaded == 0:
+		code, message = "failed", "No images could be uploaded"
+	case uploaded < len(results):
+		code, message = "partial", "Some images could not be uploaded"
 	}
 
 	// Return response in Hasura Action format
-	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Images uploaded successfully", map[string]interface{}{
-		"urls": urls,
+	json.NewEncoder(w).Encode(hasura.NewActionResponse(code, message, map[string]interface{}{
+		"urls":   urls,
+		"images": results,
 	}))
 }
+
+// processing reports whether any of results is still being processed.
+func processing(results []imageUploadResult) bool {
+	for _, result := range results {
+		if result.Status == uploadProcessing {
+			return true
+		}
+	}
+	return false
+}
+
+// UploadImagesMultipartHandler accepts recipe images as multipart/form-data.
+// Each file part is spooled to a temporary file under the size limits,
+// validated and stripped of metadata, then streamed to the blob store, so
+// no file is held in memory. A recipeId field attaches the images to that
+// recipe of the uploader; other non-file fields are ignored.
+func UploadImagesMultipartHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role := requestUser(r)
+	cfg := config.LoadConfig()
+
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.UploadMaxTotalSize+uploadOverhead)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart/form-data body", http.StatusBadRequest)
+		return
+	}
+
+	client := hasura.NewClient(cfg)
+	quota, err := loadUploadQuota(r.Context(), client, cfg, userID, role)
+	if err != nil {
+		log.Printf("Error loading upload quota: %v", err)
+		http.Error(w, "Error checking upload quota", http.StatusInternalServerError)
+		return
+	}
+	totalLeft := cfg.UploadMaxTotalSize
+
+	// Parts arrive one after another, but once spooled each file is
+	// uploaded concurrently with the parts that follow. results never grows
+	// past its capacity, so the pointers handed to the uploads stay valid.
+	results := make([]imageUploadResult, 0, cfg.UploadMaxFiles)
+	pool := newUploadPool(cfg.UploadConcurrency)
+	var recipeID string
+	// A request that fails part way deletes the images it had already
+	// stored, as its caller only hears about the error.
+	fail := func(message string, code int) {
+		pool.Wait()
+		abandonUploads(context.Background(), client, results)
+		http.Error(w, message, code)
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				fail(errUploadTooLarge.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			fail("Malformed multipart body", http.StatusBadRequest)
+			return
+		}
+		filename := part.FileName()
+		if filename == "" && part.FormName() == "recipeId" {
+			value, err := io.ReadAll(io.LimitReader(part, 64))
+			part.Close()
+			if err != nil {
+				fail("Malformed multipart body", http.StatusBadRequest)
+				return
+			}
+			recipeID = strings.TrimSpace(string(value))
+			if status, err := checkUploadRecipe(r.Context(), client, recipeID, userID); err != nil {
+				if status == http.StatusInternalServerError {
+					log.Printf("Error loading recipe author: %v", err)
+					err = errors.New("Error loading recipe")
+				}
+				fail(err.Error(), status)
+				return
+			}
+			continue
+		}
+		if filename == "" {
+			part.Close()
+			continue
+		}
+		if len(results) >= cfg.UploadMaxFiles {
+			part.Close()
+			fail(fmt.Sprintf("at most %d files can be uploaded at once", cfg.UploadMaxFiles), http.StatusBadRequest)
+			return
+		}
+
+		results = append(results, imageUploadResult{Index: len(results), Filename: filename})
+		result := &results[len(results)-1]
+		spool, tooLarge, err := spoolUpload(cfg, result, part, &totalLeft)
+		part.Close()
+		if tooLarge {
+			fail(errUploadTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			log.Printf("Error buffering upload: %v", err)
+			fail("Error receiving upload", http.StatusInternalServerError)
+			return
+		}
+		if spool == nil {
+			continue
+		}
+		reservation, err := reserveSpooled(r.Context(), client, quota, result, spool)
+		if err != nil {
+			removeSpool(spool)
+			log.Printf("Error buffering upload: %v", err)
+			fail("Error receiving upload", http.StatusInternalServerError)
+			return
+		}
+		if result.Error != "" {
+			removeSpool(spool)
+			continue
+		}
+		pool.Go(func() {
+			defer removeSpool(spool)
+			defer reservation.release(context.Background(), client)
+			uploadImageWithRetry(r.Context(), client, cfg, userID, result, spool)
+		})
+	}
+
+	if len(results) == 0 {
+		http.Error(w, "No image files provided", http.StatusBadRequest)
+		return
+	}
+
+	pool.Wait()
+	if recipeID != "" {
+		if err := attachUploadedImages(r.Context(), client, userID, recipeID, results); err != nil {
+			log.Printf("Error attaching uploads to recipe %s: %v", recipeID, err)
+		}
+	}
+	writeUploadResults(w, results)
+}
+
+// abandonUploads deletes the images of results that were stored. Reused
+// uploads belong to earlier requests and are left alone.
+func abandonUploads(ctx context.Context, client *hasura.Client, results []imageUploadResult) {
+	for _, result := range results {
+		if result.Error != "" || result.Reused || result.Key == "" {
+			continue
+		}
+		upload, err := getUploadByKey(ctx, client, result.Key)
+		if err != nil {
+			log.Printf("Error loading abandoned upload %s: %v", result.Key, err)
+			continue
+		}
+		if upload == nil {
+			continue
+		}
+		if _, err := deleteUpload(ctx, client, upload); err != nil {
+			log.Printf("Error deleting abandoned upload %s: %v", upload.ID, err)
+		}
+	}
+}
+
+// spoolUpload copies one file into a temporary file, which validation and
+// metadata stripping need to seek in; the caller removes it with
+// removeSpool. It reports whether the request went over its total size
+// limit. A file over its own limit only fails that file, and no spool is
+// returned for it.
+func spoolUpload(cfg *config.Config, result *imageUploadResult, part io.Reader, totalLeft *int64) (*os.File, bool, error) {
+	spool, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return nil, false, err
+	}
+
+	body := &sizeLimitedReader{r: part, fileLeft: cfg.UploadMaxFileSize, totalLeft: totalLeft}
+	if _, err := io.Copy(spool, body); err != nil {
+		removeSpool(spool)
+		switch {
+		case body.err == errFileTooLarge:
+			result.fail(errFileTooLarge)
+			return nil, false, nil
+		case body.err == errUploadTooLarge:
+			return nil, true, nil
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, true, nil
+		}
+		return nil, false, err
+	}
+	return spool, false, nil
+}
+
+// reserveSpooled holds room in quota for a spooled file, failing its result
+// when the quota has no room for it.
+func reserveSpooled(ctx context.Context, client *hasura.Client, quota *uploadQuota, result *imageUploadResult, spool *os.File) (*uploadReservation, error) {
+	info, err := spool.Stat()
+	if err != nil {
+		return nil, err
+	}
+	reservation, err := quota.reserve(ctx, client, info.Size())
+	if errors.Is(err, errQuotaExceeded) {
+		result.fail(err)
+		return nil, nil
+	}
+	return reservation, err
+}
+
+func removeSpool(spool *os.File) {
+	spool.Close()
+	os.Remove(spool.Name())
+}
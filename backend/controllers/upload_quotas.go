@@ -0,0 +1,351 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"backend/config"
+	"backend/hasura"
+	"backend/middleware"
+)
+
+// Upload quota tiers. Authors are users with at least one recipe; premium
+// users have a current subscription. Admins have no quota.
+const (
+	uploadTierFree    = "free"
+	uploadTierAuthor  = "author"
+	uploadTierPremium = "premium"
+	uploadTierAdmin   = "admin"
+)
+
+var errQuotaExceeded = errors.New("upload quota exceeded")
+
+// uploadQuota is a user's upload usage against the limits of their tier.
+// Stored bytes count the originals, not generated variants; LastHour
+// counts the uploads started in the current clock hour. A zero limit is
+// no limit.
+type uploadQuota struct {
+	Tier       string `json:"tier"`
+	Bytes      int64  `json:"bytes"`
+	MaxBytes   int64  `json:"maxBytes,omitempty"`
+	Images     int64  `json:"images"`
+	MaxImages  int64  `json:"maxImages,omitempty"`
+	LastHour   int64  `json:"lastHour"`
+	MaxPerHour int64  `json:"maxPerHour,omitempty"`
+
+	userID string
+	mu     sync.Mutex
+}
+
+// uploadReservation is room in a user's quota held for one upload while it
+// is stored. Once the upload's row is in, the row counts instead and the
+// reservation is released; a failed upload releases it too.
+type uploadReservation struct {
+	userID string
+	bytes  int64
+}
+
+// reserve holds room for an upload of size bytes in the user's usage row,
+// or explains why it would exceed the quota. The upload is counted in the
+// current hour's window first, then its bytes are reserved; both
+// increments are guarded by the limits in the database, so concurrent
+// requests cannot together overshoot them.
+func (q *uploadQuota) reserve(ctx context.Context, client *hasura.Client, size int64) (*uploadReservation, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	window, err := q.reserveHourly(ctx, client, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	reservation, err := q.reserveUsage(ctx, client, size)
+	if err != nil {
+		q.releaseHourly(context.Background(), client, window)
+		return nil, err
+	}
+	return reservation, nil
+}
+
+// uploadWindow is the start of the clock hour the hourly limit counts
+// uploads at now in.
+func uploadWindow(now time.Time) time.Time {
+	return now.UTC().Truncate(time.Hour)
+}
+
+// reserveHourly counts one more upload in the user's window for now,
+// unless the window is full, and returns the window. Without an hourly
+// limit nothing is counted and the window is zero.
+func (q *uploadQuota) reserveHourly(ctx context.Context, client *hasura.Client, now time.Time) (time.Time, error) {
+	if q.MaxPerHour <= 0 {
+		return time.Time{}, nil
+	}
+	window := uploadWindow(now)
+	query := `
+		mutation ReserveHourlyUpload($user_id: uuid!, $window: timestamptz!, $max: Int!) {
+			insert_UploadHourlyUsage_one(object: {user_id: $user_id, window_start: $window}, on_conflict: {constraint: UploadHourlyUsage_pkey, update_columns: []}) {
+				user_id
+			}
+			update_UploadHourlyUsage(where: {user_id: {_eq: $user_id}, window_start: {_eq: $window}, uploads: {_lt: $max}}, _inc: {uploads: 1}) {
+				returning {
+					uploads
+				}
+			}
+		}
+	`
+	var response struct {
+		UpdateUploadHourlyUsage struct {
+			Returning []struct {
+				Uploads int64 `json:"uploads"`
+			} `json:"returning"`
+		} `json:"update_UploadHourlyUsage"`
+	}
+	variables := map[string]interface{}{"user_id": q.userID, "window": formatTimestamp(window), "max": q.MaxPerHour}
+	if err := client.Execute(ctx, query, variables, &response); err != nil {
+		return time.Time{}, err
+	}
+	if len(response.UpdateUploadHourlyUsage.Returning) == 0 {
+		q.LastHour = q.MaxPerHour
+		return time.Time{}, fmt.Errorf("%w: at most %d images can be uploaded per hour", errQuotaExceeded, q.MaxPerHour)
+	}
+	q.LastHour = response.UpdateUploadHourlyUsage.Returning[0].Uploads
+	return window, nil
+}
+
+// releaseHourly takes back an upload counted in window when its bytes
+// could not be reserved. It does nothing for a zero window.
+func (q *uploadQuota) releaseHourly(ctx context.Context, client *hasura.Client, window time.Time) {
+	if window.IsZero() {
+		return
+	}
+	query := `
+		mutation ReleaseHourlyUpload($user_id: uuid!, $window: timestamptz!) {
+			update_UploadHourlyUsage(where: {user_id: {_eq: $user_id}, window_start: {_eq: $window}, uploads: {_gt: 0}}, _inc: {uploads: -1}) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		UpdateUploadHourlyUsage struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_UploadHourlyUsage"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"user_id": q.userID, "window": formatTimestamp(window)}, &response); err != nil {
+		log.Printf("Error releasing hourly upload of user %s: %v", q.userID, err)
+		return
+	}
+	q.LastHour = max(0, q.LastHour-1)
+}
+
+// reserveUsage holds size bytes and one image in the user's usage row.
+func (q *uploadQuota) reserveUsage(ctx context.Context, client *hasura.Client, size int64) (*uploadReservation, error) {
+	where := map[string]interface{}{"user_id": map[string]interface{}{"_eq": q.userID}}
+	if q.MaxBytes > 0 {
+		where["bytes_used"] = map[string]interface{}{"_lte": q.MaxBytes - size}
+	}
+	if q.MaxImages > 0 {
+		where["uploads_used"] = map[string]interface{}{"_lte": q.MaxImages - 1}
+	}
+	query := `
+		mutation ReserveUpload($user_id: uuid!, $where: UploadUsage_bool_exp!, $bytes: bigint!) {
+			insert_UploadUsage_one(object: {user_id: $user_id}, on_conflict: {constraint: UploadUsage_pkey, update_columns: []}) {
+				user_id
+			}
+			update_UploadUsage(where: $where, _inc: {bytes_used: $bytes, uploads_used: 1}) {
+				returning {
+					bytes_used
+					uploads_used
+				}
+			}
+		}
+	`
+	var response struct {
+		UpdateUploadUsage struct {
+			Returning []struct {
+				BytesUsed   int64 `json:"bytes_used"`
+				UploadsUsed int64 `json:"uploads_used"`
+			} `json:"returning"`
+		} `json:"update_UploadUsage"`
+	}
+	variables := map[string]interface{}{"user_id": q.userID, "where": where, "bytes": size}
+	if err := client.Execute(ctx, query, variables, &response); err != nil {
+		return nil, err
+	}
+	if len(response.UpdateUploadUsage.Returning) == 0 {
+		if err := q.refresh(ctx, client); err != nil {
+			return nil, err
+		}
+		if q.MaxImages > 0 && q.Images+1 > q.MaxImages {
+			return nil, fmt.Errorf("%w: you have stored %d of %d images; delete some to upload more", errQuotaExceeded, q.Images, q.MaxImages)
+		}
+		return nil, fmt.Errorf("%w: this image needs %s but only %s of your %s is left", errQuotaExceeded,
+			formatMB(size), formatMB(max(0, q.MaxBytes-q.Bytes)), formatMB(q.MaxBytes))
+	}
+	usage := response.UpdateUploadUsage.Returning[0]
+	q.Bytes, q.Images = usage.BytesUsed, usage.UploadsUsed
+	return &uploadReservation{userID: q.userID, bytes: size}, nil
+}
+
+// refresh rereads the usage the quota was loaded with.
+func (q *uploadQuota) refresh(ctx context.Context, client *hasura.Client) error {
+	query := `
+		query UploadUsage($user_id: uuid!) {
+			UploadUsage_by_pk(user_id: $user_id) {
+				bytes_used
+				uploads_used
+			}
+		}
+	`
+	var response struct {
+		Usage *struct {
+			BytesUsed   int64 `json:"bytes_used"`
+			UploadsUsed int64 `json:"uploads_used"`
+		} `json:"UploadUsage_by_pk"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"user_id": q.userID}, &response); err != nil {
+		return err
+	}
+	if response.Usage != nil {
+		q.Bytes, q.Images = response.Usage.BytesUsed, response.Usage.UploadsUsed
+	}
+	return nil
+}
+
+// release gives the reserved room back. It is safe on a nil reservation.
+func (res *uploadReservation) release(ctx context.Context, client *hasura.Client) {
+	if res == nil {
+		return
+	}
+	query := `
+		mutation ReleaseUpload($user_id: uuid!, $bytes: bigint!) {
+			update_UploadUsage(where: {user_id: {_eq: $user_id}}, _inc: {bytes_used: $bytes, uploads_used: -1}) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		UpdateUploadUsage struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_UploadUsage"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"user_id": res.userID, "bytes": -res.bytes}, &response); err != nil {
+		log.Printf("Error releasing upload reservation of user %s: %v", res.userID, err)
+	}
+}
+
+func formatMB(bytes int64) string {
+	return fmt.Sprintf("%.1f MB", float64(bytes)/(1<<20))
+}
+
+// loadUploadQuota works out the user's tier and current usage.
+func loadUploadQuota(ctx context.Context, client *hasura.Client, cfg *config.Config, userID, role string) (*uploadQuota, error) {
+	query := `
+		query UploadQuota($user_id: uuid!, $window: timestamptz!, $now: timestamptz!) {
+			UploadUsage_by_pk(user_id: $user_id) {
+				bytes_used
+				uploads_used
+			}
+			UploadHourlyUsage_by_pk(user_id: $user_id, window_start: $window) {
+				uploads
+			}
+			Subscriptions(where: {user_id: {_eq: $user_id}, _or: [
+				{status: {_eq: "active"}, current_period_end: {_gt: $now}},
+				{status: {_eq: "past_due"}, grace_until: {_gt: $now}}
+			]}, limit: 1) {
+				id
+			}
+			Recipes(where: {user_id: {_eq: $user_id}}, limit: 1) {
+				id
+			}
+		}
+	`
+	now := time.Now().UTC()
+	variables := map[string]interface{}{
+		"user_id": userID,
+		"window":  formatTimestamp(uploadWindow(now)),
+		"now":     formatTimestamp(now),
+	}
+	var response struct {
+		Usage *struct {
+			BytesUsed   int64 `json:"bytes_used"`
+			UploadsUsed int64 `json:"uploads_used"`
+		} `json:"UploadUsage_by_pk"`
+		Hourly *struct {
+			Uploads int64 `json:"uploads"`
+		} `json:"UploadHourlyUsage_by_pk"`
+		Subscriptions []struct {
+			ID string `json:"id"`
+		} `json:"Subscriptions"`
+		Recipes []struct {
+			ID string `json:"id"`
+		} `json:"Recipes"`
+	}
+	if err := client.Execute(ctx, query, variables, &response); err != nil {
+		return nil, err
+	}
+
+	quota := &uploadQuota{userID: userID}
+	if response.Usage != nil {
+		quota.Bytes, quota.Images = response.Usage.BytesUsed, response.Usage.UploadsUsed
+	}
+	if response.Hourly != nil {
+		quota.LastHour = response.Hourly.Uploads
+	}
+	switch {
+	case role == middleware.RoleAdmin:
+		quota.Tier = uploadTierAdmin
+		return quota, nil
+	case len(response.Subscriptions) > 0:
+		quota.Tier = uploadTierPremium
+	case len(response.Recipes) > 0:
+		quota.Tier = uploadTierAuthor
+	default:
+		quota.Tier = uploadTierFree
+	}
+	tier := strings.ToUpper(quota.Tier)
+	quota.MaxBytes = int64(cfg.UploadQuotaMB[tier] * (1 << 20))
+	quota.MaxImages = int64(cfg.UploadQuotaImages[tier])
+	quota.MaxPerHour = int64(cfg.UploadHourlyLimit[tier])
+	return quota, nil
+}
+
+// cleanupHourlyUsage deletes the upload counts of hours that are over.
+func cleanupHourlyUsage(ctx context.Context, client *hasura.Client) {
+	query := `
+		mutation CleanupHourlyUsage($before: timestamptz!) {
+			delete_UploadHourlyUsage(where: {window_start: {_lt: $before}}) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		DeleteUploadHourlyUsage struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"delete_UploadHourlyUsage"`
+	}
+	before := formatTimestamp(uploadWindow(time.Now()))
+	if err := client.Execute(ctx, query, map[string]interface{}{"before": before}, &response); err != nil {
+		log.Printf("Error deleting old hourly upload counts: %v", err)
+	}
+}
+
+// UploadUsageHandler returns the caller's upload usage and limits.
+func UploadUsageHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role := requestUser(r)
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	quota, err := loadUploadQuota(r.Context(), client, cfg, userID, role)
+	if err != nil {
+		log.Printf("Error loading upload usage: %v", err)
+		http.Error(w, "Error loading upload usage", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Upload usage", quota))
+}
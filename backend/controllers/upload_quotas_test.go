@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUploadCounts keeps the hourly windows and image counts the quota
+// mutations guard, like the tables would.
+type fakeUploadCounts struct {
+	mu     sync.Mutex
+	hourly map[string]int
+	images int
+}
+
+func (f *fakeUploadCounts) answer(call graphqlCall) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch call.Operation {
+	case "ReserveHourlyUpload":
+		window := call.Variables["window"].(string)
+		if f.hourly[window] >= int(call.Variables["max"].(float64)) {
+			return map[string]interface{}{"update_UploadHourlyUsage": map[string]interface{}{"returning": []interface{}{}}}
+		}
+		f.hourly[window]++
+		return map[string]interface{}{"update_UploadHourlyUsage": map[string]interface{}{
+			"returning": []interface{}{map[string]interface{}{"uploads": f.hourly[window]}},
+		}}
+	case "ReleaseHourlyUpload":
+		f.hourly[call.Variables["window"].(string)]--
+		return map[string]interface{}{"update_UploadHourlyUsage": map[string]interface{}{"affected_rows": 1}}
+	case "ReserveUpload":
+		where := call.Variables["where"].(map[string]interface{})
+		if limit, ok := where["uploads_used"].(map[string]interface{}); ok && f.images > int(limit["_lte"].(float64)) {
+			return map[string]interface{}{"update_UploadUsage": map[string]interface{}{"returning": []interface{}{}}}
+		}
+		f.images++
+		return map[string]interface{}{"update_UploadUsage": map[string]interface{}{
+			"returning": []interface{}{map[string]interface{}{"bytes_used": 0, "uploads_used": f.images}},
+		}}
+	case "UploadUsage":
+		return map[string]interface{}{"UploadUsage_by_pk": map[string]interface{}{"bytes_used": 0, "uploads_used": f.images}}
+	}
+	return map[string]interface{}{}
+}
+
+func TestUploadQuotaHourlyLimit(t *testing.T) {
+	counts := &fakeUploadCounts{hourly: map[string]int{}}
+	_, client := newFakeHasura(t, counts.answer)
+	quota := &uploadQuota{MaxPerHour: 3, userID: "u1"}
+
+	// Concurrent uploads race for the same hour.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reserved := 0
+	for range 6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := quota.reserve(t.Context(), client, 100)
+			if err != nil && !errors.Is(err, errQuotaExceeded) {
+				t.Errorf("reserve() = %v", err)
+			}
+			if err == nil {
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reserved != 3 {
+		t.Errorf("%d uploads reserved, want 3", reserved)
+	}
+	window := formatTimestamp(uploadWindow(time.Now()))
+	if counts.hourly[window] != 3 {
+		t.Errorf("window %s counts %d uploads, want 3", window, counts.hourly[window])
+	}
+	if quota.LastHour != 3 {
+		t.Errorf("LastHour = %d, want 3", quota.LastHour)
+	}
+}
+
+func TestUploadQuotaReleasesHourOverQuota(t *testing.T) {
+	counts := &fakeUploadCounts{hourly: map[string]int{}, images: 1}
+	fake, client := newFakeHasura(t, counts.answer)
+	quota := &uploadQuota{MaxPerHour: 3, MaxImages: 1, userID: "u1"}
+
+	if _, err := quota.reserve(t.Context(), client, 100); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("reserve() = %v, want the quota exceeded", err)
+	}
+	if fake.call("ReleaseHourlyUpload") == nil {
+		t.Error("the upload was not taken back out of its hour")
+	}
+	for window, n := range counts.hourly {
+		if n != 0 {
+			t.Errorf("window %s counts %d uploads, want 0", window, n)
+		}
+	}
+}
+
+func TestUploadQuotaWithoutHourlyLimit(t *testing.T) {
+	counts := &fakeUploadCounts{hourly: map[string]int{}}
+	fake, client := newFakeHasura(t, counts.answer)
+	quota := &uploadQuota{userID: "u1"}
+
+	if _, err := quota.reserve(t.Context(), client, 100); err != nil {
+		t.Fatal(err)
+	}
+	if fake.call("ReserveHourlyUpload") != nil {
+		t.Error("an upload without an hourly limit was counted in its hour")
+	}
+}
+
+func TestUploadWindow(t *testing.T) {
+	now := time.Date(2026, 3, 4, 15, 59, 59, 0, time.FixedZone("EAT", 3*60*60))
+	if got, want := uploadWindow(now), time.Date(2026, 3, 4, 12, 0, 0, 0, time.UTC); !got.Equal(want) || got.Location() != time.UTC {
+		t.Errorf("uploadWindow() = %v, want %v", got, want)
+	}
+}
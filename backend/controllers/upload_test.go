@@ -0,0 +1,243 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"backend/config"
+	"backend/images"
+)
+
+func TestRetryUpload(t *testing.T) {
+	transient := errors.New("connection reset")
+	invalid := &images.ValidationError{Reason: "unsupported image format"}
+	tests := []struct {
+		name     string
+		errs     []error
+		attempts int
+		want     string
+	}{
+		{"first try", []error{nil}, 1, ""},
+		{"transient then success", []error{transient, nil}, 2, ""},
+		{"transient twice then success", []error{transient, transient, nil}, 3, ""},
+		{"out of attempts", []error{transient, transient, transient, nil}, 3, "failed to upload image"},
+		{"invalid image", []error{invalid, nil}, 1, "unsupported image format"},
+		{"too large", []error{errFileTooLarge, nil}, 1, errFileTooLarge.Error()},
+		{"transient then invalid", []error{transient, invalid}, 2, "unsupported image format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{UploadRetryAttempts: 3, UploadRetryBackoff: time.Millisecond}
+			result := &imageUploadResult{Index: 1, Filename: "a.png"}
+			attempts := 0
+			retryUpload(t.Context(), cfg, result, func() error {
+				if result.Error != "" || result.Key != "" {
+					t.Errorf("attempt %d started with a dirty result: %+v", attempts+1, result)
+				}
+				err := tt.errs[attempts]
+				attempts++
+				if err != nil {
+					// A failed attempt may leave partial state behind.
+					result.Key = "partial"
+				}
+				return err
+			})
+			if attempts != tt.attempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.attempts)
+			}
+			if result.Error != tt.want {
+				t.Errorf("error = %q, want %q", result.Error, tt.want)
+			}
+			if result.Index != 1 || result.Filename != "a.png" {
+				t.Errorf("result lost its file: %+v", result)
+			}
+		})
+	}
+}
+
+func TestRetryUploadBackoff(t *testing.T) {
+	cfg := &config.Config{UploadRetryAttempts: 4, UploadRetryBackoff: 10 * time.Millisecond}
+	var starts []time.Time
+	retryUpload(t.Context(), cfg, &imageUploadResult{}, func() error {
+		starts = append(starts, time.Now())
+		return errors.New("timeout")
+	})
+	if len(starts) != 4 {
+		t.Fatalf("attempts = %d, want 4", len(starts))
+	}
+	// 10ms, 20ms and 40ms.
+	for i, want := range []time.Duration{10, 20, 40} {
+		if got := starts[i+1].Sub(starts[i]); got < want*time.Millisecond {
+			t.Errorf("wait before attempt %d = %s, want at least %dms", i+2, got, want)
+		}
+	}
+}
+
+func TestRetryUploadCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	cfg := &config.Config{UploadRetryAttempts: 3, UploadRetryBackoff: time.Hour}
+	result := &imageUploadResult{}
+	attempts := 0
+	retryUpload(ctx, cfg, result, func() error {
+		attempts++
+		cancel()
+		return errors.New("connection reset")
+	})
+	if attempts != 1 || result.Error == "" {
+		t.Errorf("attempts = %d, error = %q; want one attempt and an error", attempts, result.Error)
+	}
+}
+
+func TestUploadPool(t *testing.T) {
+	tests := []struct {
+		size int
+		want int
+	}{
+		{1, 1},
+		{3, 3},
+		{0, 1},
+	}
+	for _, tt := range tests {
+		pool := newUploadPool(tt.size)
+		var running, peak, done atomic.Int32
+		for range 8 {
+			pool.Go(func() {
+				n := running.Add(1)
+				for {
+					p := peak.Load()
+					if n <= p || peak.CompareAndSwap(p, n) {
+						break
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+				running.Add(-1)
+				done.Add(1)
+			})
+		}
+		pool.Wait()
+		if done.Load() != 8 {
+			t.Errorf("size %d: %d uploads finished, want 8", tt.size, done.Load())
+		}
+		if peak.Load() != int32(tt.want) {
+			t.Errorf("size %d: %d uploads ran at once, want %d", tt.size, peak.Load(), tt.want)
+		}
+	}
+}
+
+func TestUploadPoolBlocksWhenFull(t *testing.T) {
+	pool := newUploadPool(1)
+	release := make(chan struct{})
+	pool.Go(func() { <-release })
+
+	var wg sync.WaitGroup
+	started := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pool.Go(func() {})
+		close(started)
+	}()
+	select {
+	case <-started:
+		t.Fatal("Go returned while the pool was full")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	wg.Wait()
+	pool.Wait()
+}
+
+func TestWriteUploadResults(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []imageUploadResult
+		code    string
+		urls    []string
+	}{
+		{"all stored", []imageUploadResult{{URL: "https://cdn/a.jpg"}, {Index: 1, URL: "https://cdn/b.jpg"}}, "success", []string{"https://cdn/a.jpg", "https://cdn/b.jpg"}},
+		{"some failed", []imageUploadResult{{Error: "too large"}, {Index: 1, URL: "https://cdn/b.jpg"}}, "partial", []string{"https://cdn/b.jpg"}},
+		{"all failed", []imageUploadResult{{Error: "too large"}}, "failed", []string{}},
+		{"processing", []imageUploadResult{{ID: "u1", Status: uploadProcessing}}, "processing", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeUploadResults(w, tt.results)
+			var response struct {
+				Code string `json:"code"`
+				Data struct {
+					URLs   []string            `json:"urls"`
+					Images []imageUploadResult `json:"images"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Code != tt.code {
+				t.Errorf("code = %s, want %s", response.Code, tt.code)
+			}
+			if !slices.Equal(response.Data.URLs, tt.urls) || response.Data.URLs == nil {
+				t.Errorf("urls = %#v, want %#v", response.Data.URLs, tt.urls)
+			}
+			if len(response.Data.Images) != len(tt.results) {
+				t.Errorf("%d images, want %d", len(response.Data.Images), len(tt.results))
+			}
+		})
+	}
+}
+
+func TestAbandonUploads(t *testing.T) {
+	store := newFakeDirectStore(t)
+	for _, key := range []string{"RecipeImages/u1/a.jpg", "RecipeImages/u1/a_thumb.jpg", "RecipeImages/u1/old.jpg"} {
+		if _, err := store.LocalStore.Put(t.Context(), key, strings.NewReader("data"), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows := map[string]uploadRecord{
+		"RecipeImages/u1/a.jpg": {ID: "up1", Key: "RecipeImages/u1/a.jpg", Variants: map[string]imageVariant{
+			"thumb": {Key: "RecipeImages/u1/a_thumb.jpg"},
+		}},
+		"RecipeImages/u1/old.jpg": {ID: "up0", Key: "RecipeImages/u1/old.jpg"},
+	}
+	fake, client := newFakeHasura(t, func(call graphqlCall) interface{} {
+		switch call.Operation {
+		case "GetUpload":
+			row, ok := rows[call.Variables["key"].(string)]
+			if !ok {
+				return map[string]interface{}{"Uploads": []interface{}{}}
+			}
+			return map[string]interface{}{"Uploads": []interface{}{row}}
+		case "DeleteUpload":
+			return map[string]interface{}{"delete_Uploads": map[string]interface{}{"affected_rows": 1}}
+		}
+		return nil
+	})
+
+	abandonUploads(t.Context(), client, []imageUploadResult{
+		{Key: "RecipeImages/u1/a.jpg"},
+		{Index: 1, Key: "RecipeImages/u1/old.jpg", Reused: true},
+		{Index: 2, Error: "too large"},
+	})
+
+	if got := fake.operations(); !slices.Equal(got, []string{"GetUpload", "DeleteUpload"}) {
+		t.Errorf("operations = %v, want only the stored upload deleted", got)
+	}
+	if id := fake.call("DeleteUpload").Variables["id"]; id != "up1" {
+		t.Errorf("deleted upload %v, want up1", id)
+	}
+	objects, err := store.List(t.Context(), "RecipeImages/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "RecipeImages/u1/old.jpg" {
+		t.Errorf("left %+v, want only the reused upload", objects)
+	}
+}
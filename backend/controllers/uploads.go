@@ -0,0 +1,605 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"backend/config"
+	"backend/hasura"
+	"backend/images"
+	"backend/middleware"
+)
+
+const uploadCleanupBatchSize = 200
+
+type DeleteUploadRequest struct {
+	Key string `json:"key"`
+}
+
+type AttachUploadsRequest struct {
+	RecipeID string   `json:"recipeId"`
+	Keys     []string `json:"keys"`
+}
+
+type uploadRecord struct {
+	ID          string                  `json:"id"`
+	UserID      string                  `json:"user_id"`
+	Key         string                  `json:"key"`
+	URL         string                  `json:"url"`
+	ContentType string                  `json:"content_type"`
+	Bytes       int64                   `json:"bytes"`
+	Width       int                     `json:"width"`
+	Height      int                     `json:"height"`
+	Variants    map[string]imageVariant `json:"variants"`
+	Placeholder *imagePlaceholder       `json:"placeholder"`
+	Phash       *string                 `json:"phash"`
+	RecipeID    *string                 `json:"recipe_id"`
+	RecipeCount int                     `json:"recipe_count"`
+	Status      string                  `json:"status"`
+	Error       *string                 `json:"error"`
+	CreatedAt   string                  `json:"created_at"`
+}
+
+const uploadFields = `
+	id
+	user_id
+	key
+	url
+	content_type
+	bytes
+	width
+	height
+	variants
+	placeholder
+	phash
+	recipe_id
+	recipe_count
+	status
+	error
+	created_at
+`
+
+// uploadKeys lists the stored files of an upload.
+func uploadKeys(key string, variants map[string]imageVariant) []string {
+	var keys []string
+	if key != "" {
+		keys = append(keys, key)
+	}
+	for _, variant := range variants {
+		if variant.Key != "" {
+			keys = append(keys, variant.Key)
+		}
+		if variant.WebPKey != "" {
+			keys = append(keys, variant.WebPKey)
+		}
+	}
+	return keys
+}
+
+// urls lists every address the upload is served at.
+func (u *uploadRecord) urls() []string {
+	urls := []string{u.URL}
+	for _, variant := range u.Variants {
+		urls = append(urls, variant.URL)
+		if variant.WebPURL != "" {
+			urls = append(urls, variant.WebPURL)
+		}
+	}
+	return urls
+}
+
+// deleteStoredKeys removes files from the blob store, carrying on past
+// failures so one bad key does not leave the rest behind.
+func deleteStoredKeys(ctx context.Context, keys []string) error {
+	var errs []error
+	for _, key := range keys {
+		if err := blobStore.Delete(ctx, key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// registerUpload records a stored image so it can be attached to a recipe
+// and cleaned up when it never is, and returns the upload's ID. A direct
+// upload already has a row, which is updated from processing to stored.
+func registerUpload(ctx context.Context, client *hasura.Client, userID string, result *imageUploadResult, hash *images.Hash) (string, error) {
+	object := map[string]interface{}{
+		"key":          result.Key,
+		"url":          result.URL,
+		"content_type": result.ContentType,
+		"bytes":        result.Bytes,
+		"width":        result.Width,
+		"height":       result.Height,
+		"variants":     result.Variants,
+		"placeholder":  result.Placeholder,
+	}
+	if result.Variants == nil {
+		object["variants"] = map[string]imageVariant{}
+	}
+	if hash != nil {
+		object["phash"] = hash.String()
+		for i, band := range hash.Bands() {
+			object[fmt.Sprintf("phash_band%d", i)] = band
+		}
+	}
+	if result.ID != "" {
+		return result.ID, storeProcessingUpload(ctx, client, result.ID, object)
+	}
+	object["user_id"] = userID
+	query := `
+		mutation RegisterUpload($object: Uploads_insert_input!) {
+			insert_Uploads_one(object: $object) {
+				id
+			}
+		}
+	`
+	var response struct {
+		InsertUploadsOne struct {
+			ID string `json:"id"`
+		} `json:"insert_Uploads_one"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"object": object}, &response); err != nil {
+		return "", err
+	}
+	return response.InsertUploadsOne.ID, nil
+}
+
+// storeProcessingUpload fills in the row of a processing direct upload.
+// It fails when the row is gone or no longer processing, as after cleanup
+// expired it.
+func storeProcessingUpload(ctx context.Context, client *hasura.Client, id string, changes map[string]interface{}) error {
+	changes["status"] = uploadStored
+	query := `
+		mutation StoreUpload($id: uuid!, $changes: Uploads_set_input!) {
+			update_Uploads(where: {id: {_eq: $id}, status: {_eq: "processing"}}, _set: $changes) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		UpdateUploads struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_Uploads"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"id": id, "changes": changes}, &response); err != nil {
+		return err
+	}
+	if response.UpdateUploads.AffectedRows == 0 {
+		return fmt.Errorf("%w: %s", errUploadExpired, id)
+	}
+	return nil
+}
+
+func getUploadByKey(ctx context.Context, client *hasura.Client, key string) (*uploadRecord, error) {
+	query := `
+		query GetUpload($key: String!) {
+			Uploads(where: {key: {_eq: $key}}) {` + uploadFields + `}
+		}
+	`
+	var response struct {
+		Uploads []uploadRecord `json:"Uploads"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"key": key}, &response); err != nil {
+		return nil, err
+	}
+	if len(response.Uploads) == 0 {
+		return nil, nil
+	}
+	return &response.Uploads[0], nil
+}
+
+type stepImage struct {
+	RecipeID string `json:"recipe_id"`
+	ImageURL string `json:"image_url"`
+}
+
+// stepsUsingImages returns the recipe steps whose image is one of urls,
+// keyed by URL.
+func stepsUsingImages(ctx context.Context, client *hasura.Client, urls []string) (map[string]stepImage, error) {
+	query := `
+		query StepsUsingImages($urls: [String!]!) {
+			Steps(where: {image_url: {_in: $urls}}) {
+				recipe_id
+				image_url
+			}
+		}
+	`
+	var response struct {
+		Steps []stepImage `json:"Steps"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"urls": urls}, &response); err != nil {
+		return nil, err
+	}
+	steps := make(map[string]stepImage, len(response.Steps))
+	for _, step := range response.Steps {
+		steps[step.ImageURL] = step
+	}
+	return steps, nil
+}
+
+// attached reports whether a recipe uses the upload.
+func (u *uploadRecord) attached() bool {
+	return u.RecipeID != nil || u.RecipeCount > 0
+}
+
+// deleteUpload removes an upload that is not attached to a recipe. The row
+// goes first, guarded so an upload attached in the meantime survives; a
+// file the store then fails to delete is only logged, as nothing refers to
+// it any more. It reports whether the upload was deleted.
+func deleteUpload(ctx context.Context, client *hasura.Client, upload *uploadRecord) (bool, error) {
+	query := `
+		mutation DeleteUpload($id: uuid!) {
+			delete_Uploads(where: {id: {_eq: $id}, recipe_id: {_is_null: true}, recipe_count: {_eq: 0}}) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		DeleteUploads struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"delete_Uploads"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"id": upload.ID}, &response); err != nil {
+		return false, err
+	}
+	if response.DeleteUploads.AffectedRows == 0 {
+		return false, nil
+	}
+
+	if err := deleteStoredKeys(ctx, uploadKeys(upload.Key, upload.Variants)); err != nil {
+		log.Printf("Error deleting files of upload %s: %v", upload.ID, err)
+	}
+	return true, nil
+}
+
+// DeleteUploadHandler deletes one of the caller's uploads, with its
+// variants. Uploads a recipe still uses must be removed from it first.
+func DeleteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role := requestUser(r)
+
+	var req DeleteUploadRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Key == "" {
+		http.Error(w, "key is required", http.StatusBadRequest)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	upload, err := getUploadByKey(r.Context(), client, req.Key)
+	if err != nil {
+		log.Printf("Error loading upload: %v", err)
+		http.Error(w, "Error loading upload", http.StatusInternalServerError)
+		return
+	}
+	if upload == nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if upload.UserID != userID && role != middleware.RoleAdmin {
+		http.Error(w, "You can only delete your own uploads", http.StatusForbidden)
+		return
+	}
+	if upload.attached() {
+		http.Error(w, "Image is attached to a recipe; remove it from the recipe first", http.StatusConflict)
+		return
+	}
+	steps, err := stepsUsingImages(r.Context(), client, upload.urls())
+	if err != nil {
+		log.Printf("Error checking image usage: %v", err)
+		http.Error(w, "Error checking image usage", http.StatusInternalServerError)
+		return
+	}
+	if len(steps) > 0 {
+		http.Error(w, "Image is used by a recipe step; remove it from the recipe first", http.StatusConflict)
+		return
+	}
+
+	deleted, err := deleteUpload(r.Context(), client, upload)
+	if err != nil {
+		log.Printf("Error deleting upload: %v", err)
+		http.Error(w, "Error deleting upload", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Image is attached to a recipe; remove it from the recipe first", http.StatusConflict)
+		return
+	}
+
+	if upload.UserID != userID {
+		recordAudit(r.Context(), client, userID, "upload.deleted", "Uploads", upload.ID, map[string]interface{}{
+			"key":     upload.Key,
+			"user_id": upload.UserID,
+		})
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Upload deleted", map[string]interface{}{
+		"key": upload.Key,
+	}))
+}
+
+var (
+	errUploadRecipeNotFound = errors.New("recipe not found")
+	errUploadRecipeNotOwned = errors.New("images can only be added to your own recipes")
+)
+
+// checkUploadRecipe checks that images userID uploads may be attached to
+// recipeID, returning the status to answer with when they may not.
+func checkUploadRecipe(ctx context.Context, client *hasura.Client, recipeID, userID string) (int, error) {
+	authorID, err := getRecipeAuthorID(ctx, client, recipeID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if authorID == "" {
+		return http.StatusNotFound, errUploadRecipeNotFound
+	}
+	if authorID != userID {
+		return http.StatusForbidden, errUploadRecipeNotOwned
+	}
+	return http.StatusOK, nil
+}
+
+// uploadLinks builds the UploadRecipes rows attaching uploads to a recipe.
+func uploadLinks(recipeID string, uploadIDs []string, now string) []map[string]interface{} {
+	links := make([]map[string]interface{}, 0, len(uploadIDs))
+	for _, id := range uploadIDs {
+		links = append(links, map[string]interface{}{
+			"upload_id":   id,
+			"recipe_id":   recipeID,
+			"attached_at": now,
+		})
+	}
+	return links
+}
+
+// attachUploadedImages attaches the images of an upload batch to the
+// recipe they were uploaded for. An image reused from an upload already
+// attached elsewhere is shared with this recipe too.
+func attachUploadedImages(ctx context.Context, client *hasura.Client, userID, recipeID string, results []imageUploadResult) error {
+	var keys []string
+	for _, result := range results {
+		if result.Error == "" && result.Key != "" {
+			keys = append(keys, result.Key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	query := `
+		query UploadedImages($user_id: uuid!, $keys: [String!]!) {
+			Uploads(where: {user_id: {_eq: $user_id}, key: {_in: $keys}, kind: {_eq: "image"}, status: {_eq: "stored"}}) {
+				id
+			}
+		}
+	`
+	var found struct {
+		Uploads []struct {
+			ID string `json:"id"`
+		} `json:"Uploads"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"user_id": userID, "keys": keys}, &found); err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(found.Uploads))
+	for _, upload := range found.Uploads {
+		ids = append(ids, upload.ID)
+	}
+	return linkUploads(ctx, client, recipeID, ids)
+}
+
+// linkUploads attaches uploads to a recipe, leaving links that exist alone.
+func linkUploads(ctx context.Context, client *hasura.Client, recipeID string, uploadIDs []string) error {
+	if len(uploadIDs) == 0 {
+		return nil
+	}
+	query := `
+		mutation LinkUploads($objects: [UploadRecipes_insert_input!]!) {
+			insert_UploadRecipes(objects: $objects, on_conflict: {constraint: UploadRecipes_pkey, update_columns: []}) {
+				affected_rows
+			}
+		}
+	`
+	var response struct {
+		InsertUploadRecipes struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"insert_UploadRecipes"`
+	}
+	objects := uploadLinks(recipeID, uploadIDs, formatTimestamp(time.Now().UTC()))
+	return client.Execute(ctx, query, map[string]interface{}{"objects": objects}, &response)
+}
+
+// AttachUploadsHandler sets the images of a recipe to the given uploads;
+// step videos are attached when they are uploaded and are left alone. An
+// image may be shared by several recipes. Uploads previously attached to
+// the recipe but not listed are detached from it, and become eligible for
+// cleanup after the grace period once no recipe uses them.
+func AttachUploadsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role := requestUser(r)
+
+	var req AttachUploadsRequest
+	if err := decodeActionInput(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.RecipeID == "" {
+		http.Error(w, "recipe ID is required", http.StatusBadRequest)
+		return
+	}
+	keys := make([]string, 0, len(req.Keys))
+	seen := make(map[string]bool, len(req.Keys))
+	for _, key := range req.Keys {
+		if key != "" && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+
+	authorID, err := getRecipeAuthorID(r.Context(), client, req.RecipeID)
+	if err != nil {
+		log.Printf("Error loading recipe author: %v", err)
+		http.Error(w, "Error loading recipe", http.StatusInternalServerError)
+		return
+	}
+	if authorID == "" {
+		http.Error(w, "Recipe not found", http.StatusNotFound)
+		return
+	}
+	if authorID != userID && role != middleware.RoleAdmin {
+		http.Error(w, "You can only change images of your own recipes", http.StatusForbidden)
+		return
+	}
+
+	query := `
+		query UploadsToAttach($keys: [String!]!) {
+			Uploads(where: {key: {_in: $keys}, kind: {_eq: "image"}, status: {_eq: "stored"}}) {` + uploadFields + `}
+		}
+	`
+	var found struct {
+		Uploads []uploadRecord `json:"Uploads"`
+	}
+	if err := client.Execute(r.Context(), query, map[string]interface{}{"keys": keys}, &found); err != nil {
+		log.Printf("Error loading uploads: %v", err)
+		http.Error(w, "Error loading uploads", http.StatusInternalServerError)
+		return
+	}
+	if len(found.Uploads) != len(keys) {
+		http.Error(w, "Unknown upload key", http.StatusBadRequest)
+		return
+	}
+	ids := make([]string, 0, len(found.Uploads))
+	for _, upload := range found.Uploads {
+		if upload.UserID != authorID {
+			http.Error(w, "Only the recipe author's uploads can be attached", http.StatusForbidden)
+			return
+		}
+		ids = append(ids, upload.ID)
+	}
+
+	// Hasura runs both mutations in one transaction.
+	query = `
+		mutation AttachUploads($recipe_id: uuid!, $ids: [uuid!]!, $objects: [UploadRecipes_insert_input!]!) {
+			detached: delete_UploadRecipes(where: {recipe_id: {_eq: $recipe_id}, upload_id: {_nin: $ids}}) {
+				affected_rows
+			}
+			attached: insert_UploadRecipes(objects: $objects, on_conflict: {constraint: UploadRecipes_pkey, update_columns: []}) {
+				affected_rows
+			}
+		}
+	`
+	variables := map[string]interface{}{
+		"recipe_id": req.RecipeID,
+		"ids":       ids,
+		"objects":   uploadLinks(req.RecipeID, ids, formatTimestamp(time.Now().UTC())),
+	}
+	var response struct {
+		Detached struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"detached"`
+		Attached struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"attached"`
+	}
+	if err := client.Execute(r.Context(), query, variables, &response); err != nil {
+		log.Printf("Error attaching uploads: %v", err)
+		http.Error(w, "Error attaching uploads", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(hasura.NewActionResponse("success", "Recipe images updated", map[string]interface{}{
+		"recipeId": req.RecipeID,
+		"attached": response.Attached.AffectedRows,
+		"detached": response.Detached.AffectedRows,
+	}))
+}
+
+// RunUploadCleanup deletes direct uploads never completed within the grace
+// period, the hourly upload counts of past hours and, when upload GC is
+// enabled, uploads no recipe uses once they are older than the grace
+// period and have been detached for as long. Uploads a step's image_url
+// points at are attached to that step's recipe instead, so they stop
+// coming up.
+func RunUploadCleanup(ctx context.Context) {
+	cfg := config.LoadConfig()
+	client := hasura.NewClient(cfg)
+	before := time.Now().UTC().Add(-cfg.UploadGracePeriod)
+	cleanupStagedUploads(ctx, cfg, client, before)
+	cleanupHourlyUsage(ctx, client)
+	if !cfg.UploadGCEnabled {
+		return
+	}
+	cutoff := formatTimestamp(before)
+
+	query := `
+		query UnattachedUploads($cutoff: timestamptz!, $limit: Int!) {
+			Uploads(where: {recipe_id: {_is_null: true}, recipe_count: {_eq: 0}, status: {_eq: "stored"}, created_at: {_lt: $cutoff}, _or: [
+				{detached_at: {_is_null: true}},
+				{detached_at: {_lt: $cutoff}}
+			]}, order_by: {created_at: asc}, limit: $limit) {` + uploadFields + `}
+		}
+	`
+	var response struct {
+		Uploads []uploadRecord `json:"Uploads"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"cutoff": cutoff, "limit": uploadCleanupBatchSize}, &response); err != nil {
+		log.Printf("Error loading unattached uploads: %v", err)
+		return
+	}
+	if len(response.Uploads) == 0 {
+		return
+	}
+
+	var urls []string
+	for i := range response.Uploads {
+		urls = append(urls, response.Uploads[i].urls()...)
+	}
+	steps, err := stepsUsingImages(ctx, client, urls)
+	if err != nil {
+		log.Printf("Error checking image usage: %v", err)
+		return
+	}
+
+	var deleted, adopted int
+	for i := range response.Uploads {
+		upload := &response.Uploads[i]
+
+		var usedBy string
+		for _, url := range upload.urls() {
+			if step, ok := steps[url]; ok {
+				usedBy = step.RecipeID
+				break
+			}
+		}
+		if usedBy != "" {
+			if err := linkUploads(ctx, client, usedBy, []string{upload.ID}); err != nil {
+				log.Printf("Error attaching upload %s to recipe %s: %v", upload.ID, usedBy, err)
+				continue
+			}
+			adopted++
+			continue
+		}
+
+		ok, err := deleteUpload(ctx, client, upload)
+		if err != nil {
+			log.Printf("Error deleting upload %s: %v", upload.ID, err)
+			continue
+		}
+		if ok {
+			deleted++
+		}
+	}
+
+	log.Printf("Upload cleanup: deleted %d and attached %d of %d unattached uploads", deleted, adopted, len(response.Uploads))
+}
@@ -4,6 +4,7 @@ go 1.24.3
 
 require (
 	github.com/cloudinary/cloudinary-go/v2 v2.7.0
+	github.com/gen2brain/webp v0.5.5
 	github.com/golang-jwt/jwt/v4 v4.5.2
 	github.com/golang-jwt/jwt/v5 v5.2.2
 	github.com/google/uuid v1.6.0
@@ -16,7 +17,9 @@ require (
 
 require (
 	github.com/creasty/defaults v1.7.0 // indirect
+	github.com/ebitengine/purego v0.8.3 // indirect
 	github.com/gorilla/schema v1.2.0 // indirect
 	github.com/matryer/is v1.4.1 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
+	github.com/tetratelabs/wazero v1.9.0 // indirect
 )
@@ -4,6 +4,7 @@ import (
 	"backend/config"
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/machinebox/graphql"
 )
@@ -37,6 +38,12 @@ func (c *Client) Execute(ctx context.Context, query string, variables map[string
 	return nil
 }
 
+// IsUniqueViolation reports whether a failed mutation was rejected by a
+// unique constraint in Postgres.
+func IsUniqueViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Uniqueness violation")
+}
+
 // HasuraActionResponse represents the standard response format for Hasura actions
 type HasuraActionResponse struct {
 	Code    string      `json:"code"`
@@ -0,0 +1,184 @@
+// Package images validates uploaded images, strips their metadata and
+// renders the resized variants pages show.
+package images
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Supported formats.
+const (
+	JPEG = "jpeg"
+	PNG  = "png"
+	GIF  = "gif"
+	WebP = "webp"
+)
+
+var contentTypes = map[string]string{
+	"image/jpeg": JPEG,
+	"image/png":  PNG,
+	"image/gif":  GIF,
+	"image/webp": WebP,
+}
+
+// ValidationError reports why an image was rejected. Its message is meant
+// for the uploader.
+type ValidationError struct {
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Reason
+}
+
+func invalid(format string, args ...interface{}) error {
+	return &ValidationError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// IsValidationError reports whether err rejects the image itself rather
+// than reporting a failure to read it.
+func IsValidationError(err error) bool {
+	var v *ValidationError
+	return errors.As(err, &v)
+}
+
+// Limits bounds the dimensions of accepted images. Checking them before
+// anything decodes pixels guards against decompression bombs: small files
+// that declare enormous canvases. Zero disables a limit.
+type Limits struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int64
+}
+
+// Info describes an accepted image.
+type Info struct {
+	Format      string
+	ContentType string
+	// Width and Height are the dimensions as displayed, after the EXIF
+	// Orientation of a JPEG, if any, is applied.
+	Width       int
+	Height      int
+	Orientation uint16
+}
+
+// ExtensionFor returns the file extension for a supported image content
+// type, or false for any other type.
+func ExtensionFor(contentType string) (string, bool) {
+	format, ok := contentTypes[contentType]
+	if !ok {
+		return "", false
+	}
+	info := Info{Format: format}
+	return info.Extension(), true
+}
+
+// Extension is the usual file extension for the image's format.
+func (i *Info) Extension() string {
+	if i.Format == JPEG {
+		return "jpg"
+	}
+	return i.Format
+}
+
+// Inspect identifies an image from its content, not its name or declared
+// type, and checks its dimensions against limits. Only the headers are read.
+func Inspect(src io.ReadSeeker, limits Limits) (*Info, error) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return nil, invalid("file is empty")
+		}
+		return nil, err
+	}
+	contentType, _, _ := strings.Cut(http.DetectContentType(head[:n]), ";")
+	format, ok := contentTypes[contentType]
+	if !ok {
+		return nil, invalid("unsupported file type %s; use JPEG, PNG, WebP or GIF", contentType)
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var width, height int
+	if format == WebP {
+		width, height, err = webpSize(src)
+	} else {
+		var config image.Config
+		config, _, err = image.DecodeConfig(bufio.NewReader(src))
+		width, height = config.Width, config.Height
+	}
+	if err != nil {
+		if IsValidationError(err) {
+			return nil, err
+		}
+		return nil, invalid("unreadable %s image: %v", format, err)
+	}
+	if width <= 0 || height <= 0 {
+		return nil, invalid("image has no dimensions")
+	}
+
+	if limits.MaxWidth > 0 && width > limits.MaxWidth || limits.MaxHeight > 0 && height > limits.MaxHeight {
+		return nil, invalid("image is %dx%d; the maximum is %dx%d", width, height, limits.MaxWidth, limits.MaxHeight)
+	}
+	if limits.MaxPixels > 0 && int64(width)*int64(height) > limits.MaxPixels {
+		return nil, invalid("image has %d pixels; the maximum is %d", int64(width)*int64(height), limits.MaxPixels)
+	}
+
+	info := &Info{Format: format, ContentType: contentType, Width: width, Height: height}
+	if format == JPEG {
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		info.Orientation = jpegOrientation(src)
+		if info.Orientation >= 5 {
+			info.Width, info.Height = height, width
+		}
+	}
+	return info, nil
+}
+
+// webpSize reads the canvas size from the first chunk of a WebP file, which
+// is VP8X for extended files and VP8 or VP8L for simple ones.
+func webpSize(r io.Reader) (int, int, error) {
+	var header [30]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, 0, err
+	}
+	chunk := header[12:16]
+	data := header[20:]
+	switch string(chunk) {
+	case "VP8X":
+		width := int(data[4]) | int(data[5])<<8 | int(data[6])<<16
+		height := int(data[7]) | int(data[8])<<8 | int(data[9])<<16
+		return width + 1, height + 1, nil
+	case "VP8 ":
+		if data[3] != 0x9d || data[4] != 0x01 || data[5] != 0x2a {
+			return 0, 0, invalid("corrupt WebP frame header")
+		}
+		width := int(binary.LittleEndian.Uint16(data[6:8]) & 0x3fff)
+		height := int(binary.LittleEndian.Uint16(data[8:10]) & 0x3fff)
+		return width, height, nil
+	case "VP8L":
+		if data[0] != 0x2f {
+			return 0, 0, invalid("corrupt WebP lossless header")
+		}
+		bits := binary.LittleEndian.Uint32(data[1:5])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1, nil
+	}
+	return 0, 0, invalid("unknown WebP chunk %q", chunk)
+}
@@ -0,0 +1,163 @@
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 8), uint8(y * 8), 128, 255})
+		}
+	}
+	return img
+}
+
+func encodeJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, testImage(width, height), nil); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func encodePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := png.Encode(&b, testImage(width, height)); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func encodeGIF(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := gif.Encode(&b, testImage(width, height), nil); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// withSegment inserts a JPEG marker segment right after SOI.
+func withSegment(jpg []byte, marker byte, payload []byte) []byte {
+	segment := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	out := append([]byte{}, jpg[:2]...)
+	out = append(out, segment...)
+	out = append(out, payload...)
+	return append(out, jpg[2:]...)
+}
+
+func webpFile(chunks ...[]byte) []byte {
+	var body []byte
+	for _, chunk := range chunks {
+		body = append(body, chunk...)
+	}
+	header := []byte("RIFF\x00\x00\x00\x00WEBP")
+	binary.LittleEndian.PutUint32(header[4:], uint32(4+len(body)))
+	return append(header, body...)
+}
+
+func riffChunk(kind string, data []byte) []byte {
+	chunk := append([]byte(kind), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(data)))
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// vp8x builds an extended WebP header for a canvas with the given flags.
+func vp8x(flags byte, width, height int) []byte {
+	data := make([]byte, 10)
+	data[0] = flags
+	w, h := width-1, height-1
+	data[4], data[5], data[6] = byte(w), byte(w>>8), byte(w>>16)
+	data[7], data[8], data[9] = byte(h), byte(h>>8), byte(h>>16)
+	return riffChunk("VP8X", data)
+}
+
+func vp8l(width, height int) []byte {
+	data := make([]byte, 10)
+	data[0] = 0x2f
+	binary.LittleEndian.PutUint32(data[1:], uint32(width-1)|uint32(height-1)<<14)
+	return riffChunk("VP8L", data)
+}
+
+func TestInspect(t *testing.T) {
+	rotated := withSegment(encodeJPEG(t, 40, 20), markerAPP1, orientationSegment(6)[4:])
+	tests := []struct {
+		name        string
+		data        []byte
+		limits      Limits
+		format      string
+		width       int
+		height      int
+		orientation uint16
+	}{
+		{"jpeg", encodeJPEG(t, 40, 20), Limits{}, JPEG, 40, 20, 0},
+		{"rotated jpeg", rotated, Limits{}, JPEG, 20, 40, 6},
+		{"png", encodePNG(t, 16, 8), Limits{}, PNG, 16, 8, 0},
+		{"gif", encodeGIF(t, 8, 16), Limits{}, GIF, 8, 16, 0},
+		{"extended webp", webpFile(vp8x(0, 300, 200), vp8l(300, 200)), Limits{}, WebP, 300, 200, 0},
+		{"lossless webp", webpFile(vp8l(64, 48)), Limits{}, WebP, 64, 48, 0},
+		{"within limits", encodePNG(t, 16, 8), Limits{MaxWidth: 16, MaxHeight: 8, MaxPixels: 128}, PNG, 16, 8, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := Inspect(bytes.NewReader(tt.data), tt.limits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Format != tt.format || info.Width != tt.width || info.Height != tt.height || info.Orientation != tt.orientation {
+				t.Errorf("Inspect() = %+v, want %s %dx%d orientation %d", info, tt.format, tt.width, tt.height, tt.orientation)
+			}
+		})
+	}
+}
+
+func TestInspectRejects(t *testing.T) {
+	jpg := encodeJPEG(t, 40, 20)
+	pngData := encodePNG(t, 16, 8)
+	tests := []struct {
+		name   string
+		data   []byte
+		limits Limits
+	}{
+		{"empty", nil, Limits{}},
+		{"text", []byte("hello, world"), Limits{}},
+		{"html", []byte("<html><body>hi</body></html>"), Limits{}},
+		{"truncated jpeg", jpg[:20], Limits{}},
+		{"truncated png", pngData[:20], Limits{}},
+		{"png header only", pngData[:8], Limits{}},
+		{"unknown webp chunk", webpFile(riffChunk("ABCD", make([]byte, 10))), Limits{}},
+		{"corrupt lossless webp", webpFile(riffChunk("VP8L", make([]byte, 10))), Limits{}},
+		{"corrupt lossy webp", webpFile(riffChunk("VP8 ", make([]byte, 10))), Limits{}},
+		{"too wide", pngData, Limits{MaxWidth: 15}},
+		{"too tall", pngData, Limits{MaxHeight: 7}},
+		{"too many pixels", pngData, Limits{MaxPixels: 127}},
+		{"declared bomb", webpFile(vp8x(0, 1<<24, 1<<24), vp8l(1, 1)), Limits{MaxPixels: 1 << 26}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := Inspect(bytes.NewReader(tt.data), tt.limits)
+			if err == nil {
+				t.Fatalf("Inspect() accepted the file as %+v", info)
+			}
+			if !IsValidationError(err) {
+				t.Errorf("Inspect() = %v, want a validation error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,519 @@
+package images
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Sanitize copies the image in src to dst without its metadata: EXIF
+// (including GPS position), XMP, IPTC and text comments. Pixel data is
+// copied byte for byte, never re-encoded, and anything after the end of the
+// image is dropped. A JPEG's EXIF orientation is kept, as the only tag, so
+// photos still display upright.
+func Sanitize(dst io.Writer, src io.ReadSeeker, format string) error {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var err error
+	switch format {
+	case JPEG:
+		err = stripJPEG(dst, bufio.NewReader(src))
+	case PNG:
+		err = stripPNG(dst, bufio.NewReader(src))
+	case WebP:
+		err = stripWebP(dst, src)
+	case GIF:
+		err = stripGIF(dst, bufio.NewReader(src))
+	default:
+		_, err = io.Copy(dst, src)
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return invalid("%s image is truncated", format)
+	}
+	return err
+}
+
+// JPEG markers.
+const (
+	markerSOI  = 0xd8
+	markerEOI  = 0xd9
+	markerSOS  = 0xda
+	markerAPP0 = 0xe0
+	markerAPP1 = 0xe1
+	markerAPP2 = 0xe2
+	markerAPPE = 0xee
+	markerAPPF = 0xef
+	markerCOM  = 0xfe
+)
+
+// keepJPEGSegment reports whether a marker segment is needed to render the
+// image. Of the application segments only JFIF (APP0), ICC profiles (APP2)
+// and Adobe colour transforms (APP14) matter.
+func keepJPEGSegment(marker byte) bool {
+	switch {
+	case marker == markerCOM:
+		return false
+	case marker >= markerAPP0 && marker <= markerAPPF:
+		return marker == markerAPP0 || marker == markerAPP2 || marker == markerAPPE
+	}
+	return true
+}
+
+// stripJPEG copies the segments that render the image up to the end-of-image
+// marker. Progressive JPEGs interleave scans with table segments, so each
+// scan's entropy-coded data is copied up to the marker that ends it and
+// parsing resumes there.
+func stripJPEG(dst io.Writer, src *bufio.Reader) error {
+	var soi [2]byte
+	if _, err := io.ReadFull(src, soi[:]); err != nil {
+		return err
+	}
+	if soi[0] != 0xff || soi[1] != markerSOI {
+		return invalid("corrupt JPEG header")
+	}
+	// Write errors are kept by the buffer and reported by Flush.
+	out := bufio.NewWriter(dst)
+	out.Write(soi[:])
+
+	// marker is the next segment's, when a scan has already read it.
+	var marker byte
+	var scanned, wroteOrientation bool
+	for {
+		if marker == 0 {
+			b, err := src.ReadByte()
+			if err != nil {
+				return err
+			}
+			if b != 0xff {
+				return invalid("corrupt JPEG segment")
+			}
+			if marker, err = readJPEGMarker(src); err != nil {
+				return err
+			}
+			if marker == 0 {
+				return invalid("corrupt JPEG segment")
+			}
+		}
+
+		// Markers without a length.
+		if marker == 0x01 || marker >= 0xd0 && marker <= markerEOI {
+			out.Write([]byte{0xff, marker})
+			if marker == markerEOI {
+				return out.Flush()
+			}
+			marker = 0
+			continue
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(src, length[:]); err != nil {
+			return err
+		}
+		size := int(binary.BigEndian.Uint16(length[:]))
+		if size < 2 {
+			return invalid("corrupt JPEG segment length")
+		}
+		payload := make([]byte, size-2)
+		if _, err := io.ReadFull(src, payload); err != nil {
+			return err
+		}
+
+		if !keepJPEGSegment(marker) {
+			// Only the first EXIF segment, before any scan, is read for
+			// the orientation.
+			if marker == markerAPP1 && !wroteOrientation && !scanned {
+				if orientation := exifOrientation(payload); orientation > 1 {
+					out.Write(orientationSegment(orientation))
+					wroteOrientation = true
+				}
+			}
+			marker = 0
+			continue
+		}
+		out.Write([]byte{0xff, marker, length[0], length[1]})
+		out.Write(payload)
+		if marker != markerSOS {
+			marker = 0
+			continue
+		}
+
+		// Entropy-coded data follows the scan header.
+		scanned = true
+		var err error
+		if marker, err = copyScan(out, src); err != nil {
+			return err
+		}
+	}
+}
+
+// readJPEGMarker reads the marker code after a 0xff, skipping fill bytes.
+func readJPEGMarker(src *bufio.Reader) (byte, error) {
+	for {
+		marker, err := src.ReadByte()
+		if err != nil || marker != 0xff {
+			return marker, err
+		}
+	}
+}
+
+// copyScan copies entropy-coded data to dst and returns the marker that ends
+// it. Stuffed zero bytes and restart markers are part of the data.
+func copyScan(dst *bufio.Writer, src *bufio.Reader) (byte, error) {
+	for {
+		data, err := src.ReadSlice(0xff)
+		if err == bufio.ErrBufferFull {
+			dst.Write(data)
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		dst.Write(data[:len(data)-1])
+		marker, err := readJPEGMarker(src)
+		if err != nil {
+			return 0, err
+		}
+		if marker != 0 && (marker < 0xd0 || marker > 0xd7) {
+			return marker, nil
+		}
+		dst.Write([]byte{0xff, marker})
+	}
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// exifOrientation returns the Orientation tag of an APP1 EXIF payload, or
+// zero when there is none.
+func exifOrientation(payload []byte) uint16 {
+	if !bytes.HasPrefix(payload, exifHeader) {
+		return 0
+	}
+	tiff := payload[len(exifHeader):]
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := order.Uint16(tiff[entry+8:])
+			if orientation > 8 {
+				return 0
+			}
+			return orientation
+		}
+	}
+	return 0
+}
+
+// orientationSegment builds an APP1 EXIF segment holding only an
+// Orientation tag.
+func orientationSegment(orientation uint16) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0xff, markerAPP1, 0, 0})
+	b.Write(exifHeader)
+	b.WriteString("MM\x00\x2a")
+	binary.Write(&b, binary.BigEndian, uint32(8)) // IFD0 offset
+	binary.Write(&b, binary.BigEndian, uint16(1)) // entry count
+	binary.Write(&b, binary.BigEndian, uint16(0x0112))
+	binary.Write(&b, binary.BigEndian, uint16(3)) // SHORT
+	binary.Write(&b, binary.BigEndian, uint32(1))
+	binary.Write(&b, binary.BigEndian, orientation)
+	binary.Write(&b, binary.BigEndian, uint16(0))
+	binary.Write(&b, binary.BigEndian, uint32(0)) // no next IFD
+	segment := b.Bytes()
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(segment)-2))
+	return segment
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks are ancillary chunks carrying EXIF, text or the time of
+// last modification.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+func stripPNG(dst io.Writer, src *bufio.Reader) error {
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(src, signature); err != nil {
+		return err
+	}
+	if !bytes.Equal(signature, pngSignature) {
+		return invalid("corrupt PNG header")
+	}
+	if _, err := dst.Write(signature); err != nil {
+		return err
+	}
+
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(src, header[:]); err != nil {
+			return err
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		kind := string(header[4:])
+		// Chunk data is followed by a CRC.
+		if pngMetadataChunks[kind] {
+			if _, err := src.Discard(int(length) + 4); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := dst.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, src, length+4); err != nil {
+			return err
+		}
+		if kind == "IEND" {
+			return nil
+		}
+	}
+}
+
+type webpChunk struct {
+	kind   string
+	offset int64
+	size   int64
+}
+
+// VP8X flags for metadata chunks.
+const (
+	webpFlagXMP  = 0x04
+	webpFlagEXIF = 0x08
+)
+
+// stripWebP drops the EXIF and XMP chunks. The RIFF header carries the file
+// size, so the chunks are listed first and the file is written in a second
+// pass.
+func stripWebP(dst io.Writer, src io.ReadSeeker) error {
+	var header [12]byte
+	if _, err := io.ReadFull(src, header[:]); err != nil {
+		return err
+	}
+	riffSize := int64(binary.LittleEndian.Uint32(header[4:8]))
+
+	var chunks []webpChunk
+	var size int64 = 4 // "WEBP"
+	offset := int64(12)
+	for offset < 8+riffSize {
+		var chunkHeader [8]byte
+		if _, err := io.ReadFull(src, chunkHeader[:]); err != nil {
+			return err
+		}
+		chunk := webpChunk{
+			kind:   string(chunkHeader[:4]),
+			offset: offset,
+			size:   int64(binary.LittleEndian.Uint32(chunkHeader[4:])),
+		}
+		padded := chunk.size + chunk.size&1
+		if chunk.kind != "EXIF" && chunk.kind != "XMP " {
+			chunks = append(chunks, chunk)
+			size += 8 + padded
+		}
+		offset += 8 + padded
+		if _, err := src.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	binary.LittleEndian.PutUint32(header[4:8], uint32(size))
+	if _, err := dst.Write(header[:]); err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if _, err := src.Seek(chunk.offset, io.SeekStart); err != nil {
+			return err
+		}
+		head := make([]byte, 8)
+		if _, err := io.ReadFull(src, head); err != nil {
+			return err
+		}
+		remaining := chunk.size + chunk.size&1
+		if chunk.kind == "VP8X" {
+			if chunk.size < 10 {
+				return invalid("corrupt WebP extended header")
+			}
+			var flags [1]byte
+			if _, err := io.ReadFull(src, flags[:]); err != nil {
+				return err
+			}
+			head = append(head, flags[0]&^(webpFlagEXIF|webpFlagXMP))
+			remaining--
+		}
+		if _, err := dst.Write(head); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, src, remaining); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GIF blocks.
+const (
+	gifExtension    = 0x21
+	gifImage        = 0x2c
+	gifTrailer      = 0x3b
+	gifComment      = 0xfe
+	gifAppExtension = 0xff
+)
+
+// gifRenderingApps are the application extensions that affect how a GIF
+// plays or looks: animation looping and ICC colour profiles. Others, such as
+// XMP, carry metadata.
+var gifRenderingApps = map[string]bool{
+	"NETSCAPE2.0": true,
+	"ANIMEXTS1.0": true,
+	"ICCRGBG1012": true,
+}
+
+// stripGIF drops comment extensions and metadata application extensions,
+// and stops at the trailer.
+func stripGIF(dst io.Writer, src *bufio.Reader) error {
+	// Header and logical screen descriptor.
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return err
+	}
+	if version := string(header[:6]); version != "GIF87a" && version != "GIF89a" {
+		return invalid("corrupt GIF header")
+	}
+	// Write errors are kept by the buffer and reported by Flush.
+	out := bufio.NewWriter(dst)
+	out.Write(header)
+	if err := copyGIFColorTable(out, src, header[10]); err != nil {
+		return err
+	}
+
+	for {
+		block, err := src.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch block {
+		case gifTrailer:
+			out.WriteByte(block)
+			return out.Flush()
+
+		case gifImage:
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(src, descriptor); err != nil {
+				return err
+			}
+			out.WriteByte(block)
+			out.Write(descriptor)
+			if err := copyGIFColorTable(out, src, descriptor[8]); err != nil {
+				return err
+			}
+			// LZW minimum code size, then the image data.
+			codeSize, err := src.ReadByte()
+			if err != nil {
+				return err
+			}
+			out.WriteByte(codeSize)
+			if err := copyGIFSubBlocks(out, src); err != nil {
+				return err
+			}
+
+		case gifExtension:
+			label, err := src.ReadByte()
+			if err != nil {
+				return err
+			}
+			var w io.Writer = out
+			switch label {
+			case gifComment:
+				w = io.Discard
+			case gifAppExtension:
+				// The first sub-block holds the application identifier.
+				id, err := readGIFSubBlock(src)
+				if err != nil {
+					return err
+				}
+				if !gifRenderingApps[string(id)] {
+					w = io.Discard
+				}
+				w.Write([]byte{block, label, byte(len(id))})
+				w.Write(id)
+				if len(id) == 0 {
+					continue
+				}
+				if err := copyGIFSubBlocks(w, src); err != nil {
+					return err
+				}
+				continue
+			}
+			w.Write([]byte{block, label})
+			if err := copyGIFSubBlocks(w, src); err != nil {
+				return err
+			}
+
+		default:
+			return invalid("corrupt GIF block")
+		}
+	}
+}
+
+// copyGIFColorTable copies the colour table a descriptor's packed flags
+// announce, if any.
+func copyGIFColorTable(dst io.Writer, src *bufio.Reader, flags byte) error {
+	if flags&0x80 == 0 {
+		return nil
+	}
+	_, err := io.CopyN(dst, src, 3<<(flags&0x07+1))
+	return err
+}
+
+// readGIFSubBlock reads one data sub-block, which is empty at the end of a
+// block.
+func readGIFSubBlock(src *bufio.Reader) ([]byte, error) {
+	size, err := src.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(src, data)
+	return data, err
+}
+
+// copyGIFSubBlocks copies data sub-blocks up to and including the empty one
+// that ends them.
+func copyGIFSubBlocks(dst io.Writer, src *bufio.Reader) error {
+	for {
+		data, err := readGIFSubBlock(src)
+		if err != nil {
+			return err
+		}
+		dst.Write([]byte{byte(len(data))})
+		dst.Write(data)
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package images
+
+import (
+	"bytes"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func sanitize(t *testing.T, data []byte, format string) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	if err := Sanitize(&out, bytes.NewReader(data), format); err != nil {
+		t.Fatalf("Sanitize() = %v", err)
+	}
+	return out.Bytes()
+}
+
+func TestSanitizeJPEG(t *testing.T) {
+	exif := orientationSegment(6)[4:]
+	exif = append(exif, []byte("GPS 9.03N 38.74E")...)
+	jpg := encodeJPEG(t, 24, 24)
+	jpg = withSegment(jpg, markerCOM, []byte("shot on my phone"))
+	jpg = withSegment(jpg, 0xed, []byte("Photoshop 3.0\x00IPTC"))
+	jpg = withSegment(jpg, markerAPP1, exif)
+	jpg = append(jpg, []byte("trailing secret")...)
+
+	out := sanitize(t, jpg, JPEG)
+	for _, leaked := range []string{"GPS", "shot on my phone", "IPTC", "trailing secret"} {
+		if bytes.Contains(out, []byte(leaked)) {
+			t.Errorf("sanitized JPEG still contains %q", leaked)
+		}
+	}
+	if !bytes.HasSuffix(out, []byte{0xff, markerEOI}) {
+		t.Error("sanitized JPEG does not end at EOI")
+	}
+	if got := jpegOrientation(bytes.NewReader(out)); got != 6 {
+		t.Errorf("orientation = %d, want 6", got)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("sanitized JPEG does not decode: %v", err)
+	}
+}
+
+func TestSanitizeJPEGScans(t *testing.T) {
+	segment := func(marker byte, payload string) []byte {
+		return append([]byte{0xff, marker, 0, byte(len(payload) + 2)}, payload...)
+	}
+	var in, want []byte
+	add := func(b []byte, keep bool) {
+		in = append(in, b...)
+		if keep {
+			want = append(want, b...)
+		}
+	}
+	add([]byte{0xff, markerSOI}, true)
+	add(segment(0xdb, "tables"), true)
+	add(segment(markerSOS, "scan1"), true)
+	// Stuffed bytes, a restart marker and fill bytes are scan data.
+	add([]byte{0x12, 0xff, 0x00, 0x34, 0xff, 0xd3, 0x56}, true)
+	add([]byte{0xff}, false)
+	add(segment(0xc4, "huffman"), true)
+	add(segment(markerAPP1, "Exif\x00\x00later"), false)
+	add(segment(markerCOM, "comment"), false)
+	add(segment(markerSOS, "scan2"), true)
+	add([]byte{0x78, 0x9a}, true)
+	add([]byte{0xff, markerEOI}, true)
+	add(segment(markerAPP1, "after the end"), false)
+	add([]byte("junk"), false)
+
+	if out := sanitize(t, in, JPEG); !bytes.Equal(out, want) {
+		t.Errorf("Sanitize() =\n%x\nwant\n%x", out, want)
+	}
+}
+
+func TestSanitizePNG(t *testing.T) {
+	data := encodePNG(t, 8, 8)
+	// Insert a text chunk after IHDR (8-byte signature, 25-byte IHDR).
+	text := []byte("\x00\x00\x00\x0ctEXtAuthor\x00Abebe\x00\x00\x00\x00")
+	data = append(append(append([]byte{}, data[:33]...), text...), data[33:]...)
+	data = append(data, []byte("trailing")...)
+
+	out := sanitize(t, data, PNG)
+	if bytes.Contains(out, []byte("Abebe")) || bytes.Contains(out, []byte("trailing")) {
+		t.Error("sanitized PNG kept its text")
+	}
+	if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("sanitized PNG does not decode: %v", err)
+	}
+}
+
+// gifExtensionBlock builds an extension with the given sub-blocks.
+func gifExtensionBlock(label byte, blocks ...string) []byte {
+	out := []byte{gifExtension, label}
+	for _, block := range blocks {
+		out = append(out, byte(len(block)))
+		out = append(out, block...)
+	}
+	return append(out, 0)
+}
+
+func TestSanitizeGIF(t *testing.T) {
+	data := encodeGIF(t, 8, 8)
+	// Extensions go before the first image descriptor, after the header,
+	// screen descriptor and global colour table.
+	at := bytes.IndexByte(data[13+3*256:], gifImage) + 13 + 3*256
+	loop := gifExtensionBlock(gifAppExtension, "NETSCAPE2.0", "\x01\x00\x00")
+	var extensions []byte
+	extensions = append(extensions, gifExtensionBlock(gifComment, "made by Abebe")...)
+	extensions = append(extensions, gifExtensionBlock(gifAppExtension, "XMP DataXMP", "<x:xmpmeta>", "GPS")...)
+	extensions = append(extensions, loop...)
+	data = append(append(append([]byte{}, data[:at]...), extensions...), data[at:]...)
+	data = append(data, []byte("trailing")...)
+
+	out := sanitize(t, data, GIF)
+	for _, leaked := range []string{"Abebe", "xmpmeta", "GPS", "trailing"} {
+		if bytes.Contains(out, []byte(leaked)) {
+			t.Errorf("sanitized GIF still contains %q", leaked)
+		}
+	}
+	if !bytes.Contains(out, loop) {
+		t.Error("sanitized GIF lost its loop extension")
+	}
+	if _, err := gif.DecodeAll(bytes.NewReader(out)); err != nil {
+		t.Errorf("sanitized GIF does not decode: %v", err)
+	}
+}
+
+func TestSanitizeWebP(t *testing.T) {
+	data := webpFile(
+		vp8x(webpFlagEXIF|webpFlagXMP|0x10, 64, 48),
+		vp8l(64, 48),
+		riffChunk("EXIF", []byte("GPS data")),
+		riffChunk("XMP ", []byte("<x:xmpmeta/>")),
+	)
+	out := sanitize(t, data, WebP)
+	want := webpFile(vp8x(0x10, 64, 48), vp8l(64, 48))
+	if !bytes.Equal(out, want) {
+		t.Errorf("Sanitize() =\n%x\nwant\n%x", out, want)
+	}
+}
+
+func TestSanitizeMalformed(t *testing.T) {
+	jpg := encodeJPEG(t, 8, 8)
+	pngData := encodePNG(t, 8, 8)
+	gifData := encodeGIF(t, 8, 8)
+	tests := []struct {
+		name   string
+		format string
+		data   []byte
+	}{
+		{"empty jpeg", JPEG, nil},
+		{"jpeg bad header", JPEG, []byte("not a jpeg")},
+		{"jpeg truncated in scan", JPEG, jpg[:len(jpg)-10]},
+		{"jpeg truncated segment", JPEG, jpg[:10]},
+		{"jpeg bad segment length", JPEG, []byte{0xff, markerSOI, 0xff, 0xdb, 0x00, 0x01}},
+		{"jpeg garbage between segments", JPEG, []byte{0xff, markerSOI, 0x00, 0x00}},
+		{"png bad signature", PNG, []byte("\x89PNX\r\n\x1a\n")},
+		{"png without IEND", PNG, pngData[:len(pngData)-12]},
+		{"gif bad header", GIF, []byte("GIF00a" + string(make([]byte, 7)))},
+		{"gif without trailer", GIF, gifData[:len(gifData)-1]},
+		{"gif unknown block", GIF, append(append([]byte{}, gifData[:len(gifData)-1]...), 0x99)},
+		{"gif truncated colour table", GIF, gifData[:20]},
+		{"webp truncated", WebP, webpFile(vp8l(8, 8))[:20]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := Sanitize(&out, bytes.NewReader(tt.data), tt.format)
+			if err == nil {
+				t.Fatal("Sanitize() accepted a malformed image")
+			}
+			if !IsValidationError(err) {
+				t.Errorf("Sanitize() = %v, want a validation error", err)
+			}
+		})
+	}
+}
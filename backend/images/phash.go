@@ -0,0 +1,62 @@
+package images
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+)
+
+// Hash is a perceptual difference hash (dHash) of an image: each bit says
+// whether a cell of a 9x8 grayscale thumbnail is brighter than its right
+// neighbour. Re-encoded, resized or lightly edited copies of an image hash
+// within a few bits of the original.
+// https://www.hackerfactor.com/blog/index.php?/archives/529-Kind-of-Like-That.html
+type Hash uint64
+
+// Hash computes the picture's dHash.
+func (p *Picture) Hash() Hash {
+	small := resize(p.img, p.img.Bounds(), 9, 8)
+	var luma [8][9]int
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 9; x++ {
+			i := small.PixOffset(x, y)
+			// Rec. 601 luma, scaled by 1000.
+			luma[y][x] = 299*int(small.Pix[i]) + 587*int(small.Pix[i+1]) + 114*int(small.Pix[i+2])
+		}
+	}
+	var h Hash
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			h <<= 1
+			if luma[y][x] > luma[y][x+1] {
+				h |= 1
+			}
+		}
+	}
+	return h
+}
+
+// Distance is the number of bits in which two hashes differ.
+func (h Hash) Distance(other Hash) int {
+	return bits.OnesCount64(uint64(h ^ other))
+}
+
+// Bands splits the hash into four 16-bit parts, most significant first. Two
+// hashes at most three bits apart agree on at least one band.
+func (h Hash) Bands() [4]int {
+	var bands [4]int
+	for i := range bands {
+		bands[i] = int(uint64(h) >> (48 - 16*i) & 0xffff)
+	}
+	return bands
+}
+
+func (h Hash) String() string {
+	return fmt.Sprintf("%016x", uint64(h))
+}
+
+// ParseHash reads a hash written by String.
+func ParseHash(s string) (Hash, error) {
+	v, err := strconv.ParseUint(s, 16, 64)
+	return Hash(v), err
+}
@@ -0,0 +1,113 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"testing"
+)
+
+// scene draws a smooth pattern, scaled to any size, so copies at different
+// sizes show the same picture.
+func scene(width, height int, phase float64) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			u, v := float64(x)/float64(width), float64(y)/float64(height)
+			l := 128 + 100*math.Sin(9*u+4*v+phase)
+			img.Set(x, y, color.RGBA{uint8(l), uint8(255 - l), uint8(l / 2), 255})
+		}
+	}
+	return img
+}
+
+func hashOf(t *testing.T, img image.Image, asJPEG bool) Hash {
+	t.Helper()
+	var b bytes.Buffer
+	var err error
+	if asJPEG {
+		err = jpeg.Encode(&b, img, &jpeg.Options{Quality: 60})
+	} else {
+		err = png.Encode(&b, img)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := bytes.NewReader(b.Bytes())
+	info, err := Inspect(src, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	picture, err := Decode(context.Background(), src, info, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return picture.Hash()
+}
+
+func TestHash(t *testing.T) {
+	original := hashOf(t, scene(640, 480, 0), false)
+	tests := []struct {
+		name    string
+		hash    Hash
+		similar bool
+	}{
+		{"same image", hashOf(t, scene(640, 480, 0), false), true},
+		{"re-encoded as jpeg", hashOf(t, scene(640, 480, 0), true), true},
+		{"resized", hashOf(t, scene(480, 360, 0), true), true},
+		{"different image", hashOf(t, scene(640, 480, 2), false), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := original.Distance(tt.hash)
+			if tt.similar && d > 3 {
+				t.Errorf("distance = %d, want at most 3", d)
+			}
+			if !tt.similar && d <= 10 {
+				t.Errorf("distance = %d, want more than 10", d)
+			}
+		})
+	}
+}
+
+func TestHashBands(t *testing.T) {
+	h := Hash(0x0123456789abcdef)
+	if got, want := h.Bands(), [4]int{0x0123, 0x4567, 0x89ab, 0xcdef}; got != want {
+		t.Errorf("Bands() = %x, want %x", got, want)
+	}
+	// Three flipped bits touch at most three bands, so one still matches.
+	other := h ^ (1 | 1<<20 | 1<<40)
+	bands, otherBands := h.Bands(), other.Bands()
+	var same int
+	for i := range bands {
+		if bands[i] == otherBands[i] {
+			same++
+		}
+	}
+	if same == 0 {
+		t.Error("hashes three bits apart share no band")
+	}
+	if d := h.Distance(other); d != 3 {
+		t.Errorf("Distance() = %d, want 3", d)
+	}
+}
+
+func TestParseHash(t *testing.T) {
+	for _, h := range []Hash{0, 1, 0x0123456789abcdef, math.MaxUint64} {
+		s := h.String()
+		if len(s) != 16 {
+			t.Errorf("String() = %q, want 16 digits", s)
+		}
+		got, err := ParseHash(s)
+		if err != nil || got != h {
+			t.Errorf("ParseHash(%q) = %v, %v, want %v", s, got, err, h)
+		}
+	}
+	if _, err := ParseHash("not a hash"); err == nil {
+		t.Error("ParseHash accepted garbage")
+	}
+}
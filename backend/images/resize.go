@@ -0,0 +1,193 @@
+package images
+
+import (
+	"bufio"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+)
+
+// jpegOrientation returns the EXIF orientation of a JPEG, or zero when it
+// has none. Only the segments before the image data are read.
+func jpegOrientation(r io.Reader) uint16 {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi[0] != 0xff || soi[1] != markerSOI {
+		return 0
+	}
+	for {
+		b, err := br.ReadByte()
+		if err != nil || b != 0xff {
+			return 0
+		}
+		marker := byte(0xff)
+		for marker == 0xff {
+			if marker, err = br.ReadByte(); err != nil {
+				return 0
+			}
+		}
+		if marker == markerSOS || marker == markerEOI {
+			return 0
+		}
+		if marker == 0x01 || marker >= 0xd0 && marker <= 0xd7 {
+			continue
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(br, length[:]); err != nil {
+			return 0
+		}
+		size := int(length[0])<<8 | int(length[1])
+		if size < 2 {
+			return 0
+		}
+		if marker != markerAPP1 {
+			if _, err := br.Discard(size - 2); err != nil {
+				return 0
+			}
+			continue
+		}
+		payload := make([]byte, size-2)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return 0
+		}
+		if orientation := exifOrientation(payload); orientation != 0 {
+			return orientation
+		}
+	}
+}
+
+// shrink draws img onto an opaque white canvas, as variants are JPEGs
+// without an alpha channel, scaled down to at most maxPixels. It works
+// through img a band of rows at a time, reusing one band buffer, so no
+// full-size copy of img is made.
+func shrink(img image.Image, maxPixels int) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tw, th := w, h
+	if w*h > maxPixels {
+		scale := math.Sqrt(float64(maxPixels) / float64(w*h))
+		tw, th = max(1, int(float64(w)*scale)), max(1, int(float64(h)*scale))
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	band := image.NewRGBA(image.Rect(0, 0, w, (h+th-1)/th))
+	for dy := 0; dy < th; dy++ {
+		y0, y1 := span(dy, h, th)
+		rows := image.Rect(0, 0, w, y1-y0)
+		draw.Draw(band, rows, image.White, image.Point{}, draw.Src)
+		draw.Draw(band, rows, img, image.Pt(b.Min.X, b.Min.Y+y0), draw.Over)
+		for dx := 0; dx < tw; dx++ {
+			x0, x1 := span(dx, w, tw)
+			offset := dst.PixOffset(dx, dy)
+			average(dst.Pix[offset:offset+4], band, image.Rect(x0, 0, x1, y1-y0))
+		}
+	}
+	return dst
+}
+
+// orient turns an image stored with EXIF orientation o upright.
+func orient(src *image.RGBA, o uint16) *image.RGBA {
+	if o < 2 || o > 8 {
+		return src
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		for dx := 0; dx < dw; dx++ {
+			var sx, sy int
+			switch o {
+			case 2:
+				sx, sy = w-1-dx, dy
+			case 3:
+				sx, sy = w-1-dx, h-1-dy
+			case 4:
+				sx, sy = dx, h-1-dy
+			case 5:
+				sx, sy = dy, dx
+			case 6:
+				sx, sy = dy, h-1-dx
+			case 7:
+				sx, sy = w-1-dy, h-1-dx
+			case 8:
+				sx, sy = w-1-dy, dx
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+// resize scales the area r of src to w by h by averaging the source pixels
+// each destination pixel covers. It is meant for shrinking; enlarging
+// repeats pixels.
+func resize(src *image.RGBA, r image.Rectangle, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for dy := 0; dy < h; dy++ {
+		y0, y1 := span(dy, r.Dy(), h)
+		for dx := 0; dx < w; dx++ {
+			x0, x1 := span(dx, r.Dx(), w)
+			offset := dst.PixOffset(dx, dy)
+			average(dst.Pix[offset:offset+4], src, image.Rect(x0, y0, x1, y1).Add(r.Min))
+		}
+	}
+	return dst
+}
+
+// span returns the source pixels [i0, i1) that destination pixel i of n
+// covers when scaling size source pixels to n. At least one pixel is
+// covered.
+func span(i, size, n int) (int, int) {
+	i0, i1 := i*size/n, (i+1)*size/n
+	if i1 <= i0 {
+		i1 = i0 + 1
+	}
+	return i0, i1
+}
+
+// average writes the mean colour of the area r of src to pixel.
+func average(pixel []uint8, src *image.RGBA, r image.Rectangle) {
+	var sum [4]int
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := src.Pix[src.PixOffset(r.Min.X, y):src.PixOffset(r.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			sum[0] += int(row[i])
+			sum[1] += int(row[i+1])
+			sum[2] += int(row[i+2])
+			sum[3] += int(row[i+3])
+		}
+	}
+	n := r.Dx() * r.Dy()
+	for c := 0; c < 4; c++ {
+		pixel[c] = uint8(sum[c] / n)
+	}
+}
+
+// fitSize returns the size of a w by h image shrunk to fit within maxW by
+// maxH, never enlarged. A zero bound is ignored.
+func fitSize(w, h, maxW, maxH int) (int, int) {
+	scale := 1.0
+	if maxW > 0 && w > maxW {
+		scale = float64(maxW) / float64(w)
+	}
+	if maxH > 0 && float64(h)*scale > float64(maxH) {
+		scale = float64(maxH) / float64(h)
+	}
+	return max(1, int(float64(w)*scale+0.5)), max(1, int(float64(h)*scale+0.5))
+}
+
+// cropRect returns the largest centred area of a w by h image with the
+// aspect ratio of cw by ch.
+func cropRect(w, h, cw, ch int) image.Rectangle {
+	if w*ch > h*cw {
+		width := h * cw / ch
+		x := (w - width) / 2
+		return image.Rect(x, 0, x+width, h)
+	}
+	height := w * ch / cw
+	y := (h - height) / 2
+	return image.Rect(0, y, w, y+height)
+}
@@ -0,0 +1,175 @@
+package images
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+
+	"github.com/gen2brain/webp"
+)
+
+// ErrNoDecoder is returned by Decode for formats the standard library
+// cannot decode, which is WebP.
+var ErrNoDecoder = errors.New("no decoder for image format")
+
+// ErrTooLarge is returned by Decode for images with more pixels than it may
+// decode.
+var ErrTooLarge = errors.New("image too large to decode")
+
+// pictureMaxPixels bounds the copy of an image a Picture keeps. It leaves
+// room for every variant of all but extreme panoramas.
+const pictureMaxPixels = 4_000_000
+
+// decodeSlots bounds how many images the process decodes at once, as each
+// decode holds a whole image's pixels in memory.
+var decodeSlots = make(chan struct{}, 2)
+
+// SetDecodeConcurrency sets how many images may be decoded at once. It is
+// meant to be called at startup.
+func SetDecodeConcurrency(n int) {
+	decodeSlots = make(chan struct{}, max(1, n))
+}
+
+const (
+	variantQuality     = 82
+	webpQuality        = 75
+	placeholderQuality = 40
+)
+
+// VariantSpec describes a resized copy of an upload. Cropped variants fill
+// Width by Height, cutting off the edges; the others fit within it.
+type VariantSpec struct {
+	Name   string
+	Width  int
+	Height int
+	Crop   bool
+}
+
+// Variants are the sizes recipe pages use.
+var Variants = []VariantSpec{
+	{Name: "thumbnail", Width: 160, Height: 160, Crop: true},
+	{Name: "card", Width: 640, Height: 480, Crop: true},
+	{Name: "hero", Width: 1600, Height: 1600},
+}
+
+// Size returns the dimensions of this variant of a w by h image. Images are
+// never enlarged, so a cropped variant of a small image keeps the variant's
+// aspect ratio at a smaller size.
+func (v VariantSpec) Size(w, h int) (int, int) {
+	if !v.Crop {
+		return fitSize(w, h, v.Width, v.Height)
+	}
+	crop := cropRect(w, h, v.Width, v.Height)
+	return fitSize(crop.Dx(), crop.Dy(), v.Width, v.Height)
+}
+
+// Picture is a decoded image, upright and without transparency. Large
+// images are kept scaled down to pictureMaxPixels.
+type Picture struct {
+	img *image.RGBA
+	// width and height are the image's own dimensions as displayed.
+	width  int
+	height int
+}
+
+// Decode reads the pixels of an image Inspect accepted, returning
+// ErrTooLarge for images of more than maxPixels; zero means no limit. Only
+// a few decodes run at once across the process, and the decoded image is
+// dropped once its scaled-down copy is made, which bounds the memory
+// decoding takes.
+func Decode(ctx context.Context, src io.ReadSeeker, info *Info, maxPixels int64) (*Picture, error) {
+	if info.Format == WebP {
+		return nil, ErrNoDecoder
+	}
+	if maxPixels > 0 && int64(info.Width)*int64(info.Height) > maxPixels {
+		return nil, ErrTooLarge
+	}
+
+	slots := decodeSlots
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-slots }()
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bufio.NewReader(src))
+	if err != nil {
+		return nil, invalid("corrupt %s image data", info.Format)
+	}
+	return &Picture{
+		img:    orient(shrink(img, pictureMaxPixels), info.Orientation),
+		width:  info.Width,
+		height: info.Height,
+	}, nil
+}
+
+// Size returns the picture's dimensions as displayed.
+func (p *Picture) Size() (int, int) {
+	return p.width, p.height
+}
+
+// Rendition is a variant of a picture encoded as JPEG, which every
+// browser shows, and as WebP, which is smaller for those that accept it.
+type Rendition struct {
+	Width  int
+	Height int
+	JPEG   []byte
+	WebP   []byte
+}
+
+// Render encodes the variant described by spec as a JPEG and a WebP.
+func (p *Picture) Render(spec VariantSpec) (*Rendition, error) {
+	area := p.img.Bounds()
+	if spec.Crop {
+		area = cropRect(area.Dx(), area.Dy(), spec.Width, spec.Height)
+	}
+	w, h := spec.Size(p.Size())
+	img := resize(p.img, area, w, h)
+	var jpg, wp bytes.Buffer
+	if err := jpeg.Encode(&jpg, img, &jpeg.Options{Quality: variantQuality}); err != nil {
+		return nil, err
+	}
+	if err := webp.Encode(&wp, img, webp.Options{Quality: webpQuality}); err != nil {
+		return nil, err
+	}
+	return &Rendition{Width: w, Height: h, JPEG: jpg.Bytes(), WebP: wp.Bytes()}, nil
+}
+
+// Placeholder stands in for an image while it loads: a BlurHash for clients
+// that can decode one, and a tiny blurred-looking JPEG inlined as a data URI
+// (LQIP) for those that cannot.
+type Placeholder struct {
+	BlurHash string
+	DataURI  string
+}
+
+func (p *Picture) Placeholder() (*Placeholder, error) {
+	w, h := p.Size()
+
+	sw, sh := fitSize(w, h, 32, 32)
+	xComponents, yComponents := 4, 3
+	if h > w {
+		xComponents, yComponents = 3, 4
+	}
+	hash := blurHash(resize(p.img, p.img.Bounds(), sw, sh), xComponents, yComponents)
+
+	lw, lh := fitSize(w, h, 16, 16)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, resize(p.img, p.img.Bounds(), lw, lh), &jpeg.Options{Quality: placeholderQuality}); err != nil {
+		return nil, err
+	}
+
+	return &Placeholder{
+		BlurHash: hash,
+		DataURI:  "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+	}, nil
+}
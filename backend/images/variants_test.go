@@ -0,0 +1,173 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	large := encodePNG(t, 2400, 2000)
+	tests := []struct {
+		name   string
+		data   []byte
+		limit  int64
+		width  int
+		height int
+		err    error
+	}{
+		{"small", encodePNG(t, 40, 30), 0, 40, 30, nil},
+		{"scaled down", large, 0, 2400, 2000, nil},
+		{"within decode limit", large, 2400 * 2000, 2400, 2000, nil},
+		{"beyond decode limit", large, 2400*2000 - 1, 0, 0, ErrTooLarge},
+		{"webp", webpFile(vp8l(8, 8)), 0, 0, 0, ErrNoDecoder},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := bytes.NewReader(tt.data)
+			info, err := Inspect(src, Limits{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			picture, err := Decode(context.Background(), src, info, tt.limit)
+			if err != tt.err {
+				t.Fatalf("Decode() = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if w, h := picture.Size(); w != tt.width || h != tt.height {
+				t.Errorf("Size() = %dx%d, want %dx%d", w, h, tt.width, tt.height)
+			}
+			if b := picture.img.Bounds(); b.Dx()*b.Dy() > pictureMaxPixels {
+				t.Errorf("picture keeps %dx%d pixels", b.Dx(), b.Dy())
+			}
+		})
+	}
+}
+
+func TestDecodeWaitsForSlot(t *testing.T) {
+	SetDecodeConcurrency(1)
+	defer SetDecodeConcurrency(2)
+	decodeSlots <- struct{}{}
+	defer func() { <-decodeSlots }()
+
+	data := encodePNG(t, 8, 8)
+	info, err := Inspect(bytes.NewReader(data), Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Decode(ctx, bytes.NewReader(data), info, 0); err != context.Canceled {
+		t.Errorf("Decode() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestDecodeFlattensAndOrients(t *testing.T) {
+	// A transparent image, 4 wide and 2 tall, with an opaque red left half.
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 2; x++ {
+			img.Set(x, y, color.NRGBA{255, 0, 0, 255})
+		}
+	}
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	info, err := Inspect(bytes.NewReader(b.Bytes()), Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pretend it was stored rotated: orientation 6 turns it clockwise.
+	info.Orientation = 6
+	info.Width, info.Height = 2, 4
+	picture, err := Decode(context.Background(), bytes.NewReader(b.Bytes()), info, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := picture.img
+	if got.Bounds().Dx() != 2 || got.Bounds().Dy() != 4 {
+		t.Fatalf("picture is %v, want 2x4", got.Bounds())
+	}
+	if c := got.RGBAAt(0, 0); c != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("top left = %v, want red", c)
+	}
+	if c := got.RGBAAt(0, 3); c != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("bottom left = %v, want white", c)
+	}
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		spec          VariantSpec
+		wantW, wantH  int
+	}{
+		{"fit landscape", 3200, 1600, VariantSpec{Width: 1600, Height: 1600}, 1600, 800},
+		{"fit small", 300, 200, VariantSpec{Width: 1600, Height: 1600}, 300, 200},
+		{"crop landscape", 3200, 1600, VariantSpec{Width: 640, Height: 480, Crop: true}, 640, 480},
+		{"crop portrait", 1000, 3000, VariantSpec{Width: 160, Height: 160, Crop: true}, 160, 160},
+		{"crop small", 120, 90, VariantSpec{Width: 640, Height: 480, Crop: true}, 120, 90},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := encodeJPEG(t, tt.width, tt.height)
+			info, err := Inspect(bytes.NewReader(data), Limits{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			picture, err := Decode(context.Background(), bytes.NewReader(data), info, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := picture.Render(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, h := out.Width, out.Height
+			if w != tt.wantW || h != tt.wantH {
+				t.Errorf("Render() size = %dx%d, want %dx%d", w, h, tt.wantW, tt.wantH)
+			}
+			config, err := jpeg.DecodeConfig(bytes.NewReader(out.JPEG))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Width != w || config.Height != h {
+				t.Errorf("rendered JPEG is %dx%d, want %dx%d", config.Width, config.Height, w, h)
+			}
+			wp, err := Inspect(bytes.NewReader(out.WebP), Limits{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wp.Format != WebP || wp.Width != w || wp.Height != h {
+				t.Errorf("rendered WebP is a %dx%d %s, want %dx%d", wp.Width, wp.Height, wp.Format, w, h)
+			}
+		})
+	}
+}
+
+func TestSpan(t *testing.T) {
+	tests := []struct {
+		i, size, n int
+		i0, i1     int
+	}{
+		{0, 10, 5, 0, 2},
+		{4, 10, 5, 8, 10},
+		{0, 3, 2, 0, 1},
+		{1, 3, 2, 1, 3},
+		// Enlarging repeats pixels.
+		{3, 2, 4, 1, 2},
+	}
+	for _, tt := range tests {
+		if i0, i1 := span(tt.i, tt.size, tt.n); i0 != tt.i0 || i1 != tt.i1 {
+			t.Errorf("span(%d, %d, %d) = %d, %d, want %d, %d", tt.i, tt.size, tt.n, i0, i1, tt.i0, tt.i1)
+		}
+	}
+}
@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
@@ -9,8 +10,13 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 
+	"backend/config"
 	"backend/controllers"
+	"backend/images"
 	"backend/middleware"
+	"backend/payments"
+	"backend/storage"
+	"backend/utils"
 )
 
 func main() {
@@ -20,22 +26,130 @@ func main() {
 		log.Fatal("Error loading .env file")
 	}
 
+	cfg := config.LoadConfig()
+
+	provider, err := payments.NewProvider(cfg)
+	if err != nil {
+		log.Fatal("Payment provider error: ", err)
+	}
+	controllers.SetPaymentProvider(provider)
+	log.Println("Using payment provider", provider.Name())
+
+	store, err := storage.NewBlobStore(cfg)
+	if err != nil {
+		log.Fatal("Storage backend error: ", err)
+	}
+	controllers.SetBlobStore(store)
+	log.Println("Using storage backend", store.Name())
+
+	images.SetDecodeConcurrency(cfg.ImageDecodeConcurrency)
+
 	r := mux.NewRouter()
 
 	// Public routes (no auth required)
 	r.HandleFunc("/auth/register", controllers.RegisterHandler).Methods("POST")
 	r.HandleFunc("/auth/login", controllers.LoginHandler).Methods("POST")
 
+	// Provider webhooks are authenticated by signature, not JWT
+	r.HandleFunc("/payments/webhook", controllers.PaymentWebhookHandler).Methods("POST")
+
+	// Local checkout pages when running against the fake provider
+	if fake, ok := provider.(*payments.FakeProvider); ok {
+		r.PathPrefix(payments.FakeCheckoutPath).Handler(fake)
+	}
+
+	// Uploaded files when they are kept on the local disk
+	if local, ok := store.(*storage.LocalStore); ok {
+		r.PathPrefix(storage.LocalFilesPath).Handler(local)
+	}
+
 	// Protected routes (auth required)
 	protected := r.PathPrefix("").Subrouter()
 	protected.Use(middleware.AuthMiddleware)
 
 	// Upload
 	protected.HandleFunc("/upload/recipe-images", controllers.UploadImagesHandler).Methods("POST")
+	protected.HandleFunc("/upload/recipe-images/multipart", controllers.UploadImagesMultipartHandler).Methods("POST")
+	protected.HandleFunc("/upload/delete", controllers.DeleteUploadHandler).Methods("POST")
+	protected.HandleFunc("/upload/attach", controllers.AttachUploadsHandler).Methods("POST")
+	protected.HandleFunc("/upload/sign", controllers.SignUploadHandler).Methods("POST")
+	protected.HandleFunc("/upload/complete", controllers.CompleteUploadHandler).Methods("POST")
+	protected.HandleFunc("/upload/status", controllers.UploadStatusHandler).Methods("POST")
+	protected.HandleFunc("/upload/usage", controllers.UploadUsageHandler).Methods("POST")
+	protected.HandleFunc("/upload/step-video", controllers.UploadStepVideoHandler).Methods("POST")
+
+	// Recipe access
+	protected.HandleFunc("/recipes/access", controllers.CanAccessRecipeHandler).Methods("POST")
+	protected.HandleFunc("/recipes/access/batch", controllers.CanAccessRecipesHandler).Methods("POST")
+	protected.HandleFunc("/recipes/content", controllers.GetRecipeContentHandler).Methods("POST")
 
 	// Payments
 	protected.HandleFunc("/payments/initiate", controllers.PaymentInitHandler).Methods("POST")
-	protected.HandleFunc("/payments/webhook", controllers.PaymentWebhookHandler).Methods("POST")
+	protected.HandleFunc("/payments/checkout", controllers.CheckoutHandler).Methods("POST")
+	protected.HandleFunc("/payments/quote", controllers.PaymentQuoteHandler).Methods("POST")
+	protected.HandleFunc("/payments/refund", controllers.RefundHandler).Methods("POST")
+
+	// Prices and exchange rates
+	protected.HandleFunc("/recipes/prices", controllers.RecipePricesHandler).Methods("POST")
+	protected.HandleFunc("/exchange-rates", controllers.ExchangeRatesHandler).Methods("POST")
+	protected.HandleFunc("/admin/exchange-rates", controllers.SetExchangeRatesHandler).Methods("POST")
+
+	// Receipts
+	protected.HandleFunc("/receipts", controllers.MyReceiptsHandler).Methods("POST")
+	protected.HandleFunc("/receipts/{purchaseId}", controllers.DownloadReceiptHandler).Methods("GET")
+
+	// Payment reconciliation (admin)
+	protected.HandleFunc("/admin/reconciliation", controllers.ReconciliationReportHandler).Methods("POST")
+	protected.HandleFunc("/admin/reconciliation/resolve", controllers.ResolveDiscrepancyHandler).Methods("POST")
+
+	// Payment risk review (admin)
+	protected.HandleFunc("/admin/payment-attempts", controllers.ListPaymentAttemptsHandler).Methods("POST")
+	protected.HandleFunc("/admin/payment-attempts/review", controllers.ReviewPaymentAttemptHandler).Methods("POST")
+
+	// Duplicate image moderation (admin)
+	protected.HandleFunc("/admin/image-duplicates", controllers.ListImageDuplicatesHandler).Methods("POST")
+	protected.HandleFunc("/admin/image-duplicates/review", controllers.ReviewImageDuplicateHandler).Methods("POST")
+
+	// Gifts
+	protected.HandleFunc("/gifts", controllers.MyGiftsHandler).Methods("POST")
+	protected.HandleFunc("/gifts/purchase", controllers.GiftPurchaseHandler).Methods("POST")
+	protected.HandleFunc("/gifts/redeem", controllers.RedeemGiftHandler).Methods("POST")
+
+	// Tips
+	protected.HandleFunc("/tips", controllers.TipHandler).Methods("POST")
+	protected.HandleFunc("/tips/presets", controllers.TipPresetsHandler).Methods("POST")
+	protected.HandleFunc("/tips/received", controllers.TipsReceivedHandler).Methods("POST")
+
+	// Bundles
+	protected.HandleFunc("/bundles", controllers.ListBundlesHandler).Methods("POST")
+	protected.HandleFunc("/bundles/create", controllers.CreateBundleHandler).Methods("POST")
+	protected.HandleFunc("/bundles/deactivate", controllers.DeactivateBundleHandler).Methods("POST")
+
+	// Coupons
+	protected.HandleFunc("/coupons", controllers.ListCouponsHandler).Methods("POST")
+	protected.HandleFunc("/coupons/create", controllers.CreateCouponHandler).Methods("POST")
+	protected.HandleFunc("/coupons/deactivate", controllers.DeactivateCouponHandler).Methods("POST")
+
+	// Premium subscriptions
+	protected.HandleFunc("/subscriptions/plans", controllers.SubscriptionPlansHandler).Methods("POST")
+	protected.HandleFunc("/subscriptions/subscribe", controllers.SubscribeHandler).Methods("POST")
+	protected.HandleFunc("/subscriptions/me", controllers.MySubscriptionHandler).Methods("POST")
+	protected.HandleFunc("/subscriptions/cancel", controllers.CancelSubscriptionHandler).Methods("POST")
+	protected.HandleFunc("/subscriptions/resume", controllers.ResumeSubscriptionHandler).Methods("POST")
+
+	// Author dashboard
+	protected.HandleFunc("/authors/dashboard", controllers.AuthorDashboardHandler).Methods("POST")
+	protected.HandleFunc("/authors/dashboard/export", controllers.AuthorDashboardExportHandler).Methods("POST")
+
+	// Author payouts
+	protected.HandleFunc("/payouts/account", controllers.RegisterPayoutAccountHandler).Methods("POST")
+	protected.HandleFunc("/payouts/earnings", controllers.EarningsHandler).Methods("POST")
+
+	// Background jobs
+	go utils.RunPeriodically(context.Background(), "manual subscription renewals", cfg.SubscriptionJobInterval, controllers.RunManualSubscriptionRenewals)
+	go utils.RunPeriodically(context.Background(), "payment reconciliation", cfg.ReconciliationInterval, controllers.RunPaymentReconciliation)
+	go utils.RunPeriodically(context.Background(), "upload cleanup", cfg.UploadCleanupInterval, controllers.RunUploadCleanup)
+	go utils.RunPeriodically(context.Background(), "receipt backfill", cfg.ReceiptBackfillInterval, controllers.RunReceiptBackfill)
 
 	// Start server
 	port := os.Getenv("PORT")
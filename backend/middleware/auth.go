@@ -8,13 +8,23 @@ import (
 	"strings"
 
 	"backend/config"
+	"backend/hasura"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
 type contextKey string
 
-const UserIDKey contextKey = "user_id"
+const (
+	UserIDKey contextKey = "user_id"
+	RoleKey   contextKey = "role"
+)
+
+// Roles carried in the "role" claim of our JWTs.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
 
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -67,8 +77,58 @@ func AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		// Add user ID to context
+		// Tokens issued before roles existed carry no role claim
+		role, _ := claims["role"].(string)
+		if role == "" {
+			role = RoleUser
+		}
+
+		// The role claim lasts as long as the token, so an admin claim is
+		// checked against Users: a demoted admin loses access at once.
+		if role == RoleAdmin {
+			current, err := loadUserRole(r.Context(), hasura.NewClient(cfg), userID)
+			if err != nil {
+				log.Printf("Error checking role of user %s: %v", userID, err)
+				http.Error(w, "Error checking user role", http.StatusInternalServerError)
+				return
+			}
+			if current == "" {
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+			role = current
+		}
+
+		// Add user ID and role to context
 		ctx := context.WithValue(r.Context(), UserIDKey, userID)
+		ctx = context.WithValue(ctx, RoleKey, role)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// loadUserRole returns the role stored for userID, or "" if there is no
+// such user.
+func loadUserRole(ctx context.Context, client *hasura.Client, userID string) (string, error) {
+	query := `
+		query UserRole($id: uuid!) {
+			Users_by_pk(id: $id) {
+				role
+			}
+		}
+	`
+	var response struct {
+		User *struct {
+			Role string `json:"role"`
+		} `json:"Users_by_pk"`
+	}
+	if err := client.Execute(ctx, query, map[string]interface{}{"id": userID}, &response); err != nil {
+		return "", err
+	}
+	if response.User == nil {
+		return "", nil
+	}
+	if response.User.Role == "" {
+		return RoleUser, nil
+	}
+	return response.User.Role, nil
+}
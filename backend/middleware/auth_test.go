@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestAuthMiddlewareRechecksAdmin(t *testing.T) {
+	// Users as stored now: admin-1 is still an admin, demoted-1 is not.
+	roles := map[string]string{"admin-1": RoleAdmin, "demoted-1": RoleUser}
+	lookups := 0
+	hasuraServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		var body struct {
+			Variables map[string]string `json:"variables"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		var user interface{}
+		if role, ok := roles[body.Variables["id"]]; ok {
+			user = map[string]string{"role": role}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"Users_by_pk": user}})
+	}))
+	defer hasuraServer.Close()
+	t.Setenv("HASURA_ENDPOINT", hasuraServer.URL)
+	t.Setenv("JWT_SECRET", "secret")
+
+	handler := AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role, _ := r.Context().Value(RoleKey).(string)
+		w.Write([]byte(role))
+	}))
+
+	tests := []struct {
+		name    string
+		sub     string
+		role    string
+		status  int
+		want    string
+		lookups int
+	}{
+		{"user", "user-1", RoleUser, http.StatusOK, RoleUser, 0},
+		{"no role claim", "user-1", "", http.StatusOK, RoleUser, 0},
+		{"admin", "admin-1", RoleAdmin, http.StatusOK, RoleAdmin, 1},
+		{"demoted admin", "demoted-1", RoleAdmin, http.StatusOK, RoleUser, 1},
+		{"deleted admin", "gone-1", RoleAdmin, http.StatusUnauthorized, "", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := jwt.MapClaims{"sub": tt.sub, "exp": time.Now().Add(time.Hour).Unix()}
+			if tt.role != "" {
+				claims["role"] = tt.role
+			}
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lookups = 0
+
+			r := httptest.NewRequest("POST", "/", nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusOK && w.Body.String() != tt.want {
+				t.Errorf("role = %q, want %q", w.Body.String(), tt.want)
+			}
+			if lookups != tt.lookups {
+				t.Errorf("role lookups = %d, want %d", lookups, tt.lookups)
+			}
+		})
+	}
+}
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS purchases_user_recipe_pending_idx;
+DROP INDEX IF EXISTS purchases_user_idempotency_key_idx;
+
+ALTER TABLE "Purchases"
+    DROP COLUMN IF EXISTS expires_at,
+    DROP COLUMN IF EXISTS idempotency_key,
+    DROP COLUMN IF EXISTS checkout_url,
+    DROP COLUMN IF EXISTS currency,
+    ALTER COLUMN amount TYPE integer;
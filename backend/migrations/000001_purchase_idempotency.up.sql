@@ -0,0 +1,30 @@
+-- Purchases need enough state to hand back an in-flight checkout instead of
+-- starting a second Chapa transaction.
+ALTER TABLE "Purchases"
+    ALTER COLUMN amount TYPE numeric(12, 2),
+    ADD COLUMN IF NOT EXISTS currency text NOT NULL DEFAULT 'ETB',
+    ADD COLUMN IF NOT EXISTS checkout_url text,
+    ADD COLUMN IF NOT EXISTS idempotency_key text,
+    ADD COLUMN IF NOT EXISTS expires_at timestamptz;
+
+ALTER TABLE "Purchases" ALTER COLUMN status SET DEFAULT 'pending';
+UPDATE "Purchases" SET status = 'pending' WHERE status IS NULL;
+
+-- Older pending rows predate expiry tracking; retire them so the partial
+-- unique index below can be built, and give recent ones the usual deadline
+-- so they expire too.
+UPDATE "Purchases" SET status = 'expired'
+WHERE status = 'pending' AND created_at < now() - interval '30 minutes';
+UPDATE "Purchases" SET expires_at = created_at + interval '30 minutes'
+WHERE status = 'pending' AND expires_at IS NULL;
+
+-- A key only has to be unique among checkouts in flight: once its purchase
+-- fails or expires the user may retry with it, and a late payment can still
+-- complete the old purchase.
+CREATE UNIQUE INDEX IF NOT EXISTS purchases_user_idempotency_key_idx
+    ON "Purchases" (user_id, idempotency_key)
+    WHERE idempotency_key IS NOT NULL AND status = 'pending';
+
+CREATE UNIQUE INDEX IF NOT EXISTS purchases_user_recipe_pending_idx
+    ON "Purchases" (user_id, recipe_id)
+    WHERE status = 'pending';
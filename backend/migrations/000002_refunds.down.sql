@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS "AuditLogs";
+DROP TABLE IF EXISTS "Refunds";
+ALTER TABLE "Purchases" DROP COLUMN IF EXISTS refunded_amount;
+ALTER TABLE "Users" DROP COLUMN IF EXISTS role;
@@ -0,0 +1,32 @@
+ALTER TABLE "Users" ADD COLUMN IF NOT EXISTS role text NOT NULL DEFAULT 'user';
+
+-- refunded_amount counts every refund that has not failed, so the refundable
+-- balance can be reserved before the provider is called.
+ALTER TABLE "Purchases" ADD COLUMN IF NOT EXISTS refunded_amount numeric(12, 2) NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS "Refunds" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    purchase_id uuid NOT NULL REFERENCES "Purchases" (id),
+    amount numeric(12, 2) NOT NULL CHECK (amount > 0),
+    currency text NOT NULL,
+    reason text NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    reference text NOT NULL UNIQUE,
+    requested_by uuid REFERENCES "Users" (id),
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS refunds_purchase_id_idx ON "Refunds" (purchase_id);
+
+CREATE TABLE IF NOT EXISTS "AuditLogs" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    actor_id uuid REFERENCES "Users" (id),
+    action text NOT NULL,
+    entity_type text NOT NULL,
+    entity_id text NOT NULL,
+    details jsonb NOT NULL DEFAULT '{}',
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS audit_logs_entity_idx ON "AuditLogs" (entity_type, entity_id);
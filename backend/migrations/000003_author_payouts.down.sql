@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS "AuthorEarnings";
+
+ALTER TABLE "Purchases"
+    DROP COLUMN IF EXISTS split_value,
+    DROP COLUMN IF EXISTS split_type,
+    DROP COLUMN IF EXISTS platform_fee,
+    DROP COLUMN IF EXISTS subaccount_id,
+    DROP COLUMN IF EXISTS author_id;
+
+DROP TABLE IF EXISTS "AuthorPayoutAccounts";
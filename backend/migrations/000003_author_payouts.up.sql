@@ -0,0 +1,47 @@
+CREATE TABLE IF NOT EXISTS "AuthorPayoutAccounts" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL UNIQUE REFERENCES "Users" (id),
+    provider text NOT NULL,
+    subaccount_id text NOT NULL,
+    business_name text NOT NULL,
+    account_name text NOT NULL,
+    bank_code text NOT NULL,
+    -- Only the last four digits are kept; the provider holds the rest.
+    account_number_last4 text NOT NULL,
+    -- The commission the subaccount was registered with, which the provider
+    -- applies to payments routed to it. A flat split is in split_currency.
+    split_type text,
+    split_value numeric(12, 4),
+    split_currency text,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
+
+-- The split is fixed when the checkout is opened so later commission changes
+-- do not rewrite what an author earned. split_type and split_value are the
+-- split sent to the provider with the charge.
+ALTER TABLE "Purchases"
+    ADD COLUMN IF NOT EXISTS author_id uuid REFERENCES "Users" (id),
+    ADD COLUMN IF NOT EXISTS subaccount_id text,
+    ADD COLUMN IF NOT EXISTS platform_fee numeric(12, 2) NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS split_type text,
+    ADD COLUMN IF NOT EXISTS split_value numeric(12, 4);
+
+CREATE TABLE IF NOT EXISTS "AuthorEarnings" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    author_id uuid NOT NULL REFERENCES "Users" (id),
+    purchase_id uuid REFERENCES "Purchases" (id),
+    refund_id uuid REFERENCES "Refunds" (id),
+    -- sale or refund; refunds carry negative amounts.
+    type text NOT NULL,
+    gross_amount numeric(12, 2) NOT NULL,
+    platform_fee numeric(12, 2) NOT NULL,
+    net_amount numeric(12, 2) NOT NULL,
+    currency text NOT NULL,
+    subaccount_id text,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS author_earnings_author_idx ON "AuthorEarnings" (author_id, created_at);
+CREATE UNIQUE INDEX IF NOT EXISTS author_earnings_purchase_sale_idx ON "AuthorEarnings" (purchase_id) WHERE type = 'sale';
+CREATE UNIQUE INDEX IF NOT EXISTS author_earnings_refund_idx ON "AuthorEarnings" (refund_id) WHERE refund_id IS NOT NULL;
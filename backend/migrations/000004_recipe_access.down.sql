@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS purchases_user_recipe_status_idx;
+ALTER TABLE "Recipes" DROP COLUMN IF EXISTS currency;
+ALTER TABLE "Recipes" DROP COLUMN IF EXISTS price;
@@ -0,0 +1,5 @@
+-- Recipes with a price above zero are premium and gated by canAccessRecipe.
+ALTER TABLE "Recipes" ADD COLUMN IF NOT EXISTS price numeric(12, 2) NOT NULL DEFAULT 0;
+ALTER TABLE "Recipes" ADD COLUMN IF NOT EXISTS currency text NOT NULL DEFAULT 'ETB';
+
+CREATE INDEX IF NOT EXISTS purchases_user_recipe_status_idx ON "Purchases" (user_id, recipe_id, status);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS "SubscriptionPayments";
+DROP TABLE IF EXISTS "Subscriptions";
+DROP TABLE IF EXISTS "SubscriptionPlans";
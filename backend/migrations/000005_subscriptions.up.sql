@@ -0,0 +1,61 @@
+CREATE TABLE IF NOT EXISTS "SubscriptionPlans" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    code text NOT NULL UNIQUE,
+    name text NOT NULL,
+    -- month or year
+    billing_interval text NOT NULL,
+    price numeric(12, 2) NOT NULL CHECK (price > 0),
+    currency text NOT NULL DEFAULT 'ETB',
+    active boolean NOT NULL DEFAULT true,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+INSERT INTO "SubscriptionPlans" (code, name, billing_interval, price, currency) VALUES
+    ('premium_monthly', 'Dishcovery Premium (Monthly)', 'month', 199, 'ETB'),
+    ('premium_annual', 'Dishcovery Premium (Annual)', 'year', 1999, 'ETB')
+ON CONFLICT (code) DO NOTHING;
+
+-- Subscriptions move pending -> active -> past_due (grace) -> expired, or to
+-- canceled at the end of a period the user chose not to renew. A pending
+-- subscription has no period until its first payment completes.
+CREATE TABLE IF NOT EXISTS "Subscriptions" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES "Users" (id),
+    plan_id uuid REFERENCES "SubscriptionPlans" (id),
+    status text NOT NULL DEFAULT 'pending',
+    current_period_start timestamptz,
+    current_period_end timestamptz,
+    cancel_at_period_end boolean NOT NULL DEFAULT false,
+    grace_until timestamptz,
+    canceled_at timestamptz,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS subscriptions_user_idx ON "Subscriptions" (user_id, current_period_end);
+
+CREATE UNIQUE INDEX IF NOT EXISTS subscriptions_user_open_idx
+    ON "Subscriptions" (user_id)
+    WHERE status IN ('pending', 'active', 'past_due');
+
+CREATE TABLE IF NOT EXISTS "SubscriptionPayments" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    subscription_id uuid NOT NULL REFERENCES "Subscriptions" (id),
+    -- The plan and interval the checkout was priced for; paying it applies
+    -- these even if the subscription has since switched plan.
+    plan_id uuid NOT NULL REFERENCES "SubscriptionPlans" (id),
+    tx_ref text NOT NULL UNIQUE,
+    amount numeric(12, 2) NOT NULL,
+    currency text NOT NULL,
+    billing_interval text NOT NULL,
+    -- initial or renewal
+    kind text NOT NULL,
+    -- pending, completed, failed, expired (superseded by another checkout),
+    -- refunding or refunded (paid but not applied)
+    status text NOT NULL DEFAULT 'pending',
+    checkout_url text,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS subscription_payments_subscription_idx ON "SubscriptionPayments" (subscription_id, created_at);
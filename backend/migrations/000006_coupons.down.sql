@@ -0,0 +1,7 @@
+ALTER TABLE "Purchases"
+    DROP COLUMN IF EXISTS coupon_id,
+    DROP COLUMN IF EXISTS discount_amount,
+    DROP COLUMN IF EXISTS original_amount;
+
+DROP TABLE IF EXISTS "CouponRedemptions";
+DROP TABLE IF EXISTS "Coupons";
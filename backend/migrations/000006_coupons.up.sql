@@ -0,0 +1,40 @@
+-- Coupons apply to one recipe (recipe_id), to all of an author's recipes
+-- (author_id only) or, when created by an admin, to every recipe (neither).
+CREATE TABLE IF NOT EXISTS "Coupons" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    code text NOT NULL UNIQUE CHECK (code = upper(code)),
+    created_by uuid NOT NULL REFERENCES "Users" (id),
+    author_id uuid REFERENCES "Users" (id),
+    recipe_id uuid REFERENCES "Recipes" (id),
+    -- percentage or fixed
+    discount_type text NOT NULL,
+    discount_value numeric(12, 2) NOT NULL CHECK (discount_value > 0),
+    -- Required for fixed discounts, which only apply in that currency.
+    currency text,
+    starts_at timestamptz NOT NULL DEFAULT now(),
+    ends_at timestamptz,
+    max_redemptions integer,
+    per_user_limit integer,
+    redemption_count integer NOT NULL DEFAULT 0,
+    active boolean NOT NULL DEFAULT true,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    CHECK (max_redemptions IS NULL OR redemption_count <= max_redemptions)
+);
+
+-- reserved while the purchase is pending, then completed or released.
+CREATE TABLE IF NOT EXISTS "CouponRedemptions" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    coupon_id uuid NOT NULL REFERENCES "Coupons" (id),
+    user_id uuid NOT NULL REFERENCES "Users" (id),
+    purchase_id uuid NOT NULL UNIQUE REFERENCES "Purchases" (id),
+    discount_amount numeric(12, 2) NOT NULL,
+    status text NOT NULL DEFAULT 'reserved',
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS coupon_redemptions_coupon_user_idx ON "CouponRedemptions" (coupon_id, user_id);
+
+ALTER TABLE "Purchases"
+    ADD COLUMN IF NOT EXISTS original_amount numeric(12, 2),
+    ADD COLUMN IF NOT EXISTS discount_amount numeric(12, 2) NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS coupon_id uuid REFERENCES "Coupons" (id);
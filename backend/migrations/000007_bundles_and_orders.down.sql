@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS purchases_chapa_tx_id_idx;
+
+ALTER TABLE "Purchases"
+    DROP COLUMN IF EXISTS bundle_id,
+    DROP COLUMN IF EXISTS order_id;
+
+DROP TABLE IF EXISTS "Orders";
+DROP TABLE IF EXISTS "BundleRecipes";
+DROP TABLE IF EXISTS "Bundles";
@@ -0,0 +1,41 @@
+CREATE TABLE IF NOT EXISTS "Bundles" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    author_id uuid NOT NULL REFERENCES "Users" (id),
+    title text NOT NULL,
+    description text,
+    price numeric(12, 2) NOT NULL CHECK (price > 0),
+    currency text NOT NULL,
+    active boolean NOT NULL DEFAULT true,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS "BundleRecipes" (
+    bundle_id uuid NOT NULL REFERENCES "Bundles" (id) ON DELETE CASCADE,
+    recipe_id uuid NOT NULL REFERENCES "Recipes" (id),
+    PRIMARY KEY (bundle_id, recipe_id)
+);
+
+-- An order is one provider transaction covering several recipes; each
+-- recipe still gets its own purchase, sharing the order's tx_ref.
+CREATE TABLE IF NOT EXISTS "Orders" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES "Users" (id),
+    tx_ref text NOT NULL UNIQUE,
+    amount numeric(12, 2) NOT NULL,
+    currency text NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    checkout_url text,
+    idempotency_key text,
+    expires_at timestamptz,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS orders_user_idempotency_key_idx
+    ON "Orders" (user_id, idempotency_key)
+    WHERE idempotency_key IS NOT NULL;
+
+ALTER TABLE "Purchases"
+    ADD COLUMN IF NOT EXISTS order_id uuid REFERENCES "Orders" (id),
+    ADD COLUMN IF NOT EXISTS bundle_id uuid REFERENCES "Bundles" (id);
+
+CREATE INDEX IF NOT EXISTS purchases_chapa_tx_id_idx ON "Purchases" (chapa_tx_id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS author_earnings_tip_idx;
+ALTER TABLE "AuthorEarnings" DROP COLUMN IF EXISTS tip_id;
+DROP TABLE IF EXISTS "Tips";
@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS "Tips" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    recipe_id uuid NOT NULL REFERENCES "Recipes" (id),
+    author_id uuid NOT NULL REFERENCES "Users" (id),
+    tipper_id uuid NOT NULL REFERENCES "Users" (id),
+    amount numeric(12, 2) NOT NULL CHECK (amount > 0),
+    currency text NOT NULL,
+    message text,
+    status text NOT NULL DEFAULT 'pending',
+    tx_ref text NOT NULL UNIQUE,
+    checkout_url text,
+    subaccount_id text,
+    platform_fee numeric(12, 2) NOT NULL DEFAULT 0,
+    split_type text,
+    split_value numeric(12, 4),
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS tips_author_idx ON "Tips" (author_id, created_at);
+CREATE INDEX IF NOT EXISTS tips_recipe_idx ON "Tips" (recipe_id);
+
+ALTER TABLE "AuthorEarnings" ADD COLUMN IF NOT EXISTS tip_id uuid REFERENCES "Tips" (id);
+CREATE UNIQUE INDEX IF NOT EXISTS author_earnings_tip_idx ON "AuthorEarnings" (tip_id) WHERE tip_id IS NOT NULL;
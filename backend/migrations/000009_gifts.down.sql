@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS author_earnings_gift_idx;
+ALTER TABLE "AuthorEarnings" DROP COLUMN IF EXISTS gift_id;
+DROP TABLE IF EXISTS "Gifts";
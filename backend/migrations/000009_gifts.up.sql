@@ -0,0 +1,37 @@
+CREATE TABLE IF NOT EXISTS "Gifts" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    purchaser_id uuid NOT NULL REFERENCES "Users" (id),
+    recipe_id uuid NOT NULL REFERENCES "Recipes" (id),
+    author_id uuid NOT NULL REFERENCES "Users" (id),
+    amount numeric(12, 2) NOT NULL CHECK (amount > 0),
+    currency text NOT NULL,
+    -- pending until paid, then paid, redeemed, or failed.
+    status text NOT NULL DEFAULT 'pending',
+    code text NOT NULL UNIQUE,
+    recipient_email text,
+    message text,
+    tx_ref text NOT NULL UNIQUE,
+    checkout_url text,
+    subaccount_id text,
+    platform_fee numeric(12, 2) NOT NULL DEFAULT 0,
+    split_type text,
+    split_value numeric(12, 4),
+    idempotency_key text,
+    paid_at timestamptz,
+    expires_at timestamptz,
+    redeemed_by uuid REFERENCES "Users" (id),
+    redeemed_at timestamptz,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    -- A code is redeemed at most once, and only while it is valid.
+    CHECK (status <> 'redeemed' OR (redeemed_by IS NOT NULL AND redeemed_at <= expires_at))
+);
+
+-- A key can be retried once its checkout has failed.
+CREATE UNIQUE INDEX IF NOT EXISTS gifts_purchaser_idempotency_key_idx
+    ON "Gifts" (purchaser_id, idempotency_key)
+    WHERE idempotency_key IS NOT NULL AND status <> 'failed';
+CREATE INDEX IF NOT EXISTS gifts_purchaser_idx ON "Gifts" (purchaser_id, created_at);
+CREATE INDEX IF NOT EXISTS gifts_redeemed_by_idx ON "Gifts" (redeemed_by, recipe_id) WHERE status = 'redeemed';
+
+ALTER TABLE "AuthorEarnings" ADD COLUMN IF NOT EXISTS gift_id uuid REFERENCES "Gifts" (id);
+CREATE UNIQUE INDEX IF NOT EXISTS author_earnings_gift_idx ON "AuthorEarnings" (gift_id) WHERE gift_id IS NOT NULL;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS "ReconciliationRuns";
+DROP TABLE IF EXISTS "PaymentDiscrepancies";
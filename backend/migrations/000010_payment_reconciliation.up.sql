@@ -0,0 +1,41 @@
+-- Transactions whose provider record disagrees with what we stored. Their
+-- purchases, tips, gifts or subscription payments sit in status 'review'
+-- and are not applied until an admin resolves them.
+CREATE TABLE IF NOT EXISTS "PaymentDiscrepancies" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    tx_ref text NOT NULL,
+    -- purchase, tip, gift or subscription.
+    source text NOT NULL,
+    -- amount_mismatch or currency_mismatch.
+    kind text NOT NULL,
+    expected_amount numeric(12, 2) NOT NULL,
+    provider_amount numeric(12, 2) NOT NULL,
+    expected_currency text NOT NULL,
+    provider_currency text NOT NULL,
+    provider_status text NOT NULL,
+    local_status text NOT NULL,
+    detected_at timestamptz NOT NULL DEFAULT now(),
+    resolved_at timestamptz,
+    resolved_by uuid REFERENCES "Users" (id),
+    resolution text,
+    resolution_note text,
+    UNIQUE (tx_ref, kind)
+);
+
+CREATE INDEX IF NOT EXISTS payment_discrepancies_open_idx ON "PaymentDiscrepancies" (detected_at) WHERE resolved_at IS NULL;
+
+-- One row per reconciler pass, for drift metrics.
+CREATE TABLE IF NOT EXISTS "ReconciliationRuns" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    started_at timestamptz NOT NULL,
+    finished_at timestamptz NOT NULL,
+    checked integer NOT NULL DEFAULT 0,
+    completed integer NOT NULL DEFAULT 0,
+    failed integer NOT NULL DEFAULT 0,
+    abandoned integer NOT NULL DEFAULT 0,
+    still_pending integer NOT NULL DEFAULT 0,
+    discrepancies integer NOT NULL DEFAULT 0,
+    errors integer NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS reconciliation_runs_started_idx ON "ReconciliationRuns" (started_at);
@@ -0,0 +1,5 @@
+DROP VIEW IF EXISTS "RecipeViewsDaily";
+DROP VIEW IF EXISTS "RecipeTipsDaily";
+DROP VIEW IF EXISTS "RecipeSalesDaily";
+DROP TABLE IF EXISTS "RecipeViews";
+ALTER TABLE "Refunds" DROP COLUMN IF EXISTS refunded_at;
@@ -0,0 +1,90 @@
+-- One row per viewer, recipe and day: the dashboard's conversion rate is
+-- sales over unique daily views.
+CREATE TABLE IF NOT EXISTS "RecipeViews" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    recipe_id uuid NOT NULL REFERENCES "Recipes" (id),
+    viewer_id uuid NOT NULL REFERENCES "Users" (id),
+    viewed_on date NOT NULL DEFAULT current_date,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    UNIQUE (recipe_id, viewer_id, viewed_on)
+);
+
+-- When a refund completed, so the dashboard shows it on the day the money
+-- went back rather than the day of the sale.
+ALTER TABLE "Refunds" ADD COLUMN IF NOT EXISTS refunded_at timestamptz;
+UPDATE "Refunds" SET refunded_at = updated_at WHERE status = 'completed' AND refunded_at IS NULL;
+
+-- Daily sales per recipe and currency, counting direct and cart purchases
+-- (including ones later refunded) and paid gifts on the day of the sale, and
+-- completed refunds on the day they were refunded. Net follows the earnings
+-- ledger: refunds return the platform fee in proportion.
+CREATE OR REPLACE VIEW "RecipeSalesDaily" AS
+SELECT author_id,
+       recipe_id,
+       day,
+       currency,
+       sum(sales)::integer AS sales_count,
+       sum(amount) AS gross_amount,
+       sum(platform_fee) AS platform_fee,
+       sum(refunded_amount) AS refunded_amount,
+       sum(net_amount) AS net_amount
+FROM (
+    SELECT p.author_id,
+           p.recipe_id,
+           p.created_at::date AS day,
+           p.currency,
+           1 AS sales,
+           p.amount,
+           p.platform_fee,
+           0 AS refunded_amount,
+           p.amount - p.platform_fee AS net_amount
+    FROM "Purchases" p
+    WHERE p.status IN ('completed', 'refunded') AND p.author_id IS NOT NULL
+    UNION ALL
+    SELECT p.author_id,
+           p.recipe_id,
+           r.refunded_at::date,
+           r.currency,
+           0,
+           0,
+           0,
+           r.amount,
+           -r.amount + CASE WHEN p.amount > 0 THEN round(p.platform_fee * r.amount / p.amount, 2) ELSE 0 END
+    FROM "Refunds" r
+    JOIN "Purchases" p ON p.id = r.purchase_id
+    WHERE r.status = 'completed' AND p.author_id IS NOT NULL
+    UNION ALL
+    SELECT g.author_id,
+           g.recipe_id,
+           g.paid_at::date,
+           g.currency,
+           1,
+           g.amount,
+           g.platform_fee,
+           0,
+           g.amount - g.platform_fee
+    FROM "Gifts" g
+    WHERE g.status IN ('paid', 'redeemed')
+) sales
+GROUP BY author_id, recipe_id, day, currency;
+
+CREATE OR REPLACE VIEW "RecipeTipsDaily" AS
+SELECT author_id,
+       recipe_id,
+       created_at::date AS day,
+       currency,
+       count(*)::integer AS tip_count,
+       sum(amount) AS gross_amount,
+       sum(amount - platform_fee) AS net_amount
+FROM "Tips"
+WHERE status = 'completed'
+GROUP BY author_id, recipe_id, created_at::date, currency;
+
+CREATE OR REPLACE VIEW "RecipeViewsDaily" AS
+SELECT r.user_id AS author_id,
+       v.recipe_id,
+       v.viewed_on AS day,
+       count(*)::integer AS views
+FROM "RecipeViews" v
+JOIN "Recipes" r ON r.id = v.recipe_id
+GROUP BY r.user_id, v.recipe_id, v.viewed_on;
@@ -0,0 +1,4 @@
+DROP VIEW IF EXISTS "PurchasesWithoutReceipt";
+DROP TABLE IF EXISTS "Receipts";
+DROP FUNCTION IF EXISTS assign_invoice_number();
+DROP TABLE IF EXISTS "InvoiceCounters";
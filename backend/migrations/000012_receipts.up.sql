@@ -0,0 +1,61 @@
+-- Invoice numbers run without gaps per prefix. The counter is taken in the
+-- same transaction as the insert, so a rejected receipt (such as a repeat
+-- for the same purchase) rolls its number back.
+CREATE TABLE IF NOT EXISTS "InvoiceCounters" (
+    prefix text PRIMARY KEY,
+    last_number bigint NOT NULL DEFAULT 0
+);
+
+-- One receipt per completed purchase. The printed fields are kept as issued
+-- so later edits to users or recipes never change a receipt.
+CREATE TABLE IF NOT EXISTS "Receipts" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    purchase_id uuid NOT NULL UNIQUE REFERENCES "Purchases" (id),
+    -- Assigned by assign_invoice_number.
+    invoice_number bigint NOT NULL,
+    invoice_prefix text NOT NULL,
+    issuer text NOT NULL,
+    issuer_tax_id text,
+    buyer_id uuid NOT NULL REFERENCES "Users" (id),
+    author_id uuid REFERENCES "Users" (id),
+    buyer_name text NOT NULL,
+    buyer_email text NOT NULL,
+    recipe_title text NOT NULL,
+    author_name text NOT NULL,
+    amount numeric(12, 2) NOT NULL,
+    currency text NOT NULL,
+    vat_label text NOT NULL DEFAULT 'VAT',
+    vat_rate numeric(5, 2) NOT NULL DEFAULT 0,
+    vat_amount numeric(12, 2) NOT NULL DEFAULT 0,
+    tx_ref text NOT NULL,
+    purchased_at timestamptz NOT NULL,
+    issued_at timestamptz NOT NULL DEFAULT now(),
+    pdf bytea,
+    emailed_at timestamptz,
+    UNIQUE (invoice_prefix, invoice_number)
+);
+
+CREATE OR REPLACE FUNCTION assign_invoice_number() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO "InvoiceCounters" (prefix, last_number) VALUES (NEW.invoice_prefix, 1)
+    ON CONFLICT (prefix) DO UPDATE SET last_number = "InvoiceCounters".last_number + 1
+    RETURNING last_number INTO NEW.invoice_number;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS receipts_invoice_number ON "Receipts";
+CREATE TRIGGER receipts_invoice_number
+    BEFORE INSERT ON "Receipts"
+    FOR EACH ROW EXECUTE FUNCTION assign_invoice_number();
+
+CREATE INDEX IF NOT EXISTS receipts_buyer_idx ON "Receipts" (buyer_id, issued_at);
+
+-- Paid purchases still owed a receipt, for the backfill job.
+CREATE OR REPLACE VIEW "PurchasesWithoutReceipt" AS
+SELECT p.id,
+       p.user_id,
+       p.created_at
+FROM "Purchases" p
+WHERE p.status IN ('completed', 'refunded')
+  AND NOT EXISTS (SELECT 1 FROM "Receipts" r WHERE r.purchase_id = p.id);
@@ -0,0 +1,12 @@
+ALTER TABLE "Gifts"
+    DROP COLUMN IF EXISTS exchange_rate_at,
+    DROP COLUMN IF EXISTS exchange_rate,
+    DROP COLUMN IF EXISTS base_currency,
+    DROP COLUMN IF EXISTS base_amount;
+ALTER TABLE "Purchases"
+    DROP COLUMN IF EXISTS exchange_rate_at,
+    DROP COLUMN IF EXISTS exchange_rate,
+    DROP COLUMN IF EXISTS base_currency,
+    DROP COLUMN IF EXISTS base_amount;
+
+DROP TABLE IF EXISTS "ExchangeRates";
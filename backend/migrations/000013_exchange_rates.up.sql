@@ -0,0 +1,25 @@
+-- How many units of quote_currency one unit of base_currency buys.
+CREATE TABLE IF NOT EXISTS "ExchangeRates" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    base_currency text NOT NULL,
+    quote_currency text NOT NULL,
+    rate numeric(18, 8) NOT NULL CHECK (rate > 0),
+    source text NOT NULL DEFAULT 'manual',
+    updated_by uuid REFERENCES "Users" (id),
+    updated_at timestamptz NOT NULL DEFAULT now(),
+    UNIQUE (base_currency, quote_currency),
+    CHECK (base_currency <> quote_currency)
+);
+
+-- The rate a purchase or gift was converted at is locked on it, so later
+-- rate updates never change what was charged or refunded.
+ALTER TABLE "Purchases"
+    ADD COLUMN IF NOT EXISTS base_amount numeric(12, 2),
+    ADD COLUMN IF NOT EXISTS base_currency text,
+    ADD COLUMN IF NOT EXISTS exchange_rate numeric(18, 8),
+    ADD COLUMN IF NOT EXISTS exchange_rate_at timestamptz;
+ALTER TABLE "Gifts"
+    ADD COLUMN IF NOT EXISTS base_amount numeric(12, 2),
+    ADD COLUMN IF NOT EXISTS base_currency text,
+    ADD COLUMN IF NOT EXISTS exchange_rate numeric(18, 8),
+    ADD COLUMN IF NOT EXISTS exchange_rate_at timestamptz;
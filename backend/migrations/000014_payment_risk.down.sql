@@ -0,0 +1,7 @@
+ALTER TABLE "Users" DROP COLUMN IF EXISTS payments_blocked;
+
+ALTER TABLE "Purchases"
+    DROP COLUMN IF EXISTS risk_decision,
+    DROP COLUMN IF EXISTS risk_attempt_id;
+
+DROP TABLE IF EXISTS "PaymentAttempts";
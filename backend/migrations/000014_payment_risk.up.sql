@@ -0,0 +1,31 @@
+-- Every payment initiation is recorded with the risk decision taken on it;
+-- the velocity rules count these rows.
+CREATE TABLE IF NOT EXISTS "PaymentAttempts" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES "Users" (id),
+    ip_address text NOT NULL,
+    email_domain text,
+    -- purchase, checkout, tip, gift or subscription.
+    kind text NOT NULL,
+    amount numeric(12, 2) NOT NULL,
+    currency text NOT NULL,
+    -- allow or block.
+    decision text NOT NULL,
+    reasons text[] NOT NULL DEFAULT '{}',
+    created_at timestamptz NOT NULL DEFAULT now(),
+    reviewed_by uuid REFERENCES "Users" (id),
+    reviewed_at timestamptz,
+    review_outcome text,
+    review_note text
+);
+
+CREATE INDEX IF NOT EXISTS payment_attempts_user_idx ON "PaymentAttempts" (user_id, created_at);
+CREATE INDEX IF NOT EXISTS payment_attempts_ip_idx ON "PaymentAttempts" (ip_address, created_at);
+CREATE INDEX IF NOT EXISTS payment_attempts_review_idx ON "PaymentAttempts" (created_at) WHERE decision = 'block' AND reviewed_at IS NULL;
+
+ALTER TABLE "Purchases"
+    ADD COLUMN IF NOT EXISTS risk_attempt_id uuid REFERENCES "PaymentAttempts" (id),
+    ADD COLUMN IF NOT EXISTS risk_decision text;
+
+-- Set by an admin after reviewing a blocked attempt.
+ALTER TABLE "Users" ADD COLUMN IF NOT EXISTS payments_blocked boolean NOT NULL DEFAULT false;
@@ -0,0 +1,26 @@
+-- Every stored upload, so unused files can be found and deleted. An upload
+-- is in use while it is attached to a recipe or a step's image_url points at
+-- it; deleting the recipe detaches its uploads. Unused uploads are deleted
+-- once they are older than a grace period and have been detached for as
+-- long.
+CREATE TABLE IF NOT EXISTS "Uploads" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES "Users" (id),
+    -- Blob store key; Cloudinary public ID plus format.
+    key text NOT NULL UNIQUE,
+    url text NOT NULL,
+    content_type text NOT NULL,
+    bytes bigint NOT NULL DEFAULT 0,
+    width integer,
+    height integer,
+    -- Generated variants by name: url, key, width and height.
+    variants jsonb NOT NULL DEFAULT '{}',
+    recipe_id uuid REFERENCES "Recipes" (id) ON DELETE SET NULL,
+    attached_at timestamptz,
+    detached_at timestamptz,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS uploads_user_idx ON "Uploads" (user_id, created_at);
+CREATE INDEX IF NOT EXISTS uploads_recipe_idx ON "Uploads" (recipe_id);
+CREATE INDEX IF NOT EXISTS uploads_unattached_idx ON "Uploads" (created_at) WHERE recipe_id IS NULL;
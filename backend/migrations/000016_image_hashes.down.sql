@@ -0,0 +1,14 @@
+DROP TABLE IF EXISTS "ImageDuplicateFlags";
+
+DROP INDEX IF EXISTS uploads_phash_band3_idx;
+DROP INDEX IF EXISTS uploads_phash_band2_idx;
+DROP INDEX IF EXISTS uploads_phash_band1_idx;
+DROP INDEX IF EXISTS uploads_phash_band0_idx;
+
+ALTER TABLE "Uploads"
+    DROP COLUMN IF EXISTS placeholder,
+    DROP COLUMN IF EXISTS phash_band3,
+    DROP COLUMN IF EXISTS phash_band2,
+    DROP COLUMN IF EXISTS phash_band1,
+    DROP COLUMN IF EXISTS phash_band0,
+    DROP COLUMN IF EXISTS phash;
@@ -0,0 +1,35 @@
+-- Perceptual hash (dHash) of each image upload, as 16 hex digits, and split
+-- into four 16-bit bands. Hashes within three bits of each other share at
+-- least one band, so the indexed bands find near-duplicate candidates.
+ALTER TABLE "Uploads"
+    ADD COLUMN IF NOT EXISTS phash text,
+    ADD COLUMN IF NOT EXISTS phash_band0 integer,
+    ADD COLUMN IF NOT EXISTS phash_band1 integer,
+    ADD COLUMN IF NOT EXISTS phash_band2 integer,
+    ADD COLUMN IF NOT EXISTS phash_band3 integer,
+    -- Placeholder returned with the upload, so a reused upload gets it too.
+    ADD COLUMN IF NOT EXISTS placeholder jsonb;
+
+CREATE INDEX IF NOT EXISTS uploads_phash_band0_idx ON "Uploads" (phash_band0);
+CREATE INDEX IF NOT EXISTS uploads_phash_band1_idx ON "Uploads" (phash_band1);
+CREATE INDEX IF NOT EXISTS uploads_phash_band2_idx ON "Uploads" (phash_band2);
+CREATE INDEX IF NOT EXISTS uploads_phash_band3_idx ON "Uploads" (phash_band3);
+
+-- An upload that is a near-duplicate of another user's earlier upload,
+-- flagged for moderators.
+CREATE TABLE IF NOT EXISTS "ImageDuplicateFlags" (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    upload_id uuid NOT NULL REFERENCES "Uploads" (id) ON DELETE CASCADE,
+    original_upload_id uuid NOT NULL REFERENCES "Uploads" (id) ON DELETE CASCADE,
+    -- Hamming distance between the two hashes.
+    distance integer NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    reviewed_by uuid REFERENCES "Users" (id),
+    reviewed_at timestamptz,
+    -- dismissed or confirmed.
+    review_outcome text,
+    review_note text,
+    UNIQUE (upload_id, original_upload_id)
+);
+
+CREATE INDEX IF NOT EXISTS image_duplicate_flags_review_idx ON "ImageDuplicateFlags" (created_at) WHERE reviewed_at IS NULL;
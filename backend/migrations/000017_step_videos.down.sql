@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS uploads_step_video_idx;
+
+ALTER TABLE "Uploads"
+    DROP COLUMN IF EXISTS stream_url,
+    DROP COLUMN IF EXISTS poster_url,
+    DROP COLUMN IF EXISTS duration_ms,
+    DROP COLUMN IF EXISTS step_id,
+    DROP COLUMN IF EXISTS kind;
@@ -0,0 +1,11 @@
+-- Short videos shown with a recipe step are uploads too. A step has at most
+-- one video; replacing it detaches the old one, which cleanup then deletes.
+ALTER TABLE "Uploads"
+    -- image or video.
+    ADD COLUMN IF NOT EXISTS kind text NOT NULL DEFAULT 'image',
+    ADD COLUMN IF NOT EXISTS step_id uuid REFERENCES "Steps" (id) ON DELETE SET NULL,
+    ADD COLUMN IF NOT EXISTS duration_ms integer,
+    ADD COLUMN IF NOT EXISTS poster_url text,
+    ADD COLUMN IF NOT EXISTS stream_url text;
+
+CREATE UNIQUE INDEX IF NOT EXISTS uploads_step_video_idx ON "Uploads" (step_id) WHERE kind = 'video';
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS uploads_pending_idx;
+
+ALTER TABLE "Uploads" DROP COLUMN IF EXISTS status;
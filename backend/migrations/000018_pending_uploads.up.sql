@@ -0,0 +1,9 @@
+-- A signed direct upload is recorded as a pending upload when it is
+-- authorized, so it counts against the uploader's quota and hourly limit
+-- before any bytes arrive. Completing it replaces the pending row with the
+-- stored upload; cleanup removes pending rows never completed.
+ALTER TABLE "Uploads"
+    -- pending or stored.
+    ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'stored';
+
+CREATE INDEX IF NOT EXISTS uploads_pending_idx ON "Uploads" (created_at) WHERE status = 'pending';
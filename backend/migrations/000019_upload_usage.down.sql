@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS uploads_track_usage ON "Uploads";
+DROP FUNCTION IF EXISTS track_upload_usage();
+DROP TABLE IF EXISTS "UploadUsage";
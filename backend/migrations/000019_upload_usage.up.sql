@@ -0,0 +1,42 @@
+-- Each user's upload usage: the bytes and number of every upload row,
+-- pending ones included, kept up to date by a trigger. Quota is enforced
+-- by reserving room with a guarded increment before a file is stored and
+-- giving it back once the upload's row is in, so concurrent uploads
+-- cannot together pass the limit.
+CREATE TABLE IF NOT EXISTS "UploadUsage" (
+    user_id uuid PRIMARY KEY REFERENCES "Users" (id) ON DELETE CASCADE,
+    bytes_used bigint NOT NULL DEFAULT 0,
+    uploads_used integer NOT NULL DEFAULT 0
+);
+
+INSERT INTO "UploadUsage" (user_id, bytes_used, uploads_used)
+SELECT user_id, sum(bytes), count(*)
+FROM "Uploads"
+GROUP BY user_id
+ON CONFLICT (user_id) DO UPDATE
+SET bytes_used = EXCLUDED.bytes_used,
+    uploads_used = EXCLUDED.uploads_used;
+
+CREATE OR REPLACE FUNCTION track_upload_usage() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP IN ('DELETE', 'UPDATE') THEN
+        UPDATE "UploadUsage"
+        SET bytes_used = bytes_used - OLD.bytes,
+            uploads_used = uploads_used - 1
+        WHERE user_id = OLD.user_id;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        INSERT INTO "UploadUsage" (user_id, bytes_used, uploads_used)
+        VALUES (NEW.user_id, NEW.bytes, 1)
+        ON CONFLICT (user_id) DO UPDATE
+        SET bytes_used = "UploadUsage".bytes_used + EXCLUDED.bytes_used,
+            uploads_used = "UploadUsage".uploads_used + EXCLUDED.uploads_used;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS uploads_track_usage ON "Uploads";
+CREATE TRIGGER uploads_track_usage
+    AFTER INSERT OR DELETE OR UPDATE OF user_id, bytes ON "Uploads"
+    FOR EACH ROW EXECUTE FUNCTION track_upload_usage();
@@ -0,0 +1,17 @@
+DROP TRIGGER IF EXISTS upload_recipes_count ON "UploadRecipes";
+DROP FUNCTION IF EXISTS count_upload_recipes();
+
+-- An image shared by several recipes goes back to the one it joined first.
+UPDATE "Uploads" u
+SET recipe_id = l.recipe_id,
+    attached_at = l.attached_at
+FROM (
+    SELECT DISTINCT ON (upload_id) upload_id, recipe_id, attached_at
+    FROM "UploadRecipes"
+    ORDER BY upload_id, attached_at
+) l
+WHERE u.id = l.upload_id;
+
+ALTER TABLE "Uploads" DROP COLUMN IF EXISTS recipe_count;
+
+DROP TABLE IF EXISTS "UploadRecipes";
@@ -0,0 +1,50 @@
+-- A reused image is shared by every recipe it is added to, so an image
+-- upload's recipes live in a join table rather than in Uploads.recipe_id,
+-- which only step videos still use. recipe_count mirrors the number of
+-- links; an upload is only deleted while it is zero, and detached_at is set
+-- when its last recipe lets go of it.
+CREATE TABLE IF NOT EXISTS "UploadRecipes" (
+    upload_id uuid NOT NULL REFERENCES "Uploads" (id) ON DELETE CASCADE,
+    recipe_id uuid NOT NULL REFERENCES "Recipes" (id) ON DELETE CASCADE,
+    attached_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (upload_id, recipe_id)
+);
+
+CREATE INDEX IF NOT EXISTS upload_recipes_recipe_idx ON "UploadRecipes" (recipe_id);
+
+ALTER TABLE "Uploads"
+    ADD COLUMN IF NOT EXISTS recipe_count integer NOT NULL DEFAULT 0;
+
+INSERT INTO "UploadRecipes" (upload_id, recipe_id, attached_at)
+SELECT id, recipe_id, coalesce(attached_at, now())
+FROM "Uploads"
+WHERE kind = 'image' AND recipe_id IS NOT NULL
+ON CONFLICT DO NOTHING;
+
+UPDATE "Uploads" u
+SET recipe_count = (SELECT count(*) FROM "UploadRecipes" l WHERE l.upload_id = u.id),
+    recipe_id = NULL,
+    attached_at = NULL
+WHERE kind = 'image';
+
+CREATE OR REPLACE FUNCTION count_upload_recipes() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        UPDATE "Uploads"
+        SET recipe_count = recipe_count + 1,
+            detached_at = NULL
+        WHERE id = NEW.upload_id;
+    ELSE
+        UPDATE "Uploads"
+        SET recipe_count = recipe_count - 1,
+            detached_at = CASE WHEN recipe_count = 1 THEN now() ELSE detached_at END
+        WHERE id = OLD.upload_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS upload_recipes_count ON "UploadRecipes";
+CREATE TRIGGER upload_recipes_count
+    AFTER INSERT OR DELETE ON "UploadRecipes"
+    FOR EACH ROW EXECUTE FUNCTION count_upload_recipes();
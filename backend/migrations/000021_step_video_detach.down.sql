@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS uploads_detach_stepless_video ON "Uploads";
+DROP FUNCTION IF EXISTS detach_stepless_video();
@@ -0,0 +1,25 @@
+-- Deleting a step sets its video's step_id to NULL through the foreign
+-- key, which left the video attached to the recipe, so cleanup never
+-- deleted it and it kept counting against the uploader's quota. A video
+-- losing its step is now detached like one replaced on its step.
+UPDATE "Uploads"
+SET recipe_id = NULL,
+    attached_at = NULL,
+    detached_at = coalesce(detached_at, now())
+WHERE kind = 'video' AND step_id IS NULL AND recipe_id IS NOT NULL;
+
+CREATE OR REPLACE FUNCTION detach_stepless_video() RETURNS trigger AS $$
+BEGIN
+    NEW.recipe_id := NULL;
+    NEW.attached_at := NULL;
+    NEW.detached_at := coalesce(NEW.detached_at, now());
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS uploads_detach_stepless_video ON "Uploads";
+CREATE TRIGGER uploads_detach_stepless_video
+    BEFORE UPDATE OF step_id ON "Uploads"
+    FOR EACH ROW
+    WHEN (NEW.kind = 'video' AND OLD.step_id IS NOT NULL AND NEW.step_id IS NULL)
+    EXECUTE FUNCTION detach_stepless_video();
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS orders_user_idempotency_key_idx;
+
+CREATE UNIQUE INDEX IF NOT EXISTS orders_user_idempotency_key_idx
+    ON "Orders" (user_id, idempotency_key)
+    WHERE idempotency_key IS NOT NULL;
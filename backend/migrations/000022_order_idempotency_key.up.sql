@@ -0,0 +1,8 @@
+-- As with purchases, an order's Idempotency-Key only has to be unique among
+-- checkouts in flight: once the order fails or expires the user may retry
+-- with the same key, and a late payment can still complete the old order.
+DROP INDEX IF EXISTS orders_user_idempotency_key_idx;
+
+CREATE UNIQUE INDEX IF NOT EXISTS orders_user_idempotency_key_idx
+    ON "Orders" (user_id, idempotency_key)
+    WHERE idempotency_key IS NOT NULL AND status = 'pending';
@@ -0,0 +1,17 @@
+-- Live (reserved or completed) redemptions of each coupon per user. Like
+-- Coupons.redemption_count, the count is incremented with a guard on the
+-- coupon's per_user_limit, so concurrent checkouts by one user cannot both
+-- take the last use.
+CREATE TABLE IF NOT EXISTS "CouponUserRedemptions" (
+    coupon_id uuid NOT NULL REFERENCES "Coupons" (id),
+    user_id uuid NOT NULL REFERENCES "Users" (id),
+    redemption_count integer NOT NULL DEFAULT 0 CHECK (redemption_count >= 0),
+    PRIMARY KEY (coupon_id, user_id)
+);
+
+INSERT INTO "CouponUserRedemptions" (coupon_id, user_id, redemption_count)
+SELECT coupon_id, user_id, count(*)
+FROM "CouponRedemptions"
+WHERE status IN ('reserved', 'completed')
+GROUP BY coupon_id, user_id
+ON CONFLICT (coupon_id, user_id) DO UPDATE SET redemption_count = EXCLUDED.redemption_count;
@@ -0,0 +1,6 @@
+DELETE FROM "Uploads" WHERE status IN ('processing', 'failed');
+
+DROP INDEX IF EXISTS uploads_pending_idx;
+CREATE INDEX IF NOT EXISTS uploads_pending_idx ON "Uploads" (created_at) WHERE status = 'pending';
+
+ALTER TABLE "Uploads" DROP COLUMN IF EXISTS error;
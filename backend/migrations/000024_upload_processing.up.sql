@@ -0,0 +1,7 @@
+-- Completed direct uploads are processed in the background. Their row is
+-- processing until the image is stored, or failed with the reason shown
+-- to the uploader until cleanup removes it.
+ALTER TABLE "Uploads" ADD COLUMN IF NOT EXISTS error text;
+
+DROP INDEX IF EXISTS uploads_pending_idx;
+CREATE INDEX IF NOT EXISTS uploads_pending_idx ON "Uploads" (created_at) WHERE status <> 'stored';
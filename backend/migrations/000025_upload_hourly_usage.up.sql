@@ -0,0 +1,17 @@
+-- Uploads each user started per clock hour, for the hourly upload limit.
+-- An upload is admitted with an increment guarded by the limit, so
+-- concurrent requests cannot together pass it. Upload cleanup deletes the
+-- rows of past hours.
+CREATE TABLE IF NOT EXISTS "UploadHourlyUsage" (
+    user_id uuid NOT NULL REFERENCES "Users" (id) ON DELETE CASCADE,
+    window_start timestamptz NOT NULL,
+    uploads integer NOT NULL DEFAULT 0 CHECK (uploads >= 0),
+    PRIMARY KEY (user_id, window_start)
+);
+
+INSERT INTO "UploadHourlyUsage" (user_id, window_start, uploads)
+SELECT user_id, date_trunc('hour', now() AT TIME ZONE 'UTC') AT TIME ZONE 'UTC', count(*)
+FROM "Uploads"
+WHERE created_at >= date_trunc('hour', now() AT TIME ZONE 'UTC') AT TIME ZONE 'UTC'
+GROUP BY user_id
+ON CONFLICT (user_id, window_start) DO NOTHING;
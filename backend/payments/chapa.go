@@ -0,0 +1,365 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const chapaBaseURL = "https://api.chapa.co/v1"
+
+// ChapaProvider talks to the Chapa REST API.
+type ChapaProvider struct {
+	secretKey     string
+	webhookSecret string
+	baseURL       string
+	httpClient    *http.Client
+}
+
+func NewChapaProvider(secretKey, webhookSecret string) *ChapaProvider {
+	return &ChapaProvider{
+		secretKey:     secretKey,
+		webhookSecret: webhookSecret,
+		baseURL:       chapaBaseURL,
+		httpClient:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *ChapaProvider) Name() string {
+	return "chapa"
+}
+
+// chapaResponse is the envelope shared by all Chapa endpoints.
+type chapaResponse struct {
+	Status  string          `json:"status"`
+	Message interface{}     `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// do sends a JSON request to Chapa and decodes the envelope. Non-2xx answers
+// are turned into errors, with field validation failures reported as a
+// ValidationError.
+func (c *ChapaProvider) do(ctx context.Context, method, path string, payload interface{}) (*chapaResponse, error) {
+	var body io.Reader
+	if payload != nil {
+		payloadBytes, err := json.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("error preparing Chapa request: %v", err)
+		}
+		log.Printf("Making Chapa request %s %s with payload: %s", method, path, string(payloadBytes))
+		body = bytes.NewReader(payloadBytes)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("error creating Chapa request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.secretKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request to Chapa: %v", err)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, _ := io.ReadAll(resp.Body)
+	log.Printf("Chapa response status: %d", resp.StatusCode)
+	log.Printf("Chapa response body: %s", string(bodyBytes))
+
+	var chapaResp chapaResponse
+	decodeErr := json.Unmarshal(bodyBytes, &chapaResp)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		if decodeErr == nil {
+			if errorMessage, ok := chapaResp.Message.(map[string]interface{}); ok {
+				// Format validation errors nicely
+				var formattedErrors []string
+				for field, errors := range errorMessage {
+					if errorList, ok := errors.([]interface{}); ok {
+						for _, err := range errorList {
+							formattedErrors = append(formattedErrors, fmt.Sprintf("%s: %v", field, err))
+						}
+					}
+				}
+				if len(formattedErrors) > 0 {
+					return nil, &ValidationError{Message: fmt.Sprintf("Chapa validation errors: %s", strings.Join(formattedErrors, ", "))}
+				}
+			}
+			if resp.StatusCode == http.StatusBadRequest {
+				return nil, &ValidationError{Message: fmt.Sprintf("Chapa rejected the request: %v", chapaResp.Message)}
+			}
+		}
+		return nil, &StatusError{Provider: "Chapa", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+	}
+
+	if decodeErr != nil {
+		return nil, fmt.Errorf("error decoding Chapa response: %v", decodeErr)
+	}
+	return &chapaResp, nil
+}
+
+func (c *ChapaProvider) Initiate(ctx context.Context, req InitiateRequest) (*InitiateResult, error) {
+	payload := map[string]interface{}{
+		"amount":       req.Amount,
+		"currency":     req.Currency,
+		"tx_ref":       req.TxRef,
+		"callback_url": req.CallbackURL,
+		"return_url":   req.ReturnURL,
+		"customization": map[string]interface{}{
+			"title":       req.Title,
+			"description": req.Description,
+		},
+	}
+	if req.Email != "" {
+		payload["email"] = req.Email
+	}
+	if req.FirstName != "" {
+		payload["first_name"] = req.FirstName
+	}
+	if req.LastName != "" {
+		payload["last_name"] = req.LastName
+	}
+	if req.SubaccountID != "" {
+		split := chapaSplit(req.Split)
+		split["id"] = req.SubaccountID
+		payload["subaccounts"] = split
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "/transaction/initialize", payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var data struct {
+		CheckoutURL string `json:"checkout_url"`
+	}
+	if err := json.Unmarshal(resp.Data, &data); err != nil || data.CheckoutURL == "" {
+		return nil, fmt.Errorf("Chapa response did not include a checkout URL")
+	}
+	return &InitiateResult{CheckoutURL: data.CheckoutURL}, nil
+}
+
+func (c *ChapaProvider) CreateSubaccount(ctx context.Context, account Subaccount) (string, error) {
+	payload := chapaSplit(account.Split)
+	payload["business_name"] = account.BusinessName
+	payload["account_name"] = account.AccountName
+	payload["bank_code"] = account.BankCode
+	payload["account_number"] = account.AccountNumber
+
+	resp, err := c.do(ctx, http.MethodPost, "/subaccount", payload)
+	if err != nil {
+		return "", err
+	}
+
+	var data struct {
+		SubaccountID string `json:"subaccount_id"`
+		ID           string `json:"id"`
+	}
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return "", fmt.Errorf("error decoding Chapa subaccount: %v", err)
+	}
+	if data.SubaccountID != "" {
+		return data.SubaccountID, nil
+	}
+	if data.ID != "" {
+		return data.ID, nil
+	}
+	return "", fmt.Errorf("Chapa response did not include a subaccount ID")
+}
+
+// chapaSplit converts a split into Chapa's fields, where percentages are
+// expressed as fractions.
+func chapaSplit(split Split) map[string]interface{} {
+	if split.Type == SplitFlat {
+		return map[string]interface{}{"split_type": "flat", "split_value": split.Value}
+	}
+	return map[string]interface{}{"split_type": "percentage", "split_value": split.Value / 100}
+}
+
+func (c *ChapaProvider) Verify(ctx context.Context, req VerifyRequest) (*Transaction, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/transaction/verify/"+url.PathEscape(req.TxRef), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var data struct {
+		TxRef     string    `json:"tx_ref"`
+		Reference string    `json:"reference"`
+		Status    string    `json:"status"`
+		Amount    flexFloat `json:"amount"`
+		Currency  string    `json:"currency"`
+	}
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return nil, fmt.Errorf("error decoding Chapa verification: %v", err)
+	}
+
+	return req.check(&Transaction{
+		TxRef:     data.TxRef,
+		Reference: data.Reference,
+		Status:    normalizeChapaStatus(data.Status),
+		Amount:    float64(data.Amount),
+		Currency:  strings.ToUpper(data.Currency),
+	})
+}
+
+func (c *ChapaProvider) Refund(ctx context.Context, req RefundRequest) (*RefundResult, error) {
+	payload := map[string]interface{}{
+		"amount":    req.Amount,
+		"reason":    req.Reason,
+		"reference": req.Reference,
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "/refund/"+url.PathEscape(req.TxRef), payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var data struct {
+		Reference string    `json:"reference"`
+		Status    string    `json:"status"`
+		Amount    flexFloat `json:"amount"`
+	}
+	// The data object is optional; a success envelope is enough.
+	_ = json.Unmarshal(resp.Data, &data)
+
+	result := &RefundResult{Reference: req.Reference, Status: StatusPending, Amount: req.Amount}
+	if data.Status != "" {
+		result.Status = normalizeChapaStatus(data.Status)
+	}
+	if data.Amount > 0 {
+		result.Amount = float64(data.Amount)
+	}
+	return result, nil
+}
+
+func (c *ChapaProvider) VerifyRefund(ctx context.Context, reference string) (*RefundResult, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/refund/verify/"+url.PathEscape(reference), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var data struct {
+		Reference string    `json:"reference"`
+		Status    string    `json:"status"`
+		Amount    flexFloat `json:"amount"`
+	}
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return nil, fmt.Errorf("error decoding Chapa refund verification: %v", err)
+	}
+	if data.Reference != "" && data.Reference != reference {
+		return nil, fmt.Errorf("Chapa verified refund %s instead of %s", data.Reference, reference)
+	}
+
+	return &RefundResult{
+		Reference: reference,
+		Status:    normalizeChapaStatus(data.Status),
+		Amount:    float64(data.Amount),
+	}, nil
+}
+
+// chapaWebhookData carries the transaction fields of a webhook. Chapa sends
+// them at the top level; older integrations nest them under "data".
+type chapaWebhookData struct {
+	TxRef     string    `json:"tx_ref"`
+	Reference string    `json:"reference"`
+	Status    string    `json:"status"`
+	Amount    flexFloat `json:"amount"`
+	Currency  string    `json:"currency"`
+	RefundRef string    `json:"refund_reference"`
+}
+
+func (c *ChapaProvider) ParseWebhook(r *http.Request) (*WebhookEvent, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading webhook body: %v", err)
+	}
+	defer r.Body.Close()
+
+	if !validSignature(c.webhookSecret, body, r.Header.Get("x-chapa-signature"), r.Header.Get("Chapa-Signature")) {
+		return nil, ErrInvalidSignature
+	}
+
+	return parseChapaWebhook(body)
+}
+
+func parseChapaWebhook(body []byte) (*WebhookEvent, error) {
+	var payload struct {
+		Event string `json:"event"`
+		chapaWebhookData
+		Data *chapaWebhookData `json:"data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid webhook payload: %v", err)
+	}
+
+	data := payload.chapaWebhookData
+	if payload.Data != nil {
+		data = *payload.Data
+	}
+	if data.TxRef == "" {
+		return nil, fmt.Errorf("webhook payload has no tx_ref")
+	}
+
+	event := &WebhookEvent{
+		TxRef:           data.TxRef,
+		Status:          normalizeChapaStatus(data.Status),
+		Amount:          float64(data.Amount),
+		Currency:        strings.ToUpper(data.Currency),
+		RefundReference: data.RefundRef,
+	}
+
+	switch {
+	case strings.HasPrefix(payload.Event, "charge.refunded"), strings.HasPrefix(payload.Event, "charge.reversed"), strings.HasPrefix(payload.Event, "refund."):
+		event.Type = EventRefund
+		if event.Status == StatusSuccess {
+			event.Status = StatusRefunded
+		}
+	case strings.HasPrefix(payload.Event, "charge."):
+		event.Type = EventCharge
+	default:
+		event.Type = payload.Event
+	}
+	return event, nil
+}
+
+// validSignature checks the HMAC-SHA256 of the body against any of the
+// signature headers the provider may have set.
+func validSignature(secret string, body []byte, signatures ...string) bool {
+	expected := signPayload(secret, body)
+	for _, signature := range signatures {
+		if signature != "" && hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+			return true
+		}
+	}
+	return false
+}
+
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func normalizeChapaStatus(status string) string {
+	switch strings.ToLower(status) {
+	case "success", "successful", "completed":
+		return StatusSuccess
+	case "failed", "failure", "cancelled", "canceled":
+		return StatusFailed
+	case "refunded", "reversed":
+		return StatusRefunded
+	default:
+		return StatusPending
+	}
+}
@@ -0,0 +1,202 @@
+package payments
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseChapaWebhook(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want WebhookEvent
+	}{
+		{
+			"charge",
+			`{"event":"charge.success","tx_ref":"tx-1","status":"success","amount":"150.00","currency":"etb"}`,
+			WebhookEvent{Type: EventCharge, TxRef: "tx-1", Status: StatusSuccess, Amount: 150, Currency: "ETB"},
+		},
+		{
+			"failed charge in data",
+			`{"event":"charge.failed","data":{"tx_ref":"tip-1","status":"failed","amount":5,"currency":"USD"}}`,
+			WebhookEvent{Type: EventCharge, TxRef: "tip-1", Status: StatusFailed, Amount: 5, Currency: "USD"},
+		},
+		{
+			"refunded charge",
+			`{"event":"charge.refunded","tx_ref":"tx-1","status":"success","amount":50,"refund_reference":"rf-1"}`,
+			WebhookEvent{Type: EventRefund, TxRef: "tx-1", Status: StatusRefunded, Amount: 50, RefundReference: "rf-1"},
+		},
+		{
+			"reversed charge",
+			`{"event":"charge.reversed","tx_ref":"tx-1","status":"reversed"}`,
+			WebhookEvent{Type: EventRefund, TxRef: "tx-1", Status: StatusRefunded},
+		},
+		{
+			"failed refund",
+			`{"event":"refund.failed","tx_ref":"tx-1","status":"failed","refund_reference":"rf-2"}`,
+			WebhookEvent{Type: EventRefund, TxRef: "tx-1", Status: StatusFailed, RefundReference: "rf-2"},
+		},
+		{
+			"other event",
+			`{"event":"payout.success","tx_ref":"po-1","status":"success"}`,
+			WebhookEvent{Type: "payout.success", TxRef: "po-1", Status: StatusSuccess},
+		},
+		{
+			"unknown status",
+			`{"event":"charge.pending","tx_ref":"tx-1","status":"processing"}`,
+			WebhookEvent{Type: EventCharge, TxRef: "tx-1", Status: StatusPending},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := parseChapaWebhook([]byte(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *event != tt.want {
+				t.Errorf("parseChapaWebhook() = %+v, want %+v", *event, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseChapaWebhookRejects(t *testing.T) {
+	for _, body := range []string{
+		``,
+		`not json`,
+		`{"event":"charge.success","status":"success"}`,
+		`{"event":"charge.success","data":{"status":"success"}}`,
+		`{"event":"charge.success","tx_ref":"tx-1","amount":"lots"}`,
+	} {
+		if event, err := parseChapaWebhook([]byte(body)); err == nil {
+			t.Errorf("parseChapaWebhook(%q) = %+v, want an error", body, event)
+		}
+	}
+}
+
+func TestChapaParseWebhookSignature(t *testing.T) {
+	body := `{"event":"charge.success","tx_ref":"tx-1","status":"success"}`
+	valid := signPayload("secret", []byte(body))
+	tests := []struct {
+		name    string
+		headers map[string]string
+		ok      bool
+	}{
+		{"x-chapa-signature", map[string]string{"x-chapa-signature": valid}, true},
+		{"Chapa-Signature", map[string]string{"Chapa-Signature": valid}, true},
+		{"upper case", map[string]string{"x-chapa-signature": strings.ToUpper(valid)}, true},
+		{"one of two", map[string]string{"x-chapa-signature": "bad", "Chapa-Signature": valid}, true},
+		{"wrong secret", map[string]string{"x-chapa-signature": signPayload("other", []byte(body))}, false},
+		{"unsigned", nil, false},
+	}
+	provider := NewChapaProvider("key", "secret")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/webhooks/payment", strings.NewReader(body))
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			event, err := provider.ParseWebhook(r)
+			if tt.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if event.TxRef != "tx-1" {
+					t.Errorf("TxRef = %q", event.TxRef)
+				}
+			} else if err != ErrInvalidSignature {
+				t.Errorf("ParseWebhook() = %v, want %v", err, ErrInvalidSignature)
+			}
+		})
+	}
+}
+
+func TestChapaRefundRejection(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		rejected bool
+	}{
+		{"validation", http.StatusBadRequest, `{"message":{"amount":["must be positive"]},"status":"failed"}`, true},
+		{"bad request", http.StatusBadRequest, `{"message":"Transaction not refundable","status":"failed"}`, true},
+		{"unknown transaction", http.StatusNotFound, `{"message":"Not found","status":"failed"}`, true},
+		{"timeout", http.StatusRequestTimeout, `{"message":"Timeout","status":"failed"}`, false},
+		{"server error", http.StatusInternalServerError, `{"message":"Internal error","status":"failed"}`, false},
+		{"bad gateway", http.StatusBadGateway, `<html>Bad Gateway</html>`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+			provider := NewChapaProvider("key", "secret")
+			provider.baseURL = server.URL
+
+			_, err := provider.Refund(t.Context(), RefundRequest{TxRef: "tx-1", Amount: 10, Reference: "rf-1"})
+			if err == nil {
+				t.Fatal("Refund() succeeded, want an error")
+			}
+			if got := IsRejected(err); got != tt.rejected {
+				t.Errorf("IsRejected(%v) = %v, want %v", err, got, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestChapaRefundUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	provider := NewChapaProvider("key", "secret")
+	provider.baseURL = server.URL
+	server.Close()
+
+	_, err := provider.Refund(t.Context(), RefundRequest{TxRef: "tx-1", Amount: 10, Reference: "rf-1"})
+	if err == nil || IsRejected(err) {
+		t.Errorf("Refund() error = %v, want an error that is not a rejection", err)
+	}
+}
+
+func TestChapaVerify(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		mismatch bool
+		wantErr  bool
+	}{
+		{"match", `{"tx_ref":"tx-1","reference":"AP1","status":"success","amount":"100.00","currency":"ETB"}`, false, false},
+		{"other transaction", `{"tx_ref":"tx-2","reference":"AP2","status":"success","amount":"100.00","currency":"ETB"}`, false, true},
+		{"missing transaction", `{"status":"success","amount":"100.00","currency":"ETB"}`, false, true},
+		{"other amount", `{"tx_ref":"tx-1","reference":"AP1","status":"success","amount":"1.00","currency":"ETB"}`, true, true},
+		{"other currency", `{"tx_ref":"tx-1","reference":"AP1","status":"success","amount":"100.00","currency":"USD"}`, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/transaction/verify/tx-1" {
+					t.Errorf("path = %s, want /transaction/verify/tx-1", r.URL.Path)
+				}
+				w.Write([]byte(`{"message":"Payment details","status":"success","data":` + tt.data + `}`))
+			}))
+			defer server.Close()
+			provider := NewChapaProvider("key", "secret")
+			provider.baseURL = server.URL
+
+			tx, err := provider.Verify(t.Context(), VerifyRequest{TxRef: "tx-1", Amount: 100, Currency: "ETB"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() = %+v, %v, want error %v", tx, err, tt.wantErr)
+			}
+			var mismatch *MismatchError
+			if got := errors.As(err, &mismatch); got != tt.mismatch {
+				t.Errorf("Verify() error = %v, want mismatch %v", err, tt.mismatch)
+			}
+			if err == nil && (tx.TxRef != "tx-1" || tx.Status != StatusSuccess) {
+				t.Errorf("Verify() = %+v, want successful tx-1", tx)
+			}
+		})
+	}
+}
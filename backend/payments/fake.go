@@ -0,0 +1,302 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeCheckoutPath is where the fake provider serves its checkout pages.
+const FakeCheckoutPath = "/payments/fake/checkout/"
+
+// FakeProvider is an in-process stand-in for Chapa used in local development
+// and integration tests. It serves its own checkout page, lets the payer pick
+// success or failure, and delivers signed webhooks after a delay.
+type FakeProvider struct {
+	baseURL       string
+	webhookSecret string
+	webhookDelay  time.Duration
+	httpClient    *http.Client
+
+	mu           sync.Mutex
+	transactions map[string]*fakeTransaction
+	refunds      map[string]*RefundResult
+	subaccounts  int
+}
+
+type fakeTransaction struct {
+	request  InitiateRequest
+	status   string
+	refunded float64
+}
+
+func NewFakeProvider(baseURL, webhookSecret string, webhookDelay time.Duration) *FakeProvider {
+	if baseURL == "" {
+		baseURL = "http://localhost:5050"
+	}
+	return &FakeProvider{
+		baseURL:       strings.TrimRight(baseURL, "/"),
+		webhookSecret: webhookSecret,
+		webhookDelay:  webhookDelay,
+		httpClient:    &http.Client{Timeout: 10 * time.Second},
+		transactions:  make(map[string]*fakeTransaction),
+		refunds:       make(map[string]*RefundResult),
+	}
+}
+
+func (f *FakeProvider) Name() string {
+	return "fake"
+}
+
+func (f *FakeProvider) Initiate(ctx context.Context, req InitiateRequest) (*InitiateResult, error) {
+	if req.TxRef == "" {
+		return nil, &ValidationError{Message: "tx_ref is required"}
+	}
+	if req.Amount <= 0 {
+		return nil, &ValidationError{Message: "amount must be greater than 0"}
+	}
+	if req.CallbackURL == "" {
+		req.CallbackURL = f.baseURL + "/payments/webhook"
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, exists := f.transactions[req.TxRef]; exists {
+		return nil, &ValidationError{Message: "tx_ref has already been used"}
+	}
+	f.transactions[req.TxRef] = &fakeTransaction{request: req, status: StatusPending}
+
+	return &InitiateResult{CheckoutURL: f.baseURL + FakeCheckoutPath + req.TxRef}, nil
+}
+
+func (f *FakeProvider) CreateSubaccount(ctx context.Context, account Subaccount) (string, error) {
+	if account.BankCode == "" || account.AccountNumber == "" {
+		return "", &ValidationError{Message: "bank code and account number are required"}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subaccounts++
+	return fmt.Sprintf("FAKE-SUB-%d", f.subaccounts), nil
+}
+
+func (f *FakeProvider) Verify(ctx context.Context, req VerifyRequest) (*Transaction, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tx, ok := f.transactions[req.TxRef]
+	if !ok {
+		return nil, fmt.Errorf("transaction %s not found", req.TxRef)
+	}
+	return req.check(&Transaction{
+		TxRef:     req.TxRef,
+		Reference: "FAKE-" + req.TxRef,
+		Status:    tx.status,
+		Amount:    tx.request.Amount,
+		Currency:  tx.request.Currency,
+	})
+}
+
+func (f *FakeProvider) Refund(ctx context.Context, req RefundRequest) (*RefundResult, error) {
+	f.mu.Lock()
+	tx, ok := f.transactions[req.TxRef]
+	if !ok {
+		f.mu.Unlock()
+		return nil, fmt.Errorf("transaction %s not found", req.TxRef)
+	}
+	if tx.status != StatusSuccess && tx.status != StatusRefunded {
+		f.mu.Unlock()
+		return nil, &ValidationError{Message: "only successful transactions can be refunded"}
+	}
+	if req.Amount <= 0 || tx.refunded+req.Amount > tx.request.Amount+0.005 {
+		f.mu.Unlock()
+		return nil, &ValidationError{Message: "refund amount exceeds the refundable balance"}
+	}
+	tx.refunded += req.Amount
+	if tx.refunded >= tx.request.Amount-0.005 {
+		tx.status = StatusRefunded
+	}
+	// Fake refunds settle at once; the webhook only announces it.
+	f.refunds[req.Reference] = &RefundResult{Reference: req.Reference, Status: StatusRefunded, Amount: req.Amount}
+	callbackURL := tx.request.CallbackURL
+	currency := tx.request.Currency
+	f.mu.Unlock()
+
+	f.sendWebhook(callbackURL, map[string]interface{}{
+		"event":            "charge.refunded",
+		"tx_ref":           req.TxRef,
+		"status":           "refunded",
+		"amount":           req.Amount,
+		"currency":         currency,
+		"refund_reference": req.Reference,
+	})
+
+	return &RefundResult{Reference: req.Reference, Status: StatusPending, Amount: req.Amount}, nil
+}
+
+func (f *FakeProvider) VerifyRefund(ctx context.Context, reference string) (*RefundResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	refund, ok := f.refunds[reference]
+	if !ok {
+		return nil, &StatusError{Provider: "fake", StatusCode: http.StatusNotFound, Body: fmt.Sprintf("refund %s not found", reference)}
+	}
+	result := *refund
+	return &result, nil
+}
+
+func (f *FakeProvider) ParseWebhook(r *http.Request) (*WebhookEvent, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading webhook body: %v", err)
+	}
+	defer r.Body.Close()
+
+	if f.webhookSecret != "" && !validSignature(f.webhookSecret, body, r.Header.Get("x-chapa-signature")) {
+		return nil, ErrInvalidSignature
+	}
+	return parseChapaWebhook(body)
+}
+
+// Complete marks a pending transaction as paid and schedules its webhook, as
+// if the payer had clicked "Pay" on the checkout page.
+func (f *FakeProvider) Complete(txRef string) error {
+	return f.settle(txRef, StatusSuccess)
+}
+
+// Fail marks a pending transaction as failed and schedules its webhook.
+func (f *FakeProvider) Fail(txRef string) error {
+	return f.settle(txRef, StatusFailed)
+}
+
+func (f *FakeProvider) settle(txRef, status string) error {
+	f.mu.Lock()
+	tx, ok := f.transactions[txRef]
+	if !ok {
+		f.mu.Unlock()
+		return fmt.Errorf("transaction %s not found", txRef)
+	}
+	if tx.status != StatusPending {
+		f.mu.Unlock()
+		return fmt.Errorf("transaction %s is already %s", txRef, tx.status)
+	}
+	tx.status = status
+	req := tx.request
+	f.mu.Unlock()
+
+	event := "charge.success"
+	if status == StatusFailed {
+		event = "charge.failed"
+	}
+	f.sendWebhook(req.CallbackURL, map[string]interface{}{
+		"event":     event,
+		"tx_ref":    txRef,
+		"reference": "FAKE-" + txRef,
+		"status":    status,
+		"amount":    req.Amount,
+		"currency":  req.Currency,
+	})
+	return nil
+}
+
+// sendWebhook posts a signed Chapa-shaped payload to the callback URL after
+// the configured delay, without blocking the caller.
+func (f *FakeProvider) sendWebhook(callbackURL string, payload map[string]interface{}) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Fake provider: error encoding webhook: %v", err)
+		return
+	}
+
+	go func() {
+		time.Sleep(f.webhookDelay)
+
+		req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Fake provider: error creating webhook request: %v", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if f.webhookSecret != "" {
+			req.Header.Set("x-chapa-signature", signPayload(f.webhookSecret, body))
+		}
+
+		resp, err := f.httpClient.Do(req)
+		if err != nil {
+			log.Printf("Fake provider: webhook to %s failed: %v", callbackURL, err)
+			return
+		}
+		resp.Body.Close()
+		log.Printf("Fake provider: webhook %s delivered with status %d", payload["event"], resp.StatusCode)
+	}()
+}
+
+var fakeCheckoutPage = template.Must(template.New("checkout").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Title}}</title></head>
+<body>
+	<h1>{{.Title}}</h1>
+	<p>{{.Description}}</p>
+	<p>Amount: {{printf "%.2f" .Amount}} {{.Currency}}</p>
+	<p>Reference: {{.TxRef}}</p>
+	<form method="POST">
+		<button type="submit" name="outcome" value="success">Pay</button>
+		<button type="submit" name="outcome" value="failure">Fail payment</button>
+	</form>
+</body>
+</html>
+`))
+
+// ServeHTTP renders the checkout page on GET and settles the transaction on
+// POST, then sends the payer to the return URL like Chapa does.
+func (f *FakeProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	txRef := strings.TrimPrefix(r.URL.Path, FakeCheckoutPath)
+
+	f.mu.Lock()
+	tx, ok := f.transactions[txRef]
+	var req InitiateRequest
+	if ok {
+		req = tx.request
+	}
+	f.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "Unknown transaction", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := fakeCheckoutPage.Execute(w, req); err != nil {
+			log.Printf("Fake provider: error rendering checkout: %v", err)
+		}
+	case http.MethodPost:
+		var err error
+		if r.FormValue("outcome") == "failure" {
+			err = f.Fail(txRef)
+		} else {
+			err = f.Complete(txRef)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if req.ReturnURL == "" {
+			fmt.Fprintf(w, "Payment %s processed", txRef)
+			return
+		}
+		http.Redirect(w, r, req.ReturnURL, http.StatusSeeOther)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
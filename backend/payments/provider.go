@@ -0,0 +1,287 @@
+// Package payments abstracts the payment gateway behind PaymentProvider so
+// handlers do not depend on Chapa directly.
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"backend/config"
+)
+
+// Transaction and refund statuses as reported by a provider.
+const (
+	StatusPending  = "pending"
+	StatusSuccess  = "success"
+	StatusFailed   = "failed"
+	StatusRefunded = "refunded"
+)
+
+// Webhook event types understood by the handlers.
+const (
+	EventCharge = "charge"
+	EventRefund = "refund"
+)
+
+// ErrInvalidSignature is returned by ParseWebhook when the request was not
+// signed by the provider.
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// ValidationError is returned when the provider rejects a request because of
+// its contents rather than an outage, so callers can answer with a 400.
+type ValidationError struct {
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// StatusError is returned when the provider answers a request with a non-2xx
+// status that is not a validation failure.
+type StatusError struct {
+	Provider   string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("received non-2xx response from %s: %s", e.Provider, e.Body)
+}
+
+// IsRejected reports whether err means the provider refused a request, so
+// nothing it asked for took place. Transport errors, timeouts and server
+// errors leave that unknown: the provider may have acted on the request.
+func IsRejected(err error) bool {
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		return true
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 400 && statusErr.StatusCode < 500 &&
+			statusErr.StatusCode != http.StatusRequestTimeout
+	}
+	return false
+}
+
+// Split types for dividing a payment between the platform and an author.
+const (
+	SplitPercentage = "percentage"
+	SplitFlat       = "flat"
+)
+
+// Split is the platform's share of a payment. Value is a percent for
+// SplitPercentage and an amount in the payment currency for SplitFlat.
+type Split struct {
+	Type  string
+	Value float64
+}
+
+// Fee returns the platform's share of amount, never more than amount itself.
+func (s Split) Fee(amount float64) float64 {
+	var fee float64
+	switch s.Type {
+	case SplitFlat:
+		fee = s.Value
+	default:
+		fee = amount * s.Value / 100
+	}
+	if fee > amount {
+		fee = amount
+	}
+	if fee < 0 {
+		fee = 0
+	}
+	return math.Round(fee*100) / 100
+}
+
+// InitiateRequest describes a checkout to open with the provider. When
+// SubaccountID is set the provider pays the author directly, keeping Split
+// for the platform.
+type InitiateRequest struct {
+	TxRef       string
+	Amount      float64
+	Currency    string
+	Email       string
+	FirstName   string
+	LastName    string
+	Title       string
+	Description string
+	CallbackURL string
+	ReturnURL   string
+
+	SubaccountID string
+	Split        Split
+}
+
+// InitiateResult is what the client needs to complete the checkout.
+type InitiateResult struct {
+	CheckoutURL string
+}
+
+// Transaction is the provider's view of a charge.
+type Transaction struct {
+	TxRef     string
+	Reference string
+	Status    string
+	Amount    float64
+	Currency  string
+}
+
+// VerifyRequest names a charge to verify together with the amount and
+// currency we recorded for it.
+type VerifyRequest struct {
+	TxRef    string
+	Amount   float64
+	Currency string
+}
+
+// Ways a verified transaction can differ from the charge we recorded.
+const (
+	MismatchAmount   = "amount"
+	MismatchCurrency = "currency"
+)
+
+// MismatchError is returned by Verify when the provider reports a different
+// amount or currency than was recorded. Transaction is what the provider
+// reported, so callers can hold the charge for review.
+type MismatchError struct {
+	Transaction *Transaction
+	Fields      []string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("transaction %s differs from the recorded charge in %s",
+		e.Transaction.TxRef, strings.Join(e.Fields, " and "))
+}
+
+// mismatches lists how tx differs from the charge req describes. Amounts
+// are compared in whole cents.
+func (req VerifyRequest) mismatches(tx *Transaction) []string {
+	var fields []string
+	if math.Abs(math.Round(tx.Amount*100)/100-math.Round(req.Amount*100)/100) >= 0.01 {
+		fields = append(fields, MismatchAmount)
+	}
+	if !strings.EqualFold(tx.Currency, req.Currency) {
+		fields = append(fields, MismatchCurrency)
+	}
+	return fields
+}
+
+// check accepts tx as the verification of req only if it is for the same
+// charge, for the same amount and in the same currency.
+func (req VerifyRequest) check(tx *Transaction) (*Transaction, error) {
+	if tx.TxRef != req.TxRef {
+		return nil, fmt.Errorf("provider verified transaction %q instead of %s", tx.TxRef, req.TxRef)
+	}
+	if fields := req.mismatches(tx); len(fields) > 0 {
+		return nil, &MismatchError{Transaction: tx, Fields: fields}
+	}
+	return tx, nil
+}
+
+// RefundRequest returns Amount of a completed charge to the payer. Reference
+// is our own identifier for the refund and is echoed back in webhooks.
+type RefundRequest struct {
+	TxRef     string
+	Amount    float64
+	Reason    string
+	Reference string
+}
+
+// RefundResult is the provider's acknowledgement of a refund request.
+type RefundResult struct {
+	Reference string
+	Status    string
+	Amount    float64
+}
+
+// WebhookEvent is a provider notification normalized to our vocabulary.
+type WebhookEvent struct {
+	Type            string
+	TxRef           string
+	Status          string
+	Amount          float64
+	Currency        string
+	RefundReference string
+}
+
+// PaymentProvider is implemented by every payment gateway the backend can
+// take money through.
+type PaymentProvider interface {
+	Name() string
+	Initiate(ctx context.Context, req InitiateRequest) (*InitiateResult, error)
+	// Verify reports the outcome of a charge. It returns a *MismatchError
+	// when the provider's amount or currency differ from req's.
+	Verify(ctx context.Context, req VerifyRequest) (*Transaction, error)
+	Refund(ctx context.Context, req RefundRequest) (*RefundResult, error)
+	// VerifyRefund reports the status of a refund by the reference it was
+	// requested with.
+	VerifyRefund(ctx context.Context, reference string) (*RefundResult, error)
+	ParseWebhook(r *http.Request) (*WebhookEvent, error)
+}
+
+// Subaccount holds an author's payout details for registration with the
+// provider. Split is the platform commission deducted from each payment.
+type Subaccount struct {
+	BusinessName  string
+	AccountName   string
+	BankCode      string
+	AccountNumber string
+	Split         Split
+}
+
+// SubaccountProvider is implemented by providers that can split payments
+// between the platform and an author's own account.
+type SubaccountProvider interface {
+	CreateSubaccount(ctx context.Context, account Subaccount) (string, error)
+}
+
+// NewProvider builds the provider selected by PAYMENT_PROVIDER.
+func NewProvider(cfg *config.Config) (PaymentProvider, error) {
+	switch strings.ToLower(cfg.PaymentProvider) {
+	case "", "chapa":
+		// The webhook route is public; without a secret anyone could post
+		// payment results to it.
+		if cfg.ChapaWebhookSecret == "" {
+			return nil, fmt.Errorf("CHAPA_WEBHOOK_SECRET must be set to receive Chapa webhooks")
+		}
+		return NewChapaProvider(cfg.ChapaSecretKey, cfg.ChapaWebhookSecret), nil
+	case "fake":
+		return NewFakeProvider(cfg.PublicBaseURL, cfg.ChapaWebhookSecret, cfg.FakeWebhookDelay), nil
+	default:
+		return nil, fmt.Errorf("unknown payment provider: %s", cfg.PaymentProvider)
+	}
+}
+
+// flexFloat accepts amounts encoded either as JSON numbers or strings, as
+// Chapa uses both depending on the endpoint.
+type flexFloat float64
+
+func (f *flexFloat) UnmarshalJSON(b []byte) error {
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		n = json.Number(s)
+	}
+	if n == "" {
+		*f = 0
+		return nil
+	}
+	v, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		return err
+	}
+	*f = flexFloat(v)
+	return nil
+}
@@ -0,0 +1,113 @@
+package payments
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"backend/config"
+)
+
+func TestNewProvider(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Config
+		want string
+	}{
+		{"chapa", config.Config{ChapaSecretKey: "key", ChapaWebhookSecret: "secret"}, "chapa"},
+		{"chapa without webhook secret", config.Config{ChapaSecretKey: "key"}, ""},
+		{"fake", config.Config{PaymentProvider: "fake"}, "fake"},
+		{"unknown", config.Config{PaymentProvider: "paypal"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, err := NewProvider(&tt.cfg)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("NewProvider() = %s, want an error", provider.Name())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if provider.Name() != tt.want {
+				t.Errorf("Name() = %s, want %s", provider.Name(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitFee(t *testing.T) {
+	tests := []struct {
+		name   string
+		split  Split
+		amount float64
+		want   float64
+	}{
+		{"percentage", Split{Type: SplitPercentage, Value: 10}, 250, 25},
+		{"percentage rounds to cents", Split{Type: SplitPercentage, Value: 15}, 9.99, 1.5},
+		{"percentage rounds down", Split{Type: SplitPercentage, Value: 10}, 0.33, 0.03},
+		{"unknown type is a percentage", Split{Type: "", Value: 10}, 50, 5},
+		{"zero percent", Split{Type: SplitPercentage, Value: 0}, 50, 0},
+		{"flat", Split{Type: SplitFlat, Value: 10}, 250, 10},
+		{"flat above amount", Split{Type: SplitFlat, Value: 10}, 4, 4},
+		{"percentage above amount", Split{Type: SplitPercentage, Value: 150}, 20, 20},
+		{"negative", Split{Type: SplitFlat, Value: -3}, 20, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.split.Fee(tt.amount); got != tt.want {
+				t.Errorf("Fee(%v) = %v, want %v", tt.amount, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyRequestCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		txRef    string
+		amount   float64
+		currency string
+		fields   []string
+		foreign  bool
+	}{
+		{"match", "tx-1", 100, "ETB", nil, false},
+		{"currency case", "tx-1", 100, "etb", nil, false},
+		{"sub-cent float noise", "tx-1", 100.004, "ETB", nil, false},
+		{"rounds to the recorded amount", "tx-1", 99.995, "ETB", nil, false},
+		{"one cent short", "tx-1", 99.99, "ETB", []string{MismatchAmount}, false},
+		{"overpaid", "tx-1", 150, "ETB", []string{MismatchAmount}, false},
+		{"other currency", "tx-1", 100, "USD", []string{MismatchCurrency}, false},
+		{"both", "tx-1", 3, "USD", []string{MismatchAmount, MismatchCurrency}, false},
+		{"other transaction", "tx-2", 100, "ETB", nil, true},
+		{"no transaction", "", 100, "ETB", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := VerifyRequest{TxRef: "tx-1", Amount: 100, Currency: "ETB"}
+			tx := &Transaction{TxRef: tt.txRef, Status: StatusSuccess, Amount: tt.amount, Currency: tt.currency}
+			got, err := req.check(tx)
+
+			var mismatch *MismatchError
+			switch {
+			case tt.foreign:
+				if err == nil || errors.As(err, &mismatch) {
+					t.Fatalf("check() error = %v, want a rejection that is not a mismatch", err)
+				}
+			case tt.fields != nil:
+				if !errors.As(err, &mismatch) {
+					t.Fatalf("check() error = %v, want a *MismatchError", err)
+				}
+				if !reflect.DeepEqual(mismatch.Fields, tt.fields) || mismatch.Transaction != tx {
+					t.Errorf("mismatch = %+v, want fields %v for the provider's transaction", mismatch, tt.fields)
+				}
+			default:
+				if err != nil || got != tx {
+					t.Errorf("check() = %v, %v, want the transaction", got, err)
+				}
+			}
+		})
+	}
+}
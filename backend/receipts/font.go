@@ -0,0 +1,393 @@
+package receipts
+
+import (
+	_ "embed"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Text the standard fonts cannot show (anything outside WinAnsiEncoding,
+// such as names in Greek or Cyrillic) is set in DejaVu Sans, embedded as a
+// subset of the glyphs the receipt uses. Characters DejaVu Sans lacks still
+// print as "?". Glyphs are placed one per character, so scripts that need
+// shaping print unjoined.
+var (
+	//go:embed fonts/DejaVuSans.ttf
+	dejaVuSans []byte
+	//go:embed fonts/DejaVuSans-Bold.ttf
+	dejaVuSansBold []byte
+)
+
+var (
+	unicodeFontsOnce sync.Once
+	unicodeFonts     [2]*trueTypeFont
+)
+
+// unicodeFont returns the embedded regular or bold font, or nil if it could
+// not be read.
+func unicodeFont(bold bool) *trueTypeFont {
+	unicodeFontsOnce.Do(func() {
+		unicodeFonts[0], _ = parseTrueType("DejaVuSans", dejaVuSans)
+		unicodeFonts[1], _ = parseTrueType("DejaVuSans-Bold", dejaVuSansBold)
+	})
+	if bold {
+		return unicodeFonts[1]
+	}
+	return unicodeFonts[0]
+}
+
+var errMalformedFont = errors.New("receipts: malformed TrueType font")
+
+// trueTypeFont is the part of a TrueType font needed to set text with it
+// and to embed a subset of it.
+type trueTypeFont struct {
+	name       string
+	tables     map[string][]byte
+	unitsPerEm int
+	numGlyphs  int
+	advances   []uint16
+	glyphs     map[rune]uint16
+	ascent     int16
+	descent    int16
+	bbox       [4]int16
+	longLoca   bool
+}
+
+func parseTrueType(name string, data []byte) (*trueTypeFont, error) {
+	if len(data) < 12 {
+		return nil, errMalformedFont
+	}
+	if version := binary.BigEndian.Uint32(data); version != 0x00010000 && version != 0x74727565 {
+		return nil, errMalformedFont
+	}
+	numTables := int(binary.BigEndian.Uint16(data[4:]))
+	if len(data) < 12+16*numTables {
+		return nil, errMalformedFont
+	}
+
+	f := &trueTypeFont{name: name, tables: make(map[string][]byte, numTables)}
+	for i := 0; i < numTables; i++ {
+		record := data[12+16*i:]
+		offset := int64(binary.BigEndian.Uint32(record[8:]))
+		length := int64(binary.BigEndian.Uint32(record[12:]))
+		if offset+length > int64(len(data)) {
+			return nil, errMalformedFont
+		}
+		f.tables[string(record[:4])] = data[offset : offset+length]
+	}
+
+	head, hhea, maxp := f.tables["head"], f.tables["hhea"], f.tables["maxp"]
+	if len(head) < 54 || len(hhea) < 36 || len(maxp) < 6 || f.tables["glyf"] == nil || f.tables["loca"] == nil {
+		return nil, errMalformedFont
+	}
+	f.unitsPerEm = int(binary.BigEndian.Uint16(head[18:]))
+	for i := range f.bbox {
+		f.bbox[i] = int16(binary.BigEndian.Uint16(head[36+2*i:]))
+	}
+	f.longLoca = binary.BigEndian.Uint16(head[50:]) == 1
+	f.ascent = int16(binary.BigEndian.Uint16(hhea[4:]))
+	f.descent = int16(binary.BigEndian.Uint16(hhea[6:]))
+	f.numGlyphs = int(binary.BigEndian.Uint16(maxp[4:]))
+	if f.unitsPerEm == 0 || f.numGlyphs == 0 {
+		return nil, errMalformedFont
+	}
+
+	numMetrics := int(binary.BigEndian.Uint16(hhea[34:]))
+	hmtx := f.tables["hmtx"]
+	if numMetrics == 0 || numMetrics > f.numGlyphs || len(hmtx) < 4*numMetrics {
+		return nil, errMalformedFont
+	}
+	f.advances = make([]uint16, f.numGlyphs)
+	for g := range f.advances {
+		f.advances[g] = binary.BigEndian.Uint16(hmtx[4*min(g, numMetrics-1):])
+	}
+
+	glyphs, err := parseCmap(f.tables["cmap"], f.numGlyphs)
+	if err != nil {
+		return nil, err
+	}
+	f.glyphs = glyphs
+	return f, nil
+}
+
+// parseCmap reads the font's Unicode character map, preferring the full
+// repertoire (format 12) over the Basic Multilingual Plane (format 4).
+func parseCmap(cmap []byte, numGlyphs int) (map[rune]uint16, error) {
+	if len(cmap) < 4 {
+		return nil, errMalformedFont
+	}
+	var bmp, full []byte
+	for i, n := 0, int(binary.BigEndian.Uint16(cmap[2:])); i < n; i++ {
+		if len(cmap) < 4+8*(i+1) {
+			return nil, errMalformedFont
+		}
+		record := cmap[4+8*i:]
+		platform, encoding := binary.BigEndian.Uint16(record), binary.BigEndian.Uint16(record[2:])
+		offset := int(binary.BigEndian.Uint32(record[4:]))
+		if offset+2 > len(cmap) {
+			return nil, errMalformedFont
+		}
+		subtable := cmap[offset:]
+		switch format := binary.BigEndian.Uint16(subtable); {
+		case format == 12 && (platform == 3 && encoding == 10 || platform == 0):
+			full = subtable
+		case format == 4 && (platform == 3 && encoding == 1 || platform == 0):
+			bmp = subtable
+		}
+	}
+
+	glyphs := make(map[rune]uint16)
+	add := func(r rune, g uint32) {
+		if g != 0 && int(g) < numGlyphs {
+			glyphs[r] = uint16(g)
+		}
+	}
+	switch {
+	case full != nil:
+		if len(full) < 16 {
+			return nil, errMalformedFont
+		}
+		groups := int(binary.BigEndian.Uint32(full[12:]))
+		if groups > (len(full)-16)/12 {
+			return nil, errMalformedFont
+		}
+		for i := 0; i < groups; i++ {
+			group := full[16+12*i:]
+			start, end := binary.BigEndian.Uint32(group), binary.BigEndian.Uint32(group[4:])
+			first := binary.BigEndian.Uint32(group[8:])
+			if end < start || end > 0x10ffff {
+				return nil, errMalformedFont
+			}
+			for c := start; c <= end; c++ {
+				add(rune(c), first+c-start)
+			}
+		}
+	case bmp != nil:
+		if len(bmp) < 14 {
+			return nil, errMalformedFont
+		}
+		segments := int(binary.BigEndian.Uint16(bmp[6:])) / 2
+		ends, starts := 14, 16+2*segments
+		deltas, ranges := starts+2*segments, starts+4*segments
+		if len(bmp) < ranges+2*segments {
+			return nil, errMalformedFont
+		}
+		for i := 0; i < segments; i++ {
+			end := binary.BigEndian.Uint16(bmp[ends+2*i:])
+			start := binary.BigEndian.Uint16(bmp[starts+2*i:])
+			delta := binary.BigEndian.Uint16(bmp[deltas+2*i:])
+			rangeOffset := int(binary.BigEndian.Uint16(bmp[ranges+2*i:]))
+			for c := uint32(start); c <= uint32(end) && c != 0xffff; c++ {
+				if rangeOffset == 0 {
+					add(rune(c), uint32(uint16(c)+delta))
+					continue
+				}
+				at := ranges + 2*i + rangeOffset + 2*int(c-uint32(start))
+				if at+2 > len(bmp) {
+					return nil, errMalformedFont
+				}
+				if g := binary.BigEndian.Uint16(bmp[at:]); g != 0 {
+					add(rune(c), uint32(g+delta))
+				}
+			}
+		}
+	default:
+		return nil, errMalformedFont
+	}
+	return glyphs, nil
+}
+
+// glyph returns the glyph for r and whether the font has one.
+func (f *trueTypeFont) glyph(r rune) (uint16, bool) {
+	g, ok := f.glyphs[r]
+	return g, ok
+}
+
+// width returns the advance of glyph g in thousandths of an em.
+func (f *trueTypeFont) width(g uint16) int {
+	return int(f.advances[g]) * 1000 / f.unitsPerEm
+}
+
+// glyphData returns the outline of glyph g, which is empty for glyphs
+// such as the space.
+func (f *trueTypeFont) glyphData(g uint16) ([]byte, error) {
+	loca, glyf := f.tables["loca"], f.tables["glyf"]
+	var start, end int
+	i := int(g)
+	if f.longLoca {
+		if len(loca) < 4*(i+2) {
+			return nil, errMalformedFont
+		}
+		start, end = int(binary.BigEndian.Uint32(loca[4*i:])), int(binary.BigEndian.Uint32(loca[4*i+4:]))
+	} else {
+		if len(loca) < 2*(i+2) {
+			return nil, errMalformedFont
+		}
+		start, end = 2*int(binary.BigEndian.Uint16(loca[2*i:])), 2*int(binary.BigEndian.Uint16(loca[2*i+2:]))
+	}
+	if start > end || end > len(glyf) {
+		return nil, errMalformedFont
+	}
+	return glyf[start:end], nil
+}
+
+// componentGlyphs lists the glyphs a composite glyph is built from.
+func componentGlyphs(data []byte) ([]uint16, error) {
+	if len(data) < 10 || int16(binary.BigEndian.Uint16(data)) >= 0 {
+		return nil, nil
+	}
+	var components []uint16
+	for at := 10; ; {
+		if at+4 > len(data) {
+			return nil, errMalformedFont
+		}
+		flags := binary.BigEndian.Uint16(data[at:])
+		components = append(components, binary.BigEndian.Uint16(data[at+2:]))
+		at += 4
+		if flags&0x0001 != 0 {
+			at += 4
+		} else {
+			at += 2
+		}
+		switch {
+		case flags&0x0008 != 0:
+			at += 2
+		case flags&0x0040 != 0:
+			at += 4
+		case flags&0x0080 != 0:
+			at += 8
+		}
+		if flags&0x0020 == 0 {
+			return components, nil
+		}
+	}
+}
+
+// subset returns a font holding only the outlines of the given glyphs and
+// those they are composed of. Glyph numbers are kept, so text set with the
+// full font shows the same with the subset.
+func (f *trueTypeFont) subset(used []uint16) ([]byte, error) {
+	keep := make(map[uint16]bool)
+	pending := append([]uint16{0}, used...)
+	for len(pending) > 0 {
+		g := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if keep[g] || int(g) >= f.numGlyphs {
+			continue
+		}
+		keep[g] = true
+		data, err := f.glyphData(g)
+		if err != nil {
+			return nil, err
+		}
+		components, err := componentGlyphs(data)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, components...)
+	}
+
+	var glyf []byte
+	loca := make([]byte, 4*(f.numGlyphs+1))
+	for g := 0; g < f.numGlyphs; g++ {
+		binary.BigEndian.PutUint32(loca[4*g:], uint32(len(glyf)))
+		if !keep[uint16(g)] {
+			continue
+		}
+		data, err := f.glyphData(uint16(g))
+		if err != nil {
+			return nil, err
+		}
+		glyf = append(glyf, data...)
+		for len(glyf)%4 != 0 {
+			glyf = append(glyf, 0)
+		}
+	}
+	binary.BigEndian.PutUint32(loca[4*f.numGlyphs:], uint32(len(glyf)))
+
+	head := append([]byte(nil), f.tables["head"]...)
+	binary.BigEndian.PutUint32(head[8:], 0)
+	binary.BigEndian.PutUint16(head[50:], 1)
+
+	tables := map[string][]byte{
+		"glyf": glyf,
+		"head": head,
+		"hhea": f.tables["hhea"],
+		"hmtx": f.tables["hmtx"],
+		"loca": loca,
+		"maxp": f.tables["maxp"],
+	}
+	// Hinting programs are kept so the subset renders as the full font does.
+	for _, tag := range []string{"cvt ", "fpgm", "prep"} {
+		if data, ok := f.tables[tag]; ok {
+			tables[tag] = data
+		}
+	}
+	font := writeTrueType(tables)
+
+	// The whole font sums to 0xB1B0AFBA once head holds the adjustment.
+	headAt := tableOffset(font, "head")
+	binary.BigEndian.PutUint32(font[headAt+8:], 0xb1b0afba-checksum(font))
+	return font, nil
+}
+
+// writeTrueType lays tables out as a font file, in tag order with each
+// table 4-byte aligned.
+func writeTrueType(tables map[string][]byte) []byte {
+	tags := make([]string, 0, len(tables))
+	for tag := range tables {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	n := len(tags)
+	searchRange, selector := 1, 0
+	for searchRange*2 <= n {
+		searchRange *= 2
+		selector++
+	}
+	font := make([]byte, 12+16*n)
+	binary.BigEndian.PutUint32(font, 0x00010000)
+	binary.BigEndian.PutUint16(font[4:], uint16(n))
+	binary.BigEndian.PutUint16(font[6:], uint16(searchRange*16))
+	binary.BigEndian.PutUint16(font[8:], uint16(selector))
+	binary.BigEndian.PutUint16(font[10:], uint16((n-searchRange)*16))
+
+	for i, tag := range tags {
+		data := tables[tag]
+		record := font[12+16*i:]
+		copy(record, tag)
+		binary.BigEndian.PutUint32(record[4:], checksum(data))
+		binary.BigEndian.PutUint32(record[8:], uint32(len(font)))
+		binary.BigEndian.PutUint32(record[12:], uint32(len(data)))
+		font = append(font, data...)
+		for len(font)%4 != 0 {
+			font = append(font, 0)
+		}
+	}
+	return font
+}
+
+func tableOffset(font []byte, tag string) int {
+	n := int(binary.BigEndian.Uint16(font[4:]))
+	for i := 0; i < n; i++ {
+		record := font[12+16*i:]
+		if string(record[:4]) == tag {
+			return int(binary.BigEndian.Uint32(record[8:]))
+		}
+	}
+	return -1
+}
+
+// checksum sums data as big-endian 32-bit words, zero-padding the last.
+func checksum(data []byte) uint32 {
+	var sum uint32
+	for i := 0; i < len(data); i += 4 {
+		var word [4]byte
+		copy(word[:], data[i:])
+		sum += binary.BigEndian.Uint32(word[:])
+	}
+	return sum
+}
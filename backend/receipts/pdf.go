@@ -0,0 +1,273 @@
+package receipts
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// Page size in points (A4).
+const (
+	pageWidth  = 595.0
+	pageHeight = 842.0
+)
+
+// document is a single-page PDF built from text and rules. Text is set in
+// the standard Helvetica fonts, which every viewer ships, where
+// WinAnsiEncoding can spell it; other text uses the embedded Unicode fonts,
+// of which only the glyphs used are included.
+type document struct {
+	content bytes.Buffer
+	// glyphs records, per embedded font (regular, bold), the characters
+	// drawn by glyph number.
+	glyphs [2]map[uint16]rune
+}
+
+func (d *document) text(x, y, size float64, bold bool, s string) {
+	if font := unicodeFont(bold); !isWinAnsi(s) && font != nil {
+		fmt.Fprintf(&d.content, "BT /%s %.1f Tf %.2f %.2f Td <%s> Tj ET\n", unicodeFontName(bold), size, x, y, d.glyphString(font, bold, s))
+		return
+	}
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(&d.content, "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, y, escapeText(s))
+}
+
+// textRight draws s ending at x. Helvetica text uses an approximate advance
+// width, good enough for right-aligning short figures.
+func (d *document) textRight(x, y, size float64, bold bool, s string) {
+	width := textWidth(s, size, bold)
+	if font := unicodeFont(bold); !isWinAnsi(s) && font != nil {
+		width = 0
+		for _, r := range s {
+			width += float64(font.width(fontGlyph(font, r))) * size / 1000
+		}
+	}
+	d.text(x-width, y, size, bold, s)
+}
+
+func unicodeFontName(bold bool) string {
+	if bold {
+		return "U2"
+	}
+	return "U1"
+}
+
+// fontGlyph returns the glyph for r, or for "?" if the font lacks it.
+func fontGlyph(font *trueTypeFont, r rune) uint16 {
+	if g, ok := font.glyph(r); ok {
+		return g
+	}
+	g, _ := font.glyph('?')
+	return g
+}
+
+// glyphString encodes s as the hex glyph numbers of an Identity-H font,
+// noting the glyphs used.
+func (d *document) glyphString(font *trueTypeFont, bold bool, s string) string {
+	i := 0
+	if bold {
+		i = 1
+	}
+	if d.glyphs[i] == nil {
+		d.glyphs[i] = make(map[uint16]rune)
+	}
+	var b strings.Builder
+	for _, r := range s {
+		g, ok := font.glyph(r)
+		if !ok {
+			r = '?'
+			g = fontGlyph(font, r)
+		}
+		d.glyphs[i][g] = r
+		fmt.Fprintf(&b, "%04X", g)
+	}
+	return b.String()
+}
+
+func (d *document) rule(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(&d.content, "%.2f w %.2f %.2f m %.2f %.2f l S\n", 0.5, x1, y1, x2, y2)
+}
+
+// bytes serializes the document, computing the cross-reference table from
+// the actual object offsets.
+func (d *document) bytes() []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", d.content.Len(), d.content.String()),
+	}
+	fonts := "/F1 4 0 R /F2 5 0 R"
+	for i, glyphs := range d.glyphs {
+		if len(glyphs) == 0 {
+			continue
+		}
+		bold := i == 1
+		fontObjects, err := embedFont(unicodeFont(bold), glyphs, len(objects)+1)
+		if err != nil {
+			// The glyphs were drawn with this font; without it the
+			// viewer shows blanks, which is the best left to do.
+			continue
+		}
+		fonts += fmt.Sprintf(" /%s %d 0 R", unicodeFontName(bold), len(objects)+1)
+		objects = append(objects, fontObjects...)
+	}
+	objects[2] = fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << %s >> >> /Contents 6 0 R >>", pageWidth, pageHeight, fonts)
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
+
+// embedFont returns the PDF objects of a Type 0 font holding the given
+// glyphs of font, numbered from first: the font, its descendant, the
+// descriptor, the subset font file, and a map back to Unicode so the text
+// can be copied and searched.
+func embedFont(font *trueTypeFont, glyphs map[uint16]rune, first int) ([]string, error) {
+	used := make([]uint16, 0, len(glyphs))
+	for g := range glyphs {
+		used = append(used, g)
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i] < used[j] })
+
+	file, err := font.subset(used)
+	if err != nil {
+		return nil, err
+	}
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(file)
+	zw.Close()
+
+	// Subsets are named with a tag derived from their glyphs, so the same
+	// receipt always renders to the same bytes.
+	h := fnv.New32a()
+	for _, g := range used {
+		h.Write([]byte{byte(g >> 8), byte(g)})
+	}
+	tag := make([]byte, 6)
+	for i, v := 0, h.Sum32(); i < len(tag); i, v = i+1, v/26 {
+		tag[i] = byte('A' + v%26)
+	}
+	name := string(tag) + "+" + font.name
+
+	var widths, toUnicode strings.Builder
+	for _, g := range used {
+		fmt.Fprintf(&widths, "%d [%d] ", g, font.width(g))
+	}
+	toUnicode.WriteString("/CIDInit /ProcSet findresource begin\n12 dict begin\nbegincmap\n" +
+		"/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def\n" +
+		"/CMapName /Adobe-Identity-UCS def\n/CMapType 2 def\n" +
+		"1 begincodespacerange\n<0000> <FFFF>\nendcodespacerange\n")
+	for start := 0; start < len(used); start += 100 {
+		chunk := used[start:min(start+100, len(used))]
+		fmt.Fprintf(&toUnicode, "%d beginbfchar\n", len(chunk))
+		for _, g := range chunk {
+			fmt.Fprintf(&toUnicode, "<%04X> <", g)
+			for _, unit := range utf16.Encode([]rune{glyphs[g]}) {
+				fmt.Fprintf(&toUnicode, "%04X", unit)
+			}
+			toUnicode.WriteString(">\n")
+		}
+		toUnicode.WriteString("endbfchar\n")
+	}
+	toUnicode.WriteString("endcmap\nCMapName currentdict /CMap defineresource pop\nend\nend")
+
+	scale := func(v int16) int { return int(v) * 1000 / font.unitsPerEm }
+	return []string{
+		fmt.Sprintf("<< /Type /Font /Subtype /Type0 /BaseFont /%s /Encoding /Identity-H /DescendantFonts [%d 0 R] /ToUnicode %d 0 R >>",
+			name, first+1, first+4),
+		fmt.Sprintf("<< /Type /Font /Subtype /CIDFontType2 /BaseFont /%s /CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >> /FontDescriptor %d 0 R /W [%s] /CIDToGIDMap /Identity >>",
+			name, first+2, strings.TrimSpace(widths.String())),
+		fmt.Sprintf("<< /Type /FontDescriptor /FontName /%s /Flags 32 /FontBBox [%d %d %d %d] /ItalicAngle 0 /Ascent %d /Descent %d /CapHeight %d /StemV 80 /FontFile2 %d 0 R >>",
+			name, scale(font.bbox[0]), scale(font.bbox[1]), scale(font.bbox[2]), scale(font.bbox[3]),
+			scale(font.ascent), scale(font.descent), scale(font.ascent), first+3),
+		fmt.Sprintf("<< /Length %d /Length1 %d /Filter /FlateDecode >>\nstream\n%s\nendstream", compressed.Len(), len(file), compressed.String()),
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", toUnicode.Len(), toUnicode.String()),
+	}, nil
+}
+
+// winAnsiExtras are the WinAnsiEncoding codes between 0x80 and 0x9f, which
+// do not follow Latin-1.
+var winAnsiExtras = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87,
+	'ˆ': 0x88, '‰': 0x89, 'Š': 0x8a, '‹': 0x8b, 'Œ': 0x8c, 'Ž': 0x8e, '‘': 0x91,
+	'’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '˜': 0x98,
+	'™': 0x99, 'š': 0x9a, '›': 0x9b, 'œ': 0x9c, 'ž': 0x9e, 'Ÿ': 0x9f,
+}
+
+// isWinAnsi reports whether every character of s can be set in the
+// standard fonts.
+func isWinAnsi(s string) bool {
+	for _, r := range s {
+		if _, ok := winAnsiExtras[r]; !(r >= 0x20 && r < 0x7f || r >= 0xa0 && r <= 0xff || ok) {
+			return false
+		}
+	}
+	return true
+}
+
+// escapeText encodes s for a PDF string in WinAnsiEncoding. Characters it
+// cannot spell are replaced with "?"; text containing them is normally set
+// in the embedded fonts instead.
+func escapeText(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch code, extra := winAnsiExtras[r]; {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		case extra:
+			fmt.Fprintf(&b, "\\%03o", code)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// textWidth estimates the width of s in points. Helvetica digits are 0.556
+// em wide; other characters are averaged.
+func textWidth(s string, size float64, bold bool) float64 {
+	var em float64
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9', r == '$', r == '?':
+			em += 0.556
+		case r == '.' || r == ',' || r == ' ':
+			em += 0.278
+		case r >= 'A' && r <= 'Z':
+			em += 0.667
+		default:
+			em += 0.5
+		}
+	}
+	if bold {
+		em *= 1.05
+	}
+	return em * size
+}
@@ -0,0 +1,199 @@
+package receipts
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEscapeText(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "Doro wat", "Doro wat"},
+		{"parentheses", "Stew (spicy)", `Stew \(spicy\)`},
+		{"backslash", `a\b`, `a\\b`},
+		{"latin-1", "Crème brûlée", `Cr\350me br\373l\351e`},
+		{"winansi extras", "€5 – “best”", `\2005 \226 \223best\224`},
+		{"control characters", "a\tb\n", "a?b?"},
+		{"outside winansi", "Борщ", "????"},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := escapeText(tt.in); got != tt.want {
+				t.Errorf("escapeText(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsWinAnsi(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"Injera", true},
+		{"Crème brûlée", true},
+		{"€ – ™", true},
+		{"Борщ", false},
+		{"Ελληνικά", false},
+		{"ዶሮ ወጥ", false},
+		{"tab\there", false},
+		{"", true},
+	}
+	for _, tt := range tests {
+		if got := isWinAnsi(tt.in); got != tt.want {
+			t.Errorf("isWinAnsi(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func testReceipt(title, buyer string) Receipt {
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	return Receipt{
+		InvoiceNumber: "INV-000042",
+		IssuedAt:      at,
+		Issuer:        "Dishcovery",
+		BuyerName:     buyer,
+		BuyerEmail:    "buyer@example.com",
+		RecipeTitle:   title,
+		AuthorName:    "author",
+		Amount:        115,
+		Currency:      "ETB",
+		VATLabel:      "VAT",
+		VATRate:       15,
+		VATAmount:     VATIncluded(115, 15),
+		TxRef:         "tx-1",
+		PurchaseDate:  at,
+	}
+}
+
+// checkXref verifies that every cross-reference entry points at the object
+// it numbers.
+func checkXref(t *testing.T, pdf []byte) {
+	t.Helper()
+	m := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(pdf)
+	if m == nil {
+		t.Fatal("missing startxref trailer")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	lines := strings.Split(string(pdf[xref:]), "\n")
+	count, _ := strconv.Atoi(strings.Fields(lines[1])[1])
+	for i := 1; i < count; i++ {
+		offset, _ := strconv.Atoi(strings.Fields(lines[2+i])[0])
+		if want := strconv.Itoa(i) + " 0 obj\n"; !bytes.HasPrefix(pdf[offset:], []byte(want)) {
+			t.Errorf("xref entry %d points at %q", i, pdf[offset:offset+10])
+		}
+	}
+}
+
+func TestRenderLatinUsesStandardFonts(t *testing.T) {
+	pdf := Render(testReceipt("Crème brûlée", "Abebe"))
+	checkXref(t, pdf)
+	if bytes.Contains(pdf, []byte("/FontFile2")) {
+		t.Error("Latin-1 receipt embeds a font")
+	}
+	if !bytes.Equal(pdf, Render(testReceipt("Crème brûlée", "Abebe"))) {
+		t.Error("rendering is not deterministic")
+	}
+}
+
+func TestRenderEmbedsUnicodeFont(t *testing.T) {
+	receipt := testReceipt("Борщ", "Αλέξης")
+	receipt.Issuer = "Кухня" // set in bold
+	pdf := Render(receipt)
+	checkXref(t, pdf)
+	for _, want := range []string{"/U1 ", "/U2 ", "/FontFile2", "/CIDToGIDMap /Identity", "/ToUnicode"} {
+		if !bytes.Contains(pdf, []byte(want)) {
+			t.Errorf("PDF lacks %s", want)
+		}
+	}
+	// The title is drawn as glyphs, with a map back to its characters.
+	if !bytes.Contains(pdf, []byte("<0411>")) {
+		t.Error("ToUnicode map lacks Б")
+	}
+	if !bytes.Equal(pdf, Render(receipt)) {
+		t.Error("rendering is not deterministic")
+	}
+}
+
+func TestSubsetKeepsUsedGlyphs(t *testing.T) {
+	font := unicodeFont(false)
+	if font == nil {
+		t.Fatal("embedded font did not parse")
+	}
+	used := []uint16{fontGlyph(font, 'Б'), fontGlyph(font, 'é'), fontGlyph(font, ' ')}
+	dropped := fontGlyph(font, 'Ж')
+
+	data, err := font.subset(used)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) >= len(dejaVuSans)/2 {
+		t.Errorf("subset is %d bytes, full font %d", len(data), len(dejaVuSans))
+	}
+	if sum := checksum(data); sum != 0xb1b0afba {
+		t.Errorf("font checksum = %#x, want 0xb1b0afba", sum)
+	}
+
+	// Read the subset's outlines through the full font's other tables.
+	full := *font
+	full.tables = make(map[string][]byte)
+	for tag, table := range font.tables {
+		full.tables[tag] = table
+	}
+	full.tables["loca"], full.tables["glyf"] = subsetTable(t, data, "loca"), subsetTable(t, data, "glyf")
+	full.longLoca = true
+	for _, g := range used[:2] {
+		if outline, err := full.glyphData(g); err != nil || len(outline) == 0 {
+			t.Errorf("glyph %d missing from subset: %v", g, err)
+		}
+	}
+	if outline, _ := full.glyphData(dropped); len(outline) != 0 {
+		t.Errorf("unused glyph %d kept in subset", dropped)
+	}
+}
+
+func subsetTable(t *testing.T, font []byte, tag string) []byte {
+	t.Helper()
+	at := tableOffset(font, tag)
+	if at < 0 {
+		t.Fatalf("subset lacks %s", tag)
+	}
+	n := int(font[4])<<8 | int(font[5])
+	for i := 0; i < n; i++ {
+		record := font[12+16*i:]
+		if string(record[:4]) == tag {
+			length := int(record[12])<<24 | int(record[13])<<16 | int(record[14])<<8 | int(record[15])
+			return font[at : at+length]
+		}
+	}
+	return nil
+}
+
+func TestParseTrueTypeMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short header", []byte{0, 1, 0, 0}},
+		{"wrong version", append([]byte("OTTO"), make([]byte, 8)...)},
+		{"truncated directory", []byte{0, 1, 0, 0, 0, 9, 0, 0, 0, 0, 0, 0}},
+		{"truncated font", dejaVuSans[:len(dejaVuSans)/2]},
+		{"no tables", []byte{0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseTrueType("bad", tt.data); err == nil {
+				t.Error("malformed font parsed")
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+// Package receipts renders purchase receipts as PDF documents.
+package receipts
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Receipt holds everything printed on a receipt. Amount is what the buyer
+// paid, tax included; VATRate is a percentage and zero leaves the VAT line
+// out.
+type Receipt struct {
+	InvoiceNumber string
+	IssuedAt      time.Time
+	Issuer        string
+	IssuerTaxID   string
+
+	BuyerName   string
+	BuyerEmail  string
+	RecipeTitle string
+	AuthorName  string
+
+	Amount       float64
+	Currency     string
+	VATLabel     string
+	VATRate      float64
+	VATAmount    float64
+	TxRef        string
+	PurchaseDate time.Time
+}
+
+// VATIncluded returns the tax contained in a tax-inclusive amount.
+func VATIncluded(amount, rate float64) float64 {
+	if rate <= 0 {
+		return 0
+	}
+	return round2(amount * rate / (100 + rate))
+}
+
+func round2(x float64) float64 {
+	v, _ := strconv.ParseFloat(strconv.FormatFloat(x, 'f', 2, 64), 64)
+	return v
+}
+
+func money(amount float64, currency string) string {
+	return fmt.Sprintf("%s %s", strconv.FormatFloat(amount, 'f', 2, 64), currency)
+}
+
+// Render lays the receipt out on a single A4 page. The output depends only
+// on r, so a stored receipt can always be reproduced.
+func Render(r Receipt) []byte {
+	var d document
+	const left, right = 56.0, pageWidth - 56.0
+	y := pageHeight - 72.0
+
+	d.text(left, y, 20, true, r.Issuer)
+	d.textRight(right, y, 20, true, "RECEIPT")
+	y -= 18
+	if r.IssuerTaxID != "" {
+		d.text(left, y, 9, false, "Tax ID: "+r.IssuerTaxID)
+	}
+	y -= 30
+
+	field := func(label, value string) {
+		d.text(left, y, 10, true, label)
+		d.text(left+120, y, 10, false, value)
+		y -= 16
+	}
+	field("Invoice number", r.InvoiceNumber)
+	field("Issued", r.IssuedAt.UTC().Format("2 January 2006 15:04 MST"))
+	field("Purchase date", r.PurchaseDate.UTC().Format("2 January 2006 15:04 MST"))
+	field("Transaction", r.TxRef)
+	y -= 10
+	buyer := r.BuyerName
+	if r.BuyerEmail != "" {
+		buyer = fmt.Sprintf("%s <%s>", r.BuyerName, r.BuyerEmail)
+	}
+	field("Billed to", buyer)
+	y -= 20
+
+	d.text(left, y, 10, true, "Item")
+	d.textRight(right, y, 10, true, "Amount")
+	y -= 6
+	d.rule(left, y, right, y)
+	y -= 16
+	d.text(left, y, 10, false, "Recipe: "+r.RecipeTitle)
+	d.textRight(right, y, 10, false, money(r.Amount, r.Currency))
+	y -= 14
+	d.text(left, y, 9, false, "by "+r.AuthorName)
+	y -= 10
+	d.rule(left, y, right, y)
+	y -= 18
+
+	if r.VATRate > 0 {
+		label := r.VATLabel
+		if label == "" {
+			label = "VAT"
+		}
+		rate := strconv.FormatFloat(r.VATRate, 'f', -1, 64)
+		d.text(left+300, y, 10, false, fmt.Sprintf("%s (%s%%, included)", label, rate))
+		d.textRight(right, y, 10, false, money(r.VATAmount, r.Currency))
+		y -= 16
+	}
+	d.text(left+300, y, 11, true, "Total paid")
+	d.textRight(right, y, 11, true, money(r.Amount, r.Currency))
+
+	d.text(left, 56, 8, false, "Thank you for supporting our recipe authors.")
+
+	return d.bytes()
+}
@@ -0,0 +1,421 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudinary/cloudinary-go/v2"
+	"github.com/cloudinary/cloudinary-go/v2/api"
+	"github.com/cloudinary/cloudinary-go/v2/api/admin"
+	"github.com/cloudinary/cloudinary-go/v2/api/uploader"
+)
+
+type cloudinaryResponse struct {
+	SecureURL string `json:"secure_url"`
+	PublicID  string `json:"public_id"`
+	Bytes     int64  `json:"bytes"`
+	Format    string `json:"format"`
+	Error     struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// CloudinaryStore keeps files as Cloudinary image assets, or video assets
+// for keys with a video extension. A key's extension is dropped to form the
+// public ID, since Cloudinary tracks the format separately.
+type CloudinaryStore struct {
+	cloudName string
+	apiKey    string
+	apiSecret string
+	cld       *cloudinary.Cloudinary
+}
+
+func NewCloudinaryStore(cloudName, apiKey, apiSecret string) (*CloudinaryStore, error) {
+	if cloudName == "" || apiKey == "" || apiSecret == "" {
+		return nil, fmt.Errorf("missing Cloudinary credentials")
+	}
+	cld, err := cloudinary.NewFromParams(cloudName, apiKey, apiSecret)
+	if err != nil {
+		return nil, err
+	}
+	return &CloudinaryStore{cloudName: cloudName, apiKey: apiKey, apiSecret: apiSecret, cld: cld}, nil
+}
+
+func (s *CloudinaryStore) Name() string {
+	return "cloudinary"
+}
+
+func publicID(key string) string {
+	return strings.TrimSuffix(key, path.Ext(key))
+}
+
+// resourceType is the Cloudinary resource type key is stored as.
+func resourceType(key string) string {
+	switch strings.ToLower(path.Ext(key)) {
+	case ".mp4", ".webm":
+		return "video"
+	}
+	return "image"
+}
+
+// deliveryType is how Cloudinary delivers key. Staged direct uploads are
+// authenticated assets, which are only served through signed URLs.
+func deliveryType(key string) string {
+	if strings.HasPrefix(key, StagingPrefix) {
+		return api.Authenticated
+	}
+	return string(api.Upload)
+}
+
+// cloudinarySignatureTTL is how long Cloudinary accepts an upload
+// signature; it cannot be shortened.
+const cloudinarySignatureTTL = time.Hour
+
+// signParams signs upload parameters, which must be given in alphabetical
+// order.
+func (s *CloudinaryStore) signParams(params [][2]string) string {
+	var payload string
+	for i, p := range params {
+		if i > 0 {
+			payload += "&"
+		}
+		payload += p[0] + "=" + p[1]
+	}
+	sum := sha1.Sum([]byte(payload + s.apiSecret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Put streams body to Cloudinary as a signed upload. The multipart request
+// body is written through a pipe while the request is being sent, so the
+// file is never held in memory; an error from reading body aborts the
+// upload.
+func (s *CloudinaryStore) Put(ctx context.Context, key string, body io.Reader, contentType string) (*Object, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	url := "https://api.cloudinary.com/v1_1/" + s.cloudName + "/" + resourceType(key) + "/upload"
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	params := [][2]string{{"public_id", publicID(key)}, {"timestamp", timestamp}}
+	signature := s.signParams(params)
+
+	form, pipe := io.Pipe()
+	writer := multipart.NewWriter(pipe)
+	go func() {
+		pipe.CloseWithError(func() error {
+			for _, p := range params {
+				if err := writer.WriteField(p[0], p[1]); err != nil {
+					return err
+				}
+			}
+			if err := writer.WriteField("api_key", s.apiKey); err != nil {
+				return err
+			}
+			if err := writer.WriteField("signature", signature); err != nil {
+				return err
+			}
+			part, err := writer.CreateFormFile("file", path.Base(key))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(part, body); err != nil {
+				return err
+			}
+			return writer.Close()
+		}())
+	}()
+	// Unblock the writer if the request fails before the body is consumed.
+	defer form.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, form)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var cloudResp cloudinaryResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&cloudResp); err != nil {
+		return nil, fmt.Errorf("error parsing response (status %d): %v", resp.StatusCode, err)
+	}
+	if cloudResp.Error.Message != "" {
+		log.Printf("Cloudinary upload rejected with status %d: %s", resp.StatusCode, cloudResp.Error.Message)
+		return nil, fmt.Errorf("cloudinary error: %s", cloudResp.Error.Message)
+	}
+	if cloudResp.SecureURL == "" {
+		return nil, fmt.Errorf("no secure URL in response")
+	}
+
+	return &Object{
+		Key:          cloudResp.PublicID + "." + cloudResp.Format,
+		URL:          cloudResp.SecureURL,
+		Size:         cloudResp.Bytes,
+		ContentType:  contentType,
+		LastModified: time.Now().UTC(),
+	}, nil
+}
+
+func (s *CloudinaryStore) Delete(ctx context.Context, key string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	result, err := s.cld.Upload.Destroy(ctx, uploader.DestroyParams{PublicID: publicID(key), Type: deliveryType(key), ResourceType: resourceType(key)})
+	if err != nil {
+		return err
+	}
+	if result.Error.Message != "" {
+		return fmt.Errorf("cloudinary error: %s", result.Error.Message)
+	}
+	if result.Result != "ok" && result.Result != "not found" {
+		return fmt.Errorf("cloudinary destroy returned %q", result.Result)
+	}
+	return nil
+}
+
+func (s *CloudinaryStore) URL(key string) string {
+	return "https://res.cloudinary.com/" + s.cloudName + "/" + resourceType(key) + "/upload/" + key
+}
+
+// VariantURL uses Cloudinary's limited fill and limit crops, which keep the
+// aspect ratio and never enlarge, and lets it pick the delivery format.
+func (s *CloudinaryStore) VariantURL(key string, width, height int, crop bool) string {
+	transformation := fmt.Sprintf("c_limit,w_%d,h_%d,f_auto,q_auto", width, height)
+	if crop {
+		transformation = fmt.Sprintf("c_lfill,g_auto,w_%d,h_%d,f_auto,q_auto", width, height)
+	}
+	return "https://res.cloudinary.com/" + s.cloudName + "/image/upload/" + transformation + "/" + key
+}
+
+func (s *CloudinaryStore) PlaceholderURL(key string) string {
+	return "https://res.cloudinary.com/" + s.cloudName + "/image/upload/w_32,e_blur:1000,q_auto:low,f_auto/" + key
+}
+
+// PosterURL takes the first frame of the video as a JPEG.
+func (s *CloudinaryStore) PosterURL(key string) string {
+	return "https://res.cloudinary.com/" + s.cloudName + "/video/upload/so_0/" + publicID(key) + ".jpg"
+}
+
+// StreamURL serves an HLS playlist in the renditions of Cloudinary's
+// automatic streaming profile.
+func (s *CloudinaryStore) StreamURL(key string) string {
+	return "https://res.cloudinary.com/" + s.cloudName + "/video/upload/sp_auto/" + publicID(key) + ".m3u8"
+}
+
+// SignedURL returns a delivery URL carrying Cloudinary's URL signature.
+// Uploaded assets are public, so the signature does not expire; expiring
+// links need Cloudinary's token-based authentication, which is not enabled.
+func (s *CloudinaryStore) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	asset, err := s.cld.Image(key)
+	if resourceType(key) == "video" {
+		asset, err = s.cld.Video(key)
+	}
+	if err != nil {
+		return "", err
+	}
+	asset.Config.URL.Secure = true
+	asset.Config.URL.SignURL = true
+	return asset.String()
+}
+
+func (s *CloudinaryStore) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	params := admin.AssetsParams{DeliveryType: deliveryType(prefix), Prefix: prefix, MaxResults: 500}
+	for {
+		result, err := s.cld.Admin.Assets(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		if result.Error.Message != "" {
+			return nil, fmt.Errorf("cloudinary error: %s", result.Error.Message)
+		}
+		for _, asset := range result.Assets {
+			key := asset.PublicID + "." + asset.Format
+			objects = append(objects, Object{
+				Key:          key,
+				URL:          asset.SecureURL,
+				Size:         int64(asset.Bytes),
+				ContentType:  mimeType(key),
+				LastModified: asset.CreatedAt,
+			})
+		}
+		if result.NextCursor == "" {
+			return objects, nil
+		}
+		params.NextCursor = result.NextCursor
+	}
+}
+
+// PresignUpload signs upload parameters restricted to key and to the format
+// of policy.ContentType, and to authenticated delivery for staged keys.
+// Cloudinary has no upload parameter limiting size, so policy.MaxBytes has
+// to be checked once the upload completes.
+func (s *CloudinaryStore) PresignUpload(key string, policy UploadPolicy) (*PresignedUpload, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	format := strings.TrimPrefix(path.Ext(key), ".")
+	now := time.Now()
+	params := [][2]string{
+		{"allowed_formats", format},
+		{"public_id", publicID(key)},
+		{"timestamp", strconv.FormatInt(now.Unix(), 10)},
+		{"type", deliveryType(key)},
+	}
+	fields := map[string]string{
+		"api_key":   s.apiKey,
+		"signature": s.signParams(params),
+	}
+	for _, p := range params {
+		fields[p[0]] = p[1]
+	}
+	return &PresignedUpload{
+		Key:       key,
+		URL:       "https://api.cloudinary.com/v1_1/" + s.cloudName + "/image/upload",
+		Fields:    fields,
+		FileField: "file",
+		ExpiresAt: now.Add(cloudinarySignatureTTL).UTC(),
+	}, nil
+}
+
+func (s *CloudinaryStore) Stat(ctx context.Context, key string) (*Object, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.cld.Admin.Asset(ctx, admin.AssetParams{PublicID: publicID(key), DeliveryType: api.DeliveryType(deliveryType(key))})
+	if err != nil {
+		return nil, err
+	}
+	if result.Error.Message != "" {
+		if strings.Contains(strings.ToLower(result.Error.Message), "not found") {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("cloudinary error: %s", result.Error.Message)
+	}
+	key = result.PublicID + "." + result.Format
+	return &Object{
+		Key:          key,
+		URL:          result.SecureURL,
+		Size:         int64(result.Bytes),
+		ContentType:  mimeType(key),
+		LastModified: result.CreatedAt,
+	}, nil
+}
+
+func (s *CloudinaryStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.open(ctx, key, nil)
+}
+
+func (s *CloudinaryStore) OpenRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	body, err := s.open(ctx, key, header)
+	if err != nil {
+		return nil, err
+	}
+	// The CDN may ignore the range and answer with the whole file.
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(body, length), body}, nil
+}
+
+// open fetches key from its delivery URL, signing the URL of staged
+// assets.
+func (s *CloudinaryStore) open(ctx context.Context, key string, header http.Header) (io.ReadCloser, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	url := s.URL(key)
+	if deliveryType(key) == api.Authenticated {
+		asset, err := s.cld.Image(key)
+		if err != nil {
+			return nil, err
+		}
+		asset.DeliveryType = api.Authenticated
+		asset.Config.URL.Secure = true
+		asset.Config.URL.SignURL = true
+		if url, err = asset.String(); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("cloudinary delivery returned status %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// Promote renames the staged asset to dst and turns it into a public
+// upload. Cloudinary keeps the asset's own format, so contentType is
+// only reported back.
+func (s *CloudinaryStore) Promote(ctx context.Context, src, dst, contentType string) (*Object, error) {
+	src, err := cleanKey(src)
+	if err != nil {
+		return nil, err
+	}
+	dst, err = cleanKey(dst)
+	if err != nil {
+		return nil, err
+	}
+	overwrite := true
+	result, err := s.cld.Upload.Rename(ctx, uploader.RenameParams{
+		FromPublicID: publicID(src),
+		ToPublicID:   publicID(dst),
+		Type:         deliveryType(src),
+		ToType:       deliveryType(dst),
+		ResourceType: resourceType(src),
+		Overwrite:    &overwrite,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Error != nil {
+		return nil, fmt.Errorf("cloudinary error: %v", result.Error)
+	}
+	return &Object{
+		Key:          result.PublicID + "." + result.Format,
+		URL:          result.SecureURL,
+		Size:         int64(result.Bytes),
+		ContentType:  contentType,
+		LastModified: time.Now().UTC(),
+	}, nil
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCloudinaryKeys(t *testing.T) {
+	tests := []struct {
+		key          string
+		publicID     string
+		resourceType string
+		deliveryType string
+	}{
+		{"Images/u1/photo.jpg", "Images/u1/photo", "image", "upload"},
+		{"RecipeVideos/u1/clip.MP4", "RecipeVideos/u1/clip", "video", "upload"},
+		{"Incoming/u1/photo.webp", "Incoming/u1/photo", "image", "authenticated"},
+		{"Incoming/u1/clip.webm", "Incoming/u1/clip", "video", "authenticated"},
+	}
+	for _, tt := range tests {
+		if got := publicID(tt.key); got != tt.publicID {
+			t.Errorf("publicID(%q) = %q, want %q", tt.key, got, tt.publicID)
+		}
+		if got := resourceType(tt.key); got != tt.resourceType {
+			t.Errorf("resourceType(%q) = %q, want %q", tt.key, got, tt.resourceType)
+		}
+		if got := deliveryType(tt.key); got != tt.deliveryType {
+			t.Errorf("deliveryType(%q) = %q, want %q", tt.key, got, tt.deliveryType)
+		}
+	}
+}
+
+func TestCloudinaryPresignUpload(t *testing.T) {
+	s, err := NewCloudinaryStore("demo", "key", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload, err := s.PresignUpload("Incoming/u1/photo.jpg", UploadPolicy{ContentType: "image/jpeg", MaxBytes: 1 << 20, Expiry: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := upload.Fields
+	if fields["type"] != "authenticated" || fields["public_id"] != "Incoming/u1/photo" || fields["allowed_formats"] != "jpg" {
+		t.Errorf("fields = %v, want an authenticated jpg upload to Incoming/u1/photo", fields)
+	}
+	params := [][2]string{
+		{"allowed_formats", "jpg"},
+		{"public_id", "Incoming/u1/photo"},
+		{"timestamp", fields["timestamp"]},
+		{"type", "authenticated"},
+	}
+	if got, want := fields["signature"], s.signParams(params); got != want {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+}
+
+func TestCloudinarySignParams(t *testing.T) {
+	// https://cloudinary.com/documentation/authentication_signatures
+	s := &CloudinaryStore{apiSecret: "abcd"}
+	params := [][2]string{
+		{"eager", "w_400,h_300,c_pad|w_260,h_200,c_crop"},
+		{"public_id", "sample_image"},
+		{"timestamp", "1315060510"},
+	}
+	if got, want := s.signParams(params), "bfd09f95f331f558cbd1320e67aa8d488770583e"; got != want {
+		t.Errorf("signParams() = %s, want %s", got, want)
+	}
+}
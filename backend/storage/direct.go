@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// StagingPrefix is where direct uploads land until the server has checked
+// them. Stores keep keys under it off their public delivery: Cloudinary
+// stores them as authenticated assets and S3 writes them with a private
+// ACL, so the bucket policy must not grant public reads on this prefix.
+const StagingPrefix = "Incoming/"
+
+// UploadPolicy constrains a direct upload.
+type UploadPolicy struct {
+	ContentType string
+	MaxBytes    int64
+	Expiry      time.Duration
+}
+
+// PresignedUpload is what a browser needs to upload one file straight to
+// the store: a multipart/form-data POST to URL with Fields, followed by the
+// file in a part named FileField.
+type PresignedUpload struct {
+	Key       string            `json:"key"`
+	URL       string            `json:"url"`
+	Fields    map[string]string `json:"fields"`
+	FileField string            `json:"fileField"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+}
+
+// DirectUploader is implemented by stores browsers can upload to directly
+// with presigned parameters, so file bytes do not pass through the server.
+type DirectUploader interface {
+	// PresignUpload authorizes a single upload to key under policy.
+	PresignUpload(key string, policy UploadPolicy) (*PresignedUpload, error)
+	// Stat describes key, or returns ErrNotFound.
+	Stat(ctx context.Context, key string) (*Object, error)
+	// Open reads the contents of key.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// OpenRange reads at most length bytes of key starting at offset, so
+	// a file can be identified from its header without fetching it whole.
+	OpenRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	// Promote moves the staged object at src to dst within the store,
+	// without its bytes passing through the server, and serves it as
+	// contentType.
+	Promote(ctx context.Context, src, dst, contentType string) (*Object, error)
+}
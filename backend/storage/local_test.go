@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalStoreServeHTTP(t *testing.T) {
+	s, err := NewLocalStore(t.TempDir(), "http://localhost:8080", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"RecipeImages/u1/a.jpg", "Incoming/u1/b.jpg"} {
+		if _, err := s.Put(t.Context(), key, strings.NewReader("data"), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	signed := func(key string, expiry time.Duration) string {
+		u, err := s.SignedURL(t.Context(), key, expiry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimPrefix(u, "http://localhost:8080")
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"public", "/files/RecipeImages/u1/a.jpg", http.StatusOK},
+		{"public signed", signed("RecipeImages/u1/a.jpg", time.Minute), http.StatusOK},
+		{"public expired", signed("RecipeImages/u1/a.jpg", -time.Minute), http.StatusForbidden},
+		{"staged unsigned", "/files/Incoming/u1/b.jpg", http.StatusForbidden},
+		{"staged through a dot segment", "/files/RecipeImages/../Incoming/u1/b.jpg", http.StatusForbidden},
+		{"staged signed", signed("Incoming/u1/b.jpg", time.Minute), http.StatusOK},
+		{"staged expired", signed("Incoming/u1/b.jpg", -time.Minute), http.StatusForbidden},
+		{"staged tampered", strings.Replace(signed("Incoming/u1/b.jpg", time.Minute), "signature=", "signature=0", 1), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxPresignExpiry is the longest validity S3 accepts for a presigned URL.
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+// S3Options configures an S3Store. Buckets are addressed path-style
+// (Endpoint/Bucket/key), which MinIO requires and AWS still accepts.
+// PublicURL, when set, replaces Endpoint/Bucket in public URLs, e.g. for a
+// CDN in front of the bucket.
+type S3Options struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PublicURL string
+}
+
+// S3Store keeps files in a bucket of an S3-compatible service. Requests are
+// signed with Signature Version 4.
+type S3Store struct {
+	endpoint  *url.URL
+	bucket    string
+	publicURL string
+	signer    sigV4Signer
+	client    *http.Client
+}
+
+func NewS3Store(opts S3Options) (*S3Store, error) {
+	if opts.Endpoint == "" || opts.Bucket == "" || opts.AccessKey == "" || opts.SecretKey == "" {
+		return nil, fmt.Errorf("missing S3 endpoint, bucket or credentials")
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(opts.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", opts.Endpoint)
+	}
+	region := opts.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Store{
+		endpoint:  endpoint,
+		bucket:    opts.Bucket,
+		publicURL: strings.TrimSuffix(opts.PublicURL, "/"),
+		signer:    sigV4Signer{accessKey: opts.AccessKey, secretKey: opts.SecretKey, region: region, service: "s3"},
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+func (s *S3Store) Name() string {
+	return "s3"
+}
+
+// objectURL addresses key within the bucket. RawPath is set so the path
+// sent is exactly the one that was signed.
+func (s *S3Store) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	u.Path = s.endpoint.Path + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, true)
+	return &u
+}
+
+// s3Error is the error document S3 returns with failed requests.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends a signed request with the given headers. A GET or HEAD of a
+// missing object returns ErrNotFound.
+func (s *S3Store) do(ctx context.Context, method string, u *url.URL, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.URL = u
+	if body != nil {
+		req.ContentLength = size
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.signer.sign(req, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && (method == http.MethodGet || method == http.MethodHead) && u.RawQuery == "" {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode >= 300 && !(method == http.MethodDelete && resp.StatusCode == http.StatusNotFound) {
+		defer resp.Body.Close()
+		var e s3Error
+		xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&e)
+		return nil, fmt.Errorf("s3 %s %s: status %d: %s %s", method, u.Path, resp.StatusCode, e.Code, e.Message)
+	}
+	return resp, nil
+}
+
+func contentTypeHeader(contentType string) http.Header {
+	if contentType == "" {
+		return nil
+	}
+	return http.Header{"Content-Type": {contentType}}
+}
+
+// Put uploads body with a single PUT, which needs its length up front. A
+// body that cannot seek is spooled to a temporary file first.
+func (s *S3Store) Put(ctx context.Context, key string, body io.Reader, contentType string) (*Object, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	seeker, ok := body.(io.ReadSeeker)
+	if !ok {
+		spool, err := os.CreateTemp("", "s3-put-*")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		if _, err := io.Copy(spool, body); err != nil {
+			return nil, err
+		}
+		seeker = spool
+	}
+	size, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// Keep the client from closing the caller's file.
+	resp, err := s.do(ctx, http.MethodPut, s.objectURL(key), io.NopCloser(seeker), size, contentTypeHeader(contentType))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &Object{
+		Key:          key,
+		URL:          s.URL(key),
+		Size:         size,
+		ContentType:  contentType,
+		LastModified: time.Now().UTC(),
+	}, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodDelete, s.objectURL(key), nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Store) URL(key string) string {
+	if s.publicURL != "" {
+		return s.publicURL + "/" + uriEncode(key, true)
+	}
+	return s.objectURL(key).String()
+}
+
+func (s *S3Store) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	if expiry <= 0 || expiry > maxPresignExpiry {
+		return "", errors.New("signed URL expiry must be between 1s and 7 days")
+	}
+	return s.signer.presign(http.MethodGet, s.objectURL(key), time.Now(), expiry), nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List pages through ListObjectsV2.
+func (s *S3Store) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	var token string
+	for {
+		u := s.objectURL("")
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u.RawQuery = canonicalQuery(query)
+
+		resp, err := s.do(ctx, http.MethodGet, u, nil, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing bucket listing: %v", err)
+		}
+
+		for _, item := range result.Contents {
+			objects = append(objects, Object{
+				Key:          item.Key,
+				URL:          s.URL(item.Key),
+				Size:         item.Size,
+				ContentType:  mimeType(item.Key),
+				LastModified: item.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// PresignUpload builds a browser-based POST upload whose policy pins the
+// key, content type and a private ACL and bounds the size, so S3 itself
+// rejects anything else.
+func (s *S3Store) PresignUpload(key string, policy UploadPolicy) (*PresignedUpload, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if policy.Expiry <= 0 || policy.Expiry > maxPresignExpiry {
+		return nil, errors.New("upload expiry must be between 1s and 7 days")
+	}
+	if policy.MaxBytes <= 0 {
+		return nil, errors.New("upload size limit is required")
+	}
+	now := time.Now().UTC()
+	expiresAt := now.Add(policy.Expiry)
+	credential := s.signer.accessKey + "/" + s.signer.scope(now)
+	date := now.Format(amzDateFormat)
+
+	document, err := json.Marshal(map[string]interface{}{
+		"expiration": expiresAt.Format("2006-01-02T15:04:05.000Z"),
+		"conditions": []interface{}{
+			map[string]string{"bucket": s.bucket},
+			map[string]string{"acl": "private"},
+			[]interface{}{"eq", "$key", key},
+			[]interface{}{"eq", "$Content-Type", policy.ContentType},
+			[]interface{}{"content-length-range", 1, policy.MaxBytes},
+			map[string]string{"x-amz-algorithm": sigV4Algorithm},
+			map[string]string{"x-amz-credential": credential},
+			map[string]string{"x-amz-date": date},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(document)
+
+	return &PresignedUpload{
+		Key: key,
+		URL: s.objectURL("").String(),
+		Fields: map[string]string{
+			"key":              key,
+			"acl":              "private",
+			"Content-Type":     policy.ContentType,
+			"policy":           encoded,
+			"x-amz-algorithm":  sigV4Algorithm,
+			"x-amz-credential": credential,
+			"x-amz-date":       date,
+			"x-amz-signature":  s.signer.signPolicy(encoded, now),
+		},
+		FileField: "file",
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+func (s *S3Store) Stat(ctx context.Context, key string) (*Object, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(ctx, http.MethodHead, s.objectURL(key), nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &Object{
+		Key:          key,
+		URL:          s.URL(key),
+		Size:         resp.ContentLength,
+		ContentType:  resp.Header.Get("Content-Type"),
+		LastModified: modified,
+	}, nil
+}
+
+func (s *S3Store) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(ctx, http.MethodGet, s.objectURL(key), nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Store) OpenRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	resp, err := s.do(ctx, http.MethodGet, s.objectURL(key), nil, 0, header)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Promote copies src to dst with a server-side CopyObject, replacing its
+// metadata to set the content type, then deletes src.
+func (s *S3Store) Promote(ctx context.Context, src, dst, contentType string) (*Object, error) {
+	src, err := cleanKey(src)
+	if err != nil {
+		return nil, err
+	}
+	dst, err = cleanKey(dst)
+	if err != nil {
+		return nil, err
+	}
+	header := contentTypeHeader(contentType)
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("X-Amz-Copy-Source", uriEncode(s.bucket+"/"+src, true))
+	header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	resp, err := s.do(ctx, http.MethodPut, s.objectURL(dst), nil, 0, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// A copy can fail after S3 has answered 200, with the error in the body.
+	var result struct {
+		XMLName      xml.Name
+		LastModified time.Time `xml:"LastModified"`
+		s3Error
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("s3 copy %s: %v", src, err)
+	}
+	if result.XMLName.Local == "Error" {
+		return nil, fmt.Errorf("s3 copy %s: %s %s", src, result.Code, result.Message)
+	}
+
+	if err := s.Delete(ctx, src); err != nil {
+		log.Printf("Error deleting %s after copying it to %s: %v", src, dst, err)
+	}
+	object, err := s.Stat(ctx, dst)
+	if err != nil {
+		return nil, err
+	}
+	object.ContentType = contentType
+	return object, nil
+}
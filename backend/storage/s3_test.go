@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testS3Store(t *testing.T) *S3Store {
+	t.Helper()
+	s, err := NewS3Store(S3Options{
+		Endpoint:  "http://minio.example.com:9000/",
+		Bucket:    "recipes",
+		AccessKey: exampleSigner.accessKey,
+		SecretKey: exampleSigner.secretKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestS3ObjectURL(t *testing.T) {
+	s := testS3Store(t)
+	if got, want := s.objectURL("Images/u1/photo one.jpg").String(), "http://minio.example.com:9000/recipes/Images/u1/photo%20one.jpg"; got != want {
+		t.Errorf("objectURL() = %s, want %s", got, want)
+	}
+	if got, want := s.objectURL("").String(), "http://minio.example.com:9000/recipes"; got != want {
+		t.Errorf("objectURL() = %s, want %s", got, want)
+	}
+}
+
+func TestS3PresignUpload(t *testing.T) {
+	s := testS3Store(t)
+	upload, err := s.PresignUpload("Incoming/u1/./clip.mp4", UploadPolicy{ContentType: "video/mp4", MaxBytes: 1 << 20, Expiry: 15 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.Key != "Incoming/u1/clip.mp4" || upload.Fields["key"] != upload.Key {
+		t.Errorf("key = %q, field %q, want the cleaned key", upload.Key, upload.Fields["key"])
+	}
+	if upload.Fields["acl"] != "private" {
+		t.Errorf("acl field = %q, want private", upload.Fields["acl"])
+	}
+	if upload.URL != "http://minio.example.com:9000/recipes" {
+		t.Errorf("URL = %s", upload.URL)
+	}
+
+	document, err := base64.StdEncoding.DecodeString(upload.Fields["policy"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var policy struct {
+		Conditions []json.RawMessage `json:"conditions"`
+	}
+	if err := json.Unmarshal(document, &policy); err != nil {
+		t.Fatal(err)
+	}
+	conditions := make(map[string]bool)
+	for _, c := range policy.Conditions {
+		conditions[string(c)] = true
+	}
+	for _, want := range []string{
+		`{"bucket":"recipes"}`,
+		`{"acl":"private"}`,
+		`["eq","$key","Incoming/u1/clip.mp4"]`,
+		`["eq","$Content-Type","video/mp4"]`,
+		`["content-length-range",1,1048576]`,
+	} {
+		if !conditions[want] {
+			t.Errorf("policy lacks condition %s", want)
+		}
+	}
+	if got, want := upload.Fields["x-amz-signature"], s.signer.signPolicy(upload.Fields["policy"], mustParseAmzDate(t, upload.Fields["x-amz-date"])); got != want {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+}
+
+func mustParseAmzDate(t *testing.T, s string) time.Time {
+	t.Helper()
+	now, err := time.Parse(amzDateFormat, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return now
+}
+
+func TestS3PresignUploadRejects(t *testing.T) {
+	s := testS3Store(t)
+	tests := []struct {
+		name   string
+		key    string
+		policy UploadPolicy
+	}{
+		{"escaping key", "../Images/u2/photo.jpg", UploadPolicy{ContentType: "image/jpeg", MaxBytes: 1, Expiry: time.Minute}},
+		{"no expiry", "Incoming/u1/a.jpg", UploadPolicy{ContentType: "image/jpeg", MaxBytes: 1}},
+		{"expiry too long", "Incoming/u1/a.jpg", UploadPolicy{ContentType: "image/jpeg", MaxBytes: 1, Expiry: 8 * 24 * time.Hour}},
+		{"no size limit", "Incoming/u1/a.jpg", UploadPolicy{ContentType: "image/jpeg", Expiry: time.Minute}},
+	}
+	for _, tt := range tests {
+		if _, err := s.PresignUpload(tt.key, tt.policy); err == nil {
+			t.Errorf("%s: PresignUpload() accepted the upload", tt.name)
+		}
+	}
+}
+
+// s3Recorder answers S3 requests from handle and records them.
+func s3Recorder(t *testing.T, handle func(w http.ResponseWriter, r *http.Request)) (*S3Store, *[]*http.Request) {
+	t.Helper()
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		handle(w, r)
+	}))
+	t.Cleanup(server.Close)
+	s, err := NewS3Store(S3Options{Endpoint: server.URL, Bucket: "recipes", AccessKey: "key", SecretKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, &requests
+}
+
+func TestS3OpenRange(t *testing.T) {
+	s, requests := s3Recorder(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusPartialContent)
+		io.WriteString(w, "head")
+	})
+	body, err := s.OpenRange(t.Context(), "Incoming/u1/a.jpg", 0, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	if data, _ := io.ReadAll(body); string(data) != "head" {
+		t.Errorf("body = %q", data)
+	}
+	if got := (*requests)[0].Header.Get("Range"); got != "bytes=0-3" {
+		t.Errorf("Range = %q, want bytes=0-3", got)
+	}
+}
+
+func TestS3Promote(t *testing.T) {
+	s, requests := s3Recorder(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			io.WriteString(w, `<CopyObjectResult><LastModified>2026-01-02T03:04:05Z</LastModified></CopyObjectResult>`)
+		case http.MethodHead:
+			w.Header().Set("Content-Length", "1234")
+		case http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	object, err := s.Promote(t.Context(), "Incoming/u1/a b.jpg", "RecipeImages/u1/c.jpg", "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object.Key != "RecipeImages/u1/c.jpg" || object.Size != 1234 || object.ContentType != "image/jpeg" {
+		t.Errorf("object = %+v", object)
+	}
+
+	var methods []string
+	for _, r := range *requests {
+		methods = append(methods, r.Method+" "+r.URL.EscapedPath())
+	}
+	want := []string{"PUT /recipes/RecipeImages/u1/c.jpg", "DELETE /recipes/Incoming/u1/a%20b.jpg", "HEAD /recipes/RecipeImages/u1/c.jpg"}
+	if strings.Join(methods, ", ") != strings.Join(want, ", ") {
+		t.Errorf("requests = %v, want %v", methods, want)
+	}
+	copyRequest := (*requests)[0]
+	if got := copyRequest.Header.Get("X-Amz-Copy-Source"); got != "recipes/Incoming/u1/a%20b.jpg" {
+		t.Errorf("copy source = %q", got)
+	}
+	if copyRequest.Header.Get("X-Amz-Metadata-Directive") != "REPLACE" || copyRequest.Header.Get("Content-Type") != "image/jpeg" {
+		t.Errorf("copy headers = %v", copyRequest.Header)
+	}
+	if !strings.Contains(copyRequest.Header.Get("Authorization"), "x-amz-copy-source") {
+		t.Errorf("copy source is not signed: %s", copyRequest.Header.Get("Authorization"))
+	}
+}
+
+func TestS3PromoteCopyError(t *testing.T) {
+	s, requests := s3Recorder(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<Error><Code>InternalError</Code><Message>We encountered an internal error.</Message></Error>`)
+	})
+	if _, err := s.Promote(t.Context(), "Incoming/u1/a.jpg", "RecipeImages/u1/c.jpg", "image/jpeg"); err == nil {
+		t.Fatal("Promote() succeeded after a failed copy")
+	}
+	if len(*requests) != 1 {
+		t.Errorf("made %d requests, want only the copy", len(*requests))
+	}
+}
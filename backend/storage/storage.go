@@ -0,0 +1,108 @@
+// Package storage abstracts where uploaded files live behind BlobStore, so
+// uploads work against Cloudinary, the local disk or any S3-compatible
+// service such as MinIO.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strings"
+	"time"
+
+	"backend/config"
+)
+
+// ErrInvalidKey is returned for keys that are empty, absolute or try to
+// escape their prefix.
+var ErrInvalidKey = errors.New("invalid storage key")
+
+// ErrNotFound is returned when a key does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// Object describes a stored file.
+type Object struct {
+	Key          string
+	URL          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// BlobStore is implemented by every backend uploads can be stored in. Keys
+// are slash-separated paths such as "RecipeImages/<userId>/<file>.jpg".
+type BlobStore interface {
+	Name() string
+	// Put stores body under key, replacing any existing object.
+	Put(ctx context.Context, key string, body io.Reader, contentType string) (*Object, error)
+	// Delete removes key; deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+	// URL is the permanent public address of key.
+	URL(key string) string
+	// SignedURL is an address for key that stops working after expiry,
+	// where the backend supports it.
+	SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error)
+	// List returns every object whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]Object, error)
+}
+
+// Transformer is implemented by stores that resize images on delivery, so
+// no variants need to be stored for them.
+type Transformer interface {
+	// VariantURL serves key at no more than width by height, cropped to
+	// fill it exactly when crop is set. Images are never enlarged.
+	VariantURL(key string, width, height int, crop bool) string
+	// PlaceholderURL serves a tiny, blurred rendition of key.
+	PlaceholderURL(key string) string
+}
+
+// VideoTransformer is implemented by stores that transcode videos on
+// delivery.
+type VideoTransformer interface {
+	// PosterURL serves a frame of the video at key as an image.
+	PosterURL(key string) string
+	// StreamURL serves key for adaptive bitrate streaming.
+	StreamURL(key string) string
+}
+
+// NewBlobStore builds the store selected by STORAGE_BACKEND.
+func NewBlobStore(cfg *config.Config) (BlobStore, error) {
+	switch strings.ToLower(cfg.StorageBackend) {
+	case "", "cloudinary":
+		return NewCloudinaryStore(cfg.CloudinaryCloud, cfg.CloudinaryAPIKey, cfg.CloudinarySecret)
+	case "local":
+		return NewLocalStore(cfg.LocalStorageDir, cfg.PublicBaseURL, cfg.JWTSecret)
+	case "s3":
+		return NewS3Store(S3Options{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			PublicURL: cfg.S3PublicURL,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", cfg.StorageBackend)
+	}
+}
+
+// cleanKey normalizes a key and rejects ones that are not a plain relative
+// path.
+func cleanKey(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return "", ErrInvalidKey
+	}
+	cleaned := path.Clean(key)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", ErrInvalidKey
+	}
+	return cleaned, nil
+}
+
+// mimeType guesses a content type from a key's extension.
+func mimeType(key string) string {
+	return mime.TypeByExtension(path.Ext(key))
+}
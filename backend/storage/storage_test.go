@@ -0,0 +1,28 @@
+package storage
+
+import "testing"
+
+func TestCleanKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+		err  error
+	}{
+		{"Images/u1/photo.jpg", "Images/u1/photo.jpg", nil},
+		{"Images//u1/./photo.jpg", "Images/u1/photo.jpg", nil},
+		{"Images/u1/../u2/photo.jpg", "Images/u2/photo.jpg", nil},
+		{"", "", ErrInvalidKey},
+		{"/etc/passwd", "", ErrInvalidKey},
+		{"..", "", ErrInvalidKey},
+		{".", "", ErrInvalidKey},
+		{"../secret", "", ErrInvalidKey},
+		{"Images/../../secret", "", ErrInvalidKey},
+		{"Images\\u1\\photo.jpg", "", ErrInvalidKey},
+	}
+	for _, tt := range tests {
+		got, err := cleanKey(tt.key)
+		if got != tt.want || err != tt.err {
+			t.Errorf("cleanKey(%q) = %q, %v, want %q, %v", tt.key, got, err, tt.want, tt.err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mailer sends plain-text email over SMTP. With no Host configured it logs
+// the message instead, which keeps local development free of an SMTP server.
+type Mailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m Mailer) Send(to, subject, body string) error {
+	if m.Host == "" {
+		log.Printf("Email to %s (SMTP not configured): %s\n%s", to, subject, body)
+		return nil
+	}
+
+	msg := buildMessage(m.From, to, subject, "text/plain; charset=UTF-8", body)
+	return m.deliver(to, msg)
+}
+
+func (m Mailer) deliver(to string, msg []byte) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	addr := net.JoinHostPort(m.Host, m.Port)
+	if err := smtp.SendMail(addr, auth, m.From, []string{to}, msg); err != nil {
+		return fmt.Errorf("error sending email to %s: %w", to, err)
+	}
+	return nil
+}
+
+func buildMessage(from, to, subject, contentType, body string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", sanitizeHeader(subject))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: %s\r\n", contentType)
+	b.WriteString("\r\n")
+	b.WriteString(body)
+	return []byte(b.String())
+}
+
+// sanitizeHeader keeps user-influenced values from injecting extra headers.
+func sanitizeHeader(value string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
+
+// SendWithAttachment sends a plain-text email with one attached file.
+func (m Mailer) SendWithAttachment(to, subject, body, filename, contentType string, data []byte) error {
+	if m.Host == "" {
+		log.Printf("Email to %s with attachment %s (SMTP not configured): %s\n%s", to, filename, subject, body)
+		return nil
+	}
+
+	boundary := "dishcovery-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	var parts strings.Builder
+	fmt.Fprintf(&parts, "--%s\r\n", boundary)
+	parts.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	parts.WriteString(body)
+	fmt.Fprintf(&parts, "\r\n--%s\r\n", boundary)
+	fmt.Fprintf(&parts, "Content-Type: %s\r\n", contentType)
+	parts.WriteString("Content-Transfer-Encoding: base64\r\n")
+	fmt.Fprintf(&parts, "Content-Disposition: attachment; filename=%q\r\n\r\n", sanitizeHeader(filename))
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		parts.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	parts.WriteString(encoded + "\r\n")
+	fmt.Fprintf(&parts, "--%s--\r\n", boundary)
+
+	msg := buildMessage(m.From, to, subject, fmt.Sprintf("multipart/mixed; boundary=%q", boundary), parts.String())
+	return m.deliver(to, msg)
+}
@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// RunPeriodically calls job every interval until ctx is cancelled. Runs never
+// overlap; a run that outlasts the interval delays the next one.
+func RunPeriodically(ctx context.Context, name string, interval time.Duration, job func(context.Context)) {
+	if interval <= 0 {
+		log.Printf("Job %s disabled", name)
+		return
+	}
+
+	log.Printf("Job %s scheduled every %s", name, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			start := time.Now()
+			job(ctx)
+			log.Printf("Job %s finished in %s", name, time.Since(start))
+		}
+	}
+}
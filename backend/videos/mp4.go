@@ -0,0 +1,181 @@
+package videos
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+// maxHeaderBox bounds the header boxes read into memory.
+const maxHeaderBox = 1 << 10
+
+// readMP4 walks the box tree for the movie header (mvhd), the track
+// headers (tkhd), the first of which with a frame size gives the video's,
+// and the media headers (mdhd). Only moov, trak and mdia are descended
+// into; every other box, media data included, is skipped. The movie box may
+// come before or after the media data. The duration is the longest the
+// headers declare, so a movie header claiming a short clip cannot hide
+// longer tracks.
+// https://developer.apple.com/documentation/quicktime-file-format
+func readMP4(r io.ReadSeeker, info *Info) error {
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var movie bool
+	var movieScale uint64
+	var movieDuration, trackDuration uint64
+	for offset := int64(0); offset < end; {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		kind := string(header[4:])
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			// The box runs to the end of the file.
+			size = end - offset
+		case 1:
+			var large [8]byte
+			if _, err := io.ReadFull(r, large[:]); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(large[:]))
+			headerSize = 16
+		}
+		if size < headerSize || offset+size > end {
+			return invalid("corrupt MP4 box %q", kind)
+		}
+
+		switch kind {
+		case "moov", "trak", "mdia":
+			// The children follow the header.
+			offset += headerSize
+			continue
+		case "mvhd", "tkhd", "mdhd":
+			if size-headerSize > maxHeaderBox {
+				return invalid("corrupt MP4 box %q", kind)
+			}
+			payload := make([]byte, size-headerSize)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return err
+			}
+			switch kind {
+			case "mvhd":
+				if movieScale, movieDuration, err = readDurationHeader(payload, "movie"); err != nil {
+					return err
+				}
+				movie = true
+			case "tkhd":
+				if info.Width == 0 {
+					readTrackHeader(payload, info)
+				}
+				trackDuration = max(trackDuration, readTrackDuration(payload))
+			case "mdhd":
+				scale, duration, err := readDurationHeader(payload, "media")
+				if err != nil {
+					return err
+				}
+				info.Duration = max(info.Duration, scaledDuration(duration, scale))
+			}
+		}
+
+		offset += size
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if !movie {
+		return invalid("MP4 file has no movie header")
+	}
+	// Track durations are in the movie's timescale.
+	info.Duration = max(info.Duration, scaledDuration(movieDuration, movieScale), scaledDuration(trackDuration, movieScale))
+	return nil
+}
+
+// readDurationHeader reads the timescale and duration of a movie or media
+// header, which share their layout. An unknown duration reads as zero.
+func readDurationHeader(p []byte, name string) (timescale, duration uint64, err error) {
+	switch {
+	case len(p) >= 32 && p[0] == 1:
+		timescale = uint64(binary.BigEndian.Uint32(p[20:24]))
+		duration = binary.BigEndian.Uint64(p[24:32])
+		if duration == math.MaxUint64 {
+			duration = 0
+		}
+	case len(p) >= 20 && p[0] == 0:
+		timescale = uint64(binary.BigEndian.Uint32(p[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(p[16:20]))
+		// All ones means the duration is unknown.
+		if duration == math.MaxUint32 {
+			duration = 0
+		}
+	default:
+		return 0, 0, invalid("corrupt MP4 %s header", name)
+	}
+	if timescale == 0 {
+		return 0, 0, invalid("corrupt MP4 %s header", name)
+	}
+	return timescale, duration, nil
+}
+
+// readTrackDuration reads the duration of a track header, in the movie's
+// timescale, or zero when it is unknown.
+func readTrackDuration(p []byte) uint64 {
+	switch {
+	case len(p) >= 36 && p[0] == 1:
+		if d := binary.BigEndian.Uint64(p[28:36]); d != math.MaxUint64 {
+			return d
+		}
+	case len(p) >= 24 && p[0] == 0:
+		if d := binary.BigEndian.Uint32(p[20:24]); d != math.MaxUint32 {
+			return uint64(d)
+		}
+	}
+	return 0
+}
+
+// scaledDuration converts a duration in timescale units per second.
+func scaledDuration(duration, timescale uint64) time.Duration {
+	if timescale == 0 {
+		return 0
+	}
+	seconds := float64(duration) / float64(timescale)
+	if seconds >= math.MaxInt64/float64(time.Second) {
+		return math.MaxInt64
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// readTrackHeader reads the display size of a track, which is zero for
+// tracks without pictures, and swaps it for tracks rotated a quarter turn,
+// as phones record portrait video.
+func readTrackHeader(p []byte, info *Info) {
+	// Version and flags, times, track ID, reserved and duration.
+	base := 24
+	if len(p) > 0 && p[0] == 1 {
+		base = 36
+	}
+	// Then reserved, layer, alternate group, volume, reserved, the 3x3
+	// transformation matrix and the 16.16 fixed-point width and height.
+	matrix := base + 16
+	size := matrix + 36
+	if len(p) < size+8 {
+		return
+	}
+	width := int(binary.BigEndian.Uint32(p[size:]) >> 16)
+	height := int(binary.BigEndian.Uint32(p[size+4:]) >> 16)
+	a := binary.BigEndian.Uint32(p[matrix:])
+	d := binary.BigEndian.Uint32(p[matrix+16:])
+	if a == 0 && d == 0 {
+		width, height = height, width
+	}
+	info.Width, info.Height = width, height
+}
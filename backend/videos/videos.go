@@ -0,0 +1,112 @@
+// Package videos validates uploaded video clips, reading their duration and
+// frame size from the container without decoding any frames.
+package videos
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Supported containers.
+const (
+	MP4  = "mp4"
+	WebM = "webm"
+)
+
+var contentTypes = map[string]string{
+	"video/mp4":  MP4,
+	"video/webm": WebM,
+}
+
+// ValidationError reports why a video was rejected. Its message is meant
+// for the uploader.
+type ValidationError struct {
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Reason
+}
+
+func invalid(format string, args ...interface{}) error {
+	return &ValidationError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// IsValidationError reports whether err rejects the video itself rather
+// than reporting a failure to read it.
+func IsValidationError(err error) bool {
+	var v *ValidationError
+	return errors.As(err, &v)
+}
+
+// Limits bounds accepted videos. Zero disables a limit.
+type Limits struct {
+	MaxDuration time.Duration
+}
+
+// Info describes an accepted video.
+type Info struct {
+	Format      string
+	ContentType string
+	Duration    time.Duration
+	Width       int
+	Height      int
+}
+
+// Extension is the usual file extension for the video's container.
+func (i *Info) Extension() string {
+	return i.Format
+}
+
+// Inspect identifies a video from its content and checks it has a video
+// track and a duration within limits. Only the container's headers and
+// block timecodes are read; media data is skipped.
+func Inspect(src io.ReadSeeker, limits Limits) (*Info, error) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return nil, invalid("file is empty")
+		}
+		return nil, err
+	}
+	contentType, _, _ := strings.Cut(http.DetectContentType(head[:n]), ";")
+	format, ok := contentTypes[contentType]
+	if !ok {
+		return nil, invalid("unsupported file type %s; use MP4 or WebM", contentType)
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	info := &Info{Format: format, ContentType: contentType}
+	if format == MP4 {
+		err = readMP4(src, info)
+	} else {
+		err = readWebM(src, info)
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, invalid("%s video is truncated", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Width <= 0 || info.Height <= 0 {
+		return nil, invalid("file has no video track")
+	}
+	if info.Duration <= 0 {
+		return nil, invalid("video has no duration")
+	}
+	if limits.MaxDuration > 0 && info.Duration > limits.MaxDuration {
+		return nil, invalid("video is %s long; the maximum is %s", info.Duration.Round(time.Second), limits.MaxDuration)
+	}
+	return info, nil
+}
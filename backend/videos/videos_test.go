@@ -0,0 +1,206 @@
+package videos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+func box(kind string, payloads ...[]byte) []byte {
+	out := []byte{0, 0, 0, 0}
+	out = append(out, kind...)
+	for _, payload := range payloads {
+		out = append(out, payload...)
+	}
+	binary.BigEndian.PutUint32(out, uint32(len(out)))
+	return out
+}
+
+func ftyp() []byte {
+	return box("ftyp", []byte("mp42\x00\x00\x00\x00isom"))
+}
+
+// durationHeader builds a version 0 movie or media header.
+func durationHeader(kind string, timescale, duration uint32) []byte {
+	p := make([]byte, 24)
+	binary.BigEndian.PutUint32(p[12:], timescale)
+	binary.BigEndian.PutUint32(p[16:], duration)
+	return box(kind, p)
+}
+
+// durationHeaderV1 builds a version 1 movie or media header.
+func durationHeaderV1(kind string, timescale uint32, duration uint64) []byte {
+	p := make([]byte, 36)
+	p[0] = 1
+	binary.BigEndian.PutUint32(p[20:], timescale)
+	binary.BigEndian.PutUint64(p[24:], duration)
+	return box(kind, p)
+}
+
+// tkhd builds a version 0 track header with a frame size, turned a quarter
+// when rotated.
+func tkhd(width, height int, rotated bool, duration uint32) []byte {
+	p := make([]byte, 84)
+	binary.BigEndian.PutUint32(p[20:], duration)
+	if !rotated {
+		binary.BigEndian.PutUint32(p[40:], 0x10000)
+		binary.BigEndian.PutUint32(p[56:], 0x10000)
+	}
+	binary.BigEndian.PutUint32(p[76:], uint32(width)<<16)
+	binary.BigEndian.PutUint32(p[80:], uint32(height)<<16)
+	return box("tkhd", p)
+}
+
+func track(header []byte, media ...[]byte) []byte {
+	return box("trak", header, box("mdia", media...))
+}
+
+func mp4File(boxes ...[]byte) []byte {
+	return bytes.Join(append([][]byte{ftyp()}, boxes...), nil)
+}
+
+// ebmlID writes an element ID with its length marker.
+func ebmlID(id uint64) []byte {
+	var out []byte
+	for ; id > 0; id >>= 8 {
+		out = append([]byte{byte(id)}, out...)
+	}
+	return out
+}
+
+// element builds a Matroska element with an eight-byte size.
+func element(id uint64, children ...[]byte) []byte {
+	data := bytes.Join(children, nil)
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(data)))
+	size[0] = 0x01
+	return append(append(ebmlID(id), size...), data...)
+}
+
+// unsized builds a master element of unknown size, as MediaRecorder writes.
+func unsized(id uint64, children ...[]byte) []byte {
+	out := append(ebmlID(id), 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	return append(out, bytes.Join(children, nil)...)
+}
+
+func uintElement(id, v uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, v)
+	return element(id, data)
+}
+
+func floatElement(id uint64, v float64) []byte {
+	return uintElement(id, math.Float64bits(v))
+}
+
+func simpleBlock(timecode int16) []byte {
+	return element(simpleBlockID, []byte{0x81, byte(uint16(timecode) >> 8), byte(timecode), 0x80, 0xde, 0xad})
+}
+
+func webmFile(info []byte, clusters ...[]byte) []byte {
+	header := element(ebmlHeaderID, element(0x4282, []byte("webm")))
+	tracks := element(tracksID, element(trackEntryID, element(videoID,
+		uintElement(pixelWidthID, 640),
+		uintElement(pixelHeightID, 360),
+	)))
+	segment := unsized(segmentID, append([][]byte{info, tracks}, clusters...)...)
+	return append(header, segment...)
+}
+
+// cluster builds a cluster of unknown size starting at timecode, in
+// milliseconds, with blocks at the given offsets.
+func cluster(timecode uint64, blocks ...int16) []byte {
+	children := [][]byte{uintElement(clusterTimecodeID, timecode)}
+	for _, block := range blocks {
+		children = append(children, simpleBlock(block))
+	}
+	return unsized(clusterID, children...)
+}
+
+func TestInspect(t *testing.T) {
+	video := track(tkhd(1920, 1080, false, 5000), durationHeader("mdhd", 90000, 450000))
+	audio := track(tkhd(0, 0, false, 5000), durationHeader("mdhd", 48000, 240000))
+	scale := uintElement(timecodeScaleID, 1000000)
+	tests := []struct {
+		name     string
+		data     []byte
+		format   string
+		width    int
+		height   int
+		duration time.Duration
+	}{
+		{"mp4", mp4File(box("moov", durationHeader("mvhd", 1000, 5000), audio, video), box("mdat", make([]byte, 64))), MP4, 1920, 1080, 5 * time.Second},
+		{"mp4 movie box last", mp4File(box("mdat", make([]byte, 64)), box("moov", durationHeader("mvhd", 1000, 5000), video)), MP4, 1920, 1080, 5 * time.Second},
+		{"mp4 version 1 headers", mp4File(box("moov", durationHeaderV1("mvhd", 600, 3000), track(tkhd(640, 480, false, 0), durationHeaderV1("mdhd", 600, 3000))), box("mdat")), MP4, 640, 480, 5 * time.Second},
+		{"mp4 portrait", mp4File(box("moov", durationHeader("mvhd", 1000, 2000), track(tkhd(1920, 1080, true, 2000)))), MP4, 1080, 1920, 2 * time.Second},
+		{"mp4 longer media", mp4File(box("moov", durationHeader("mvhd", 1000, 1000), track(tkhd(640, 480, false, 1000), durationHeader("mdhd", 1000, 8000)))), MP4, 640, 480, 8 * time.Second},
+		{"mp4 longer track", mp4File(box("moov", durationHeader("mvhd", 1000, 1000), track(tkhd(640, 480, false, 6000)))), MP4, 640, 480, 6 * time.Second},
+		{"webm", webmFile(element(infoID, scale, floatElement(durationID, 5000)), cluster(0, 0, 2000), cluster(4000, 0)), WebM, 640, 360, 5 * time.Second},
+		{"recorded webm", webmFile(element(infoID, scale), cluster(0, 0, 1000), cluster(7000, 0, 500)), WebM, 640, 360, 7500 * time.Millisecond},
+		{"webm longer blocks", webmFile(element(infoID, scale, floatElement(durationID, 1000)), cluster(0, 0), cluster(30000, 250)), WebM, 640, 360, 30250 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := Inspect(bytes.NewReader(tt.data), Limits{MaxDuration: 90 * time.Second})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Format != tt.format || info.Width != tt.width || info.Height != tt.height || info.Duration != tt.duration {
+				t.Errorf("Inspect() = %+v, want %s %dx%d lasting %s", info, tt.format, tt.width, tt.height, tt.duration)
+			}
+		})
+	}
+}
+
+func TestInspectRejects(t *testing.T) {
+	video := track(tkhd(640, 480, false, 5000))
+	movie := box("moov", durationHeader("mvhd", 1000, 5000), video)
+	valid := mp4File(movie)
+	scale := uintElement(timecodeScaleID, 1000000)
+	info := element(infoID, scale, floatElement(durationID, 5000))
+	validWebM := webmFile(info, cluster(0, 0))
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"text", []byte("hello, world")},
+		{"mp4 truncated", valid[:len(valid)-10]},
+		{"mp4 box smaller than its header", mp4File([]byte{0, 0, 0, 4, 'm', 'o', 'o', 'v'})},
+		{"mp4 box past the end", mp4File([]byte{0, 0, 1, 0, 'm', 'd', 'a', 't'})},
+		{"mp4 large box past the end", mp4File([]byte{0, 0, 0, 1, 'm', 'd', 'a', 't', 0, 0, 0, 0, 0, 1, 0, 0})},
+		{"mp4 without movie header", mp4File(box("moov", video))},
+		{"mp4 movie header too short", mp4File(box("moov", box("mvhd", make([]byte, 8)), video))},
+		{"mp4 zero timescale", mp4File(box("moov", durationHeader("mvhd", 0, 5000), video))},
+		{"mp4 zero media timescale", mp4File(box("moov", durationHeader("mvhd", 1000, 5000), track(tkhd(640, 480, false, 5000), durationHeader("mdhd", 0, 1))))},
+		{"mp4 oversized header box", mp4File(box("moov", box("mvhd", make([]byte, maxHeaderBox+1)), video))},
+		{"mp4 without video track", mp4File(box("moov", durationHeader("mvhd", 1000, 5000), track(tkhd(0, 0, false, 5000))))},
+		{"mp4 without duration", mp4File(box("moov", durationHeader("mvhd", 1000, 0xffffffff), track(tkhd(640, 480, false, 0))))},
+		{"mp4 too long", mp4File(box("moov", durationHeader("mvhd", 1000, 120000), video))},
+		{"mp4 media longer than the movie", mp4File(box("moov", durationHeader("mvhd", 1000, 5000), track(tkhd(640, 480, false, 5000), durationHeader("mdhd", 90000, 90000*600))))},
+		{"webm truncated", validWebM[:len(validWebM)-3]},
+		{"webm bad element ID", append(validWebM[:len(validWebM):len(validWebM)], 0x00)},
+		{"webm unknown size", webmFile(unsized(infoID, unsized(durationID)))},
+		{"webm integer too long", webmFile(element(infoID, element(timecodeScaleID, make([]byte, 9))))},
+		{"webm float of odd size", webmFile(element(infoID, scale, element(durationID, make([]byte, 3))))},
+		{"webm NaN duration", webmFile(element(infoID, scale, floatElement(durationID, math.NaN())))},
+		{"webm negative duration", webmFile(element(infoID, scale, floatElement(durationID, -5000)))},
+		{"webm block shorter than its header", webmFile(info, unsized(clusterID, element(simpleBlockID, []byte{0x81, 0}), simpleBlock(0)))},
+		{"webm without duration", webmFile(element(infoID, scale))},
+		{"webm without video track", append(element(ebmlHeaderID), unsized(segmentID, info, cluster(0, 0))...)},
+		{"webm too long", webmFile(info, cluster(0, 0), cluster(95000, 0))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := Inspect(bytes.NewReader(tt.data), Limits{MaxDuration: 90 * time.Second})
+			if err == nil {
+				t.Fatalf("Inspect() accepted the file as %+v", info)
+			}
+			if !IsValidationError(err) {
+				t.Errorf("Inspect() = %v, want a validation error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package videos
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// Matroska element IDs, with their length markers.
+// https://www.matroska.org/technical/elements.html
+const (
+	ebmlHeaderID      = 0x1a45dfa3
+	segmentID         = 0x18538067
+	infoID            = 0x1549a966
+	timecodeScaleID   = 0x2ad7b1
+	durationID        = 0x4489
+	tracksID          = 0x1654ae6b
+	trackEntryID      = 0xae
+	videoID           = 0xe0
+	pixelWidthID      = 0xb0
+	pixelHeightID     = 0xba
+	clusterID         = 0x1f43b675
+	clusterTimecodeID = 0xe7
+	blockGroupID      = 0xa0
+	blockID           = 0xa1
+	simpleBlockID     = 0xa3
+)
+
+// webmMasters are the elements whose children readWebM reads. Every element
+// inside them it needs has an ID found nowhere else in those elements, so
+// the file is read as a flat run of elements and the end of a master never
+// needs to be known. That matters because browsers recording with
+// MediaRecorder write segments and clusters of unknown size.
+var webmMasters = map[uint64]bool{
+	ebmlHeaderID: true,
+	segmentID:    true,
+	infoID:       true,
+	tracksID:     true,
+	trackEntryID: true,
+	videoID:      true,
+	clusterID:    true,
+	blockGroupID: true,
+}
+
+// readWebM reads the duration from the segment info and the frame size of
+// the first video track. The clusters are read too, skipping the frames in
+// them, and the duration is the later of the declared one and the timecode
+// of the last block: files recorded in the browser declare no duration, and
+// a declared one cannot be trusted to cover every block.
+func readWebM(r io.Reader, info *Info) error {
+	br := bufio.NewReader(r)
+	scale := uint64(1000000)
+	var duration float64
+	var clusterTime, lastBlock int64
+
+	for {
+		id, err := readElementID(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		size, known, err := readElementSize(br)
+		if err != nil {
+			return err
+		}
+		if webmMasters[id] {
+			continue
+		}
+		if !known {
+			return invalid("corrupt WebM element size")
+		}
+
+		switch id {
+		case timecodeScaleID:
+			if scale, err = readUint(br, size); err != nil {
+				return err
+			}
+		case durationID:
+			if duration, err = readFloat(br, size); err != nil {
+				return err
+			}
+			if math.IsNaN(duration) || duration < 0 {
+				return invalid("corrupt WebM duration")
+			}
+		case pixelWidthID, pixelHeightID:
+			v, err := readUint(br, size)
+			if err != nil {
+				return err
+			}
+			if id == pixelWidthID && info.Width == 0 {
+				info.Width = int(v)
+			} else if id == pixelHeightID && info.Height == 0 {
+				info.Height = int(v)
+			}
+		case clusterTimecodeID:
+			v, err := readUint(br, size)
+			if err != nil {
+				return err
+			}
+			clusterTime = int64(v)
+		case simpleBlockID, blockID:
+			// A block starts with its track number and a timecode relative
+			// to its cluster.
+			_, n, err := readVint(br)
+			if err != nil {
+				return err
+			}
+			var relative [2]byte
+			if _, err := io.ReadFull(br, relative[:]); err != nil {
+				return err
+			}
+			lastBlock = max(lastBlock, clusterTime+int64(int16(binary.BigEndian.Uint16(relative[:]))))
+			if err := skip(br, int64(size)-int64(n)-2); err != nil {
+				return err
+			}
+		default:
+			if err := skip(br, int64(size)); err != nil {
+				return err
+			}
+		}
+	}
+
+	duration = max(duration, float64(lastBlock))
+	if duration*float64(scale) >= math.MaxInt64 {
+		info.Duration = math.MaxInt64
+	} else {
+		info.Duration = time.Duration(duration * float64(scale))
+	}
+	return nil
+}
+
+// readVint reads a variable-length integer, returning its value without
+// the length marker and its length.
+func readVint(br *bufio.Reader) (uint64, int, error) {
+	first, err := br.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	length := bits.LeadingZeros8(first) + 1
+	if length > 8 {
+		return 0, 0, invalid("corrupt WebM variable-length integer")
+	}
+	value := uint64(first) & (0xff >> length)
+	for i := 1; i < length; i++ {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, 0, noEOF(err)
+		}
+		value = value<<8 | uint64(b)
+	}
+	return value, length, nil
+}
+
+// readElementID reads an element ID, which keeps its length marker. It
+// returns io.EOF only at the end of the file.
+func readElementID(br *bufio.Reader) (uint64, error) {
+	first, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	length := bits.LeadingZeros8(first) + 1
+	if length > 4 {
+		return 0, invalid("corrupt WebM element ID")
+	}
+	id := uint64(first)
+	for i := 1; i < length; i++ {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, noEOF(err)
+		}
+		id = id<<8 | uint64(b)
+	}
+	return id, nil
+}
+
+// readElementSize reads an element's data size. A size of all ones means
+// the size is unknown.
+func readElementSize(br *bufio.Reader) (uint64, bool, error) {
+	size, length, err := readVint(br)
+	if err != nil {
+		return 0, false, noEOF(err)
+	}
+	return size, size != 1<<(7*length)-1, nil
+}
+
+func readUint(br *bufio.Reader, size uint64) (uint64, error) {
+	if size > 8 {
+		return 0, invalid("corrupt WebM integer")
+	}
+	var v uint64
+	for i := uint64(0); i < size; i++ {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, noEOF(err)
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+func readFloat(br *bufio.Reader, size uint64) (float64, error) {
+	switch size {
+	case 4:
+		v, err := readUint(br, size)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 8:
+		v, err := readUint(br, size)
+		return math.Float64frombits(v), err
+	}
+	return 0, invalid("corrupt WebM float")
+}
+
+func skip(br *bufio.Reader, n int64) error {
+	if n < 0 {
+		return invalid("corrupt WebM block")
+	}
+	_, err := io.CopyN(io.Discard, br, n)
+	return noEOF(err)
+}
+
+// noEOF turns an end of file in the middle of an element into
+// io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}